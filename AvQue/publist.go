@@ -1,13 +1,14 @@
 package AvQue
 
 import (
-	//"sync"
+	"sync"
 	"container/list"
 )
 
 //just for
+//推流协程分发时遍历，其他协程数播放端，用 GetList 遍历时先 Lock
 type CursorList struct {
-	//sync.SpinLock
+	sync.Mutex
 	data *list.List
 }
 
@@ -18,9 +19,9 @@ func NewPublist() *CursorList {
 }
 
 func (q *CursorList) PushFront(v interface{}) {
-	//q.Lock()
+	q.Lock()
 	q.data.PushFront(v)
-	//q.Unlock()
+	q.Unlock()
 }
 
 func (q *CursorList) GetList() *list.List {
@@ -28,21 +29,21 @@ func (q *CursorList) GetList() *list.List {
 }
 
 func (q *CursorList) PushBack(v interface{}) {
-	//q.Lock()
+	q.Lock()
 	q.data.PushBack(v)
-	//q.Unlock()
+	q.Unlock()
 }
 
 func (q *CursorList) Len() int {
-	//q.Lock()
-	//defer q.Unlock()
+	q.Lock()
+	defer q.Unlock()
 	return q.data.Len()
 }
 
 func (q *CursorList) Pop() interface{} {
 
-	//q.Lock()
-	//defer q.Unlock()
+	q.Lock()
+	defer q.Unlock()
 	iter := q.data.Back()
 	if iter == nil {
 		return nil
@@ -161,6 +161,8 @@ var (
 	PCM_ALAW   = MakeAudioCodecType(avCodecTypeMagic + 3)
 	SPEEX      = MakeAudioCodecType(avCodecTypeMagic + 4)
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
+	MP3        = MakeAudioCodecType(avCodecTypeMagic + 6)
+	OPUS       = MakeAudioCodecType(avCodecTypeMagic + 7)
 )
 
 const codecTypeAudioBit = 0x1
@@ -170,6 +172,8 @@ func (self CodecType) String() string {
 	switch self {
 	case H264:
 		return "H264"
+	case H265:
+		return "H265"
 	case AAC:
 		return "AAC"
 	case PCM_MULAW:
@@ -180,6 +184,10 @@ func (self CodecType) String() string {
 		return "SPEEX"
 	case NELLYMOSER:
 		return "NELLYMOSER"
+	case MP3:
+		return "MP3"
+	case OPUS:
+		return "OPUS"
 	}
 	return ""
 }
@@ -318,6 +326,7 @@ type Packet struct {
 	IsKeyFrame      bool // video packet is key frame
 	GopIsKeyFrame   bool // just for no video
 	PacketType      uint8
+	Idx             int8 // stream index in container format
 	CompositionTime time.Duration // packet presentation time minus decode time for H264 B-Frame
 	Time            time.Duration // packet decode time
 	DataPos         int
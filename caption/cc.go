@@ -0,0 +1,44 @@
+package caption
+
+/*
+ATSC A/53 的 cc_data，放在 H.264 SEI user_data_registered_itu_t_t35 中
+itu_t_t35_country_code(8)=0xb5 itu_t_t35_provider_code(16)=0x0031 user_identifier(32)='GA94' user_data_type_code(8)=0x03
+reserved(1) process_cc_data_flag(1) additional_data_flag(1) cc_count(5) em_data(8)
+cc_count 个 marker_bits(5) cc_valid(1) cc_type(2) cc_data_1(8) cc_data_2(8)
+cc_type 0 1 是 CEA-608 field 1 field 2，2 3 是 CEA-708 DTVCC 包
+*/
+
+const (
+	CCTypeField1     = 0
+	CCTypeField2     = 1
+	CCTypeDTVCCData  = 2
+	CCTypeDTVCCStart = 3
+)
+
+type CCData struct {
+	Type uint8
+	Data [2]byte
+}
+
+//解析 t35 payload，不是 GA94 cc_data 返回 false，只返回 cc_valid 的
+func ParseA53(b []byte) (ccs []CCData, ok bool) {
+	if len(b) < 10 || b[0] != 0xb5 || b[1] != 0x00 || b[2] != 0x31 {
+		return
+	}
+	if string(b[3:7]) != "GA94" || b[7] != 0x03 {
+		return
+	}
+	if b[8]&0x40 == 0 {
+		//process_cc_data_flag 为 0
+		return nil, true
+	}
+	count := int(b[8] & 0x1f)
+	n := 10
+	for i := 0; i < count && n+3 <= len(b); i++ {
+		if b[n]&0x04 != 0 {
+			ccs = append(ccs, CCData{Type: b[n] & 0x03, Data: [2]byte{b[n+1], b[n+2]}})
+		}
+		n += 3
+	}
+	return ccs, true
+}
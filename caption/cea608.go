@@ -0,0 +1,312 @@
+package caption
+
+import (
+	"strings"
+	"time"
+)
+
+/*
+CEA-608 解码，只解 field 1 的一个通道 (CC1 或 CC2)
+每个字节去掉奇校验位，0x10-0x1f 开头的是控制码，控制码连续发两次
+pop-on 写在不显示的内存，EOC 时交换；roll-up paint-on 直接写在显示的内存
+显示的内容变化时上一屏结束成为一条 cue，roll-up paint-on 在换行时才更新
+*/
+
+const (
+	mode608None = iota
+	mode608PopOn
+	mode608RollUp
+	mode608PaintOn
+)
+
+const (
+	rows608 = 15
+	cols608 = 32
+)
+
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+type screen608 [rows608][cols608]rune
+
+func (self *screen608) clear() {
+	*self = screen608{}
+}
+
+func (self *screen608) text() string {
+	var lines []string
+	for _, row := range self {
+		line := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == 0 {
+				return ' '
+			}
+			return r
+		}, string(row[:])))
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type Decoder608 struct {
+	//解码的通道，1 或 2
+	Channel    int
+	curChannel int
+	lastCtrl   [2]byte
+	mode       int
+	rollRows   int
+	row, col   int
+
+	displayed    screen608
+	nonDisplayed screen608
+
+	shown      string
+	shownStart time.Duration
+	cues       []Cue
+}
+
+func NewDecoder608(channel int) *Decoder608 {
+	return &Decoder608{
+		Channel:    channel,
+		curChannel: 1,
+		row:        rows608 - 1,
+	}
+}
+
+//0x2a 0x5c 0x5e-0x60 0x7b-0x7f 与 ascii 不同
+var basic608 = map[byte]rune{
+	0x2a: 'á', 0x5c: 'é', 0x5e: 'í', 0x5f: 'ó', 0x60: 'ú',
+	0x7b: 'ç', 0x7c: '÷', 0x7d: 'Ñ', 0x7e: 'ñ', 0x7f: '█',
+}
+
+//0x11 0x30-0x3f
+var special608 = []rune("®°½¿™¢£♪à èâêîôû")
+
+//0x12 0x20-0x3f 和 0x13 0x20-0x3f
+var extended608 = [2][]rune{
+	[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"),
+}
+
+//pac 第一个字节 (去掉通道位) 对应的行，第二个字节 0x60-0x7f 时加 1
+var pacRow608 = map[byte]int{
+	0x11: 0, 0x12: 2, 0x15: 4, 0x16: 6, 0x17: 8, 0x10: 10, 0x13: 11, 0x14: 13,
+}
+
+//一对 cc_data，tm 是所在帧的 pts
+func (self *Decoder608) Decode(b0, b1 byte, tm time.Duration) {
+	b0 &= 0x7f
+	b1 &= 0x7f
+	if b0 == 0 && b1 == 0 {
+		return
+	}
+	if b0 >= 0x10 && b0 <= 0x1f {
+		//重复的控制码忽略
+		if self.lastCtrl[0] == b0 && self.lastCtrl[1] == b1 {
+			self.lastCtrl = [2]byte{}
+			return
+		}
+		self.lastCtrl = [2]byte{b0, b1}
+		self.curChannel = 1
+		if b0&0x08 != 0 {
+			self.curChannel = 2
+		}
+		if self.curChannel == self.Channel {
+			self.control(b0&^0x08, b1, tm)
+		}
+		return
+	}
+	self.lastCtrl = [2]byte{}
+	if self.curChannel != self.Channel || b0 < 0x20 {
+		return
+	}
+	self.putChar(char608(b0))
+	if b1 >= 0x20 {
+		self.putChar(char608(b1))
+	}
+}
+
+func char608(b byte) rune {
+	if r, ok := basic608[b]; ok {
+		return r
+	}
+	return rune(b)
+}
+
+//写入的内存，text 模式和还没有模式时不写
+func (self *Decoder608) memory() *screen608 {
+	switch self.mode {
+	case mode608PopOn:
+		return &self.nonDisplayed
+	case mode608RollUp, mode608PaintOn:
+		return &self.displayed
+	}
+	return nil
+}
+
+func (self *Decoder608) putChar(r rune) {
+	mem := self.memory()
+	if mem == nil {
+		return
+	}
+	if self.col >= cols608 {
+		self.col = cols608 - 1
+	}
+	mem[self.row][self.col] = r
+	self.col++
+}
+
+func (self *Decoder608) backspace() {
+	mem := self.memory()
+	if mem == nil || self.col == 0 {
+		return
+	}
+	self.col--
+	mem[self.row][self.col] = 0
+}
+
+func (self *Decoder608) control(b0, b1 byte, tm time.Duration) {
+	switch {
+	case (b0 == 0x14 || b0 == 0x15) && b1 >= 0x20 && b1 <= 0x2f:
+		self.command(b1, tm)
+	case b0 == 0x17 && b1 >= 0x21 && b1 <= 0x23:
+		//tab offset
+		self.col += int(b1 - 0x20)
+		if self.col >= cols608 {
+			self.col = cols608 - 1
+		}
+	case b0 == 0x11 && b1 >= 0x30 && b1 <= 0x3f:
+		self.putChar(special608[b1-0x30])
+	case b0 == 0x11 && b1 >= 0x20 && b1 <= 0x2f:
+		//mid-row 样式占一个空格
+		self.putChar(' ')
+	case (b0 == 0x12 || b0 == 0x13) && b1 >= 0x20 && b1 <= 0x3f:
+		//扩展字符前面先发了一个替代的基本字符
+		self.backspace()
+		self.putChar(extended608[b0-0x12][b1-0x20])
+	case b1 >= 0x40 && b1 <= 0x7f:
+		self.pac(b0, b1)
+	}
+}
+
+func (self *Decoder608) pac(b0, b1 byte) {
+	row, ok := pacRow608[b0]
+	if !ok {
+		return
+	}
+	if b1 >= 0x60 {
+		row++
+	}
+	if row >= rows608 || (b0 == 0x10 && b1 >= 0x60) {
+		return
+	}
+	//roll-up 的基线不变
+	if self.mode != mode608RollUp {
+		self.row = row
+	}
+	self.col = 0
+	if b1&0x10 != 0 {
+		self.col = int((b1>>1)&0x07) * 4
+	}
+}
+
+func (self *Decoder608) command(b1 byte, tm time.Duration) {
+	switch b1 {
+	case 0x20:
+		//RCL
+		self.mode = mode608PopOn
+	case 0x21:
+		//BS
+		self.backspace()
+	case 0x24:
+		//DER
+		if mem := self.memory(); mem != nil {
+			for i := self.col; i < cols608; i++ {
+				mem[self.row][i] = 0
+			}
+		}
+	case 0x25, 0x26, 0x27:
+		//RU2 RU3 RU4
+		if self.mode != mode608RollUp {
+			self.displayed.clear()
+			self.nonDisplayed.clear()
+			self.row = rows608 - 1
+		}
+		self.mode = mode608RollUp
+		self.rollRows = int(b1-0x25) + 2
+		self.col = 0
+		self.update(tm)
+	case 0x29:
+		//RDC
+		self.mode = mode608PaintOn
+	case 0x2a, 0x2b:
+		//TR RTD text 模式不是字幕
+		self.mode = mode608None
+	case 0x2c:
+		//EDM
+		self.displayed.clear()
+		self.update(tm)
+	case 0x2d:
+		//CR
+		switch self.mode {
+		case mode608RollUp:
+			//换行前的几行一起显示到下一次换行
+			self.update(tm)
+			top := self.row - self.rollRows + 1
+			if top < 0 {
+				top = 0
+			}
+			for i := 0; i < self.row; i++ {
+				if i < top {
+					self.displayed[i] = [cols608]rune{}
+				} else {
+					self.displayed[i] = self.displayed[i+1]
+				}
+			}
+			self.displayed[self.row] = [cols608]rune{}
+			self.col = 0
+		case mode608PaintOn:
+			self.update(tm)
+			if self.row < rows608-1 {
+				self.row++
+			}
+			self.col = 0
+		}
+	case 0x2e:
+		//ENM
+		self.nonDisplayed.clear()
+	case 0x2f:
+		//EOC
+		self.displayed, self.nonDisplayed = self.nonDisplayed, self.displayed
+		self.mode = mode608PopOn
+		self.update(tm)
+	}
+}
+
+//显示内容变化，上一屏结束
+func (self *Decoder608) update(tm time.Duration) {
+	text := self.displayed.text()
+	if text == self.shown {
+		return
+	}
+	if len(self.shown) > 0 && tm > self.shownStart {
+		self.cues = append(self.cues, Cue{Start: self.shownStart, End: tm, Text: self.shown})
+	}
+	self.shown = text
+	self.shownStart = tm
+}
+
+//取走已经结束的 cue
+func (self *Decoder608) Cues() (cues []Cue) {
+	cues, self.cues = self.cues, nil
+	return
+}
+
+//正在显示的内容和开始时间，没有显示时为空
+func (self *Decoder608) Shown() (text string, start time.Duration) {
+	return self.shown, self.shownStart
+}
@@ -0,0 +1,31 @@
+package caption
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//hh:mm:ss.ttt
+func VttTime(tm time.Duration) string {
+	if tm < 0 {
+		tm = 0
+	}
+	ms := int64(tm / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var vttEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+//hls 的 webvtt 分片，X-TIMESTAMP-MAP 把 ts 的 pts 对应到 cue 的时间
+//cue 的时间和 base 都是 ts 中的 pts
+func WebVTT(cues []Cue, base time.Duration) []byte {
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n",
+		uint64(base*90000/time.Second), VttTime(base))
+	for _, cue := range cues {
+		fmt.Fprintf(w, "\n%s --> %s\n%s\n", VttTime(cue.Start), VttTime(cue.End), vttEscape.Replace(cue.Text))
+	}
+	return w.Bytes()
+}
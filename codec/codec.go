@@ -0,0 +1,158 @@
+// Package codec 没有 sequence header 或者 sequence header 很简单的音频 codec data
+// G.711 A/µ-law MP3 Opus
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"rtmpServerStudy/av"
+	"time"
+)
+
+//G.711 由 flv tag 头决定声道，采样率固定 8k
+type PCMCodecData struct {
+	Typ        av.CodecType
+	Rate       int
+	Layout     av.ChannelLayout
+}
+
+func (self PCMCodecData) Type() av.CodecType {
+	return self.Typ
+}
+
+func (self PCMCodecData) SampleRate() int {
+	return self.Rate
+}
+
+func (self PCMCodecData) ChannelLayout() av.ChannelLayout {
+	return self.Layout
+}
+
+func (self PCMCodecData) SampleFormat() av.SampleFormat {
+	return av.S16
+}
+
+//一个字节一个采样
+func (self PCMCodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	channels := self.Layout.Count()
+	if channels == 0 || self.Rate == 0 {
+		err = fmt.Errorf("%s","Codec.PCM.Invalid")
+		return
+	}
+	dur = time.Duration(len(data)/channels) * time.Second / time.Duration(self.Rate)
+	return
+}
+
+func NewPCMMulawCodecData(layout av.ChannelLayout) av.AudioCodecData {
+	return PCMCodecData{
+		Typ:    av.PCM_MULAW,
+		Rate:   8000,
+		Layout: layout,
+	}
+}
+
+func NewPCMAlawCodecData(layout av.ChannelLayout) av.AudioCodecData {
+	return PCMCodecData{
+		Typ:    av.PCM_ALAW,
+		Rate:   8000,
+		Layout: layout,
+	}
+}
+
+const OpusHeadLength = 19
+
+//Opus 输出采样率固定 48k，Head 为 RFC 7845 的 OpusHead
+type OpusCodecData struct {
+	Head            []byte
+	Channels        int
+	PreSkip         uint16
+	InputSampleRate uint32
+}
+
+func (self OpusCodecData) Type() av.CodecType {
+	return av.OPUS
+}
+
+func (self OpusCodecData) SampleRate() int {
+	return 48000
+}
+
+func (self OpusCodecData) ChannelLayout() av.ChannelLayout {
+	if self.Channels == 1 {
+		return av.CH_MONO
+	}
+	return av.CH_STEREO
+}
+
+func (self OpusCodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+//没有 OpusHead 时生成一个默认的
+func (self OpusCodecData) HeadBytes() []byte {
+	if len(self.Head) > 0 {
+		return self.Head
+	}
+	b := make([]byte, OpusHeadLength)
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = uint8(self.Channels)
+	binary.LittleEndian.PutUint16(b[10:], self.PreSkip)
+	binary.LittleEndian.PutUint32(b[12:], self.InputSampleRate)
+	return b
+}
+
+//每个 config 对应的帧长 48k 采样数 RFC 6716 3.1
+func opusFrameSamples(config uint8) int {
+	switch {
+	case config < 12:
+		return []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		return []int{480, 960}[config%2]
+	default:
+		return []int{120, 240, 480, 960}[config%4]
+	}
+}
+
+func (self OpusCodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	if len(data) < 1 {
+		err = fmt.Errorf("%s","Codec.Opus.Packet.Invalid")
+		return
+	}
+	toc := data[0]
+	frames := 1
+	switch toc & 0x3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(data) < 2 {
+			err = fmt.Errorf("%s","Codec.Opus.Packet.Invalid")
+			return
+		}
+		frames = int(data[1] & 0x3f)
+	}
+	samples := opusFrameSamples(toc >> 3) * frames
+	dur = time.Duration(samples) * time.Second / time.Duration(48000)
+	return
+}
+
+func NewOpusCodecData(channels int) OpusCodecData {
+	return OpusCodecData{
+		Channels:        channels,
+		PreSkip:         3840,
+		InputSampleRate: 48000,
+	}
+}
+
+//解析 OpusHead
+func NewOpusCodecDataFromHead(head []byte) (self OpusCodecData, err error) {
+	if len(head) < OpusHeadLength || string(head[:8]) != "OpusHead" {
+		err = fmt.Errorf("%s","Codec.Opus.Head.Invalid")
+		return
+	}
+	self.Head = head
+	self.Channels = int(head[9])
+	self.PreSkip = binary.LittleEndian.Uint16(head[10:])
+	self.InputSampleRate = binary.LittleEndian.Uint32(head[12:])
+	return
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"fmt"
+	"rtmpServerStudy/av"
+	"time"
+)
+
+const (
+	MPEG_VERSION_2_5 = 0
+	MPEG_VERSION_2   = 2
+	MPEG_VERSION_1   = 3
+
+	MPEG_LAYER_3 = 1
+	MPEG_LAYER_2 = 2
+	MPEG_LAYER_1 = 3
+)
+
+const MP3HeaderLength = 4
+
+var mp3SampleRates = [4][3]int{
+	MPEG_VERSION_2_5: {11025, 12000, 8000},
+	MPEG_VERSION_2:   {22050, 24000, 16000},
+	MPEG_VERSION_1:   {44100, 48000, 32000},
+}
+
+type MP3CodecData struct {
+	Version    uint8
+	Layer      uint8
+	Rate       int
+	Layout     av.ChannelLayout
+}
+
+func (self MP3CodecData) Type() av.CodecType {
+	return av.MP3
+}
+
+func (self MP3CodecData) SampleRate() int {
+	return self.Rate
+}
+
+func (self MP3CodecData) ChannelLayout() av.ChannelLayout {
+	return self.Layout
+}
+
+func (self MP3CodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+//ts 中 MPEG-1 为 0x03 MPEG-2/2.5 为 0x04
+func (self MP3CodecData) IsMPEG1() bool {
+	return self.Version == MPEG_VERSION_1
+}
+
+//每帧采样数
+func (self MP3CodecData) FrameSamples() int {
+	switch self.Layer {
+	case MPEG_LAYER_1:
+		return 384
+	case MPEG_LAYER_2:
+		return 1152
+	}
+	if self.Version == MPEG_VERSION_1 {
+		return 1152
+	}
+	return 576
+}
+
+//一个 flv tag 一帧
+func (self MP3CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	if self.Rate == 0 {
+		err = fmt.Errorf("%s","Codec.MP3.Invalid")
+		return
+	}
+	dur = time.Duration(self.FrameSamples()) * time.Second / time.Duration(self.Rate)
+	return
+}
+
+//解析 mp3 帧头 11bit sync version(2) layer(2) protection(1) bitrate(4) samplerate(2) padding(1) private(1) mode(2)
+func NewMP3CodecDataFromFrame(b []byte) (self MP3CodecData, err error) {
+	if len(b) < MP3HeaderLength || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		err = fmt.Errorf("%s","Codec.MP3.Header.Invalid")
+		return
+	}
+	self.Version = (b[1] >> 3) & 0x3
+	self.Layer = (b[1] >> 1) & 0x3
+	rateIdx := (b[2] >> 2) & 0x3
+	if self.Version == 1 || self.Layer == 0 || rateIdx == 3 {
+		err = fmt.Errorf("%s","Codec.MP3.Header.Invalid")
+		return
+	}
+	self.Rate = mp3SampleRates[self.Version][rateIdx]
+	if b[3]>>6 == 3 {
+		self.Layout = av.CH_MONO
+	} else {
+		self.Layout = av.CH_STEREO
+	}
+	return
+}
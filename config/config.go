@@ -8,19 +8,81 @@ import (
 )
 
 type App struct {
+	//缓存的 gop 个数，用于秒开，默认 1
 	GopCacheNum int `yaml:"GopCacheNum"`
+	//type 3 chunk 是否带扩展时间戳 1 带 2 不带，0 默认带
 	ExtTimeSend int `yaml:"ExtTimeSend"`
 	RecodeFlv int `yaml:"RecodeFlv"`
 	RecodeHls int `yaml:"RecodeHls"`
 	HlsFragment   string `yaml:"HlsFragment"`
+	//hls 模式 live 滑动窗口 event(dvr) 回看 vod 完整点播，默认 live
+	HlsPlaylistType string `yaml:"HlsPlaylistType"`
+	//live 模式 m3u8 中保留的分片数，默认 3
+	HlsPlaylistLength int `yaml:"HlsPlaylistLength"`
+	//event 模式可回看的时长 如 "30m"
+	HlsDvrWindow string `yaml:"HlsDvrWindow"`
+	//hls 加密 "" 不加密 AES-128 SAMPLE-AES
+	HlsEncrypt string `yaml:"HlsEncrypt"`
+	//每 N 个分片换一次 key，0 整个推流一个 key
+	HlsKeyRotate int `yaml:"HlsKeyRotate"`
+	//EXT-X-KEY 中 key uri 的前缀，空使用本服务的 /hlskey/app/stream/
+	HlsKeyUrl string `yaml:"HlsKeyUrl"`
+	//本地 key 存放目录，不要放在 hls 目录下
+	HlsKeyPath string `yaml:"HlsKeyPath"`
+	//key provider 名字，默认 local
+	HlsKeyProvider string `yaml:"HlsKeyProvider"`
+	//多码率分组，推流名去掉后缀相同的为一组，生成 master m3u8 和 mpd
+	HlsAbr []AbrRendition `yaml:"HlsAbr"`
+	//1 解析 H.264 SEI 中的 CEA-608 字幕，hls 输出 webvtt，控制接口取 json
+	//只解 field 1 的 CC1，field 2 (CC3 CC4) 和 CEA-708 DTVCC 丢弃
+	Caption int `yaml:"Caption"`
+	//内存时移缓存的时长 如 "10m"，空不缓存，播放 ?delay=30 ?start=-120
+	TimeShift string `yaml:"TimeShift"`
+	//每路流时移缓存最多的字节数，0 默认 256M
+	TimeShiftMaxSize int64 `yaml:"TimeShiftMaxSize"`
 	RecodeFlvPath string `yaml:"RecodeFlvPath"`
+	//flv 切片时长 如 "600s"，0 不按时间切
+	RecodeFlvFragment string `yaml:"RecodeFlvFragment"`
+	//flv 单文件最大字节数，0 不限制
+	RecodeFlvMaxSize int64 `yaml:"RecodeFlvMaxSize"`
+	//按日期分目录 golang time layout 如 "2006-01-02"，空不分目录
+	RecodeFlvDateDir string `yaml:"RecodeFlvDateDir"`
+	//录制文件完成后的 http 回调地址
+	OnRecordDone string `yaml:"OnRecordDone"`
 	RecodeHlsPath string `yaml:"RecodeHlsPath"`
+	//1 按间隔保存关键帧截图 (annex-b .h264 和只有一帧的 .flv)
 	RecodePicture int `yaml:"RecodePicture"`
 	RecodePicPath string `yaml:"RecodePicPath"`
+	//截图间隔 如 "10s"，默认 10s
 	RecidePicFragment string `yaml:"RecidePicFragment"`
 	TurnHost []string `yaml:"TurnHost"`
+	//转发给播放端和录制的 data 消息名 如 onTextData onCuePoint onFI，"*" 全部转发，空不转发
+	DataForward []string `yaml:"DataForward"`
+	//从外部源拉流，播放域名下配置，拉到的流和推流一样
+	Pull []PullSource `yaml:"Pull"`
 }
 
+//外部拉流源
+type PullSource struct {
+	//流名，支持 * ? 通配
+	Name string `yaml:"Name"`
+	//rtmp://host/app/stream 或 http://host/app/stream.flv，{name} 替换为流名
+	Url string `yaml:"Url"`
+	//static 启动时开始一直拉，ondemand 有播放时才拉，默认 ondemand
+	Mode string `yaml:"Mode"`
+	//ondemand 最后一个播放离开后多久停止 如 "30s"，默认 30s
+	IdleTimeout string `yaml:"IdleTimeout"`
+}
+
+//一路码率，码率和分辨率优先取实际值，取不到时使用配置
+type AbrRendition struct {
+	//推流名后缀 如 "_720"
+	Suffix string `yaml:"Suffix"`
+	//bit/s
+	Bandwidth int `yaml:"Bandwidth"`
+	//如 "1280x720"
+	Resolution string `yaml:"Resolution"`
+}
 
 type playDomain struct {
 	UniqueName string `yaml:"UniqueName"`
@@ -32,6 +94,36 @@ type publishdomain struct {
 	App map[string]*App `yaml:"App"`
 }
 
+//mpegts 推流监听，一个地址对应一路流
+type TsListen struct {
+	//udp://:9000 udp://239.1.1.1:1234 (组播) tcp://:9001
+	Listen string `yaml:"Listen"`
+	//组播网卡，空为系统默认
+	Interface string `yaml:"Interface"`
+	Vhost string `yaml:"Vhost"`
+	App string `yaml:"App"`
+	Name string `yaml:"Name"`
+	//多久没有数据认为断流 如 "10s"，默认 10s
+	Timeout string `yaml:"Timeout"`
+}
+
+//webrtc whip 推流 whep 播放，ice-lite，所有连接复用一个 udp 端口
+type Webrtc struct {
+	//如 ":8000"，空每个连接使用随机端口
+	UdpListen string `yaml:"UdpListen"`
+	//nat 后面时写到 candidate 中的公网 ip，空使用本机网卡地址
+	PublicIp []string `yaml:"PublicIp"`
+}
+
+//flv 文件循环推成直播流，多个文件按顺序循环
+type FileFeeder struct {
+	//推流域名
+	Vhost string `yaml:"Vhost"`
+	App string `yaml:"App"`
+	Name string `yaml:"Name"`
+	Files []string `yaml:"Files"`
+}
+
 type Rtmpserver struct{
 	RtmpListen []string `yaml:"RtmpListen"`
 	ClusterCnf []string `yaml:"ClusterCnf"`
@@ -39,6 +131,14 @@ type Rtmpserver struct{
 	HttpListen []string `yaml:"HttpListen"`
 	QuicListen string `yaml:"QuicListen"`
 	KcpListen string `yaml:"KcpListen"`
+	TsListen []TsListen `yaml:"TsListen"`
+	RtspListen []string `yaml:"RtspListen"`
+	Webrtc Webrtc `yaml:"Webrtc"`
+	//控制接口 http 监听，只监听本机或内网地址 如 "127.0.0.1:8088"，空不开启
+	ControlListen string `yaml:"ControlListen"`
+	FileFeeder []FileFeeder `yaml:"FileFeeder"`
+	//播放端 ack 流控，未确认的字节超过窗口时暂停发送，等待超过这个时间断开 如 "10s"，空不开启
+	AckTimeout string `yaml:"AckTimeout"`
 }
 type UserConf struct {
 	PublishDomain map[string]publishdomain `yaml:"PublishDomain"`
@@ -11,6 +11,7 @@ import (
 	"rtmpServerStudy/amf"
 	"rtmpServerStudy/h264Parse"
 	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/codec"
 	"encoding/hex"
 )
 
@@ -101,6 +102,19 @@ func CodecDataToTag(stream av.CodecData) (_tag *flvio.Tag, ok bool, err error) {
 		ok = true
 	case av.NELLYMOSER:
 	case av.SPEEX:
+	//mp3 g711 没有 sequence header
+	case av.MP3:
+	case av.PCM_ALAW:
+	case av.PCM_MULAW:
+
+	case av.OPUS:
+		opus := stream.(codec.OpusCodecData)
+		_tag.Type = flvio.TAG_AUDIO
+		_tag.SoundFormat = flvio.SOUND_EXHEADER
+		_tag.AudioPacketType = flvio.AUDIO_PACKET_SEQSTART
+		_tag.AudioFourCC = flvio.FOURCC_OPUS
+		_tag.Data = opus.HeadBytes()
+		ok = true
 
 	case av.AAC:
 		aac := stream.(aacparser.CodecData)
@@ -151,7 +165,7 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 		tag = flvio.Tag{
 			Type:            flvio.TAG_VIDEO,
 			AVCPacketType:   flvio.AVC_NALU,
-			CodecID:         flvio.VIDEO_H264,
+			CodecID:         flvio.VIDEO_H265,
 			Data:            pkt.Data,
 			CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
 		}
@@ -196,6 +210,36 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 			SoundFormat: flvio.SOUND_NELLYMOSER,
 			Data:        pkt.Data,
 		}
+
+	case av.MP3, av.PCM_ALAW, av.PCM_MULAW:
+		tag = flvio.Tag{
+			Type:        flvio.TAG_AUDIO,
+			SoundFormat: flvio.SOUND_MP3,
+			SoundRate:   flvio.SOUND_44Khz,
+			SoundSize:   flvio.SOUND_16BIT,
+			Data:        pkt.Data,
+		}
+		astream := stream.(av.AudioCodecData)
+		switch stream.Type() {
+		case av.PCM_ALAW:
+			tag.SoundFormat = flvio.SOUND_ALAW
+			tag.SoundRate = flvio.SOUND_5_5Khz
+		case av.PCM_MULAW:
+			tag.SoundFormat = flvio.SOUND_MULAW
+			tag.SoundRate = flvio.SOUND_5_5Khz
+		}
+		if astream.ChannelLayout().Count() == 2 {
+			tag.SoundType = flvio.SOUND_STEREO
+		}
+
+	case av.OPUS:
+		tag = flvio.Tag{
+			Type:            flvio.TAG_AUDIO,
+			SoundFormat:     flvio.SOUND_EXHEADER,
+			AudioPacketType: flvio.AUDIO_PACKET_CODEDFRAMES,
+			AudioFourCC:     flvio.FOURCC_OPUS,
+			Data:            pkt.Data,
+		}
 	}
 
 	timestamp = flvio.TimeToTs(pkt.Time)
@@ -31,8 +31,10 @@ const (
 	SOUND_NELLYMOSER            = 6
 	SOUND_ALAW                  = 7
 	SOUND_MULAW                 = 8
+	SOUND_EXHEADER              = 9
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_MP3_8KHZ              = 14
 
 	SOUND_5_5Khz = 0
 	SOUND_11Khz  = 1
@@ -49,6 +51,17 @@ const (
 	AAC_RAW    = 1
 )
 
+//Enhanced RTMP SoundFormat 为 9 时，低 4 位为 AudioPacketType，后面跟 FourCC
+const (
+	AUDIO_PACKET_SEQSTART    = 0
+	AUDIO_PACKET_CODEDFRAMES = 1
+	AUDIO_PACKET_SEQEND      = 2
+
+	FOURCC_OPUS = 0x4f707573 //"Opus"
+	FOURCC_MP3  = 0x2e6d7033 //".mp3"
+	FOURCC_AAC  = 0x6d703461 //"mp4a"
+)
+
 const (
 	AVC_SEQHDR = 0
 	AVC_NALU   = 1
@@ -161,6 +174,14 @@ type Tag struct {
 	*/
 	AVCPacketType uint8
 
+	/*
+		Enhanced RTMP audio
+		AudioPacketType: UB[4] 0 SequenceStart 1 CodedFrames 2 SequenceEnd
+		AudioFourCC: UI32 Opus .mp3 mp4a ...
+	*/
+	AudioPacketType uint8
+	AudioFourCC     uint32
+
 	CompositionTime int32
 	NoHead bool
 	Data []byte
@@ -195,6 +216,14 @@ func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 		}
 		self.AACPacketType = b[n]
 		n++
+	case SOUND_EXHEADER:
+		if len(b) < n+4 {
+			err = fmt.Errorf("%s","Flvio.Audio.Data.Parse.Invalid")
+			return
+		}
+		self.AudioPacketType = flags & 0xf
+		self.AudioFourCC = pio.U32BE(b[n:])
+		n += 4
 	}
 
 	return
@@ -206,6 +235,9 @@ func (self Tag) audioFillHeader(b []byte) (n int) {
 	flags |= self.SoundRate << 2
 	flags |= self.SoundSize << 1
 	flags |= self.SoundType
+	if self.SoundFormat == SOUND_EXHEADER {
+		flags = SOUND_EXHEADER<<4 | self.AudioPacketType&0xf
+	}
 	b[n] = flags
 	n++
 
@@ -213,6 +245,9 @@ func (self Tag) audioFillHeader(b []byte) (n int) {
 	case SOUND_AAC:
 		b[n] = self.AACPacketType
 		n++
+	case SOUND_EXHEADER:
+		pio.PutU32BE(b[n:], self.AudioFourCC)
+		n += 4
 	}
 
 	return
@@ -0,0 +1,72 @@
+package h264parser
+
+/*
+SEI rbsp: sei_message() 直到 rbsp_trailing_bits
+payloadType 和 payloadSize 都是 0xff 累加最后一个字节
+*/
+
+const (
+	SEI_USER_DATA_REGISTERED_ITU_T_T35 = 4
+	SEI_USER_DATA_UNREGISTERED         = 5
+)
+
+type SEIMessage struct {
+	Type    int
+	Payload []byte
+}
+
+//去掉 00 00 03 防竞争字节
+func RemoveEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+//解析 sei nalu (带 nalu 头)，不完整的 message 丢掉
+func ParseSEI(nalu []byte) (msgs []SEIMessage) {
+	if len(nalu) < 2 || nalu[0]&0x1f != AVC_NAL_SEI {
+		return
+	}
+	b := RemoveEmulationPrevention(nalu[1:])
+	n := 0
+	for n < len(b) && b[n] != 0x80 {
+		typ := 0
+		for n < len(b) && b[n] == 0xff {
+			typ += 0xff
+			n++
+		}
+		if n >= len(b) {
+			return
+		}
+		typ += int(b[n])
+		n++
+		size := 0
+		for n < len(b) && b[n] == 0xff {
+			size += 0xff
+			n++
+		}
+		if n >= len(b) {
+			return
+		}
+		size += int(b[n])
+		n++
+		if n+size > len(b) {
+			return
+		}
+		msgs = append(msgs, SEIMessage{Type: typ, Payload: b[n : n+size]})
+		n += size
+	}
+	return
+}
@@ -6,7 +6,6 @@ import (
 "rtmpServerStudy/utils/bits"
 "rtmpServerStudy/utils/bits/pio"
 "rtmpServerStudy/av"
-	"encoding/hex"
 )
 
 const (
@@ -16,9 +15,10 @@ const (
 	NALU_AUD = 9
 )
 
+//vcl nalu
 func IsDataNALU(b []byte) bool {
-	typ := b[0] & 0x1f
-	return typ >= 1 && typ <= 5
+	typ := NALUType(b)
+	return typ < HEVC_NAL_VPS
 }
 
 /*
@@ -228,7 +228,36 @@ const (
 )
 
 var StartCodeBytes = []byte{0, 0, 1}
-var AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01,0x10, 0, 0, 0, 1} // AUD
+var AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50, 0, 0, 0, 1} // AUD pic_type=2
+
+func NALUType(b []byte) int {
+	return int(b[0]>>1) & 0x3f
+}
+
+//irap 帧(bla idr cra) 前需要有 vps sps pps
+func IsIRAPNALU(b []byte) bool {
+	typ := NALUType(b)
+	return typ >= HEVC_NAL_BLA_W_LP && typ <= 23
+}
+
+//去掉 00 00 03 防竞争字节
+func RemoveEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
 
 func CheckNALUsType(b []byte) (typ int) {
 	_, typ = SplitNALUs(b)
@@ -335,6 +364,9 @@ type SPSInfo struct {
 
 	Width  uint
 	Height uint
+
+	BitDepthLumaMinus8   uint
+	BitDepthChromaMinus8 uint
 }
 
 const(
@@ -427,9 +459,10 @@ func CodecParsePtl(r *bits.GolombBitReader,MaxSubLayers uint)(err error){
 }
 
 func ParseSPS(data []byte) (self SPSInfo, err error) {
-	r := &bits.GolombBitReader{R: bytes.NewReader(data)}
+	r := &bits.GolombBitReader{R: bytes.NewReader(RemoveEmulationPrevention(data))}
 	var nalType uint
 	var tmp  uint
+	var separateColourPlane uint
 
 	if _,err=r.ReadBit();err!=nil{
 		return 
@@ -464,10 +497,6 @@ func ParseSPS(data []byte) (self SPSInfo, err error) {
 		return 
 	}
 
-	if _,err = r.ReadBits(4);err != nil{
-		return
-	}
-
 	if self.SpsId, err = r.ReadExponentialGolombCode(); err != nil {
 		return
 	}
@@ -482,7 +511,7 @@ func ParseSPS(data []byte) (self SPSInfo, err error) {
 	}
 
 	if self.CfIdc == 3{
-		if _,err = r.ReadBit();err != nil{
+		if separateColourPlane,err = r.ReadBit();err != nil{
         		return
     		}
 	}
@@ -522,8 +551,25 @@ func ParseSPS(data []byte) (self SPSInfo, err error) {
 		self.CropBottom = 0
 	}
 
-	self.Width = self.Width - (self.CropLeft + self.CropRight)
-	self.Height = self.Height - (self.CropRight + self.CropBottom)
+	if self.BitDepthLumaMinus8 ,err =  r.ReadExponentialGolombCode();err != nil {
+		return
+	}
+	if self.BitDepthChromaMinus8 ,err =  r.ReadExponentialGolombCode();err != nil {
+		return
+	}
+
+	//conformance window 以色度采样为单位，4:2:0 宽高都乘 2，4:2:2 只有宽乘 2
+	subWidthC, subHeightC := uint(1), uint(1)
+	if separateColourPlane == 0 {
+		switch self.CfIdc {
+		case 1:
+			subWidthC, subHeightC = 2, 2
+		case 2:
+			subWidthC = 2
+		}
+	}
+	self.Width = self.Width - subWidthC*(self.CropLeft + self.CropRight)
+	self.Height = self.Height - subHeightC*(self.CropTop + self.CropBottom)
 
 	return
 }
@@ -542,6 +588,13 @@ func (self CodecData) AVCDecoderConfRecordBytes() []byte {
 	return self.Record
 }
 
+func (self CodecData) VPS() []byte {
+	if len(self.RecordInfo.VPS) == 0 {
+		return nil
+	}
+	return self.RecordInfo.VPS[0]
+}
+
 func (self CodecData) SPS() []byte {
 	return self.RecordInfo.SPS[0]
 }
@@ -560,7 +613,6 @@ func (self CodecData) Height() int {
 
 func NewCodecDataFromAVCDecoderConfRecord(record []byte) (self CodecData, err error) {
 	self.Record = record
-	fmt.Print(hex.Dump(record))
 	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
 		fmt.Println(err)
 		return
@@ -575,7 +627,6 @@ func NewCodecDataFromAVCDecoderConfRecord(record []byte) (self CodecData, err er
 		fmt.Println(err)
 		return
 	}
-	fmt.Print(hex.Dump(self.RecordInfo.SPS[0]))
 	if self.SPSInfo, err = ParseSPS(self.RecordInfo.SPS[0]); err != nil {
 		err = fmt.Errorf("H265Parser.Parse.SPS.Failed(%s)", err)
 		fmt.Println(err)
@@ -584,76 +635,118 @@ func NewCodecDataFromAVCDecoderConfRecord(record []byte) (self CodecData, err er
 	return
 }
 
-func NewCodecDataFromSPSAndPPS(sps, pps [][]byte) (self CodecData, err error) {
+//由 annexb 中的 vps sps pps 生成 hvcC
+func NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps [][]byte) (self CodecData, err error) {
+	if len(sps) == 0 || len(pps) == 0 {
+		err = ErrDecconfInvalid
+		return
+	}
+	if self.SPSInfo, err = ParseSPS(sps[0]); err != nil {
+		return
+	}
+
+	// sps rbsp: nal header(16) vps_id(4) max_sub_layers_minus1(3) temporal_id_nesting(1) profile_tier_level
+	rbsp := RemoveEmulationPrevention(sps[0])
+	if len(rbsp) < 15 {
+		err = ErrDecconfInvalid
+		return
+	}
 	recordinfo := AVCDecoderConfRecord{}
-	recordinfo.AVCProfileIndication = sps[0][1]
-	recordinfo.ProfileCompatibility = uint32(pio.U32BE(sps[0][2:]))
-	recordinfo.AVCLevelIndication = sps[0][3]
+	recordinfo.ProfileSpaceTier = rbsp[3] & 0xe0
+	recordinfo.AVCProfileIndication = rbsp[3] & 0x1f
+	recordinfo.ProfileCompatibility = pio.U32BE(rbsp[4:])
+	recordinfo.ConstraintIndicatorFlags = uint64(pio.U16BE(rbsp[8:]))<<32 | uint64(pio.U32BE(rbsp[10:]))
+	recordinfo.AVCLevelIndication = rbsp[14]
+	recordinfo.ChromaFormat = uint8(self.SPSInfo.CfIdc)
+	recordinfo.BitDepthLumaMinus8 = uint8(self.SPSInfo.BitDepthLumaMinus8)
+	recordinfo.BitDepthChromaMinus8 = uint8(self.SPSInfo.BitDepthChromaMinus8)
+	recordinfo.NumTemporalLayers = (rbsp[2]>>1)&0x7 + 1
+	recordinfo.TemporalIdNested = rbsp[2] & 0x1
+	recordinfo.LengthSizeMinusOne = 3
+	recordinfo.VPS = vps
 	recordinfo.SPS = sps
 	recordinfo.PPS = pps
-	recordinfo.LengthSizeMinusOne = 3
 
 	buf := make([]byte, recordinfo.Len())
 	recordinfo.Marshal(buf)
 
 	self.RecordInfo = recordinfo
 	self.Record = buf
-
-	if self.SPSInfo, err = ParseSPS(sps[0]); err != nil {
-		return
-	}
 	return
 }
 
+//hvcC HEVCDecoderConfigurationRecord ISO/IEC 14496-15 8.3.3.1
+//为了兼容之前的代码，字段名沿用 avc 的
 type AVCDecoderConfRecord struct {
+	ProfileSpaceTier     uint8
 	AVCProfileIndication uint8
 	ProfileCompatibility uint32
+	ConstraintIndicatorFlags uint64
 	AVCLevelIndication   uint8
+	ChromaFormat         uint8
+	BitDepthLumaMinus8   uint8
+	BitDepthChromaMinus8 uint8
+	NumTemporalLayers    uint8
+	TemporalIdNested     uint8
 	LengthSizeMinusOne   uint8
 	VPS                  [][]byte
 	SPS                  [][]byte
 	PPS                  [][]byte
 }
 
-var ErrDecconfInvalid = fmt.Errorf("%s","H264Parser.AVCDecoderConfRecord.invalid")
+var ErrDecconfInvalid = fmt.Errorf("%s","H265Parser.AVCDecoderConfRecord.invalid")
+
+const HEVCDecoderConfHeaderLength = 23
 
 func (self *AVCDecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
-	b_len:=len(b)	
-	if len(b) < 7 {
+	b_len:=len(b)
+	if b_len < HEVCDecoderConfHeaderLength {
 		err = ErrDecconfInvalid
 		return
 	}
-	
+
 	n++
-	self.AVCProfileIndication = b[1] & 0x1f
+	self.ProfileSpaceTier = b[n] & 0xe0
+	self.AVCProfileIndication = b[n] & 0x1f
 	n++
-	self.ProfileCompatibility =  uint32(pio.U32BE(b[n:]))
+	self.ProfileCompatibility =  pio.U32BE(b[n:])
 	n+=4
+	self.ConstraintIndicatorFlags = uint64(pio.U16BE(b[n:]))<<32 | uint64(pio.U32BE(b[n+2:]))
+	n+=6
 	self.AVCLevelIndication = b[n]
 	n++
-	fmt.Println(self.AVCProfileIndication, self.ProfileCompatibility,self.AVCLevelIndication)
-	if n+15 >= b_len{
-		err = ErrDecconfInvalid
-		return
-	}
-	n += 15
-	spscount :=int(b[n])
-	n++;
-	fmt.Println("spscount:%d,,%d",spscount,len(b))	
-	nal_type := 0
-	
-	for i := 0; i < spscount; i++ {
-		nal_type = int(b[n] & 0x3f)
-		n++
+	// min_spatial_segmentation_idc(16) parallelismType(8)
+	n+=3
+	self.ChromaFormat = b[n] & 0x3
+	n++
+	self.BitDepthLumaMinus8 = b[n] & 0x7
+	n++
+	self.BitDepthChromaMinus8 = b[n] & 0x7
+	n++
+	// avgFrameRate(16)
+	n+=2
+	self.NumTemporalLayers = (b[n]>>3) & 0x7
+	self.TemporalIdNested = (b[n]>>2) & 0x1
+	self.LengthSizeMinusOne = b[n] & 0x3
+	n++
+	arraycount :=int(b[n])
+	n++
 
-		if b_len < n+2 {
+	for i := 0; i < arraycount; i++ {
+		if b_len < n+3 {
 			err = ErrDecconfInvalid
 			return
 		}
+		nal_type := int(b[n] & 0x3f)
+		n++
 
 		nal_num:= int(pio.U16BE(b[n:]))
 		n += 2
 		for m:=0;m < nal_num;m++{
+			if b_len < n+2 {
+				err = ErrDecconfInvalid
+				return
+			}
 			nal_len:= int(pio.U16BE(b[n:]))
 			n += 2
 			if b_len < (n + nal_len){
@@ -663,58 +756,84 @@ func (self *AVCDecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
 			switch nal_type {
 				case     HEVC_NAL_VPS:
 					self.VPS = append(self.VPS, b[n:n+nal_len])
-    			case 	 HEVC_NAL_SPS:
+				case 	 HEVC_NAL_SPS:
 					self.SPS = append(self.SPS, b[n:n+nal_len])
-    			case     HEVC_NAL_PPS:
+				case     HEVC_NAL_PPS:
 					self.PPS = append(self.PPS, b[n:n+nal_len])
 			}
 			n += nal_len
 		}
 	}
-	fmt.Print("VPS:",hex.Dump(self.VPS[0]))
-	fmt.Print("SPS:",hex.Dump(self.SPS[0]))
-	fmt.Print("PPS:",hex.Dump(self.PPS[0]))
 	return
 }
 
 func (self AVCDecoderConfRecord) Len() (n int) {
-	n = 7
-	for _, sps := range self.SPS {
-		n += 2 + len(sps)
-	}
-	for _, pps := range self.PPS {
-		n += 2 + len(pps)
+	n = HEVCDecoderConfHeaderLength
+	for _, nals := range [][][]byte{self.VPS, self.SPS, self.PPS} {
+		if len(nals) == 0 {
+			continue
+		}
+		n += 3
+		for _, nal := range nals {
+			n += 2 + len(nal)
+		}
 	}
 	return
 }
 
 func (self AVCDecoderConfRecord) Marshal(b []byte) (n int) {
-	
+
 	b[n] = 1
 	n++
-	b[n] = self.AVCProfileIndication
+	b[n] = self.ProfileSpaceTier | self.AVCProfileIndication
 	n++
 	pio.PutU32BE(b[n:],self.ProfileCompatibility)
 	n+=4
+	pio.PutU16BE(b[n:], uint16(self.ConstraintIndicatorFlags>>32))
+	pio.PutU32BE(b[n+2:], uint32(self.ConstraintIndicatorFlags))
+	n+=6
 	b[n] = self.AVCLevelIndication
-	//n += 6
-
-	for _, sps := range self.SPS {
-		pio.PutU16BE(b[n:], uint16(len(sps)))
-		n += 2
-		copy(b[n:], sps)
-		n += len(sps)
-	}
-
-	b[n] = uint8(len(self.PPS))
+	n++
+	// reserved(4) min_spatial_segmentation_idc(12)
+	pio.PutU16BE(b[n:], 0xf000)
+	n+=2
+	// reserved(6) parallelismType(2)
+	b[n] = 0xfc
+	n++
+	b[n] = 0xfc | self.ChromaFormat
+	n++
+	b[n] = 0xf8 | self.BitDepthLumaMinus8
+	n++
+	b[n] = 0xf8 | self.BitDepthChromaMinus8
+	n++
+	// avgFrameRate
+	pio.PutU16BE(b[n:], 0)
+	n+=2
+	// constantFrameRate(2) numTemporalLayers(3) temporalIdNested(1) lengthSizeMinusOne(2)
+	b[n] = (self.NumTemporalLayers&0x7)<<3 | (self.TemporalIdNested&0x1)<<2 | self.LengthSizeMinusOne&0x3
 	n++
 
-	for _, pps := range self.PPS {
-		pio.PutU16BE(b[n:], uint16(len(pps)))
-		n += 2
-		copy(b[n:], pps)
-		n += len(pps)
+	hold := n
+	n++
+	arraycount := 0
+	for i, nals := range [][][]byte{self.VPS, self.SPS, self.PPS} {
+		if len(nals) == 0 {
+			continue
+		}
+		arraycount++
+		// array_completeness(1) reserved(1) NAL_unit_type(6)
+		b[n] = 0x80 | uint8(HEVC_NAL_VPS+i)
+		n++
+		pio.PutU16BE(b[n:], uint16(len(nals)))
+		n+=2
+		for _, nal := range nals {
+			pio.PutU16BE(b[n:], uint16(len(nal)))
+			n += 2
+			copy(b[n:], nal)
+			n += len(nal)
+		}
 	}
+	b[hold] = uint8(arraycount)
 
 	return
 }
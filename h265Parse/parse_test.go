@@ -0,0 +1,67 @@
+package h265parser
+
+import (
+	"bytes"
+	"rtmpServerStudy/utils/bits"
+	"testing"
+)
+
+func spsTestUe(w *bits.Writer, v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.WriteBits(0, n)
+	w.WriteBits(v, n+1)
+}
+
+//4:2:0 1920x1088 裁掉下面 4 个色度行，没有防竞争字节
+//Writer 一次不能超过 64 位，按字节对齐的地方 FlushBits
+func spsTestCrop() []byte {
+	buf := &bytes.Buffer{}
+	w := &bits.Writer{W: buf}
+	//nal header 类型 33
+	w.WriteBits(HEVC_NAL_SPS<<1, 8)
+	w.WriteBits(1, 8)
+	//vps_id max_sub_layers_minus1 temporal_id_nesting
+	w.WriteBits(0, 4)
+	w.WriteBits(0, 3)
+	w.WriteBits(1, 1)
+	//profile_tier_level，跳过的字段填 1
+	w.WriteBits(1, 8)
+	w.WriteBits(0xffffffff, 32)
+	w.FlushBits()
+	w.WriteBits64(0xffffffffffff, 48)
+	w.WriteBits(93, 8)
+	w.FlushBits()
+	spsTestUe(w, 0)
+	//chroma_format_idc 4:2:0
+	spsTestUe(w, 1)
+	spsTestUe(w, 1920)
+	spsTestUe(w, 1088)
+	//conformance_window_flag left right top bottom
+	w.WriteBits(1, 1)
+	spsTestUe(w, 0)
+	spsTestUe(w, 0)
+	spsTestUe(w, 0)
+	spsTestUe(w, 4)
+	spsTestUe(w, 0)
+	spsTestUe(w, 0)
+	w.WriteBits(1, 1)
+	w.FlushBits()
+	return buf.Bytes()
+}
+
+func TestParseSPSCrop(t *testing.T) {
+	sps, err := ParseSPS(spsTestCrop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.CropBottom != 4 || sps.CropRight != 0 {
+		t.Fatalf("crop right %d bottom %d want 0 4", sps.CropRight, sps.CropBottom)
+	}
+	if sps.Width != 1920 || sps.Height != 1080 {
+		t.Fatalf("size %dx%d want 1920x1080", sps.Width, sps.Height)
+	}
+}
@@ -0,0 +1,536 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/codec"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/utils/bits/pio"
+)
+
+/*
+mp4 点播读取，只支持 moov 在文件中的普通 mp4，不支持 fragmented mp4
+moov 整个读到内存，按各 track 的 sample 表生成按时间排序的 sample 列表
+h264 h265 的 sample 本身就是 avcc 格式，和 flv 一致
+*/
+
+type sample struct {
+	idx    int8
+	offset int64
+	size   uint32
+	time   time.Duration
+	cts    time.Duration
+	key    bool
+}
+
+type track struct {
+	codec     av.CodecData
+	timescale uint32
+	//stsd 中的 mp3 没有头，用第一个 sample 生成
+	isMp3 bool
+
+	stts   []uint32
+	ctts   []uint32
+	stss   []uint32
+	stsc   []uint32
+	stsz   []uint32
+	stszN  uint32
+	stszSz uint32
+	chunks []int64
+}
+
+type Demuxer struct {
+	r        io.ReadSeeker
+	streams  []av.CodecData
+	samples  []sample
+	pos      int
+	duration time.Duration
+	probed   bool
+}
+
+func NewDemuxer(r io.ReadSeeker) *Demuxer {
+	return &Demuxer{r: r}
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	return self.streams, nil
+}
+
+//文件时长，取最长的 track
+func (self *Demuxer) Duration() time.Duration {
+	return self.duration
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	if self.pos >= len(self.samples) {
+		err = io.EOF
+		return
+	}
+	s := self.samples[self.pos]
+	self.pos++
+	if pkt.Data, err = self.readSample(s); err != nil {
+		return
+	}
+	pkt.Idx = s.idx
+	pkt.Time = s.time
+	pkt.CompositionTime = s.cts
+	pkt.IsKeyFrame = s.key
+	return
+}
+
+//跳到 t 之前最近的视频关键帧，没有视频时跳到 t 之后的第一个 sample，返回实际的时间
+func (self *Demuxer) SeekToTime(t time.Duration) (pos time.Duration, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	video := int8(-1)
+	for i, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			video = int8(i)
+			break
+		}
+	}
+	i := sort.Search(len(self.samples), func(i int) bool { return self.samples[i].time > t })
+	if video >= 0 {
+		for i--; i > 0; i-- {
+			if s := self.samples[i]; s.idx == video && s.key {
+				break
+			}
+		}
+		if i < 0 {
+			i = 0
+		}
+	} else {
+		i = sort.Search(len(self.samples), func(i int) bool { return self.samples[i].time >= t })
+	}
+	self.pos = i
+	if i < len(self.samples) {
+		pos = self.samples[i].time
+	} else {
+		pos = self.duration
+	}
+	return
+}
+
+func (self *Demuxer) readSample(s sample) (b []byte, err error) {
+	if _, err = self.r.Seek(s.offset, io.SeekStart); err != nil {
+		return
+	}
+	b = make([]byte, s.size)
+	_, err = io.ReadFull(self.r, b)
+	return
+}
+
+//找到 moov 并解析，mdat 在前面时跳过
+func (self *Demuxer) probe() (err error) {
+	if self.probed {
+		return
+	}
+	h := make([]byte, 16)
+	var offset int64
+	for {
+		if _, err = self.r.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(self.r, h[:8]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("%s", "Mp4.Moov.NotFound")
+			}
+			return
+		}
+		size := int64(pio.U32BE(h))
+		typ := string(h[4:8])
+		hdr := int64(8)
+		if size == 1 {
+			if _, err = io.ReadFull(self.r, h[8:16]); err != nil {
+				return
+			}
+			size = int64(pio.U64BE(h[8:]))
+			hdr = 16
+		}
+		if typ == "moof" {
+			return fmt.Errorf("%s", "Mp4.Fragmented.Unsupported")
+		}
+		if size == 0 {
+			return fmt.Errorf("%s", "Mp4.Moov.NotFound")
+		}
+		if size < hdr {
+			return fmt.Errorf("%s", "Mp4.Box.Size.Invalid")
+		}
+		if typ == "moov" {
+			b := make([]byte, size-hdr)
+			if _, err = io.ReadFull(self.r, b); err != nil {
+				return
+			}
+			if err = self.parseMoov(b); err != nil {
+				return
+			}
+			self.probed = true
+			return
+		}
+		offset += size
+	}
+}
+
+//遍历 b 中的 box
+func eachBox(b []byte, fn func(typ string, body []byte) error) (err error) {
+	for len(b) >= 8 {
+		size := uint64(pio.U32BE(b))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		if size == 1 {
+			if len(b) < 16 {
+				break
+			}
+			size = pio.U64BE(b[8:])
+			hdr = 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return fmt.Errorf("%s", "Mp4.Box.Size.Invalid")
+		}
+		if err = fn(typ, b[hdr:size]); err != nil {
+			return
+		}
+		b = b[size:]
+	}
+	return
+}
+
+func (self *Demuxer) parseMoov(b []byte) (err error) {
+	var tracks []*track
+	if err = eachBox(b, func(typ string, body []byte) error {
+		if typ != "trak" {
+			return nil
+		}
+		t := &track{}
+		if err := t.parse(body); err != nil {
+			return err
+		}
+		if t.codec != nil || t.isMp3 {
+			tracks = append(tracks, t)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	for _, t := range tracks {
+		idx := int8(len(self.streams))
+		samples, err := t.samples(idx)
+		if err != nil {
+			return err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		if t.isMp3 {
+			var frame []byte
+			if frame, err = self.readSample(samples[0]); err != nil {
+				return err
+			}
+			if t.codec, err = codec.NewMP3CodecDataFromFrame(frame); err != nil {
+				return err
+			}
+		}
+		self.streams = append(self.streams, t.codec)
+		self.samples = append(self.samples, samples...)
+		last := samples[len(samples)-1]
+		if last.time > self.duration {
+			self.duration = last.time
+		}
+	}
+	if len(self.streams) == 0 {
+		return fmt.Errorf("%s", "Mp4.NoSupported.Track")
+	}
+	//按解码时间交织，同一时间保持 track 顺序
+	sort.SliceStable(self.samples, func(i, j int) bool {
+		return self.samples[i].time < self.samples[j].time
+	})
+	return
+}
+
+func (self *track) parse(b []byte) error {
+	return eachBox(b, func(typ string, body []byte) (err error) {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return self.parse(body)
+		case "mdhd":
+			if len(body) < 4 {
+				return fmt.Errorf("%s", "Mp4.Mdhd.Invalid")
+			}
+			if body[0] == 1 {
+				if len(body) < 24 {
+					return fmt.Errorf("%s", "Mp4.Mdhd.Invalid")
+				}
+				self.timescale = pio.U32BE(body[20:])
+			} else {
+				if len(body) < 16 {
+					return fmt.Errorf("%s", "Mp4.Mdhd.Invalid")
+				}
+				self.timescale = pio.U32BE(body[12:])
+			}
+		case "stsd":
+			if len(body) < 8 {
+				return fmt.Errorf("%s", "Mp4.Stsd.Invalid")
+			}
+			//只用第一个 entry
+			return eachBox(body[8:], func(typ string, entry []byte) error {
+				if self.codec == nil && !self.isMp3 {
+					return self.parseSampleEntry(typ, entry)
+				}
+				return nil
+			})
+		case "stts":
+			self.stts, err = tableU32(body, 2)
+		case "ctts":
+			self.ctts, err = tableU32(body, 2)
+		case "stss":
+			self.stss, err = tableU32(body, 1)
+		case "stsc":
+			self.stsc, err = tableU32(body, 3)
+		case "stsz":
+			if len(body) < 12 {
+				return fmt.Errorf("%s", "Mp4.Stsz.Invalid")
+			}
+			self.stszSz = pio.U32BE(body[4:])
+			self.stszN = pio.U32BE(body[8:])
+			if self.stszSz == 0 {
+				self.stsz, err = tableU32(append(make([]byte, 4), body[8:]...), 1)
+			}
+		case "stco":
+			var offsets []uint32
+			if offsets, err = tableU32(body, 1); err == nil {
+				for _, offset := range offsets {
+					self.chunks = append(self.chunks, int64(offset))
+				}
+			}
+		case "co64":
+			var offsets []uint32
+			if offsets, err = tableU32(body, 2); err == nil {
+				for i := 0; i+1 < len(offsets); i += 2 {
+					self.chunks = append(self.chunks, int64(offsets[i])<<32|int64(offsets[i+1]))
+				}
+			}
+		}
+		return
+	})
+}
+
+//full box 后面是 entry_count 和 entry_count 个 n*4 字节的表项
+func tableU32(b []byte, n int) (table []uint32, err error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%s", "Mp4.Table.Invalid")
+	}
+	count := int(pio.U32BE(b[4:]))
+	b = b[8:]
+	if count < 0 || count*n*4 > len(b) {
+		return nil, fmt.Errorf("%s", "Mp4.Table.Invalid")
+	}
+	table = make([]uint32, count*n)
+	for i := range table {
+		table[i] = pio.U32BE(b[i*4:])
+	}
+	return
+}
+
+func (self *track) parseSampleEntry(typ string, b []byte) (err error) {
+	switch typ {
+	case "avc1", "avc3", "hvc1", "hev1":
+		//VisualSampleEntry 固定 78 字节
+		if len(b) < 78 {
+			return fmt.Errorf("%s", "Mp4.VisualSampleEntry.Invalid")
+		}
+		return eachBox(b[78:], func(typ string, body []byte) (err error) {
+			switch typ {
+			case "avcC":
+				self.codec, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(body)
+			case "hvcC":
+				self.codec, err = h265parser.NewCodecDataFromAVCDecoderConfRecord(body)
+			}
+			return
+		})
+	case "mp4a", ".mp3":
+		//AudioSampleEntry 28 字节，quicktime version 1 多 16 字节 version 2 多 36 字节
+		if len(b) < 28 {
+			return fmt.Errorf("%s", "Mp4.AudioSampleEntry.Invalid")
+		}
+		if typ == ".mp3" {
+			self.isMp3 = true
+			return
+		}
+		skip := 28
+		switch pio.U16BE(b[8:]) {
+		case 1:
+			skip += 16
+		case 2:
+			skip += 36
+		}
+		if len(b) < skip {
+			return fmt.Errorf("%s", "Mp4.AudioSampleEntry.Invalid")
+		}
+		return eachBox(b[skip:], func(typ string, body []byte) error {
+			if typ == "esds" && len(body) > 4 {
+				return self.parseEsds(body[4:])
+			}
+			return nil
+		})
+	}
+	return
+}
+
+//es 描述符的长度，每字节 7 位
+func descLen(b []byte) (n int, size int) {
+	for i := 0; i < 4 && i < len(b); i++ {
+		n = n<<7 | int(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return n, i + 1
+		}
+	}
+	return -1, 0
+}
+
+//ES_Descriptor -> DecoderConfigDescriptor -> DecoderSpecificInfo
+func (self *track) parseEsds(b []byte) (err error) {
+	var objectType uint8
+	for len(b) > 2 {
+		tag := b[0]
+		n, size := descLen(b[1:])
+		if n < 0 || 1+size+n > len(b) {
+			return fmt.Errorf("%s", "Mp4.Esds.Invalid")
+		}
+		body := b[1+size : 1+size+n]
+		switch tag {
+		case 0x03:
+			if len(body) < 3 {
+				return fmt.Errorf("%s", "Mp4.Esds.Invalid")
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > len(body) {
+				return fmt.Errorf("%s", "Mp4.Esds.Invalid")
+			}
+			b = body[skip:]
+			continue
+		case 0x04:
+			if len(body) < 13 {
+				return fmt.Errorf("%s", "Mp4.Esds.Invalid")
+			}
+			objectType = body[0]
+			//mpeg1/2 audio
+			if objectType == 0x69 || objectType == 0x6b {
+				self.isMp3 = true
+				return
+			}
+			b = body[13:]
+			continue
+		case 0x05:
+			if objectType == 0x40 {
+				self.codec, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(body)
+			}
+			return
+		}
+		b = b[1+size+n:]
+	}
+	return
+}
+
+func (self *track) toTime(ts uint64) time.Duration {
+	scale := uint64(self.timescale)
+	return time.Duration(ts/scale)*time.Second + time.Duration(ts%scale)*time.Second/time.Duration(scale)
+}
+
+//由 stts ctts stss stsc stsz stco 生成 sample 列表
+func (self *track) samples(idx int8) (samples []sample, err error) {
+	if self.timescale == 0 {
+		return nil, fmt.Errorf("%s", "Mp4.Timescale.Invalid")
+	}
+	count := int(self.stszN)
+	if self.stszSz == 0 && len(self.stsz) < count {
+		return nil, fmt.Errorf("%s", "Mp4.Stsz.Invalid")
+	}
+	samples = make([]sample, 0, count)
+
+	keys := map[uint32]bool{}
+	for _, n := range self.stss {
+		keys[n] = true
+	}
+	isVideo := self.codec != nil && self.codec.Type().IsVideo()
+
+	var dts uint64
+	stts, ctts := self.stts, self.ctts
+	var sttsLeft, cttsLeft uint32
+	stsc := self.stsc
+	num := 0
+	for chunk := 0; chunk < len(self.chunks) && num < count; chunk++ {
+		//当前 chunk 适用的 stsc 表项
+		for len(stsc) >= 6 && int(stsc[3]) <= chunk+1 {
+			stsc = stsc[3:]
+		}
+		if len(stsc) < 3 {
+			return nil, fmt.Errorf("%s", "Mp4.Stsc.Invalid")
+		}
+		offset := self.chunks[chunk]
+		for i := uint32(0); i < stsc[1] && num < count; i++ {
+			s := sample{idx: idx, offset: offset, size: self.stszSz, key: true}
+			if self.stszSz == 0 {
+				s.size = self.stsz[num]
+			}
+			offset += int64(s.size)
+
+			s.time = self.toTime(dts)
+			for sttsLeft == 0 && len(stts) >= 2 {
+				if sttsLeft = stts[0]; sttsLeft == 0 {
+					stts = stts[2:]
+				}
+			}
+			if sttsLeft > 0 {
+				dts += uint64(stts[1])
+				if sttsLeft--; sttsLeft == 0 {
+					stts = stts[2:]
+				}
+			}
+			for cttsLeft == 0 && len(ctts) >= 2 {
+				if cttsLeft = ctts[0]; cttsLeft == 0 {
+					ctts = ctts[2:]
+				}
+			}
+			if cttsLeft > 0 {
+				//version 1 是有符号的
+				if off := int32(ctts[1]); off > 0 {
+					s.cts = self.toTime(uint64(off))
+				}
+				if cttsLeft--; cttsLeft == 0 {
+					ctts = ctts[2:]
+				}
+			}
+			if isVideo && len(self.stss) > 0 {
+				s.key = keys[uint32(num+1)]
+			}
+			samples = append(samples, s)
+			num++
+		}
+	}
+	return
+}
@@ -11,6 +11,7 @@ import (
 	"rtmpServerStudy/flv"
 	"rtmpServerStudy/flv/flvio"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"net/url"
 	"rtmpServerStudy/timer"
 	//"rtmpServerStudy/amf"
@@ -55,6 +56,8 @@ func PacketToTag(pkt *av.Packet) (tag *flvio.Tag, timestamp int32) {
 		tag.Type = flvio.TAG_AUDIO
 	case RtmpMsgVideo:
 		tag.Type  = flvio.TAG_VIDEO
+	case RtmpMsgAmfMeta:
+		tag.Type = flvio.TAG_SCRIPTDATA
 	}
 	timestamp = flvio.TimeToTs(pkt.Time)
 	tag.Data = pkt.Data
@@ -121,6 +124,10 @@ func (self *Session) hdlSendAvPackets(w * flv.Muxer, r *http.Request) (err error
 		}
 
 		if pkt == nil && self.isClosed  != true {
+			//没有数据时把缓存的发出去
+			if err = w.GetMuxerWrite().Flush(); err != nil {
+				return
+			}
 			//t := timer.GlobalTimerPool.Get(time.Second * MAXREADTIMEOUT)
 			select {
 			case <-self.PacketAck:
@@ -131,6 +138,11 @@ func (self *Session) hdlSendAvPackets(w * flv.Muxer, r *http.Request) (err error
 		if self.pubSession.isClosed == true{
 			self.isClosed = true
 		}
+		//播放端断开或者推流结束
+		if self.isClosed == true && pkt == nil {
+			err = fmt.Errorf("%s","Hdl.Session.Closed.And.pkts.Is.Nil")
+			return
+		}
 		if pkt != nil {
 			tag,ts := PacketToTag(pkt)
 			if err = flvio.WriteTag(w.GetMuxerWrite(),tag, ts,w.B); err != nil {
@@ -141,10 +153,9 @@ func (self *Session) hdlSendAvPackets(w * flv.Muxer, r *http.Request) (err error
 	return
 }
 
-func HDLHandler(w http.ResponseWriter, r *http.Request){
-	fmt.Println(r.URL.Path)
-	//itmes:=strings.Split(r.URL.Path, ".flv")
-	host :=r.Host
+//域名取 ?vhost= 或者 Host，去掉端口
+func httpRequestHost(r *http.Request) (host string) {
+	host =r.Host
 	m, _ := url.ParseQuery(r.URL.RawQuery)
 	if len(m["vhost"])>0{
 		host = m["vhost"][0]
@@ -154,18 +165,84 @@ func HDLHandler(w http.ResponseWriter, r *http.Request){
 	if  len(h)>0{
 		host = h[0]
 	}
+	return
+}
+
+//http 播放鉴权 vhost 取 ?vhost= 或者 host，不是播放域名返回 404
+func httpPlayAuth(w http.ResponseWriter, r *http.Request) (host string, ok bool) {
+	host = httpRequestHost(r)
 
 	if _,PlayOk:=Gconfig.UserConf.PlayDomain[host];PlayOk == false{
 		w.WriteHeader(404)
+		return
 	}
+	ok = true
+	return
+}
 
-	//hashPath:=itmes[0]
-	//fmt.Println(hashPath)
-	name := mux.Vars(r)["name"]
-	app := mux.Vars(r)["app"]
-	fmt.Println(name,app)
-	stage := 0
-	//重试10次
+//发送 flv 头 gop 和之后的音视频，http flv 和 websocket flv 共用
+func (self *Session) hdlPlay(muxer *flv.Muxer, r *http.Request) (err error) {
+	//?delay= ?start= 从时移缓存发送，先发时移点的头
+	self.timeShiftQuery(r.URL.Query())
+	if self.timeShiftOpen() {
+		self.metaversion = self.pubSession.metaversion
+		if err = self.hdlSendTimeShiftHead(muxer, r); err == nil {
+			err = self.hdlSendTimeShift(muxer, r)
+		}
+		self.isClosed = true
+		return
+	}
+	//send audio,video head and meta
+	if err = self.hdlSendHead(muxer, r); err != nil {
+		self.isClosed = true
+		return
+	}
+	self.metaversion = self.pubSession.metaversion
+	//send gop for first screen
+	if err = self.hdlSendGop(muxer, r); err != nil {
+		self.isClosed = true
+		return
+	}
+	if err = muxer.GetMuxerWrite().Flush(); err != nil {
+		self.isClosed = true
+		return
+	}
+	if err = self.hdlSendAvPackets(muxer, r); err != nil {
+		self.isClosed = true
+		return
+	}
+	return
+}
+
+func HDLHandler(w http.ResponseWriter, r *http.Request){
+	httpLivePlay(w, r, func(session *Session) {
+		if websocket.IsWebSocketUpgrade(r) {
+			session.wsFlvPlay(w, r)
+			return
+		}
+		/*Cache-Control: no-cache
+		Content-Type: video/x-flv
+		Connection: close
+		Expires: -1
+		Pragma: no-cache*/
+
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+
+		flusher := w.(http.Flusher)
+		flusher.Flush()
+
+		muxer := flv.NewMuxerWriteFlusher(writeFlusher{httpflusher: flusher, Writer: w})
+		session.hdlPlay(muxer, r)
+		flusher.Flush()
+	})
+}
+
+//非 rtmp 的播放 session，播放域名已经检查过
+func newLivePlaySession(host, app, name string) *Session {
 	session := new(Session)
 	session.CursorList = AvQue.NewPublist()
 	session.lock = &sync.RWMutex{}
@@ -174,70 +251,63 @@ func HDLHandler(w http.ResponseWriter, r *http.Request){
 	session.StreamId = name
 	session.App = app
 	session.Vhost = host
+	return session
+}
+
+//挂到推流的 CursorList，拷贝 codec 和 gop，http rtsp 播放共用
+func (self *Session) livePlayAttach(pubSession *Session) {
+	self.context, self.cancel = pubSession.context, pubSession.cancel
+	self.CurQue = AvQue.RingBufferCreate(10)
+	//onpublish handler
+	t := timer.GlobalTimerPool.Get(time.Second * MAXREADTIMEOUT)
+	select {
+	case pubSession.RegisterChannel <- self:
+	case <-t.C:
+	//may be is err
+	}
+	timer.GlobalTimerPool.Put(t)
+	self.pubSession = pubSession
+
+
+	//copy gop,codec here all new play Competitive the publishing lock
+	pubSession.RLock()
+	self.updatedGop = true
+	self.aCodec = pubSession.aCodec
+	self.vCodecData = pubSession.vCodecData
+	self.aCodecData = pubSession.aCodecData
+	self.vCodec = pubSession.vCodec
+	//copy all gop just ptr copy
+	//session.metaversion = pubSession.metaversion
+	self.metaData = pubSession.metaData
+	self.GopCache = pubSession.GopCache.GopCopy()
+	pubSession.RUnlock()
+}
+
+//http 播放 鉴权 等待推流 挂到推流的 CursorList 后由 play 发送数据，flv ts 共用
+func httpLivePlay(w http.ResponseWriter, r *http.Request, play func(session *Session)){
+	fmt.Println(r.URL.Path)
+	//itmes:=strings.Split(r.URL.Path, ".flv")
+	host, ok := httpPlayAuth(w, r)
+	if !ok {
+		return
+	}
+
+	//hashPath:=itmes[0]
+	//fmt.Println(hashPath)
+	name := mux.Vars(r)["name"]
+	app := mux.Vars(r)["app"]
+	fmt.Println(name,app)
+	stage := 0
+	//重试10次
+	session := newLivePlaySession(host, app, name)
 
 	for stage <= 15 {
 		pubSession := RtmpSessionGet(session.StreamAnchor)
 		if pubSession != nil {
-			session.context, session.cancel = pubSession.context, pubSession.cancel
-			session.CurQue = AvQue.RingBufferCreate(10)
-			//onpublish handler
-			t := timer.GlobalTimerPool.Get(time.Second * MAXREADTIMEOUT)
-			select {
-			case pubSession.RegisterChannel <- session:
-			case <-t.C:
-			//may be is err
-			}
-			timer.GlobalTimerPool.Put(t)
-			session.pubSession = pubSession
-
-
-			//copy gop,codec here all new play Competitive the publishing lock
-			pubSession.RLock()
-			session.updatedGop = true
-			session.aCodec = pubSession.aCodec
-			session.vCodecData = pubSession.vCodecData
-			session.aCodecData = pubSession.aCodecData
-			session.vCodec = pubSession.vCodec
-			//copy all gop just ptr copy
-			//session.metaversion = pubSession.metaversion
-			session.metaData = pubSession.metaData
-			session.GopCache = pubSession.GopCache.GopCopy()
-			pubSession.RUnlock()
-			/*Cache-Control: no-cache
-			Content-Type: video/x-flv
-			Connection: close
-			Expires: -1
-			Pragma: no-cache*/
-
-			w.Header().Set("Content-Type", "video/x-flv")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.WriteHeader(200)
-
-			flusher := w.(http.Flusher)
-			flusher.Flush()
-
-			muxer := flv.NewMuxerWriteFlusher(writeFlusher{httpflusher: flusher, Writer: w})
-			//send audio,video head and meta
-			if err := session.hdlSendHead(muxer, r); err != nil {
-				session.isClosed = true
-				flusher.Flush()
-				return
-			}
-			session.metaversion = session.pubSession.metaversion
-			//send gop for first screen
-			if err := session.hdlSendGop(muxer, r); err != nil {
-				session.isClosed = true
-				flusher.Flush()
-				return
-			}
-			if err := session.hdlSendAvPackets(muxer, r); err != nil {
-				session.isClosed = true
-				flusher.Flush()
-				return
-			}
-			flusher.Flush()
+			session.livePlayAttach(pubSession)
+			play(session)
+			session.isClosed = true
+			return
 
 		} else {
 			//hdl relay or rtmp relay must add
@@ -249,6 +319,9 @@ func HDLHandler(w http.ResponseWriter, r *http.Request){
 				url1:= "rtmp://" + session.pushIp + "/" + session.App +"?" + "vhost=" + session.Vhost + "/" + session.StreamId +"?relay=1"
 				fmt.Println(url1)
 				RtmpRelay("tcp", session.pushIp, session.Vhost, session.App, session.StreamId, url1, stageSessionDone)
+			} else {
+				//本机的流，配置了外部拉流时按需拉
+				sourcePullOnDemand(session.Vhost, session.App, session.StreamId)
 			}
 			time.Sleep(1 * time.Second)
 			stage++
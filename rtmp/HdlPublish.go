@@ -0,0 +1,42 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//http flv 推流，POST/PUT /{app}/{name}.flv?vhost=xxx，body 为 flv 文件格式，一般是 chunked
+//例如 ffmpeg -re -i 4b.flv -c copy -f flv -method POST http://test.uplive.com:8087/live/123.flv
+func HDLPublishHandler(w http.ResponseWriter, r *http.Request) {
+	host := httpRequestHost(r)
+	app := mux.Vars(r)["app"]
+	name := mux.Vars(r)["name"]
+
+	session := newIngestSession(r.Body, "httpflv", r.RemoteAddr)
+	if err := session.ingestCheck(host, app, name); err != nil {
+		fmt.Printf("http flv publish %s err the err is %s\n", r.URL.Path, err.Error())
+		w.WriteHeader(403)
+		return
+	}
+
+	if err := session.ingestFlvHeader(); err != nil {
+		fmt.Printf("http flv publish %s err the err is %s\n", r.URL.Path, err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	if err := session.ingestPublish(); err != nil {
+		w.WriteHeader(409)
+		return
+	}
+	defer session.ingestClose()
+
+	err := session.ingestFlvTags()
+	if err != io.EOF {
+		fmt.Printf("http flv publish %s end the err is %s\n", r.URL.Path, err.Error())
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,114 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"rtmpServerStudy/flv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//websocket flv，代理不支持 chunked 时 flv.js mpegts.js 使用
+const (
+	wsFlvWriteWait  = 10 * time.Second
+	wsFlvPongWait   = 60 * time.Second
+	wsFlvPingPeriod = wsFlvPongWait * 9 / 10
+	//缓存超过后立即发送一个 binary message
+	wsFlvMaxMessage = 64 * 1024
+)
+
+var wsFlvUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	//跨域由播放鉴权控制
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+//flv tag 缓存后一次作为一个 binary message 发送
+type wsWriteFlusher struct {
+	conn *websocket.Conn
+	buf  bytes.Buffer
+}
+
+func (self *wsWriteFlusher) Write(b []byte) (n int, err error) {
+	n, _ = self.buf.Write(b)
+	if self.buf.Len() >= wsFlvMaxMessage {
+		err = self.Flush()
+	}
+	return
+}
+
+func (self *wsWriteFlusher) Flush() (err error) {
+	if self.buf.Len() == 0 {
+		return
+	}
+	self.conn.SetWriteDeadline(time.Now().Add(wsFlvWriteWait))
+	err = self.conn.WriteMessage(websocket.BinaryMessage, self.buf.Bytes())
+	self.buf.Reset()
+	return
+}
+
+//读 pong 和 close，断开后从推流的 CursorList 中摘掉
+func (self *Session) wsFlvKeepalive(conn *websocket.Conn, done chan struct{}) {
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(wsFlvPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsFlvPongWait))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(wsFlvPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsFlvWriteWait)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	//推流端下次分发时摘掉，唤醒发送协程退出
+	self.isClosed = true
+	select {
+	case self.PacketAck <- true:
+	default:
+	}
+	close(done)
+}
+
+func (self *Session) wsFlvPlay(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsFlvUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("websocket flv upgrade %s err the err is %s\n", r.URL.Path, err.Error())
+		self.isClosed = true
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go self.wsFlvKeepalive(conn, done)
+
+	muxer := flv.NewMuxerWriteFlusher(&wsWriteFlusher{conn: conn})
+	if err = self.hdlPlay(muxer, r); err != nil {
+		fmt.Printf("websocket flv play %s end the err is %s\n", r.URL.Path, err.Error())
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsFlvWriteWait))
+	//等对端回 close 或者超时
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,173 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/ts"
+	"time"
+)
+
+//http ts 直播 /{app}/{name}.live.ts，机顶盒 vlc 使用，.ts 留给 hls 的分片
+const (
+	//pcr 间隔不超过 100ms
+	httpTsPCRInterval = 40 * time.Millisecond
+	httpTsPSIInterval = 500 * time.Millisecond
+)
+
+//http 的 ResponseWriter 没有 Close
+type httpTsWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (self httpTsWriter) Write(b []byte) (int, error) {
+	return self.w.Write(b)
+}
+
+func (self httpTsWriter) Close() error {
+	return nil
+}
+
+func (self httpTsWriter) Flush() {
+	self.flusher.Flush()
+}
+
+//sequence header 不写入 ts，由 codec 生成
+func httpTsIsSeqHeader(pkt *av.Packet) bool {
+	tag := flvio.Tag{}
+	switch pkt.PacketType {
+	case RtmpMsgAudio:
+		tag.Type = flvio.TAG_AUDIO
+	case RtmpMsgVideo:
+		tag.Type = flvio.TAG_VIDEO
+	default:
+		return true
+	}
+	if _, err := tag.ParseHeader(pkt.Data); err != nil {
+		return true
+	}
+	if tag.Type == flvio.TAG_AUDIO {
+		return tag.SoundFormat == flvio.SOUND_AAC && tag.AACPacketType == flvio.AAC_SEQHDR
+	}
+	return (tag.CodecID == flvio.VIDEO_H264 || tag.CodecID == flvio.VIDEO_H265) && tag.AVCPacketType == flvio.AVC_SEQHDR
+}
+
+func (self *Session) httpTsStreams() (streams []av.CodecData) {
+	if ts.IsCodecSupported(self.aCodec) {
+		streams = append(streams, self.aCodec)
+	}
+	if ts.IsCodecSupported(self.vCodec) {
+		streams = append(streams, self.vCodec)
+	}
+	return
+}
+
+func (self *Session) httpTsWritePacket(muxer *ts.Muxer, pkt *av.Packet) (err error) {
+	if len(pkt.Data) <= pkt.DataPos {
+		return
+	}
+	if httpTsIsSeqHeader(pkt) {
+		//编码参数变化后 pmt 和 sps pps 跟着变
+		self.pubSession.RLock()
+		aCodec, vCodec := self.pubSession.aCodec, self.pubSession.vCodec
+		aCodecData, vCodecData := self.pubSession.aCodecData, self.pubSession.vCodecData
+		self.pubSession.RUnlock()
+		if !bytes.Equal(aCodecData, self.aCodecData) || !bytes.Equal(vCodecData, self.vCodecData) {
+			self.aCodec, self.vCodec = aCodec, vCodec
+			self.aCodecData, self.vCodecData = aCodecData, vCodecData
+			err = muxer.UpdateHeader(self.httpTsStreams())
+		}
+		return
+	}
+	switch pkt.PacketType {
+	case RtmpMsgAudio:
+		if !ts.IsCodecSupported(self.aCodec) {
+			return
+		}
+		pts := uint64(flvio.TimeToTs(pkt.Time) * 90)
+		err = muxer.WriteAudioPacket([]*av.Packet{pkt}, self.aCodec, pts)
+	case RtmpMsgVideo:
+		if !ts.IsCodecSupported(self.vCodec) {
+			return
+		}
+		err = muxer.WritePacket(pkt, self.vCodec)
+	}
+	return
+}
+
+//先发 gop 再发实时的包
+func (self *Session) httpTsPlay(muxer *ts.Muxer, w httpTsWriter) (err error) {
+	if err = muxer.WriteHeader(self.httpTsStreams()); err != nil {
+		return
+	}
+	if self.GopCache != nil {
+		for pkt := self.GopCache.RingBufferGet(); pkt != nil; pkt = self.GopCache.RingBufferGet() {
+			if err = self.httpTsWritePacket(muxer, pkt); err != nil {
+				self.GopCache = nil
+				return
+			}
+		}
+		self.GopCache = nil
+	}
+
+	for {
+		pkt := self.CurQue.RingBufferGet()
+
+		select {
+		case <-self.context.Done():
+			// here publish may over so play is over
+			fmt.Println("the publisher is close")
+			self.isClosed = true
+			return
+		default:
+		}
+
+		if pkt == nil && self.isClosed != true {
+			//没有数据时把缓存的发出去
+			if err = muxer.Flush(); err != nil {
+				return
+			}
+			w.Flush()
+			select {
+			case <-self.PacketAck:
+			}
+		}
+		if self.pubSession.isClosed == true {
+			self.isClosed = true
+		}
+		if self.isClosed == true && pkt == nil {
+			err = fmt.Errorf("%s", "HttpTs.Session.Closed.And.pkts.Is.Nil")
+			return
+		}
+		if pkt != nil {
+			if err = self.httpTsWritePacket(muxer, pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func tsHandler(w http.ResponseWriter, r *http.Request) {
+	httpLivePlay(w, r, func(session *Session) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+
+		tw := httpTsWriter{w: w, flusher: w.(http.Flusher)}
+		tw.Flush()
+
+		muxer := ts.NewMuxer(tw)
+		muxer.PCRInterval = httpTsPCRInterval
+		muxer.PSIInterval = httpTsPSIInterval
+		if err := session.httpTsPlay(muxer, tw); err != nil {
+			fmt.Printf("http ts play %s end the err is %s\n", r.URL.Path, err.Error())
+		}
+		session.isClosed = true
+		muxer.Flush()
+		tw.Flush()
+	})
+}
@@ -3,9 +3,11 @@ package rtmp
 import (
 	"bytes"
 	"container/list"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 
@@ -13,10 +15,110 @@ var (
 	ErrNoKey = errors.New("No key for cache")
 )
 
+//hls 播放列表模式
+const (
+	//滑动窗口直播，过期的 ts 删除
+	HlsPlaylistLive  = "live"
+	//dvr 可回看最近 N 分钟，EXT-X-PLAYLIST-TYPE:EVENT
+	HlsPlaylistEvent = "event"
+	//完整点播，断流时写 EXT-X-ENDLIST
+	HlsPlaylistVod   = "vod"
+)
+
 type TSItem struct {
 	Name     string
 	SeqNum   uint64
 	Duration float32
+	//与前一个分片不连续（断流重推）
+	Discontinuity bool
+	//加密信息，nil 不加密
+	Key *HlsKey
+	//文件大小，用于计算码率
+	Size int64
+	//广告插入标记，nil 没有
+	Cue *HlsCue
+	//分片开始的时间，有 cue 时写 EXT-X-PROGRAM-DATE-TIME
+	StartTime time.Time
+}
+
+//EXT-X-KEY
+type HlsKey struct {
+	Method string
+	URI    string
+	IV     []byte
+}
+
+func (self *HlsKey) equal(other *HlsKey) bool {
+	if self == nil || other == nil {
+		return self == other
+	}
+	return self.Method == other.Method && self.URI == other.URI && bytes.Equal(self.IV, other.IV)
+}
+
+func (self *HlsKey) tag() string {
+	if self == nil {
+		return "#EXT-X-KEY:METHOD=NONE\n"
+	}
+	return fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=0x%s\n", self.Method, self.URI, hex.EncodeToString(self.IV))
+}
+
+//SCTE-35 广告插入点，分片开始时生效
+type HlsCue struct {
+	//true cue-out 开始插播，false cue-in 回到直播
+	Out bool
+	//插播中的分片 EXT-X-CUE-OUT-CONT
+	Cont bool
+	Id   uint32
+	//插播时长(秒)，0 未知
+	Duration float32
+	//插播已经过去的时长(秒)
+	Elapsed float32
+	//cue-out 开始的时间，cue-in 的 DATERANGE 结束在分片开始
+	Start time.Time
+	//splice_info_section
+	Scte35 []byte
+}
+
+const hlsDateLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func (self *HlsCue) tags(start time.Time) string {
+	w := bytes.NewBuffer(nil)
+	if self.Cont {
+		fmt.Fprintf(w, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f", self.Elapsed)
+		if self.Duration > 0 {
+			fmt.Fprintf(w, ",Duration=%.3f", self.Duration)
+		}
+		fmt.Fprintf(w, "\n")
+		return w.String()
+	}
+	//EXT-X-DATERANGE 要求有 EXT-X-PROGRAM-DATE-TIME
+	fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", start.Format(hlsDateLayout))
+	if self.Out {
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"splice-%d\",START-DATE=\"%s\"", self.Id, start.Format(hlsDateLayout))
+		if self.Duration > 0 {
+			fmt.Fprintf(w, ",PLANNED-DURATION=%.3f", self.Duration)
+		}
+		if len(self.Scte35) > 0 {
+			fmt.Fprintf(w, ",SCTE35-OUT=0x%s", hex.EncodeToString(self.Scte35))
+		}
+		if self.Duration > 0 {
+			fmt.Fprintf(w, "\n#EXT-X-CUE-OUT:DURATION=%.3f\n", self.Duration)
+		} else {
+			fmt.Fprintf(w, "\n#EXT-X-CUE-OUT\n")
+		}
+		return w.String()
+	}
+	begin := self.Start
+	if begin.IsZero() || begin.After(start) {
+		begin = start
+	}
+	fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"splice-%d\",START-DATE=\"%s\",END-DATE=\"%s\",DURATION=%.3f",
+		self.Id, begin.Format(hlsDateLayout), start.Format(hlsDateLayout), start.Sub(begin).Seconds())
+	if len(self.Scte35) > 0 {
+		fmt.Fprintf(w, ",SCTE35-IN=0x%s", hex.EncodeToString(self.Scte35))
+	}
+	fmt.Fprintf(w, "\n#EXT-X-CUE-IN\n")
+	return w.String()
 }
 
 func NewTSItem(name string, duration float32 ,seqNum uint64) *TSItem {
@@ -29,7 +131,15 @@ func NewTSItem(name string, duration float32 ,seqNum uint64) *TSItem {
 
 type m3u8Box struct {
 	id   string
+	//最多保留的分片数，0 不限制
 	num  int
+	//最多保留的分片总时长(秒)，0 不限制
+	window float32
+	duration float32
+	playlistType string
+	endList bool
+	//滑出窗口的 EXT-X-DISCONTINUITY 个数
+	discSeq uint64
 	lock sync.RWMutex
 	ll   *list.List
 }
@@ -39,7 +149,35 @@ func NewM3u8Box(id string) *m3u8Box {
 		id:  id,
 		ll:  list.New(),
 		num: 3,
+		playlistType: HlsPlaylistLive,
+	}
+}
+
+//根据模式创建，live 按分片数滑动，event 按时长滑动，vod 保留全部
+func NewM3u8BoxWithType(id string, playlistType string, num int, window float32) *m3u8Box {
+	box := NewM3u8Box(id)
+	box.playlistType = playlistType
+	switch playlistType {
+	case HlsPlaylistEvent, "dvr":
+		box.playlistType = HlsPlaylistEvent
+		box.num = 0
+		box.window = window
+	case HlsPlaylistVod:
+		box.num = 0
+	default:
+		box.playlistType = HlsPlaylistLive
+		if num > 0 {
+			box.num = num
+		}
 	}
+	return box
+}
+
+//断流时结束播放列表
+func (self *m3u8Box) SetEndList() {
+	self.lock.Lock()
+	self.endList = true
+	self.lock.Unlock()
 }
 
 func (tcCacheItem *m3u8Box) ID() string {
@@ -48,9 +186,13 @@ func (tcCacheItem *m3u8Box) ID() string {
 
 
 func (self *m3u8Box) GenM3U8PlayList() ([]byte, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	var seq uint64
 	var getSeq bool
 	var maxDuration float32
+	var lastKey *HlsKey
+	version := 3
 	m3u8body := bytes.NewBuffer(nil)
 	for e := self.ll.Front(); e != nil; e = e.Next() {
 		key := e.Value.(*TSItem)
@@ -61,22 +203,113 @@ func (self *m3u8Box) GenM3U8PlayList() ([]byte, error) {
 			getSeq = true
 			seq = key.SeqNum
 		}
+		if key.Discontinuity {
+			fmt.Fprintf(m3u8body, "#EXT-X-DISCONTINUITY\n")
+		}
+		//key 或 iv 变化时才输出 EXT-X-KEY
+		if !key.Key.equal(lastKey) {
+			m3u8body.WriteString(key.Key.tag())
+			lastKey = key.Key
+		}
+		if key.Key != nil && key.Key.Method == HlsEncryptSampleAES {
+			version = 5
+		}
+		if key.Cue != nil {
+			m3u8body.WriteString(key.Cue.tags(key.StartTime))
+		}
 		fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(key.Duration), key.Name)
 
 	}
 
 	w := bytes.NewBuffer(nil)
 	fmt.Fprintf(w,
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		int32(maxDuration)+1, seq)
+		"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-DISCONTINUITY-SEQUENCE:%d\n",
+		version, int32(maxDuration)+1, seq, self.discSeq)
+	switch self.playlistType {
+	case HlsPlaylistEvent:
+		fmt.Fprintf(w, "#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	case HlsPlaylistVod:
+		fmt.Fprintf(w, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	fmt.Fprintf(w, "\n")
 	w.Write(m3u8body.Bytes())
+	if self.endList {
+		fmt.Fprintf(w, "#EXT-X-ENDLIST\n")
+	}
 	return w.Bytes(), nil
 }
 
-func (self *m3u8Box) SetItem(item *TSItem) {
-	if self.ll.Len() == self.num {
-		e := self.ll.Front()
-		self.ll.Remove(e)
+//当前窗口内的分片
+func (self *m3u8Box) Items() (items []TSItem) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for e := self.ll.Front(); e != nil; e = e.Next() {
+		items = append(items, *e.Value.(*TSItem))
+	}
+	return
+}
+
+func (self *m3u8Box) EndList() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.endList
+}
+
+//窗口内分片的峰值码率和平均码率 bit/s
+func (self *m3u8Box) Bandwidth() (peak int, average int) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var size int64
+	var duration float32
+	for e := self.ll.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*TSItem)
+		if item.Duration <= 0 || item.Size <= 0 {
+			continue
+		}
+		if bw := int(float32(item.Size*8) / item.Duration); bw > peak {
+			peak = bw
+		}
+		size += item.Size
+		duration += item.Duration
+	}
+	if duration > 0 {
+		average = int(float32(size*8) / duration)
+	}
+	return
+}
+
+//窗口内是否还有分片使用这个 key
+func (self *m3u8Box) keyInUse(uri string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for e := self.ll.Front(); e != nil; e = e.Next() {
+		if key := e.Value.(*TSItem).Key; key != nil && key.URI == uri {
+			return true
+		}
 	}
+	return false
+}
+
+//加入新的分片，返回滑出窗口的分片，由调用者删除文件
+func (self *m3u8Box) SetItem(item *TSItem) (expired []*TSItem) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.ll.PushBack(item)
+	self.duration += item.Duration
+	for self.ll.Len() > 1 {
+		if (self.num > 0 && self.ll.Len() > self.num) ||
+			(self.window > 0 && self.duration - self.ll.Front().Value.(*TSItem).Duration >= self.window) {
+			e := self.ll.Front()
+			old := e.Value.(*TSItem)
+			self.ll.Remove(e)
+			self.duration -= old.Duration
+			if old.Discontinuity {
+				self.discSeq++
+			}
+			expired = append(expired, old)
+			continue
+		}
+		break
+	}
+	return
 }
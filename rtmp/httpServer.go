@@ -28,9 +28,23 @@ func (self *Server) httpServerStart(addr string)(err error) {
 	r := mux.NewRouter()
 	// Routes consist of a path and a handler function.
 	r.HandleFunc("/test", handler1)
+	//rtmp over websocket 和 rtmpt
+	r.HandleFunc("/rtmp/ws", self.rtmpWsHandler)
+	r.HandleFunc("/fcs/ident2", rtmptIdentHandler).Methods("POST")
+	r.HandleFunc("/open/1", self.rtmptOpenHandler).Methods("POST")
+	r.HandleFunc("/send/{id}/{seq:[0-9]+}", rtmptSendHandler).Methods("POST")
+	r.HandleFunc("/idle/{id}/{seq:[0-9]+}", rtmptIdleHandler).Methods("POST")
+	r.HandleFunc("/close/{id}/{seq:[0-9]+}", rtmptCloseHandler).Methods("POST")
+	//webrtc whip 推流 whep 播放
+	r.HandleFunc("/whip/{app}/{name:[A-Za-z0-9-_+]+}",WHIPHandler).Methods("POST")
+	r.HandleFunc("/whep/{app}/{name:[A-Za-z0-9-_+]+}",WHEPHandler).Methods("POST")
+	r.HandleFunc("/{path:whip|whep}/{app}/{name:[A-Za-z0-9-_+]+}",WebrtcOptionsHandler).Methods("OPTIONS")
+	r.HandleFunc("/webrtc/{id:[0-9a-f]+}",WebrtcDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/{app}/{name:[A-Za-z0-9-_+]+}.flv",HDLPublishHandler).Methods("POST", "PUT")
 	r.HandleFunc("/{app}/{name:[A-Za-z0-9-_+]+}.flv",HDLHandler)
+	r.HandleFunc("/hlskey/{app}/{name:[A-Za-z0-9-_+]+}/{key:[0-9]+}.key",hlsKeyHandler)
 	r.HandleFunc("/{app}/{name:[A-Za-z0-9-_+]+}.m3u8",m3u8Handler)
-	r.HandleFunc("/{app}/{name:[A-Za-z0-9-_+]+}.ts",tsHandler)
+	r.HandleFunc("/{app}/{name:[A-Za-z0-9-_+]+}.live.ts",tsHandler)
 	r.HandleFunc("/debug/pprof/", pprof.Index)
 	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
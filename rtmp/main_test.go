@@ -0,0 +1,15 @@
+package rtmp
+
+import (
+	"os"
+	"rtmpServerStudy/log"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+//各处直接用 log.Log 打日志，测试时不输出
+func TestMain(m *testing.M) {
+	log.Log = zap.NewNop()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"rtmpServerStudy/log"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ack 和窗口流控
+读: 对端 WindowAckSize 之后每收到 readAckSize 字节回一个 Acknowledgement，序号是累计收到的字节数
+写: 统计写到连接的字节数，对端 SetPeerBandwidth 按 hard soft dynamic 更新窗口
+配置 AckTimeout 后播放端未确认的字节超过窗口时暂停发送，等待超过 AckTimeout 断开
+*/
+
+//配置 AckTimeout，0 不开启播放端 ack 流控
+var playAckTimeout time.Duration
+
+//统计写到连接的字节数
+type countWriter struct {
+	w io.Writer
+	n *uint32
+}
+
+func (self countWriter) Write(b []byte) (n int, err error) {
+	n, err = self.w.Write(b)
+	*self.n += uint32(n)
+	return
+}
+
+//readChunk 之后调用，读写分开时由发送协程调用 rtmpAckSend 回 ack，这里不写
+func (self *Session) rtmpAckCheck() (err error) {
+	if self.ctrlRead {
+		return
+	}
+	return self.rtmpAckSend()
+}
+
+//收到的字节超过窗口时回 ack，只在写 bufw 的协程调用，读写分开时 inBytes readAckSize 由读协程更新
+func (self *Session) rtmpAckSend() (err error) {
+	//读协程收到的 SetPeerBandwidth 在这里回 WindowAckSize
+	if window := atomic.SwapUint32(&self.peerWindowAck, 0); window != 0 && window != self.writeAckSize {
+		if err = self.writeWindowAckSize(window); err != nil {
+			return
+		}
+		if err = self.flushWrite(); err != nil {
+			return
+		}
+	}
+	size := atomic.LoadUint32(&self.readAckSize)
+	in := atomic.LoadUint32(&self.inBytes)
+	if size == 0 || in-self.inLastAck < size {
+		return
+	}
+	if err = self.writeRtmpMsgAck(in); err != nil {
+		return
+	}
+	self.inLastAck = in
+	return self.flushWrite()
+}
+
+//对端没有确认的字节数超过窗口时等待 ack，对端从来没有回过 ack 的不限制
+func (self *Session) rtmpAckThrottle() (err error) {
+	if playAckTimeout <= 0 || atomic.LoadInt32(&self.peerAcked) == 0 {
+		return
+	}
+	//对端设置了带宽按对端的，否则允许落后一个窗口
+	window := atomic.LoadUint32(&self.peerBandwidth)
+	if window == 0 {
+		window = 2 * self.writeAckSize
+	}
+	if window == 0 {
+		return
+	}
+	var t *time.Timer
+	for self.outBytes-atomic.LoadUint32(&self.peerAckSeq) > window {
+		if t == nil {
+			t = time.NewTimer(playAckTimeout)
+			defer t.Stop()
+		}
+		select {
+		case <-self.ackNotify:
+		case <-t.C:
+			log.Log.Info(fmt.Sprintf("%s rtmp ack timeout out:%d acked:%d window:%d", self.LogFormat(),
+				self.outBytes, atomic.LoadUint32(&self.peerAckSeq), window))
+			return fmt.Errorf("%s", "Rtmp.Ack.Timeout")
+		}
+	}
+	return
+}
+
+//直播播放只写不读，开启 ack 流控时起一个读协程读对端的 ack，只处理控制消息，断开时关闭连接
+func (self *Session) rtmpCtrlReadStart() {
+	self.ctrlRead = true
+	self.rtmpCmdHandler = RtmpCmdHandle{
+		"closeStream":  RtmpCloseStreamCmdHandler,
+		"deleteStream": RtmpDeleteStreamCmdHandler,
+	}
+	self.readDone = make(chan struct{})
+	go func() {
+		for {
+			if err := self.readChunk(RtmpMsgHandles); err != nil {
+				log.Log.Info(fmt.Sprintf("%s rtmp play read err:%s", self.LogFormat(), err.Error()))
+				self.netconn.Close()
+				close(self.readDone)
+				return
+			}
+		}
+	}()
+}
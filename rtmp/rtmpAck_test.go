@@ -0,0 +1,115 @@
+package rtmp
+
+import (
+	"io"
+	"net"
+	"rtmpServerStudy/utils/bits/pio"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//对端发来的 WindowAckSize，type 0 头 12 字节加 4 字节窗口
+func ackTestWindowAckSize(size uint32) []byte {
+	b := make([]byte, 16)
+	b[0] = 2
+	pio.PutU24BE(b[4:], 4)
+	b[7] = RtmpMsgAckSize
+	pio.PutU32BE(b[12:], size)
+	return b
+}
+
+//读写分开时读协程只计数不写，ack 由发送协程回
+func TestAckCtrlRead(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	session := NewSsesion(server)
+	session.rtmpCtrlReadStart()
+
+	//窗口 16 字节，两个消息 32 字节
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write(ackTestWindowAckSize(16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint32(&session.inBytes) < 32 {
+		if time.Now().After(deadline) {
+			t.Fatalf("read %d bytes want 32", atomic.LoadUint32(&session.inBytes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if size := atomic.LoadUint32(&session.readAckSize); size != 16 {
+		t.Fatalf("read ack size %d want 16", size)
+	}
+	//读协程不写
+	b := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := client.Read(b); err == nil {
+		t.Fatalf("read goroutine wrote %x", b[:n])
+	}
+	client.SetReadDeadline(time.Time{})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- session.rtmpAckSend()
+	}()
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if b[7] != RtmpMsgAck || pio.U32BE(b[12:]) != 32 {
+		t.Fatalf("ack %x want sequence 32", b)
+	}
+	//没有新的数据不再回 ack
+	if err := session.rtmpAckSend(); err != nil || session.inLastAck != 32 {
+		t.Fatalf("ack send again err %v last ack %d", err, session.inLastAck)
+	}
+}
+
+//读写分开时 SetPeerBandwidth 的 WindowAckSize 由发送协程回
+func TestAckCtrlReadBandwidth(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	session := NewSsesion(server)
+	session.rtmpCtrlReadStart()
+
+	b := make([]byte, 17)
+	b[0] = 2
+	pio.PutU24BE(b[4:], 5)
+	b[7] = RtmpMsgBandwidth
+	pio.PutU32BE(b[12:], 4096)
+	b[16] = RtmpLimitHard
+	if _, err := client.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint32(&session.peerWindowAck) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("bandwidth not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if limit := atomic.LoadUint32(&session.peerLimitType); limit != RtmpLimitHard {
+		t.Fatalf("limit type %d want hard", limit)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- session.rtmpAckSend()
+	}()
+	if _, err := io.ReadFull(client, b[:16]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if b[7] != RtmpMsgAckSize || pio.U32BE(b[12:]) != 4096 {
+		t.Fatalf("window ack size %x want 4096", b[:16])
+	}
+	if session.writeAckSize != 4096 {
+		t.Fatalf("write ack size %d want 4096", session.writeAckSize)
+	}
+}
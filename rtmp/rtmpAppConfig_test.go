@@ -0,0 +1,208 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/utils/bits/pio"
+	"sort"
+	"testing"
+	"time"
+)
+
+var (
+	//high profile level 3.1
+	appConfigTestSps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03,
+		0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	appConfigTestPps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func appConfigTestCodec(t *testing.T) av.CodecData {
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS([][]byte{appConfigTestSps}, [][]byte{appConfigTestPps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+//flv video tag 头加一个 avcc 的 nalu
+func appConfigTestPacket(i int, key bool) *av.Packet {
+	frameType := byte(0x27)
+	nalu := []byte{0x41, 0x9a, byte(i)}
+	if key {
+		frameType = 0x17
+		nalu = []byte{0x65, 0x88, byte(i)}
+	}
+	data := []byte{frameType, 1, 0, 0, 0, 0, 0, 0, byte(len(nalu))}
+	return &av.Packet{
+		PacketType: RtmpMsgVideo,
+		IsKeyFrame: key,
+		Time:       time.Duration(i) * 100 * time.Millisecond,
+		DataPos:    5,
+		Data:       append(data, nalu...),
+	}
+}
+
+func TestGopCacheNum(t *testing.T) {
+	codec := appConfigTestCodec(t)
+	//没有配置时和原来一样缓存 1 个
+	for _, c := range []struct{ num, gops int }{{0, 1}, {1, 1}, {2, 2}, {3, 3}} {
+		session := &Session{UserCnf: config.App{GopCacheNum: c.num}, vCodec: codec}
+		session.gopCacheCreate()
+		//5 个 gop，每个 gop 4 帧
+		for i := 0; i < 20; i++ {
+			session.rtmpUpdateGopCache(appConfigTestPacket(i, i%4 == 0))
+		}
+		gop := session.GopCache.GopCopy()
+		var pkts []*av.Packet
+		for pkt := gop.RingBufferGet(); pkt != nil; pkt = gop.RingBufferGet() {
+			pkts = append(pkts, pkt)
+		}
+		if len(pkts) != c.gops*4 {
+			t.Fatalf("GopCacheNum %d cached %d packets want %d", c.num, len(pkts), c.gops*4)
+		}
+		if !pkts[0].IsKeyFrame || pkts[0].Time != time.Duration(20-c.gops*4)*100*time.Millisecond {
+			t.Fatalf("GopCacheNum %d first packet %v key %v", c.num, pkts[0].Time, pkts[0].IsKeyFrame)
+		}
+	}
+}
+
+func TestExtTimeSend(t *testing.T) {
+	for _, c := range []struct {
+		extTimeSend int
+		timestamp   uint32
+		ext         bool
+	}{
+		{0, 0x01000000, true},
+		{1, 0x01000000, true},
+		{2, 0x01000000, false},
+		//时间戳没有超过 24 位时都不带
+		{1, 0x1000, false},
+	} {
+		w := bytes.NewBuffer(nil)
+		session := &Session{UserCnf: config.App{ExtTimeSend: c.extTimeSend}}
+		session.bufw = bufio.NewWriter(w)
+		session.chunkHeaderBuf = make([]byte, chunkHeaderLength)
+		session.writeMaxChunkSize = 128
+		data := make([]byte, 300)
+		if _, err := session.DoSend(data, 7, c.timestamp, RtmpMsgVideo, 1, len(data)); err != nil {
+			t.Fatal(err)
+		}
+		session.flushWrite()
+		b := w.Bytes()
+
+		//type 0 头，时间戳超过 24 位时 type 0 总是带扩展时间戳
+		n := 12
+		if c.timestamp >= 0xffffff {
+			n += 4
+		}
+		//300 字节分成 128 128 44 三个 chunk，后两个是 type 3
+		for _, size := range []int{128, 128, 44} {
+			if n+size > len(b) {
+				t.Fatalf("ExtTimeSend %d short chunk stream len %d", c.extTimeSend, len(b))
+			}
+			n += size
+			if size == 44 {
+				break
+			}
+			if b[n] != 0xc7 {
+				t.Fatalf("ExtTimeSend %d chunk header %x want c7", c.extTimeSend, b[n])
+			}
+			n++
+			if c.ext {
+				if pio.U32BE(b[n:]) != c.timestamp {
+					t.Fatalf("ExtTimeSend %d type 3 extended timestamp %x", c.extTimeSend, pio.U32BE(b[n:]))
+				}
+				n += 4
+			}
+		}
+		if n != len(b) {
+			t.Fatalf("ExtTimeSend %d chunk stream len %d want %d", c.extTimeSend, len(b), n)
+		}
+	}
+}
+
+//flv 文件中的 tag 类型和数据
+func appConfigTestFlvTags(t *testing.T, b []byte) (types []uint8, datas [][]byte) {
+	if len(b) < 13 || string(b[:3]) != "FLV" {
+		t.Fatalf("bad flv header %x", b)
+	}
+	n := 13
+	for n+11 <= len(b) {
+		size := int(pio.U24BE(b[n+1:]))
+		if n+11+size+4 > len(b) {
+			t.Fatalf("short flv tag at %d", n)
+		}
+		types = append(types, b[n])
+		datas = append(datas, b[n+11:n+11+size])
+		n += 11 + size + 4
+	}
+	return
+}
+
+func TestPicRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	session := &Session{
+		UserCnf:    config.App{RecodePicture: 1, RecodePicPath: dir, RecidePicFragment: "1s"},
+		uniqueName: "test",
+		App:        "live",
+		StreamId:   "abc",
+		vCodec:     appConfigTestCodec(t),
+	}
+	picRecordOnPublish(session)
+	//每 100ms 一帧，每 5 帧一个关键帧，1s 间隔截到 0 1s 2s
+	for i := 0; i < 25; i++ {
+		picRecord(session, session.vCodec, appConfigTestPacket(i, i%5 == 0))
+	}
+	picRecordOnPublishDone(session)
+
+	picDir := filepath.Join(dir, "test", "live", "abc")
+	files, _ := filepath.Glob(filepath.Join(picDir, "*.h264"))
+	if len(files) != 3 {
+		t.Fatalf("saved %d pictures want 3: %v", len(files), files)
+	}
+	sort.Strings(files)
+	for i, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//sps pps 和关键帧
+		want := []byte{}
+		for _, nalu := range [][]byte{appConfigTestSps, appConfigTestPps, {0x65, 0x88, byte(i * 10)}} {
+			want = append(want, annexbStartCode...)
+			want = append(want, nalu...)
+		}
+		if !bytes.Equal(b, want) {
+			t.Fatalf("%s annex-b %x want %x", file, b, want)
+		}
+
+		b, err = ioutil.ReadFile(file[:len(file)-len(".h264")] + ".flv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//sequence header 和一个关键帧
+		var video [][]byte
+		types, datas := appConfigTestFlvTags(t, b)
+		for j, typ := range types {
+			if typ == RtmpMsgVideo {
+				video = append(video, datas[j])
+			}
+		}
+		if len(video) != 2 || video[0][1] != 0 || video[1][0] != 0x17 || video[1][1] != 1 {
+			t.Fatalf("%s flv video tags %x", file, video)
+		}
+	}
+
+	//没有配置间隔时默认 10s
+	session = &Session{UserCnf: config.App{RecodePicture: 1, RecodePicPath: dir}}
+	picRecordOnPublish(session)
+	if session.picRecordInfo.picFragment != picRecordFragment {
+		t.Fatalf("default picture fragment %v", session.picRecordInfo.picFragment)
+	}
+}
@@ -0,0 +1,207 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/caption"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+字幕，app 配置 Caption: 1 时解析 H.264 SEI user_data_registered_itu_t_t35 中 A/53 (GA94) 的 cc_data
+解码 field 1 的 CEA-608 CC1，cue 的时间是视频的 pts
+field 2 (CC3 CC4) 和 CEA-708 DTVCC 包不解码，直接丢弃
+hls 每个 ts 分片对应一个 webvtt 分片，生成 subs.m3u8 和带 EXT-X-MEDIA TYPE=SUBTITLES 的 master.m3u8
+控制接口 GET /control/captions?vhost=&app=&name=&seq= 返回 seq 之后的字幕
+*/
+
+//控制接口保留最近的字幕条数
+const captionKeep = 100
+
+const hlsCaptionPlaylist = "subs.m3u8"
+
+type captionCue struct {
+	Seq uint64
+	//秒
+	Start float64
+	End   float64
+	Text  string
+}
+
+type captionInfo struct {
+	sync.Mutex
+	//推流协程使用
+	dec  *caption.Decoder608
+	seq  uint64
+	cues []captionCue
+}
+
+//只解析 H.264
+func (self *Session) captionEnabled() bool {
+	_, ok := self.vCodec.(h264parser.CodecData)
+	return ok && self.UserCnf.Caption == 1
+}
+
+//视频包中的字幕，推流协程调用
+func (self *Session) captionPut(pkt *av.Packet) {
+	if !self.captionEnabled() {
+		return
+	}
+	info := self.caption
+	if info.dec == nil {
+		info.dec = caption.NewDecoder608(1)
+	}
+	pts := pkt.Time + pkt.CompositionTime
+	nalus, _ := h264parser.SplitNALUs(pkt.Data[pkt.DataPos:])
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || nalu[0]&0x1f != h264parser.AVC_NAL_SEI {
+			continue
+		}
+		for _, msg := range h264parser.ParseSEI(nalu) {
+			if msg.Type != h264parser.SEI_USER_DATA_REGISTERED_ITU_T_T35 {
+				continue
+			}
+			ccs, _ := caption.ParseA53(msg.Payload)
+			//只有 CC1，其他 cc_type 丢弃
+			for _, cc := range ccs {
+				if cc.Type == caption.CCTypeField1 {
+					info.dec.Decode(cc.Data[0], cc.Data[1], pts)
+				}
+			}
+		}
+	}
+	cues := info.dec.Cues()
+	if len(cues) == 0 {
+		return
+	}
+	if self.UserCnf.RecodeHls == 1 && self.hlsLiveRecordInfo.muxer != nil {
+		self.hlsLiveRecordInfo.captionCues = append(self.hlsLiveRecordInfo.captionCues, cues...)
+	}
+	info.Lock()
+	for _, cue := range cues {
+		info.seq++
+		info.cues = append(info.cues, captionCue{
+			Seq:   info.seq,
+			Start: float64(cue.Start/time.Millisecond) / 1000,
+			End:   float64(cue.End/time.Millisecond) / 1000,
+			Text:  cue.Text,
+		})
+	}
+	if len(info.cues) > captionKeep {
+		info.cues = append([]captionCue(nil), info.cues[len(info.cues)-captionKeep:]...)
+	}
+	info.Unlock()
+}
+
+//seq 之后的字幕
+func (self *captionInfo) since(seq uint64) (last uint64, cues []captionCue) {
+	self.Lock()
+	defer self.Unlock()
+	cues = []captionCue{}
+	for _, cue := range self.cues {
+		if cue.Seq > seq {
+			cues = append(cues, cue)
+		}
+	}
+	return self.seq, cues
+}
+
+//分片结束时写 webvtt，正在显示的字幕截到分片结束，下一个分片接着显示
+func hlsLiveRecordCaption(self *Session, tsitem *TSItem) {
+	if !self.captionEnabled() {
+		return
+	}
+	info := &self.hlsLiveRecordInfo
+	start, end := info.lastTs, info.lastPktTs
+	cues := info.captionCues
+	info.captionCues = nil
+	if dec := self.caption.dec; dec != nil {
+		if text, from := dec.Shown(); len(text) > 0 {
+			cues = append(cues, caption.Cue{Start: from, End: end, Text: text})
+		}
+	}
+	var segCues []caption.Cue
+	for _, cue := range cues {
+		if cue.Start < start {
+			cue.Start = start
+		}
+		if cue.End > end {
+			cue.End = end
+		}
+		if cue.End > cue.Start {
+			segCues = append(segCues, cue)
+		}
+	}
+
+	name := strings.TrimSuffix(tsitem.Name, ".ts") + ".vtt"
+	if err := ioutil.WriteFile(self.UserCnf.RecodeHlsPath+name, caption.WebVTT(segCues, start), 0666); err != nil {
+		log.Log.Error(self.LogFormat()+"caption webvtt write err the file: "+name, zap.String("errMsg", err.Error()))
+		return
+	}
+	if info.captionBox == nil {
+		info.captionBox = NewM3u8BoxWithType(self.StreamId, info.m3u8Box.playlistType,
+			self.UserCnf.HlsPlaylistLength, info.m3u8Box.window)
+	}
+	item := NewTSItem(name, tsitem.Duration, tsitem.SeqNum)
+	item.Discontinuity = tsitem.Discontinuity
+	hlsLiveRecordRemoveExpired(self, info.captionBox.SetItem(item))
+	hlsLiveRecordCaptionWrite(self)
+}
+
+func hlsLiveRecordCaptionWrite(self *Session) {
+	info := &self.hlsLiveRecordInfo
+	b, err := info.captionBox.GenM3U8PlayList()
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(self.UserCnf.RecodeHlsPath+hlsCaptionPlaylist, b, 0666); err != nil {
+		log.Log.Error(self.LogFormat()+"caption playlist write err", zap.String("errMsg", err.Error()))
+	}
+	//多码率的 master 由分组生成
+	if len(info.abrKey) > 0 {
+		return
+	}
+	rendition := &hlsAbrRendition{box: info.m3u8Box, vCodec: self.vCodec, aCodec: self.aCodec}
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n\n")
+	hlsSubtitleMedia(w, hlsCaptionPlaylist)
+	rendition.streamInf(w, "index.m3u8", true)
+	if err = ioutil.WriteFile(self.UserCnf.RecodeHlsPath+"master.m3u8", w.Bytes(), 0666); err != nil {
+		log.Log.Error(self.LogFormat()+"caption master playlist write err", zap.String("errMsg", err.Error()))
+	}
+}
+
+//断流时 event vod 的字幕列表也结束
+func hlsLiveRecordCaptionDone(self *Session) {
+	info := &self.hlsLiveRecordInfo
+	if info.captionBox == nil {
+		return
+	}
+	if info.captionBox.playlistType != HlsPlaylistLive {
+		info.captionBox.SetEndList()
+		hlsLiveRecordCaptionWrite(self)
+	}
+	info.captionBox = nil
+	info.captionCues = nil
+}
+
+func controlCaptionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	session := controlPublishSession(w, query.Get("vhost"), query.Get("app"), query.Get("name"))
+	if session == nil {
+		return
+	}
+	seq, _ := strconv.ParseUint(query.Get("seq"), 10, 64)
+	last, cues := session.caption.since(seq)
+	controlReply(w, 200, map[string]interface{}{"Seq": last, "Cues": cues})
+}
@@ -0,0 +1,693 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/codec"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/utils/bits/pio"
+	"time"
+)
+
+/*
+独立的 rtmp 客户端，给测试工具和推流机器人用
+不依赖服务端的配置、推流表和日志，读消息用自己的 handler 表
+	conn, err := rtmp.DialURL("rtmp://127.0.0.1/live/123")
+	推流: conn.Publish(streams, metadata) 之后 conn.WritePacket(pkt)，实现 av.Muxer
+	播放: conn.Play() 之后 conn.Streams() conn.ReadPacket()，实现 av.Demuxer
+包里是原始帧，和 flv.PacketToTag 一致，Idx 是 streams 中的下标
+*/
+
+const (
+	clientDefaultTimeout   = 10 * time.Second
+	clientDefaultChunkSize = 4096
+	clientDefaultBufLen    = 3000
+	//Streams 探测时最多读的音视频消息数
+	clientProbeCount = 64
+)
+
+type ClientConf struct {
+	//建连 握手 connect createStream publish/play 的超时，默认 10s
+	Timeout time.Duration
+	//ReadPacket WritePacket 单次的超时，0 不超时
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	ChunkSize    int
+	FlashVer     string
+	//合并到 connect 的命令对象，可以覆盖 tcUrl 等默认字段
+	ConnectObject amf.AMFMap
+	//connect 命令对象之后的参数，鉴权用
+	ConnectArgs []interface{}
+}
+
+type clientResult struct {
+	name    string
+	transid float64
+	params  []interface{}
+}
+
+type Conn struct {
+	URL *url.URL
+
+	conf    ClientConf
+	session *Session
+	handles RtmpMsgHandle
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	app     string
+	name    string
+	transid int
+
+	result *clientResult
+	status amf.AMFMap
+
+	publishing bool
+	playing    bool
+	eof        bool
+	probed     bool
+	probeCount int
+	streams    []av.CodecData
+	metadata   amf.AMFMap
+	videoIdx   int
+	audioIdx   int
+	pkts       []av.Packet
+}
+
+//按 rtmp url 连接，Dial(network, host) 仍是服务端拉流转推用的裸连接
+func DialURL(rawurl string) (*Conn, error) {
+	return DialConf(context.Background(), rawurl, ClientConf{})
+}
+
+//ctx 取消时关闭连接，正在进行的读写返回 ctx.Err()
+func DialConf(ctx context.Context, rawurl string, conf ClientConf) (conn *Conn, err error) {
+	var u *url.URL
+	if u, err = url.Parse(rawurl); err != nil {
+		return
+	}
+	if u.Scheme != "rtmp" {
+		return nil, fmt.Errorf("%s", "Rtmp.Client.BadScheme")
+	}
+	host := u.Host
+	if _, _, err1 := net.SplitHostPort(host); err1 != nil {
+		host = host + ":1935"
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = clientDefaultTimeout
+	}
+	if conf.ChunkSize <= 0 {
+		conf.ChunkSize = clientDefaultChunkSize
+	}
+	if len(conf.FlashVer) == 0 {
+		conf.FlashVer = "LNX 9,0,124,2"
+	}
+
+	dialer := net.Dialer{Timeout: conf.Timeout}
+	var netconn net.Conn
+	if netconn, err = dialer.DialContext(ctx, "tcp", host); err != nil {
+		return
+	}
+	conn = &Conn{URL: u, conf: conf, videoIdx: -1, audioIdx: -1}
+	conn.app, conn.name = SplitPath(u)
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	conn.session = NewSsesion(netconn)
+	conn.session.network = "tcp"
+	conn.session.URL = u
+	//客户端不发 SetPeerBandwidth
+	conn.session.isPull = true
+	conn.session.writeMaxChunkSize = conf.ChunkSize
+	conn.session.rtmpCmdHandler = conn.cmdHandler()
+	conn.handles = conn.msgHandles()
+	go func() {
+		<-conn.ctx.Done()
+		netconn.Close()
+	}()
+
+	conn.deadline(conf.Timeout)
+	if err = conn.session.handshakeClient(); err == nil {
+		err = conn.connect()
+	}
+	if err != nil {
+		err = conn.err(err)
+		conn.Close()
+		return nil, err
+	}
+	conn.deadline(0)
+	return
+}
+
+func (self *Conn) Close() error {
+	self.cancel()
+	return self.session.netconn.Close()
+}
+
+//onMetaData，播放时 Streams 之后才有
+func (self *Conn) Metadata() amf.AMFMap {
+	return self.metadata
+}
+
+func (self *Conn) err(err error) error {
+	if self.ctx.Err() != nil {
+		return self.ctx.Err()
+	}
+	return err
+}
+
+func (self *Conn) deadline(d time.Duration) {
+	if d > 0 {
+		self.session.netconn.SetDeadline(time.Now().Add(d))
+	} else {
+		self.session.netconn.SetDeadline(time.Time{})
+	}
+}
+
+func (self *Conn) nextTransid() int {
+	self.transid++
+	return self.transid
+}
+
+func (self *Conn) connect() (err error) {
+	session := self.session
+	obj := amf.AMFMap{
+		"app":            self.app,
+		"flashVer":       self.conf.FlashVer,
+		"tcUrl":          getTcUrl(self.URL),
+		"fpad":           false,
+		"capabilities":   15,
+		"audioCodecs":    3575,
+		"videoCodecs":    252,
+		"videoFunction":  1,
+		"objectEncoding": 0,
+	}
+	for k, v := range self.conf.ConnectObject {
+		obj[k] = v
+	}
+	if err = session.writeBasicConf(); err != nil {
+		return
+	}
+	transid := self.nextTransid()
+	args := append([]interface{}{"connect", transid, obj}, self.conf.ConnectArgs...)
+	if err = session.writeCommandMsg(3, 0, args...); err != nil {
+		return
+	}
+	if err = session.flushWrite(); err != nil {
+		return
+	}
+	_, err = self.waitResult(transid)
+	return
+}
+
+func (self *Conn) createStream() (err error) {
+	session := self.session
+	transid := self.nextTransid()
+	if err = session.writeCommandMsg(3, 0, "createStream", transid, nil); err != nil {
+		return
+	}
+	if err = session.flushWrite(); err != nil {
+		return
+	}
+	var res *clientResult
+	if res, err = self.waitResult(transid); err != nil {
+		return
+	}
+	if len(res.params) < 2 {
+		return fmt.Errorf("%s", "Rtmp.Client.CreateStream.Result.Invalid")
+	}
+	id, ok := res.params[1].(float64)
+	if !ok {
+		return fmt.Errorf("%s", "Rtmp.Client.CreateStream.Result.Invalid")
+	}
+	session.avmsgsid = uint32(id)
+	return
+}
+
+//等 transid 的 _result，_error 时返回 description 中的 code
+func (self *Conn) waitResult(transid int) (res *clientResult, err error) {
+	self.result = nil
+	for {
+		if err = self.session.readChunk(self.handles); err != nil {
+			return
+		}
+		if res = self.result; res == nil || res.transid != float64(transid) {
+			continue
+		}
+		self.result = nil
+		if res.name == "_error" {
+			return nil, clientStatusErr(res.params, "Rtmp.Client.Command.Error")
+		}
+		return
+	}
+}
+
+//等 onStatus 的 code，level 是 error 时返回 code
+func (self *Conn) waitStatus(code string) (err error) {
+	self.status = nil
+	for {
+		if err = self.session.readChunk(self.handles); err != nil {
+			return
+		}
+		status := self.status
+		if status == nil {
+			continue
+		}
+		self.status = nil
+		if c, _ := status["code"].(string); c == code {
+			return
+		}
+		if level, _ := status["level"].(string); level == "error" {
+			return clientStatusErr([]interface{}{status}, "Rtmp.Client.Status.Error")
+		}
+	}
+}
+
+func clientStatusErr(params []interface{}, def string) error {
+	for _, param := range params {
+		if info, ok := param.(amf.AMFMap); ok {
+			if code, ok := info["code"].(string); ok {
+				return fmt.Errorf("%s", code)
+			}
+		}
+	}
+	return fmt.Errorf("%s", def)
+}
+
+//推流，metadata 为空时由 streams 生成
+func (self *Conn) Publish(streams []av.CodecData, metadata amf.AMFMap) (err error) {
+	if self.publishing || self.playing {
+		return fmt.Errorf("%s", "Rtmp.Client.State.Invalid")
+	}
+	self.deadline(self.conf.Timeout)
+	defer self.deadline(0)
+	if err = self.createStream(); err != nil {
+		return self.err(err)
+	}
+	session := self.session
+	if err = session.writeCommandMsg(8, session.avmsgsid, "publish", self.nextTransid(), nil, self.name, "live"); err != nil {
+		return self.err(err)
+	}
+	if err = session.flushWrite(); err != nil {
+		return self.err(err)
+	}
+	if err = self.waitStatus("NetStream.Publish.Start"); err != nil {
+		return self.err(err)
+	}
+	self.publishing = true
+	return self.writeHeader(streams, metadata)
+}
+
+//av.Muxer，没有 Publish 时先推流，已经推流时更新 codec 重发 sequence header
+func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
+	if !self.publishing {
+		return self.Publish(streams, nil)
+	}
+	return self.writeHeader(streams, nil)
+}
+
+func (self *Conn) writeHeader(streams []av.CodecData, metadata amf.AMFMap) (err error) {
+	session := self.session
+	self.streams = streams
+	if metadata == nil {
+		//不支持写进 metadata 的编码忽略
+		metadata, _ = flv.NewMetadataByStreams(streams)
+	}
+	if metadata != nil {
+		if err = session.writeDataMsg(5, session.avmsgsid, "@setDataFrame", "onMetaData", metadata); err != nil {
+			return self.err(err)
+		}
+	}
+	for _, stream := range streams {
+		var tag *flvio.Tag
+		var ok bool
+		if tag, ok, err = flv.CodecDataToTag(stream); err != nil {
+			return
+		}
+		if ok {
+			if err = self.writeTag(*tag, 0); err != nil {
+				return
+			}
+		}
+	}
+	return self.err(session.flushWrite())
+}
+
+func (self *Conn) writeTag(tag flvio.Tag, ts int32) (err error) {
+	csid, msgtypeid := uint32(6), uint8(RtmpMsgAudio)
+	if tag.Type == flvio.TAG_VIDEO {
+		csid, msgtypeid = 7, RtmpMsgVideo
+	}
+	b := flvTagBody(tag)
+	_, err = self.session.DoSend(b, csid, uint32(ts), msgtypeid, self.session.avmsgsid, len(b))
+	return self.err(err)
+}
+
+func (self *Conn) WritePacket(pkt av.Packet) (err error) {
+	if !self.publishing {
+		return fmt.Errorf("%s", "Rtmp.Client.Not.Publishing")
+	}
+	if int(pkt.Idx) < 0 || int(pkt.Idx) >= len(self.streams) {
+		return fmt.Errorf("%s", "Rtmp.Client.Packet.Idx.Invalid")
+	}
+	if self.conf.WriteTimeout > 0 {
+		self.session.netconn.SetWriteDeadline(time.Now().Add(self.conf.WriteTimeout))
+	}
+	tag, ts := flv.PacketToTag(pkt, self.streams[pkt.Idx])
+	if err = self.writeTag(tag, ts); err != nil {
+		return
+	}
+	return self.err(self.session.flushWrite())
+}
+
+//停止推流，连接由 Close 关闭
+func (self *Conn) WriteTrailer() (err error) {
+	if !self.publishing {
+		return
+	}
+	self.publishing = false
+	session := self.session
+	if err = session.writeCommandMsg(3, 0, "deleteStream", self.nextTransid(), nil, session.avmsgsid); err != nil {
+		return self.err(err)
+	}
+	return self.err(session.flushWrite())
+}
+
+//播放，返回后用 Streams ReadPacket 读
+func (self *Conn) Play() (err error) {
+	if self.publishing || self.playing {
+		return fmt.Errorf("%s", "Rtmp.Client.State.Invalid")
+	}
+	self.deadline(self.conf.Timeout)
+	defer self.deadline(0)
+	if err = self.createStream(); err != nil {
+		return self.err(err)
+	}
+	session := self.session
+	if err = session.writeCommandMsg(8, session.avmsgsid, "play", self.nextTransid(), nil, self.name); err != nil {
+		return self.err(err)
+	}
+	if err = self.writeSetBufLen(session.avmsgsid, clientDefaultBufLen); err != nil {
+		return self.err(err)
+	}
+	if err = session.flushWrite(); err != nil {
+		return self.err(err)
+	}
+	if err = self.waitStatus("NetStream.Play.Start"); err != nil {
+		return self.err(err)
+	}
+	self.playing = true
+	return
+}
+
+func (self *Conn) writeSetBufLen(msgsid uint32, ms uint32) (err error) {
+	session := self.session
+	b := session.GetWriteBuf(chunkHeaderLength + 10)
+	n := session.fillChunk0Header(b, 2, 0, RtmpMsgUser, 0, 10)
+	pio.PutU16BE(b[n:], RtmpUserSetBufLen)
+	n += 2
+	pio.PutU32BE(b[n:], msgsid)
+	n += 4
+	pio.PutU32BE(b[n:], ms)
+	n += 4
+	_, err = session.bufw.Write(b[:n])
+	return
+}
+
+//av.Demuxer，读到 metadata 中的音视频 codec，或者读了 clientProbeCount 个音视频消息
+func (self *Conn) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	return self.streams, nil
+}
+
+func (self *Conn) probe() (err error) {
+	if !self.playing {
+		return fmt.Errorf("%s", "Rtmp.Client.Not.Playing")
+	}
+	if self.probed {
+		return
+	}
+	self.deadline(self.conf.Timeout)
+	defer self.deadline(0)
+	for !self.probed {
+		if err = self.session.readChunk(self.handles); err != nil {
+			return self.err(err)
+		}
+		wantVideo, wantAudio := true, true
+		if self.metadata != nil {
+			_, wantVideo = self.metadata["videocodecid"]
+			_, wantAudio = self.metadata["audiocodecid"]
+		}
+		got := (self.videoIdx >= 0 || !wantVideo) && (self.audioIdx >= 0 || !wantAudio) && len(self.streams) > 0
+		if got || self.probeCount >= clientProbeCount || self.eof {
+			self.probed = true
+		}
+	}
+	if len(self.streams) == 0 {
+		return fmt.Errorf("%s", "Rtmp.Client.NoStreams")
+	}
+	return
+}
+
+//点播结束或推流停止时返回 io.EOF
+func (self *Conn) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for len(self.pkts) == 0 {
+		if self.eof {
+			return pkt, io.EOF
+		}
+		if self.conf.ReadTimeout > 0 {
+			self.session.netconn.SetReadDeadline(time.Now().Add(self.conf.ReadTimeout))
+		}
+		if err = self.session.readChunk(self.handles); err != nil {
+			return pkt, self.err(err)
+		}
+	}
+	pkt = self.pkts[0]
+	self.pkts = self.pkts[1:]
+	return
+}
+
+//新的 codec 放到对应的下标，sequence header 变化时替换
+func (self *Conn) setStream(idx *int, stream av.CodecData) {
+	if *idx < 0 {
+		*idx = len(self.streams)
+		self.streams = append(self.streams, stream)
+		return
+	}
+	self.streams[*idx] = stream
+}
+
+func (self *Conn) pushPacket(idx int, tag *flvio.Tag, ts uint32) {
+	self.pkts = append(self.pkts, av.Packet{
+		Idx:             int8(idx),
+		PacketType:      tag.Type,
+		IsKeyFrame:      tag.Type == flvio.TAG_VIDEO && tag.FrameType == flvio.FRAME_KEY,
+		CompositionTime: flvio.TsToTime(tag.CompositionTime),
+		Time:            flvio.TsToTime(int32(ts)),
+		Data:            tag.Data,
+	})
+}
+
+func (self *Conn) videoHandler(session *Session, timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+	if len(msgdata) == 0 {
+		return
+	}
+	self.probeCount++
+	tag := flvio.Tag{Type: flvio.TAG_VIDEO}
+	var n int
+	if n, err = tag.ParseHeader(msgdata); err != nil {
+		return
+	}
+	tag.Data = msgdata[n:]
+	if tag.CodecID != flvio.VIDEO_H264 && tag.CodecID != flvio.VIDEO_H265 {
+		return
+	}
+	switch tag.AVCPacketType {
+	case flvio.AVC_SEQHDR:
+		var stream av.CodecData
+		if tag.CodecID == flvio.VIDEO_H264 {
+			stream, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(tag.Data)
+		} else {
+			stream, err = h265parser.NewCodecDataFromAVCDecoderConfRecord(tag.Data)
+		}
+		if err != nil {
+			return
+		}
+		self.setStream(&self.videoIdx, stream)
+	case flvio.AVC_NALU:
+		if self.videoIdx >= 0 {
+			self.pushPacket(self.videoIdx, &tag, timestamp)
+		}
+	}
+	return
+}
+
+func (self *Conn) audioHandler(session *Session, timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+	if len(msgdata) == 0 {
+		return
+	}
+	self.probeCount++
+	tag := flvio.Tag{Type: flvio.TAG_AUDIO}
+	var n int
+	if n, err = tag.ParseHeader(msgdata); err != nil {
+		return
+	}
+	tag.Data = msgdata[n:]
+	var stream av.CodecData
+	switch tag.SoundFormat {
+	case flvio.SOUND_AAC:
+		if tag.AACPacketType == flvio.AAC_SEQHDR {
+			if stream, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(tag.Data); err != nil {
+				return
+			}
+			self.setStream(&self.audioIdx, stream)
+			return
+		}
+	case flvio.SOUND_MP3, flvio.SOUND_MP3_8KHZ:
+		//mp3 没有 sequence header，由第一帧的帧头得到 codec
+		if self.audioIdx < 0 {
+			if stream, err = codec.NewMP3CodecDataFromFrame(tag.Data); err != nil {
+				return
+			}
+			self.setStream(&self.audioIdx, stream)
+		}
+	case flvio.SOUND_ALAW:
+		if self.audioIdx < 0 {
+			self.setStream(&self.audioIdx, codec.NewPCMAlawCodecData(tag.ChannelLayout()))
+		}
+	case flvio.SOUND_MULAW:
+		if self.audioIdx < 0 {
+			self.setStream(&self.audioIdx, codec.NewPCMMulawCodecData(tag.ChannelLayout()))
+		}
+	case flvio.SOUND_EXHEADER:
+		if tag.AudioFourCC != flvio.FOURCC_OPUS {
+			return
+		}
+		switch tag.AudioPacketType {
+		case flvio.AUDIO_PACKET_SEQSTART:
+			if stream, err = codec.NewOpusCodecDataFromHead(tag.Data); err != nil {
+				return
+			}
+			self.setStream(&self.audioIdx, stream)
+			return
+		case flvio.AUDIO_PACKET_CODEDFRAMES:
+			//没有发 OpusHead 的按双声道处理
+			if self.audioIdx < 0 {
+				self.setStream(&self.audioIdx, codec.NewOpusCodecData(2))
+			}
+		default:
+			return
+		}
+	default:
+		return
+	}
+	if self.audioIdx >= 0 {
+		self.pushPacket(self.audioIdx, &tag, timestamp)
+	}
+	return
+}
+
+//客户端的消息表，不用服务端的 handler，服务端的 handler 会写日志和推流表
+func (self *Conn) msgHandles() (handles RtmpMsgHandle) {
+	handles = make(RtmpMsgHandle)
+	handles[RtmpMsgChunkSize] = func(session *Session, timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+		if len(msgdata) < 4 || pio.U32BE(msgdata) == 0 {
+			return fmt.Errorf("%s", "Rtmp.Client.ChunkSize.Invalid")
+		}
+		session.readMaxChunkSize = int(pio.U32BE(msgdata) & 0x7fffffff)
+		return
+	}
+	handles[RtmpMsgAckSize] = RtmpMsgAckSizeHandler
+	handles[RtmpMsgAck] = RtmpMsgAckHanldler
+	handles[RtmpMsgBandwidth] = RtmpMsgBandwidthHandler
+	handles[RtmpMsgUser] = func(session *Session, timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+		if len(msgdata) >= 6 && pio.U16BE(msgdata) == RtmpUserPingRequest {
+			if err = session.sendSetPingResponse(msgsid, pio.U32BE(msgdata[2:])); err != nil {
+				return
+			}
+			return session.flushWrite()
+		}
+		return
+	}
+	handles[RtmpMsgVideo] = self.videoHandler
+	handles[RtmpMsgAudio] = self.audioHandler
+	handles[RtmpMsgAmfCMD] = RtmpMsgAmfHandler
+	handles[RtmpMsgAmfMeta] = RtmpMsgAmfHandler
+	handles[RtmpMsgAmf3CMD] = RtmpMsgAmf3Handler
+	handles[RtmpMsgAmf3Meta] = RtmpMsgAmf3Handler
+	return
+}
+
+func clientParseArgs(b []byte) (args []interface{}, err error) {
+	for n := 0; n < len(b); {
+		var obj interface{}
+		var size int
+		if obj, size, err = amf.ParseAMF0Val(b[n:]); err != nil {
+			return
+		}
+		n += size
+		args = append(args, obj)
+	}
+	return
+}
+
+func (self *Conn) cmdHandler() (handles RtmpCmdHandle) {
+	handles = make(RtmpCmdHandle)
+	result := func(name string) cmdHandler {
+		return func(session *Session, b []byte) (n int, err error) {
+			var args []interface{}
+			if args, err = clientParseArgs(b); err != nil || len(args) == 0 {
+				return
+			}
+			transid, _ := args[0].(float64)
+			self.result = &clientResult{name: name, transid: transid, params: args[1:]}
+			return
+		}
+	}
+	handles["_result"] = result("_result")
+	handles["_error"] = result("_error")
+	status := func(session *Session, b []byte) (n int, err error) {
+		var args []interface{}
+		if args, err = clientParseArgs(b); err != nil {
+			return
+		}
+		for _, arg := range args {
+			if info, ok := arg.(amf.AMFMap); ok {
+				self.status = info
+				switch info["code"] {
+				case "NetStream.Play.Stop", "NetStream.Play.UnpublishNotify", "NetStream.Play.Complete":
+					self.eof = self.playing
+				}
+			}
+		}
+		return
+	}
+	handles["onStatus"] = status
+	handles["onPlayStatus"] = status
+	metadata := func(session *Session, b []byte) (n int, err error) {
+		var args []interface{}
+		if args, err = clientParseArgs(b); err != nil {
+			return
+		}
+		for _, arg := range args {
+			if info, ok := arg.(amf.AMFMap); ok {
+				self.metadata = info
+			}
+		}
+		return
+	}
+	handles["onMetaData"] = metadata
+	handles["@setDataFrame"] = metadata
+	return
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"rtmpServerStudy/amf"
 	"context"
-	"rtmpServerStudy/AvQue"
 	"net/url"
 	"rtmpServerStudy/log"
 	"time"
@@ -333,7 +332,8 @@ func RtmpPublishCmdHandler(session *Session, b []byte) (n int, err error) {
 	var code , level,desc string
 	session.URL = createURL(session.TcUrl, session.App, publishpath)
 	session.context, session.cancel = context.WithCancel(context.Background())
-	session.GopCache = AvQue.RingBufferCreate(8)
+	session.gopCacheCreate()
+	session.timeShift = newTimeShiftBuffer(&session.UserCnf)
 	ok := RtmpSessionPush(session)
 	if !ok {
 		code ,level,desc = "NetStream.Publish.BadName","status","Already publishing"
@@ -424,6 +424,12 @@ func RtmpPlayCmdHandler(session *Session, b []byte) (n int, err error) {
 
 	playpath, _ := commandparams[0].(string)
 
+	//录制文件点播，url.Parse 会把 mp4: 前缀当成 scheme
+	if name, ok := vodName(playpath); ok {
+		err = session.vodPlayCmd(name, commandparams[1:])
+		return
+	}
+
 	var u *url.URL
 	if u, err = url.Parse(playpath); err != nil {
 		log.Log.Info(fmt.Sprintf("%s rtmp play parse playPath err playPath:%s err:%s !",
@@ -432,6 +438,7 @@ func RtmpPlayCmdHandler(session *Session, b []byte) (n int, err error) {
 	} else {
 		session.StreamId = u.Path
 		session.StreamAnchor = u.Path + ":" + Gconfig.UserConf.PlayDomain[session.Vhost].UniqueName + ":" + session.App
+		session.timeShiftQuery(u.Query())
 	}
 
 	//Onplay_handler{}
@@ -516,6 +523,10 @@ func CheckOnStatus(session *Session,b[]byte)(n int ,err error){
 			return
 		}
 	case PlayStage:
+		//点播先回 Play.Reset 再回 Play.Start
+		if code == "NetStream.Play.Reset"{
+			return
+		}
 		if code != "NetStream.Play.Start"{
 			err = fmt.Errorf("%s","NetStream.Play.Bad")
 			return
@@ -653,6 +664,10 @@ func onMetaDataHandler(session *Session, b []byte) (n int, err error) {
 	}
 	session.metaData["create"] = "kouyang"
 	session.metaversion++
+	//时移播放按时间发出 metadata 的变化
+	if session.timeShift != nil {
+		session.timeShift.putMeta(session.metaData)
+	}
 	return
 }
 
@@ -664,6 +679,10 @@ func newRtmpCmdHandler() (RtmpCmdHandles RtmpCmdHandle){
 	RtmpCmdHandles["deleteStream"] = RtmpDeleteStreamCmdHandler
 	RtmpCmdHandles["publish"] = RtmpPublishCmdHandler
 	RtmpCmdHandles["play"] = RtmpPlayCmdHandler
+	RtmpCmdHandles["play2"] = RtmpPlay2CmdHandler
+	RtmpCmdHandles["seek"] = RtmpSeekCmdHandler
+	RtmpCmdHandles["pause"] = RtmpPauseCmdHandler
+	RtmpCmdHandles["pauseraw"] = RtmpPauseCmdHandler
 	RtmpCmdHandles["onStatus"] =CheckOnStatus
 	RtmpCmdHandles["@setDataFrame"] =setDtaFrameHandler
 	RtmpCmdHandles["onMetaData"] =onMetaDataHandler
@@ -4,7 +4,9 @@ import (
 	"container/list"
 	"fmt"
 	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/AvQue"
 	"rtmpServerStudy/av"
+	"rtmpServerStudy/codec"
 	"rtmpServerStudy/flv/flvio"
 	"rtmpServerStudy/h264Parse"
 	"rtmpServerStudy/h265Parse"
@@ -97,29 +99,55 @@ func RtmpMsgDecodeVideoHandler(session *Session, timestamp uint32, msgsid uint32
 	var pkt *av.Packet
 	pkt, _ = TagToPacket(tag, int32(timestamp), msgdata)
 	pkt.DataPos = dataPos
+	pkt.GopIsKeyFrame = pkt.IsKeyFrame
+	session.rtmpDataInjectPut(timestamp)
+	session.rtmpPacketPut(pkt)
+
+	if AvHeader == true {
+		return
+	}
+
+	//startTime:=time.Now()
+
+	session.captionPut(pkt)
+	if session.IsSelf == true {
+		RecordHandler(session, session.vCodec, pkt)
+	}
+	//dis := time.Now().Sub(startTime).Nanoseconds()/1000
+	//fmt.Println(dis)
+	return
+}
+
+//放入 gop 缓存并分发给所有播放端
+func (session *Session) rtmpPacketPut(pkt *av.Packet) {
 	//this is a long time lock may be something err must
 	//every chunk check the register
-
 	session.Lock()
 	//session.updatedGop == true
 	session.rtmpUpdateGopCache(pkt)
+	if session.timeShift != nil {
+		session.timeShift.put(pkt)
+	}
 	session.ReadRegister()
 	//session.updatedGop == true
 	session.Unlock()
 
-
 	var next *list.Element
+	session.CursorList.Lock()
+	defer session.CursorList.Unlock()
 	CursorList := session.CursorList.GetList()
-	pkt.GopIsKeyFrame = pkt.IsKeyFrame
 	for e := CursorList.Front(); e != nil; {
 		switch value1 := e.Value.(type) {
 		case *Session:
 			cursorSession := value1
 			if !cursorSession.isClosed {
-				if cursorSession.needUpPkt == true  {
-					if cursorSession.CurQue.RingBufferPut(pkt) != 0 {
+				if cursorSession.needUpPkt == true {
+					//jumst put may be the ring is full ,when the ring is full ,drop the pkt
+					//时移播放从时移缓存读，只通知
+					if cursorSession.shiftCursor == nil && cursorSession.CurQue.RingBufferPut(pkt) != 0 {
 						//fmt.Println("the cursorsession ring is full so drop the messg")
 					}
+					//just ack
 					select {
 					case cursorSession.PacketAck <- true:
 					default:
@@ -127,28 +155,15 @@ func RtmpMsgDecodeVideoHandler(session *Session, timestamp uint32, msgsid uint32
 				}else{
 					cursorSession.needUpPkt = true
 				}
+
 				e = e.Next()
 			} else {
 				next = e.Next()
 				CursorList.Remove(e)
 				e = next
 			}
-
 		}
 	}
-
-	if AvHeader == true {
-		return
-	}
-
-	//startTime:=time.Now()
-
-	if session.IsSelf == true {
-		RecordHandler(session, session.vCodec, pkt)
-	}
-	//dis := time.Now().Sub(startTime).Nanoseconds()/1000
-	//fmt.Println(dis)
-	return
 }
 
 func (self *Session)ReadRegister(){
@@ -156,7 +171,6 @@ func (self *Session)ReadRegister(){
 		return
 	}
 	flag := 0
-	CursorList := self.CursorList.GetList()
 	for i := 0; i < MAXREGISTERCHANNEL; i++ {
 		select {
 		case registerSession, ok := <-self.RegisterChannel:
@@ -164,7 +178,7 @@ func (self *Session)ReadRegister(){
 				if registerSession.updatedGop == true{
 					registerSession.needUpPkt = true
 				}
-				CursorList.PushBack(registerSession)
+				self.CursorList.PushBack(registerSession)
 			} else {
 				//some log
 				//may be register session is close
@@ -217,51 +231,70 @@ func RtmpMsgDecodeAudioHandler(session *Session, timestamp uint32, msgsid uint32
 			session.Unlock()
 			AvHeader = true
 		}
+	case flvio.SOUND_MP3, flvio.SOUND_MP3_8KHZ:
+		//mp3 没有 sequence header，由第一帧的帧头得到 codec
+		tag.Data = msgdata[n:]
+		if session.aCodec == nil || session.aCodec.Type() != av.MP3 {
+			var stream codec.MP3CodecData
+			if stream, err = codec.NewMP3CodecDataFromFrame(tag.Data); err != nil {
+				return
+			}
+			session.Lock()
+			session.aCodec = stream
+			session.aCodecData = nil
+			session.Unlock()
+		}
+	case flvio.SOUND_ALAW, flvio.SOUND_MULAW:
+		tag.Data = msgdata[n:]
+		codecType := av.PCM_ALAW
+		if tag.SoundFormat == flvio.SOUND_MULAW {
+			codecType = av.PCM_MULAW
+		}
+		if session.aCodec == nil || session.aCodec.Type() != codecType {
+			stream := codec.NewPCMAlawCodecData(tag.ChannelLayout())
+			if codecType == av.PCM_MULAW {
+				stream = codec.NewPCMMulawCodecData(tag.ChannelLayout())
+			}
+			session.Lock()
+			session.aCodec = stream
+			session.aCodecData = nil
+			session.Unlock()
+		}
+	case flvio.SOUND_EXHEADER:
+		tag.Data = msgdata[n:]
+		if tag.AudioFourCC != flvio.FOURCC_OPUS {
+			break
+		}
+		switch tag.AudioPacketType {
+		case flvio.AUDIO_PACKET_SEQSTART:
+			fmt.Println("find opus seqhdr")
+			var stream codec.OpusCodecData
+			if stream, err = codec.NewOpusCodecDataFromHead(tag.Data); err != nil {
+				return
+			}
+			session.Lock()
+			session.aCodec = stream
+			session.aCodecData = msgdata
+			session.Unlock()
+			AvHeader = true
+		case flvio.AUDIO_PACKET_CODEDFRAMES:
+			//没有发 OpusHead 的按双声道处理
+			if session.aCodec == nil || session.aCodec.Type() != av.OPUS {
+				session.Lock()
+				session.aCodec = codec.NewOpusCodecData(2)
+				session.aCodecData = nil
+				session.Unlock()
+			}
+		}
 	}
 	var pkt *av.Packet
 	pkt, _ = TagToPacket(tag, int32(timestamp), msgdata)
 	pkt.DataPos = dataPos
-	//this is a long time lock may be something err must
-	//session.CursorList.Lock()
 	if session.audioAfterLastVideoCnt > audioAfterLastVideoCnt {
 		pkt.GopIsKeyFrame = true
 	}
-	session.Lock()
-	//session.updatedGop == true
-	session.rtmpUpdateGopCache(pkt)
-	session.ReadRegister()
-	//session.updatedGop == true
-	session.Unlock()
-
-	var next *list.Element
-	CursorList := session.CursorList.GetList()
-	for e := CursorList.Front(); e != nil; {
-		switch value1 := e.Value.(type) {
-		case *Session:
-			cursorSession := value1
-			if !cursorSession.isClosed {
-				if cursorSession.needUpPkt == true {
-					//jumst put may be the ring is full ,when the ring is full ,drop the pkt
-					if cursorSession.CurQue.RingBufferPut(pkt) != 0 {
-						//fmt.Println("the cursorsession ring is full so drop the messg")
-					}
-					//just ack
-					select {
-					case cursorSession.PacketAck <- true:
-					default:
-					}
-				}else{
-					cursorSession.needUpPkt = true
-				}
-
-				e = e.Next()
-			} else {
-				next = e.Next()
-				CursorList.Remove(e)
-				e = next
-			}
-		}
-	}
+	session.rtmpDataInjectPut(timestamp)
+	session.rtmpPacketPut(pkt)
 
 	if AvHeader == true {
 		return
@@ -274,6 +307,17 @@ func RtmpMsgDecodeAudioHandler(session *Session, timestamp uint32, msgsid uint32
 }
 
 
+//推流的 gop 缓存，GopCacheNum 是缓存的 gop 个数 (包括正在收的)，没有配置时缓存 1 个
+func (session *Session) gopCacheCreate() {
+	num := session.UserCnf.GopCacheNum
+	if num <= 0 {
+		num = 1
+	}
+	session.maxgopcount = num + 1
+	session.curgopcount = 0
+	session.GopCache = AvQue.RingBufferCreate(8)
+}
+
 func (session *Session) rtmpUpdateGopCache(pkt *av.Packet) (err error) {
 
 	if session.vCodec == nil {
@@ -302,7 +346,7 @@ func (session *Session) rtmpUpdateGopCache(pkt *av.Packet) (err error) {
 	}
 	if pkt.PacketType == flvio.TAG_AUDIO {
 		session.audioAfterLastVideoCnt++
-	} else {
+	} else if pkt.PacketType == flvio.TAG_VIDEO {
 		session.audioAfterLastVideoCnt = 0
 	}
 
@@ -1 +1,216 @@
 package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/log"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+/*
+控制接口，单独监听，只给内部调用，不做鉴权
+请求和返回都是 json，出错时返回 {"error":"NetStream.xxx"}
+GET  /control/feeder            列出文件推流
+POST /control/feeder/start      {"Vhost":"test.uplive.com","App":"live","Name":"filler","Files":["a.flv","b.flv"]}
+POST /control/feeder/stop       {"Vhost":"test.uplive.com","App":"live","Name":"filler"}
+POST /control/inject            {"Vhost":"test.uplive.com","App":"live","Name":"123","Message":"onQuiz","Data":{"id":1,"question":"..."}}
+POST /control/cue               {"Vhost":"test.uplive.com","App":"live","Name":"123","Type":"out","Duration":30,"Id":1} 或 {...,"Scte35":"base64"}
+GET  /control/captions?vhost=test.uplive.com&app=live&name=123&seq=0  seq 之后的字幕 {"Seq":12,"Cues":[{"Seq":12,"Start":1.2,"End":3.4,"Text":"..."}]}
+*/
+
+func controlRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/control/feeder", controlFeederListHandler).Methods("GET")
+	r.HandleFunc("/control/feeder/start", controlFeederStartHandler).Methods("POST")
+	r.HandleFunc("/control/feeder/stop", controlFeederStopHandler).Methods("POST")
+	r.HandleFunc("/control/inject", controlInjectHandler).Methods("POST")
+	r.HandleFunc("/control/cue", controlCueHandler).Methods("POST")
+	r.HandleFunc("/control/captions", controlCaptionsHandler).Methods("GET")
+	return r
+}
+
+func (self *Server) controlServerStart(addr string) (err error) {
+	defer func() {
+		self.done <- false
+	}()
+	var ln net.Listener
+	if ln, err = self.socketListen(addr); err != nil {
+		log.Log.Error("control server listen err the addr: "+addr, zap.String("errMsg", err.Error()))
+		return
+	}
+	Hserver := &http.Server{Addr: addr, Handler: controlRouter()}
+	return Hserver.Serve(ln)
+}
+
+func controlReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, code int, err error) {
+	controlReply(w, code, map[string]string{"error": err.Error()})
+}
+
+//请求体解析成 v，失败时已经返回 400
+func controlDecode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		controlError(w, 400, fmt.Errorf("%s", "Rtmp.Control.BadRequest"))
+		return false
+	}
+	return true
+}
+
+func controlFeederListHandler(w http.ResponseWriter, r *http.Request) {
+	controlReply(w, 200, feederList())
+}
+
+func controlFeederStartHandler(w http.ResponseWriter, r *http.Request) {
+	var cnf config.FileFeeder
+	if !controlDecode(w, r, &cnf) {
+		return
+	}
+	if err := feederStart(cnf); err != nil {
+		code := 403
+		switch err.Error() {
+		case "Rtmp.Feeder.NoFile":
+			code = 400
+		case "NetStream.Publish.BadName":
+			if code = 409; len(cnf.Name) == 0 {
+				code = 400
+			}
+		}
+		controlError(w, code, err)
+		return
+	}
+	log.Log.Info(fmt.Sprintf("control feeder start vhost:%s app:%s name:%s files:%v", cnf.Vhost, cnf.App, cnf.Name, cnf.Files))
+	controlReply(w, 200, cnf)
+}
+
+func controlFeederStopHandler(w http.ResponseWriter, r *http.Request) {
+	var cnf config.FileFeeder
+	if !controlDecode(w, r, &cnf) {
+		return
+	}
+	if !feederStop(cnf.Vhost, cnf.App, cnf.Name) {
+		controlError(w, 404, fmt.Errorf("%s", "NetStream.Play.StreamNotFound"))
+		return
+	}
+	log.Log.Info(fmt.Sprintf("control feeder stop vhost:%s app:%s name:%s", cnf.Vhost, cnf.App, cnf.Name))
+	controlReply(w, 200, cnf)
+}
+
+//注入到直播流的 data 消息
+type controlInject struct {
+	Vhost   string
+	App     string
+	Name    string
+	Message string
+	Data    map[string]interface{}
+}
+
+//json 解析出的对象和数组转成 amf 类型，数字都是 float64
+func controlJsonToAmf(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		obj := amf.AMFMap{}
+		for k, item := range value {
+			obj[k] = controlJsonToAmf(item)
+		}
+		return obj
+	case []interface{}:
+		arr := amf.AMFArray{}
+		for _, item := range value {
+			arr = append(arr, controlJsonToAmf(item))
+		}
+		return arr
+	}
+	return v
+}
+
+//正在推流的 session，找不到时返回 404
+func controlPublishSession(w http.ResponseWriter, vhost, app, name string) *Session {
+	domain, ok := Gconfig.UserConf.PublishDomain[vhost]
+	if !ok {
+		controlError(w, 404, fmt.Errorf("%s", "NetStream.Play.StreamNotFound"))
+		return nil
+	}
+	session := RtmpSessionGet(name + ":" + domain.UniqueName + ":" + app)
+	if session == nil || session.isClosed {
+		controlError(w, 404, fmt.Errorf("%s", "NetStream.Play.StreamNotFound"))
+		return nil
+	}
+	return session
+}
+
+func controlInjectHandler(w http.ResponseWriter, r *http.Request) {
+	var req controlInject
+	if !controlDecode(w, r, &req) {
+		return
+	}
+	if len(req.Message) == 0 || dataMsgSkip[req.Message] {
+		controlError(w, 400, fmt.Errorf("%s", "Rtmp.Inject.BadMessage"))
+		return
+	}
+	session := controlPublishSession(w, req.Vhost, req.App, req.Name)
+	if session == nil {
+		return
+	}
+	data, _ := controlJsonToAmf(req.Data).(amf.AMFMap)
+	if err := session.rtmpDataInject(req.Message, data); err != nil {
+		controlError(w, 503, err)
+		return
+	}
+	log.Log.Info(fmt.Sprintf("control inject vhost:%s app:%s name:%s message:%s", req.Vhost, req.App, req.Name, req.Message))
+	controlReply(w, 200, req)
+}
+
+//hls 广告插入点，Type 为 out 或 in，Scte35 为 base64 的 splice_info_section
+type controlCue struct {
+	Vhost    string
+	App      string
+	Name     string
+	Type     string
+	Duration float64
+	Id       uint32
+	Scte35   string
+}
+
+//按 onCuePoint 注入，推流协程在下一个音视频包时交给 hls
+func controlCueHandler(w http.ResponseWriter, r *http.Request) {
+	var req controlCue
+	if !controlDecode(w, r, &req) {
+		return
+	}
+	data := amf.AMFMap{}
+	if len(req.Scte35) > 0 {
+		data["scte35"] = req.Scte35
+	} else {
+		data["type"] = req.Type
+		data["duration"] = req.Duration
+		data["id"] = float64(req.Id)
+	}
+	b := make([]byte, amf.LenAMF0Val("onCuePoint")+amf.LenAMF0Val(data))
+	n := amf.FillAMF0Val(b, "onCuePoint")
+	amf.FillAMF0Val(b[n:], data)
+	if hlsCueParse(b) == nil {
+		controlError(w, 400, fmt.Errorf("%s", "Rtmp.Cue.BadRequest"))
+		return
+	}
+	session := controlPublishSession(w, req.Vhost, req.App, req.Name)
+	if session == nil {
+		return
+	}
+	if err := session.rtmpDataInject("onCuePoint", data); err != nil {
+		controlError(w, 503, err)
+		return
+	}
+	log.Log.Info(fmt.Sprintf("control cue vhost:%s app:%s name:%s type:%s id:%d", req.Vhost, req.App, req.Name, req.Type, req.Id))
+	controlReply(w, 200, req)
+}
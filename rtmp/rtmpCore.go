@@ -11,6 +11,7 @@ import (
 	"time"
 	//"encoding/hex"
 	"sync"
+	"sync/atomic"
 	"rtmpServerStudy/AvQue"
 	//"rtmpServerStudy/aacParse"
 	"rtmpServerStudy/flv/flvio"
@@ -74,6 +75,11 @@ type Server struct {
 	HttpAddr      []string
 	QuicAddr      string
 	KcpAddr       string
+	TsListen      []config.TsListen
+	RtspAddr      []string
+	Webrtc        config.Webrtc
+	ControlAddr   string
+	FileFeeder    []config.FileFeeder
 	done          chan bool
 	HandlePublish func(*Session)
 	HandlePlay    func(*Session)
@@ -122,11 +128,41 @@ type Session struct {
 	isPlay            bool
 	isPull            bool
 	connected         bool
-	ackn              uint32
+	//流控，字节数按规范是累计值，超过 4G 回绕
+	inBytes           uint32
+	inLastAck         uint32
+	//对端的 WindowAckSize，每收到这么多字节回一个 ack
 	readAckSize       uint32
+	outBytes          uint32
+	//发给对端的 WindowAckSize
+	writeAckSize      uint32
+	//对端 SetPeerBandwidth 限制的窗口和类型，读协程写，发送协程读
+	peerBandwidth     uint32
+	peerLimitType     uint32
+	//读写分开时读协程要回的 WindowAckSize，发送协程取出发送
+	peerWindowAck     uint32
+	peerAckSeq        uint32
+	peerAcked         int32
+	ackNotify         chan bool
+	//读和发送分在两个协程，读协程不写
+	ctrlRead          bool
+	//读协程退出时关闭，播放端已经断开
+	readDone          chan struct{}
+	//控制接口注入的 amf0 data 消息，推流协程取出
+	dataInject        chan []byte
+	//cea-608 字幕，控制接口读取
+	caption           *captionInfo
+	//推流的时移缓存，app 配置了 TimeShift 时创建
+	timeShift         *timeShiftBuffer
+	//播放带 ?delay= 或 ?start= 时从推流的时移缓存读
+	shiftMode         int
+	shiftOffset       time.Duration
+	shiftCursor       *timeShiftCursor
 	avmsgsid          uint32
 	publishing        bool
 	playing           bool
+	//录制文件点播
+	vod               *vodPlayer
 	isRelay           bool
 	//状态机
 	stage             int
@@ -161,6 +197,7 @@ type Session struct {
 	//hls 直播录制ts状态信息
 	hlsLiveRecordInfo hlsLiveRecordInfo
 	flvReordInfo  flvReordInfo
+	picRecordInfo picRecordInfo
 }
 
 const (
@@ -262,12 +299,15 @@ func NewSsesion(netconn net.Conn) *Session {
 	//true register ok ,false register false
 
 	session.PacketAck = make(chan bool, 1)
+	session.ackNotify = make(chan bool, 1)
+	session.dataInject = make(chan []byte, 16)
+	session.caption = &captionInfo{}
 
 	//this maybe
 	//session.context , session.cancel = context.WithCancel(context.Background())
 	//
 	session.bufr = bufio.NewReaderSize(netconn, pio.RecommendBufioSize)
-	session.bufw = bufio.NewWriterSize(netconn, pio.RecommendBufioSize)
+	session.bufw = bufio.NewWriterSize(countWriter{netconn, &session.outBytes}, pio.RecommendBufioSize)
 	session.writebuf = make([]byte, 4096)
 	session.readbuf = make([]byte, 4096)
 	session.chunkHeaderBuf = make([]byte, chunkHeaderLength)
@@ -283,10 +323,22 @@ func (self *Session) GetWriteBuf(n int) []byte {
 	return self.writebuf
 }
 
+//type 3 chunk 是否带扩展时间戳，ExtTimeSend 1 带 2 不带，没有配置时用 EXTTIME
+//规范要求带，有些老的客户端不认
+func (self *Session) extTimeSend() bool {
+	switch self.UserCnf.ExtTimeSend {
+	case 1:
+		return true
+	case 2:
+		return false
+	}
+	return EXTTIME
+}
+
 func (self *Session) fillChunk3Header(b []byte, csid uint32, timestamp uint32) (n int) {
 	b[n] = (byte(csid) & 0x3f) | 0xC0
 	n++
-	if timestamp >= 0xffffff {
+	if timestamp >= 0xffffff && self.extTimeSend() {
 		pio.PutU32BE(b[n:], timestamp)
 		n += 4
 	}
@@ -567,12 +619,9 @@ func (self *Session) readChunk(hands RtmpMsgHandle) (err error) {
 		}
 	}
 
-	self.ackn += uint32(n)
-	if self.readAckSize != 0 && self.ackn > self.readAckSize {
-		if err = self.writeRtmpMsgAck(self.ackn); err != nil {
-			return
-		}
-		self.ackn = 0
+	atomic.AddUint32(&self.inBytes, uint32(n))
+	if err = self.rtmpAckCheck(); err != nil {
+		return
 	}
 
 	return
@@ -624,7 +673,7 @@ func (self *Session) writeAVTag(tag *flvio.Tag, ts int32) (err error) {
 	}
 	n := 0
 	n, err = self.DoSend(tag.Data, csid, uint32(ts), msgtypeid, self.avmsgsid, len(tag.Data))
-	fmt.Println("send byte :%d", n)
+	fmt.Printf("send byte :%d\n", n)
 	return
 }
 
@@ -639,6 +688,9 @@ func (self *Session) writeAVPacket(packet *av.Packet) (err error) {
 	case RtmpMsgVideo:
 		msgtypeid = RtmpMsgVideo
 		csid = 7
+	case RtmpMsgAmfMeta:
+		msgtypeid = RtmpMsgAmfMeta
+		csid = 5
 	}
 	//n := 0
 	ts := flvio.TimeToTs(packet.Time)
@@ -675,6 +727,12 @@ func (self *Session)CodecDataToTag(stream av.CodecData) (tag *flvio.Tag, ok bool
 		tag.AACPacketType = flvio.AAC_SEQHDR
 		tag.Data = self.aCodecData
 		ok = true
+	case av.OPUS:
+		tag.Type = flvio.TAG_AUDIO
+		tag.Data = self.aCodecData
+		ok = len(self.aCodecData) > 0
+	//没有 sequence header
+	case av.MP3, av.PCM_ALAW, av.PCM_MULAW:
 	default:
 		err = fmt.Errorf("Rtmp.Unspported.CodecType.%v", stream.Type())
 		return
@@ -788,10 +846,41 @@ func (self *Server)ListenAndServersStart(){
 	}
 
 
+	//whip whep 在 http server 上
+	var err error
+	if webrtcApi, _, err = newWebrtcApi(self.Webrtc); err != nil {
+		log.Log.Error("webrtc server start err", zap.String("errMsg", err.Error()))
+	}
+
 	//http server start
 	for _, addr :=  range self.HttpAddr{
 		go self.httpServerStart(addr)
 	}
+
+	//mpegts 推流
+	for _, cnf := range self.TsListen {
+		go self.tsServeStart(cnf)
+	}
+
+	//rtsp 推流和播放
+	for _, addr := range self.RtspAddr {
+		go self.rtspServeStart(addr)
+	}
+
+	//外部 static 拉流
+	sourcePullStatic()
+
+	//控制接口
+	if len(self.ControlAddr) > 0 {
+		go self.controlServerStart(self.ControlAddr)
+	}
+
+	//文件循环推流
+	for _, cnf := range self.FileFeeder {
+		if err = feederStart(cnf); err != nil {
+			log.Log.Error("file feeder start err the stream: "+cnf.App+"/"+cnf.Name, zap.String("errMsg", err.Error()))
+		}
+	}
 	<-self.done
 }
 
@@ -804,6 +893,16 @@ func NewServer(file string) (err error,server *Server){
 	}
 	server.RtmpAddr ,server.HttpAddr,server.QuicAddr,server.KcpAddr =
 		Gconfig.RtmpServer.RtmpListen,Gconfig.RtmpServer.HttpListen ,Gconfig.RtmpServer.QuicListen,Gconfig.RtmpServer.KcpListen
+	server.TsListen = Gconfig.RtmpServer.TsListen
+	server.RtspAddr = Gconfig.RtmpServer.RtspListen
+	server.Webrtc = Gconfig.RtmpServer.Webrtc
+	server.ControlAddr = Gconfig.RtmpServer.ControlListen
+	server.FileFeeder = Gconfig.RtmpServer.FileFeeder
+	if len(Gconfig.RtmpServer.AckTimeout) > 0 {
+		if playAckTimeout, err = time.ParseDuration(Gconfig.RtmpServer.AckTimeout); err != nil {
+			return
+		}
+	}
 
 	logpath:=""
 	if len(Gconfig.LogInfo.OutPaths) >0 {
@@ -892,25 +991,28 @@ func (self *Server) rtmpServeStart(addr string,) (err error) {
 		session.RemoteAddr = tcpConn.RemoteAddr().String()
 
 		session.isServer = true
-		go func() {
-			defer func() {
-				if err := recover(); err != nil  {
-					const size = 64 << 10
-					buf := make([]byte, size)
-					buf = buf[:runtime.Stack(buf, false)]
-					session.rtmpCloseSessionHanler()
-					log.Log.Error(fmt.Sprintf("%s rtmp: panic serving %v: %v\n%s",
-							session.LogFormat(),session.netconn.RemoteAddr(), err, string(buf)))
-				}
-			}()
-
-			err := self.ServerHandle(session)
-			log.Log.Info(fmt.Sprintf("%s rtmp server: client closed the remoteAddr %s err:%s",
-				session.LogFormat(),session.netconn.RemoteAddr(), err.Error()))
-		}()
+		go self.rtmpServeSession(session)
 	}
 }
 
+//tcp websocket rtmpt 共用，同一个 ServerSession 状态机
+func (self *Server) rtmpServeSession(session *Session) {
+	defer func() {
+		if err := recover(); err != nil  {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			session.rtmpCloseSessionHanler()
+			log.Log.Error(fmt.Sprintf("%s rtmp: panic serving %v: %v\n%s",
+					session.LogFormat(),session.netconn.RemoteAddr(), err, string(buf)))
+		}
+	}()
+
+	err := self.ServerHandle(session)
+	log.Log.Info(fmt.Sprintf("%s rtmp server: client closed the remoteAddr %s err:%v",
+		session.LogFormat(),session.netconn.RemoteAddr(), err))
+}
+
 func NewQuicSesion(netconn quic.Stream) *Session {
 	session := &Session{}
 	session.readcsmap = make(map[uint32]*chunkStream)
@@ -929,12 +1031,15 @@ func NewQuicSesion(netconn quic.Stream) *Session {
 	//true register ok ,false register false
 
 	session.PacketAck = make(chan bool, 1)
+	session.ackNotify = make(chan bool, 1)
+	session.dataInject = make(chan []byte, 16)
+	session.caption = &captionInfo{}
 
 	//this maybe
 	//session.context , session.cancel = context.WithCancel(context.Background())
 	//
 	session.bufr = bufio.NewReaderSize(netconn, 4096)
-	session.bufw = bufio.NewWriterSize(netconn, 4096)
+	session.bufw = bufio.NewWriterSize(countWriter{netconn, &session.outBytes}, 4096)
 	//session.bufr = bufio.NewReaderSize(netconn, pio.RecommendBufioSize)
 	session.writebuf = make([]byte, 4096)
 	session.readbuf = make([]byte, 4096)
@@ -992,7 +1097,7 @@ func (self * Server)rtmpQuicServerStart(addr string)(err error) {
 					buf := make([]byte, size)
 					buf = buf[:runtime.Stack(buf, false)]
 					session.rtmpCloseSessionHanler()
-					fmt.Println("rtmp: panic serving %v: %v\n%s", session.netconn.RemoteAddr(), err, string(buf))
+					fmt.Printf("rtmp: panic serving %v: %v\n%s\n", session.netconn.RemoteAddr(), err, string(buf))
 				}
 			}()
 
@@ -1038,7 +1143,7 @@ func (self * Server)rtmpKcpServerStart(addr string)(err error) {
 					buf := make([]byte, size)
 					buf = buf[:runtime.Stack(buf, false)]
 					session.rtmpCloseSessionHanler()
-					fmt.Println("rtmp: panic serving %v: %v\n%s", session.netconn.RemoteAddr(), err, string(buf))
+					fmt.Printf("rtmp: panic serving %v: %v\n%s\n", session.netconn.RemoteAddr(), err, string(buf))
 				}
 			}()
 
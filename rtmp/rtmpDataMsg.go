@@ -0,0 +1,124 @@
+package rtmp
+
+import (
+	"fmt"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv/flvio"
+)
+
+/*
+推流端的 data 消息 (onTextData onCuePoint onFI 和自定义消息)
+按 app 配置的 DataForward 放入 gop 缓存，分发给 rtmp http-flv 播放端，写入 flv 录制
+onMetaData 和 @setDataFrame 还是由 metadata 处理
+控制接口注入的消息不受 DataForward 限制，推流协程收到下一个音视频包时按它的时间戳发出，
+给播放端和 flv 录制，hls 录制写成 id3 timed metadata
+onCuePoint onAdCue 是 hls 的广告插入点，见 rtmpHlsCue.go，其他进 hls 录制的消息写成 id3，见 rtmpHlsId3.go
+*/
+
+//不转发的 data 消息
+var dataMsgSkip = map[string]bool{
+	"@setDataFrame":   true,
+	"@clearDataFrame": true,
+	"onMetaData":      true,
+}
+
+//消息名是否在 app 的转发列表中，* 转发所有
+func (self *Session) dataMsgAllowed(name string) bool {
+	if dataMsgSkip[name] {
+		return false
+	}
+	for _, allow := range self.UserCnf.DataForward {
+		if allow == "*" || allow == name {
+			return true
+		}
+	}
+	return false
+}
+
+//amf0 data 消息，转发的返回 true，不在列表中的交给命令表处理
+//广告插入点和 onTextData 不在列表中时只给 hls 录制
+func (self *Session) rtmpDataMsgForward(timestamp uint32, msgdata []byte) bool {
+	if !self.publishing {
+		return false
+	}
+	name, _, err := amf.ParseAMF0Val(msgdata)
+	if err != nil {
+		return false
+	}
+	s, ok := name.(string)
+	if !ok {
+		return false
+	}
+	if self.dataMsgAllowed(s) {
+		self.rtmpDataPacketPut(timestamp, msgdata)
+		return true
+	}
+	if hlsDataMsg(s) {
+		if self.IsSelf == true {
+			hlsLiveRecord(self, nil, rtmpDataPacket(timestamp, msgdata))
+		}
+		return true
+	}
+	return false
+}
+
+func rtmpDataPacket(timestamp uint32, msgdata []byte) *av.Packet {
+	return &av.Packet{
+		PacketType: RtmpMsgAmfMeta,
+		Time:       flvio.TsToTime(int32(timestamp)),
+		Data:       msgdata,
+	}
+}
+
+//data 消息按推流的时间戳打包，和音视频一样进 gop 缓存、播放队列和录制
+func (self *Session) rtmpDataPacketPut(timestamp uint32, msgdata []byte) {
+	pkt := rtmpDataPacket(timestamp, msgdata)
+	self.rtmpPacketPut(pkt)
+	if self.IsSelf == true {
+		RecordHandler(self, nil, pkt)
+	}
+}
+
+//控制接口注入 data 消息，不阻塞，队列满返回错误
+func (self *Session) rtmpDataInject(name string, data amf.AMFMap) (err error) {
+	b := make([]byte, amf.LenAMF0Val(name)+amf.LenAMF0Val(data))
+	n := amf.FillAMF0Val(b, name)
+	amf.FillAMF0Val(b[n:], data)
+	select {
+	case self.dataInject <- b:
+	default:
+		err = fmt.Errorf("%s", "Rtmp.Inject.Busy")
+	}
+	return
+}
+
+//注入的消息进 gop 缓存、播放队列和 flv 录制，hls 录制单独写入
+func (self *Session) rtmpDataInjectPacketPut(timestamp uint32, msgdata []byte) {
+	pkt := rtmpDataPacket(timestamp, msgdata)
+	self.rtmpPacketPut(pkt)
+	if self.IsSelf == true {
+		flvRecord(self, nil, pkt)
+		hlsLiveRecordInject(self, pkt)
+	}
+}
+
+//注入的消息写入当前的 hls 分片，广告插入点切片，其他的写成 id3
+func hlsLiveRecordInject(self *Session, pkt *av.Packet) {
+	if self.UserCnf.RecodeHls != 1 {
+		return
+	}
+	hlsLiveRecordData(self, pkt)
+}
+
+//推流协程处理音视频包前调用，注入的消息用这个包的时间戳
+func (self *Session) rtmpDataInjectPut(timestamp uint32) {
+	for {
+		select {
+		case b := <-self.dataInject:
+			self.rtmpDataInjectPacketPut(timestamp, b)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"sync"
+	"time"
+)
+
+/*
+flv 文件循环推成直播流，用于测试频道和垫片
+按 tag 时间戳实时发送，多个文件按顺序循环，时间戳接着上一个文件继续往后，保持单调递增
+推流注册和 http flv 推流一样走 ingestPublish
+*/
+
+//文件结束后下一个文件和上一个 tag 的间隔
+const feederDefaultGap = 40
+
+var errFeederStop = fmt.Errorf("%s", "Rtmp.Feeder.Stop")
+
+type fileFeeder struct {
+	cnf     config.FileFeeder
+	session *Session
+
+	lock    sync.Mutex
+	stopped bool
+	done    chan bool
+}
+
+var fileFeeders = struct {
+	sync.Mutex
+	feeders map[string]*fileFeeder
+}{feeders: make(map[string]*fileFeeder)}
+
+//开始文件推流，域名 app 检查和推流一致，流已存在返回 NetStream.Publish.BadName
+func feederStart(cnf config.FileFeeder) (err error) {
+	if len(cnf.Files) == 0 {
+		return fmt.Errorf("%s", "Rtmp.Feeder.NoFile")
+	}
+	//数据不从 conn 读
+	session := newIngestSession(ioutil.NopCloser(bytes.NewReader(nil)), "feeder", cnf.Files[0])
+	if err = session.ingestCheck(cnf.Vhost, cnf.App, cnf.Name); err != nil {
+		return
+	}
+
+	fileFeeders.Lock()
+	defer fileFeeders.Unlock()
+	if _, ok := fileFeeders.feeders[session.StreamAnchor]; ok {
+		return fmt.Errorf("%s", "NetStream.Publish.BadName")
+	}
+	if err = session.ingestPublish(); err != nil {
+		return
+	}
+	feeder := &fileFeeder{cnf: cnf, session: session, done: make(chan bool)}
+	fileFeeders.feeders[session.StreamAnchor] = feeder
+	go feeder.run()
+	return
+}
+
+//停止文件推流，没有这路返回 false
+func feederStop(vhost, app, name string) bool {
+	domain, ok := Gconfig.UserConf.PublishDomain[vhost]
+	if !ok {
+		return false
+	}
+	fileFeeders.Lock()
+	feeder, ok := fileFeeders.feeders[name+":"+domain.UniqueName+":"+app]
+	fileFeeders.Unlock()
+	if ok {
+		feeder.stop()
+	}
+	return ok
+}
+
+func feederList() (list []config.FileFeeder) {
+	fileFeeders.Lock()
+	defer fileFeeders.Unlock()
+	list = []config.FileFeeder{}
+	for _, feeder := range fileFeeders.feeders {
+		list = append(list, feeder.cnf)
+	}
+	return
+}
+
+func (self *fileFeeder) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.stopped {
+		self.stopped = true
+		close(self.done)
+	}
+}
+
+func (self *fileFeeder) run() {
+	defer func() {
+		fileFeeders.Lock()
+		delete(fileFeeders.feeders, self.session.StreamAnchor)
+		fileFeeders.Unlock()
+		self.session.ingestClose()
+	}()
+
+	start := time.Now()
+	var offset, last, gap int32 = 0, 0, feederDefaultGap
+	for {
+		played := false
+		for _, file := range self.cnf.Files {
+			n, err := self.feedFile(file, start, &offset, &last, &gap)
+			if err == errFeederStop || self.session.isClosed {
+				return
+			}
+			if err != nil && err != io.EOF {
+				log.Log.Info(fmt.Sprintf("%s feeder file:%s err:%s", self.session.LogFormat(), file, err.Error()))
+			}
+			if n > 0 {
+				played = true
+				//下一个文件从上一个 tag 之后开始
+				offset = last + gap
+			}
+		}
+		//所有文件都读不了时不要空转
+		if !played {
+			select {
+			case <-self.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+//发送一个文件的所有 tag，返回发送的 tag 数
+//输出时间戳 = offset + 文件内时间戳 - 文件第一个 tag 的时间戳，按 start 开始的墙上时间发送
+func (self *fileFeeder) feedFile(file string, start time.Time, offset, last, gap *int32) (n int, err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64*1024)
+
+	b := make([]byte, flvio.TagHeaderLength+flvio.FileHeaderLength)
+	if _, err = io.ReadFull(r, b[:flvio.FileHeaderLength]); err != nil {
+		return
+	}
+	var skip int
+	if _, skip, err = flvio.ParseFileHeader(b[:flvio.FileHeaderLength]); err != nil {
+		return
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, int64(skip)); err != nil {
+		return
+	}
+
+	var base int32
+	for {
+		var tag flvio.Tag
+		var ts int32
+		if tag, ts, err = flvio.ReadTag(r, b); err != nil {
+			return
+		}
+		if n == 0 {
+			base = ts
+		}
+		out := *offset + ts - base
+		if n > 0 && out < *last {
+			//文件内时间戳回退，不能让输出回退
+			out = *last
+		}
+		if delta := out - *last; delta > 0 && delta < 1000 {
+			*gap = delta
+		}
+		*last = out
+		n++
+
+		select {
+		case <-self.done:
+			return n, errFeederStop
+		case <-time.After(start.Add(time.Duration(out) * time.Millisecond).Sub(time.Now())):
+		}
+		if err = self.session.ingestWriteTag(tag, out); err != nil {
+			return
+		}
+	}
+}
@@ -5,119 +5,198 @@ import (
 	"time"
 	"rtmpServerStudy/flv"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
 	"strconv"
 	"strings"
 )
 
 type flvReordInfo struct  {
 	muxer           	 *flv.Muxer
+	file                     *flvFileWriter
+	//当前文件第一个包的时间戳，文件内时间戳从0开始
+	baseTs           	 time.Duration
 	lastTs           	 time.Duration
+	flvPath                  string
 	flvBackFileName   	 string
 	flvName 		 string
-	RecidePicFragment        float64
+	flvFragment              float64
+	flvMaxSize               int64
 }
 
-//截图，只生成关键帧
+//统计写入文件的字节数，用于按大小切片
+type flvFileWriter struct {
+	w    io.WriteCloser
+	size int64
+}
+
+func (self *flvFileWriter) Write(b []byte) (n int, err error) {
+	n, err = self.w.Write(b)
+	self.size += int64(n)
+	return
+}
+
+func (self *flvFileWriter) Close() error {
+	return self.w.Close()
+}
+
+//flv 完整录制，初始化目录
 func flvRecordOnPublish(self *Session){
 
 	if self.UserCnf.RecodeFlv != 1{
 		return
 	}
 
-	if len(self.UserCnf.RecodeFlvPath) < 0{
-		self.UserCnf.RecodeFlvPath = BasePath + "/pic/"
+	flvPath := self.UserCnf.RecodeFlvPath
+	if len(flvPath) == 0{
+		flvPath = BasePath + "/flv/"
 	}
 
-	if self.UserCnf.RecodeFlvPath[len(self.UserCnf.RecodeFlvPath)-1] !='/'{
-		self.UserCnf.RecodeFlvPath = self.UserCnf.RecodeFlvPath + "/"
+	if flvPath[len(flvPath)-1] !='/'{
+		flvPath = flvPath + "/"
 	}
 
-	// /data/pic/test/app/
-	self.UserCnf.RecodeFlvPath = fmt.Sprintf("%s%s/%s/%s/",self.UserCnf.RecodeFlvPath,self.uniqueName,self.App,self.StreamId)
-	err:=os.MkdirAll(self.UserCnf.RecodeFlvPath,0666)
+	// /data/flv/test/app/stream/
+	self.flvReordInfo.flvPath = fmt.Sprintf("%s%s/%s/%s/",flvPath,self.uniqueName,self.App,self.StreamId)
+	err:=os.MkdirAll(self.flvReordInfo.flvPath,0755)
 	if err != nil{
 		fmt.Printf("%s\n",err.Error())
 		return
 	}
-	RecidePicFragment:=(5.0)
-	if len(self.UserCnf.RecidePicFragment)>0{
-		time_len := len(self.UserCnf.RecidePicFragment)
-		if self.UserCnf.RecidePicFragment[time_len-1] == 's' {
-			time_len--
-			RecidePicFragment, _ = strconv.ParseFloat(self.UserCnf.HlsFragment[:time_len],64)
-		}
-	}
-	self.flvReordInfo.RecidePicFragment = (RecidePicFragment)
-	//是否录制flv点播
-	//初始化相关目录
+	self.flvReordInfo.flvFragment = parseFragment(self.UserCnf.RecodeFlvFragment, 0)
+	self.flvReordInfo.flvMaxSize = self.UserCnf.RecodeFlvMaxSize
 	return
 }
 
-func flvRecord(self *Session,stream av.CodecData,pkt *av.Packet){
+//打开新的录制文件 写入 flv头 metadata 和 sequence header
+func (self *Session) flvRecordOpen(pkt *av.Packet) (err error) {
 
-	if self.UserCnf.RecodeFlv != 1{
-		return
+	dir := self.flvReordInfo.flvPath
+	if len(self.UserCnf.RecodeFlvDateDir) > 0 {
+		dir = fmt.Sprintf("%s%s/", dir, time.Now().Format(self.UserCnf.RecodeFlvDateDir))
 	}
-	if self.vCodec == nil {
+	if err = os.MkdirAll(dir, 0755); err != nil {
 		return
 	}
-	//pic 只要有视频idr帧即可
-	if (pkt.PacketType != RtmpMsgVideo) || (false == pkt.IsKeyFrame) {
+
+	nowTime:=time.Now().UnixNano()/1000000
+	self.flvReordInfo.flvBackFileName = fmt.Sprintf("%s%d.flvbak",dir,nowTime)
+	self.flvReordInfo.flvName = fmt.Sprintf("%d.flv",nowTime)
+	f1, err := FileCreate(self.flvReordInfo.flvBackFileName)
+	if err != nil {
 		return
 	}
-	//判断pkt 是否是idr帧
-	//打开文件
-	//写入文件
-	//关闭文件
+	self.flvReordInfo.file = &flvFileWriter{w: f1}
 	if self.flvReordInfo.muxer == nil {
+		self.flvReordInfo.muxer = flv.NewMuxer(self.flvReordInfo.file)
+	} else {
+		self.flvReordInfo.muxer.ResetMuxer(self.flvReordInfo.file)
+	}
 
-		nowTime:=time.Now().UnixNano()/1000000
-		self.flvReordInfo.flvBackFileName = fmt.Sprintf("%s%d.flvbak",self.UserCnf.RecodeFlvPath,nowTime)
-		self.flvReordInfo.flvName = fmt.Sprintf("%d.flv",nowTime)
-		fmt.Println(self.flvReordInfo.flvBackFileName)
-		f1, err := FileCreate(self.flvReordInfo.flvBackFileName)
-		if err != nil {
-			fmt.Printf("create flv file %s err the err is %s\n",self.flvReordInfo.flvBackFileName,err.Error())
-		}
-		defer f1.Close()
-		self.flvReordInfo.muxer = flv.NewMuxer(f1)
-		var streams []av.CodecData
+	var streams []av.CodecData
+	if self.aCodec != nil {
+		streams = append(streams, self.aCodec)
+	}
+	if self.vCodec != nil {
 		streams = append(streams, self.vCodec)
-		self.flvReordInfo.muxer.WriteHeader(streams,self.metaData)
-		tag,ts := PacketToTag(pkt)
-		self.flvReordInfo.lastTs = pkt.Time
-		if err = flvio.WriteTag(self.flvReordInfo.muxer.GetMuxerWrite(), tag, ts,self.flvReordInfo.muxer.B); err != nil {
-			return
-		}
-		self.flvReordInfo.muxer.GetMuxerWrite().Flush()
+	}
+	if err = self.flvReordInfo.muxer.WriteHeader(streams,self.metaData); err != nil {
+		return
+	}
+	self.flvReordInfo.baseTs = pkt.Time
+	self.flvReordInfo.lastTs = pkt.Time
+	log.Log.Info(fmt.Sprintf("%s create flv record file %s",
+		self.LogFormat(), self.flvReordInfo.flvBackFileName))
+	return
+}
+
+//关闭当前录制文件 并回调 on_record_done
+func (self *Session) flvRecordClose() {
+
+	if self.flvReordInfo.file == nil {
+		return
+	}
+	self.flvReordInfo.muxer.GetMuxerWrite().Flush()
+	self.flvReordInfo.file.Close()
+
+	size := self.flvReordInfo.file.size
+	duration := flvio.TimeToTs(self.flvReordInfo.lastTs - self.flvReordInfo.baseTs)
+	self.flvReordInfo.file = nil
+
+	dstkey := strings.Replace(self.flvReordInfo.flvBackFileName, ".flvbak", ".flv", 1)
+	if err := os.Rename(self.flvReordInfo.flvBackFileName, dstkey); err != nil {
+		log.Log.Info(fmt.Sprintf("%s rename flv record file %s err:%s",
+			self.LogFormat(), self.flvReordInfo.flvBackFileName, err.Error()))
+		return
+	}
+
+	values := url.Values{}
+	values.Set("path", dstkey)
+	values.Set("size", strconv.FormatInt(size, 10))
+	values.Set("duration", strconv.Itoa(int(duration)))
+	rtmpNotify(self.UserCnf.OnRecordDone, "record_done", self, values)
+}
+
+//是否需要切换新文件，只在关键帧处切，纯音频任意包都可以切
+func (self *Session) flvRecordNeedSplit(pkt *av.Packet) bool {
+
+	if self.vCodec != nil && (pkt.PacketType != RtmpMsgVideo || !pkt.IsKeyFrame) {
+		return false
+	}
+	if self.flvReordInfo.flvFragment > 0 &&
+		float64(flvio.TimeToTs(pkt.Time - self.flvReordInfo.baseTs))/(1000.0) >= self.flvReordInfo.flvFragment {
+		return true
+	}
+	if self.flvReordInfo.flvMaxSize > 0 && self.flvReordInfo.file.size >= self.flvReordInfo.flvMaxSize {
+		return true
+	}
+	return false
+}
 
-	}else if (float64(flvio.TimeToTs(pkt.Time - self.flvReordInfo.lastTs))/(1000.0) >self.flvReordInfo.RecidePicFragment ){
+func flvRecord(self *Session,stream av.CodecData,pkt *av.Packet){
 
-		nowTime:=time.Now().UnixNano()/1000000
-		self.flvReordInfo.flvBackFileName = fmt.Sprintf("%s%d.flvbak",self.UserCnf.RecodeFlvPath,nowTime)
-		fmt.Println(self.flvReordInfo.flvBackFileName)
-		f1, err := FileCreate(self.flvReordInfo.flvBackFileName)
-		if err != nil {
+	if self.UserCnf.RecodeFlv != 1{
+		return
+	}
+	if len(self.flvReordInfo.flvPath) == 0 {
+		return
+	}
+
+	if self.flvReordInfo.file == nil {
+		//有视频时从关键帧开始录，保证文件可以直接播放
+		if self.vCodec != nil && (pkt.PacketType != RtmpMsgVideo || !pkt.IsKeyFrame) {
+			return
+		}
+		if err := self.flvRecordOpen(pkt); err != nil {
 			fmt.Printf("create flv file %s err the err is %s\n",self.flvReordInfo.flvBackFileName,err.Error())
+			self.flvReordInfo.file = nil
+			return
 		}
-		defer f1.Close()
-		self.flvReordInfo.muxer.ResetMuxer(f1)
-		var streams []av.CodecData
-		streams = append(streams, self.vCodec)
-		self.flvReordInfo.muxer.WriteHeader(streams,self.metaData)
-		tag,ts := PacketToTag(pkt)
-		self.flvReordInfo.lastTs = pkt.Time
-		if err = flvio.WriteTag(self.flvReordInfo.muxer.GetMuxerWrite(), tag, ts,self.flvReordInfo.muxer.B); err != nil {
+	} else if self.flvRecordNeedSplit(pkt) {
+		self.flvRecordClose()
+		if err := self.flvRecordOpen(pkt); err != nil {
+			fmt.Printf("create flv file %s err the err is %s\n",self.flvReordInfo.flvBackFileName,err.Error())
+			self.flvReordInfo.file = nil
 			return
 		}
-		self.flvReordInfo.muxer.GetMuxerWrite().Flush()
-
 	}
-	dstkey := strings.Replace(self.flvReordInfo.flvBackFileName, ".flvbak", ".flv", 1)
-	os.Rename(self.flvReordInfo.flvBackFileName, dstkey)
 
+	tag,_ := PacketToTag(pkt)
+	//文件内时间戳从0开始
+	ts := pkt.Time - self.flvReordInfo.baseTs
+	if ts < 0 {
+		ts = 0
+	}
+	if err := flvio.WriteTag(self.flvReordInfo.muxer.GetMuxerWrite(), tag, flvio.TimeToTs(ts), self.flvReordInfo.muxer.B); err != nil {
+		fmt.Printf("write flv file %s err the err is %s\n",self.flvReordInfo.flvBackFileName,err.Error())
+		return
+	}
+	if pkt.Time > self.flvReordInfo.lastTs {
+		self.flvReordInfo.lastTs = pkt.Time
+	}
 	return
 }
 
@@ -127,4 +206,6 @@ func flvRecordOnPublishDone(self *Session){
 	if self.UserCnf.RecodeFlv != 1{
 		return
 	}
+	self.flvRecordClose()
+	self.flvReordInfo.muxer = nil
 }
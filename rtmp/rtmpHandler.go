@@ -98,3 +98,14 @@ func (self *Session) writeStreamBegin(msgsid uint32) (err error) {
 	_, err = self.bufw.Write(b[:n])
 	return
 }
+
+func (self *Session) writeStreamEof(msgsid uint32) (err error) {
+	b := self.GetWriteBuf(chunkHeaderLength + 6)
+	n := self.fillChunk0Header(b, 2, 0, RtmpMsgUser, 0, 6)
+	pio.PutU16BE(b[n:], RtmpUserStreamEof)
+	n += 2
+	pio.PutU32BE(b[n:], msgsid)
+	n += 4
+	_, err = self.bufw.Write(b[:n])
+	return
+}
@@ -0,0 +1,366 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/h264Parse"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+多码率 hls，同一个 app 下 room_1080 room_720 room_480 按配置的后缀分为一组 room
+在 app 目录下生成 room.m3u8 (master) 和 room.mpd (mp2t profile)，引用各码率的 index.m3u8 和 ts
+各码率按 HlsFragment 的整数倍时间戳在关键帧切片，编码器关键帧对齐时分片和序号对齐
+*/
+
+type hlsAbrRendition struct {
+	name   string
+	order  int
+	conf   config.AbrRendition
+	box    *m3u8Box
+	vCodec av.CodecData
+	aCodec av.CodecData
+	done   bool
+	//有 webvtt 字幕
+	caption bool
+}
+
+type hlsAbrGroup struct {
+	//app 目录
+	path       string
+	base       string
+	fragment   float64
+	start      time.Time
+	renditions map[string]*hlsAbrRendition
+}
+
+var hlsAbrGroups = struct {
+	sync.Mutex
+	groups map[string]*hlsAbrGroup
+}{groups: make(map[string]*hlsAbrGroup)}
+
+//推流名匹配最长的后缀，返回组名和配置序号
+func hlsAbrMatch(cnf *config.App, name string) (base string, order int, ok bool) {
+	order = -1
+	for i, rendition := range cnf.HlsAbr {
+		if len(rendition.Suffix) == 0 || len(rendition.Suffix) >= len(name) || !strings.HasSuffix(name, rendition.Suffix) {
+			continue
+		}
+		if order < 0 || len(rendition.Suffix) > len(cnf.HlsAbr[order].Suffix) {
+			order = i
+		}
+	}
+	if order < 0 {
+		return
+	}
+	return strings.TrimSuffix(name, cnf.HlsAbr[order].Suffix), order, true
+}
+
+//第一个分片创建时加入分组
+func hlsAbrOnRecord(self *Session) bool {
+	base, order, ok := hlsAbrMatch(&self.UserCnf, self.StreamId)
+	if !ok {
+		return false
+	}
+	key := self.uniqueName + ":" + self.App + ":" + base
+	hlsAbrGroups.Lock()
+	defer hlsAbrGroups.Unlock()
+	group, ok := hlsAbrGroups.groups[key]
+	if !ok {
+		group = &hlsAbrGroup{
+			path:       strings.TrimSuffix(self.UserCnf.RecodeHlsPath, self.StreamId+"/"),
+			base:       base,
+			fragment:   self.hlsLiveRecordInfo.HlsFragment,
+			start:      time.Now(),
+			renditions: make(map[string]*hlsAbrRendition),
+		}
+		hlsAbrGroups.groups[key] = group
+	}
+	group.renditions[self.StreamId] = &hlsAbrRendition{
+		name:   self.StreamId,
+		order:  order,
+		conf:   self.UserCnf.HlsAbr[order],
+		box:    self.hlsLiveRecordInfo.m3u8Box,
+		vCodec: self.vCodec,
+		aCodec: self.aCodec,
+		caption: self.captionEnabled(),
+	}
+	self.hlsLiveRecordInfo.abrKey = key
+	return true
+}
+
+//按 HlsFragment 的整数倍对齐的分片序号
+func hlsAbrSegmentIndex(self *Session, ts time.Duration) uint64 {
+	fragment := time.Duration(self.hlsLiveRecordInfo.HlsFragment * float64(time.Second))
+	if fragment <= 0 || ts < 0 {
+		return 0
+	}
+	return uint64(ts / fragment)
+}
+
+//关键帧是否跨过了对齐的切片点
+func hlsAbrNeedCut(self *Session, ts time.Duration) bool {
+	return ts > self.hlsLiveRecordInfo.lastTs &&
+		hlsAbrSegmentIndex(self, ts) > hlsAbrSegmentIndex(self, self.hlsLiveRecordInfo.lastTs)
+}
+
+//各码率 m3u8 更新后重新生成 master 和 mpd
+func hlsAbrUpdate(self *Session) {
+	if len(self.hlsLiveRecordInfo.abrKey) == 0 {
+		return
+	}
+	hlsAbrGroups.Lock()
+	defer hlsAbrGroups.Unlock()
+	if group, ok := hlsAbrGroups.groups[self.hlsLiveRecordInfo.abrKey]; ok {
+		group.write()
+	}
+}
+
+//live 断流后从 master 中去掉，event vod 保留；全部结束后删除分组
+func hlsAbrOnPublishDone(self *Session) {
+	if len(self.hlsLiveRecordInfo.abrKey) == 0 {
+		return
+	}
+	hlsAbrGroups.Lock()
+	defer hlsAbrGroups.Unlock()
+	key := self.hlsLiveRecordInfo.abrKey
+	self.hlsLiveRecordInfo.abrKey = ""
+	group, ok := hlsAbrGroups.groups[key]
+	if !ok {
+		return
+	}
+	if rendition, ok := group.renditions[self.StreamId]; ok {
+		if rendition.box.playlistType == HlsPlaylistLive {
+			delete(group.renditions, self.StreamId)
+		} else {
+			rendition.done = true
+		}
+	}
+	group.write()
+	for _, rendition := range group.renditions {
+		if !rendition.done {
+			return
+		}
+	}
+	delete(hlsAbrGroups.groups, key)
+}
+
+//按配置顺序排列，一般从高码率到低码率
+func (self *hlsAbrGroup) sorted() (renditions []*hlsAbrRendition) {
+	for _, rendition := range self.renditions {
+		i := len(renditions)
+		renditions = append(renditions, rendition)
+		for ; i > 0 && renditions[i-1].order > rendition.order; i-- {
+			renditions[i] = renditions[i-1]
+		}
+		renditions[i] = rendition
+	}
+	return
+}
+
+func (self *hlsAbrGroup) write() {
+	renditions := self.sorted()
+	if len(renditions) == 0 {
+		os.Remove(self.path + self.base + ".m3u8")
+		os.Remove(self.path + self.base + ".mpd")
+		return
+	}
+	if err := ioutil.WriteFile(self.path+self.base+".m3u8", self.genMaster(renditions), 0666); err != nil {
+		fmt.Println(err)
+	}
+	if err := ioutil.WriteFile(self.path+self.base+".mpd", self.genMpd(renditions), 0666); err != nil {
+		fmt.Println(err)
+	}
+}
+
+//实际码率，还没有分片时用配置
+func (self *hlsAbrRendition) bandwidth() (peak int, average int) {
+	if peak, average = self.box.Bandwidth(); peak > 0 {
+		return
+	}
+	return self.conf.Bandwidth, 0
+}
+
+func (self *hlsAbrRendition) resolution() (width int, height int) {
+	if codec, ok := self.vCodec.(av.VideoCodecData); ok && codec.Width() > 0 && codec.Height() > 0 {
+		return codec.Width(), codec.Height()
+	}
+	fmt.Sscanf(self.conf.Resolution, "%dx%d", &width, &height)
+	return
+}
+
+//RFC 6381 codecs，不认识的编码返回空
+func (self *hlsAbrRendition) codecs() string {
+	var codecs []string
+	switch codec := self.vCodec.(type) {
+	case nil:
+	case h264parser.CodecData:
+		sps := codec.SPS()
+		if len(sps) < 4 {
+			return ""
+		}
+		codecs = append(codecs, fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3]))
+	default:
+		return ""
+	}
+	switch codec := self.aCodec.(type) {
+	case nil:
+	case aacparser.CodecData:
+		codecs = append(codecs, fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType))
+	default:
+		if self.aCodec.Type() == av.MP3 {
+			codecs = append(codecs, "mp4a.40.34")
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
+const hlsSubtitleGroup = "subs"
+
+//字幕 rendition，uri 是字幕的 m3u8
+func hlsSubtitleMedia(w io.Writer, uri string) {
+	fmt.Fprintf(w, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"CC1\",DEFAULT=NO,AUTOSELECT=YES,URI=\"%s\"\n",
+		hlsSubtitleGroup, uri)
+}
+
+//还没有码率时不输出
+func (self *hlsAbrRendition) streamInf(w io.Writer, uri string, subtitles bool) {
+	peak, average := self.bandwidth()
+	if peak <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d", peak)
+	if average > 0 {
+		fmt.Fprintf(w, ",AVERAGE-BANDWIDTH=%d", average)
+	}
+	if width, height := self.resolution(); width > 0 && height > 0 {
+		fmt.Fprintf(w, ",RESOLUTION=%dx%d", width, height)
+	}
+	if codecs := self.codecs(); len(codecs) > 0 {
+		fmt.Fprintf(w, ",CODECS=\"%s\"", codecs)
+	}
+	if subtitles {
+		fmt.Fprintf(w, ",SUBTITLES=\"%s\"", hlsSubtitleGroup)
+	}
+	fmt.Fprintf(w, "\n%s\n", uri)
+}
+
+func (self *hlsAbrGroup) genMaster(renditions []*hlsAbrRendition) []byte {
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n\n")
+	//字幕用第一个码率的
+	subtitles := false
+	for _, rendition := range renditions {
+		if rendition.caption {
+			hlsSubtitleMedia(w, rendition.name+"/"+hlsCaptionPlaylist)
+			subtitles = true
+			break
+		}
+	}
+	for _, rendition := range renditions {
+		rendition.streamInf(w, rendition.name+"/index.m3u8", subtitles)
+	}
+	return w.Bytes()
+}
+
+const mpdTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+//第一个分片相对 availabilityStartTime 的时间，毫秒
+//直播时窗口最后一个分片结束于它的开始时间加时长，重推合并的分片没有开始时间时用当前时间
+func (self *hlsAbrGroup) mpdStart(items []TSItem, static bool) int64 {
+	if static {
+		return 0
+	}
+	var total float64
+	for _, item := range items {
+		total += float64(item.Duration)
+	}
+	last := items[len(items)-1]
+	end := time.Now()
+	if !last.StartTime.IsZero() {
+		end = last.StartTime.Add(time.Duration(float64(last.Duration) * float64(time.Second)))
+	}
+	t := int64(end.Sub(self.start)/time.Millisecond) - int64(total*1000+0.5)
+	if t < 0 {
+		t = 0
+	}
+	return t
+}
+
+func mpdDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
+
+//mp2t-simple profile，直接引用 hls 的 ts 分片
+func (self *hlsAbrGroup) genMpd(renditions []*hlsAbrRendition) []byte {
+	static := true
+	var maxDuration float32
+	for _, rendition := range renditions {
+		if !rendition.box.EndList() {
+			static = false
+		}
+		var duration float32
+		for _, item := range rendition.box.Items() {
+			duration += item.Duration
+		}
+		if duration > maxDuration {
+			maxDuration = duration
+		}
+	}
+
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:mp2t-simple:2011\"")
+	if static {
+		fmt.Fprintf(w, " type=\"static\" mediaPresentationDuration=\"%s\"", mpdDuration(float64(maxDuration)))
+	} else {
+		fmt.Fprintf(w, " type=\"dynamic\" availabilityStartTime=\"%s\" publishTime=\"%s\" minimumUpdatePeriod=\"%s\" timeShiftBufferDepth=\"%s\"",
+			self.start.UTC().Format(mpdTimeFormat), time.Now().UTC().Format(mpdTimeFormat),
+			mpdDuration(self.fragment), mpdDuration(float64(maxDuration)))
+	}
+	fmt.Fprintf(w, " minBufferTime=\"%s\">\n", mpdDuration(self.fragment*2))
+	fmt.Fprintf(w, "  <Period id=\"0\" start=\"PT0S\">\n")
+	fmt.Fprintf(w, "    <AdaptationSet mimeType=\"video/mp2t\" segmentAlignment=\"true\" bitstreamSwitching=\"true\">\n")
+	for _, rendition := range renditions {
+		items := rendition.box.Items()
+		peak, _ := rendition.bandwidth()
+		if peak <= 0 || len(items) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "      <Representation id=\"%s\" bandwidth=\"%d\"", rendition.name, peak)
+		if width, height := rendition.resolution(); width > 0 && height > 0 {
+			fmt.Fprintf(w, " width=\"%d\" height=\"%d\"", width, height)
+		}
+		if codecs := rendition.codecs(); len(codecs) > 0 {
+			fmt.Fprintf(w, " codecs=\"%s\"", codecs)
+		}
+		fmt.Fprintf(w, ">\n        <BaseURL>%s/</BaseURL>\n", rendition.name)
+		fmt.Fprintf(w, "        <SegmentList timescale=\"1000\" startNumber=\"%d\">\n", items[0].SeqNum)
+		//分片时长不固定，用 SegmentTimeline 写每个分片的实际时长
+		fmt.Fprintf(w, "          <SegmentTimeline>\n")
+		t := self.mpdStart(items, static)
+		for i, item := range items {
+			d := int64(item.Duration*1000 + 0.5)
+			if i == 0 {
+				fmt.Fprintf(w, "            <S t=\"%d\" d=\"%d\"/>\n", t, d)
+			} else {
+				fmt.Fprintf(w, "            <S d=\"%d\"/>\n", d)
+			}
+		}
+		fmt.Fprintf(w, "          </SegmentTimeline>\n")
+		for _, item := range items {
+			fmt.Fprintf(w, "          <SegmentURL media=\"%s\"/>\n", item.Name)
+		}
+		fmt.Fprintf(w, "        </SegmentList>\n      </Representation>\n")
+	}
+	fmt.Fprintf(w, "    </AdaptationSet>\n  </Period>\n</MPD>\n")
+	return w.Bytes()
+}
@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/ts/tsio"
+	"strings"
+	"time"
+)
+
+/*
+广告插入点，推流端的 onCuePoint onAdCue 或者控制接口 /control/cue
+参数 {"type":"cue-out","duration":30,"id":1} 或 {"scte35":"base64 的 splice_info_section"}，onCuePoint 的参数也可以放在 parameters 中
+hls 在下一个关键帧切片，新分片前写 EXT-X-CUE-OUT/EXT-X-CUE-IN 和 EXT-X-DATERANGE，ts 中在 scte35 pid 上写 splice_info_section
+cue-out 带时长时到时间自动 cue-in
+*/
+
+//识别为广告插入点的 data 消息
+var hlsCueMsg = map[string]bool{
+	"onCuePoint": true,
+	"onAdCue":    true,
+}
+
+func hlsCueString(obj amf.AMFMap, keys ...string) (string, bool) {
+	for _, key := range keys {
+		if s, ok := obj[key].(string); ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func hlsCueNumber(obj amf.AMFMap, keys ...string) float64 {
+	for _, key := range keys {
+		if f, ok := obj[key].(float64); ok {
+			return f
+		}
+	}
+	return 0
+}
+
+func hlsAmfObject(v interface{}) (amf.AMFMap, bool) {
+	switch obj := v.(type) {
+	case amf.AMFMap:
+		return obj, true
+	case amf.AMFECMAArray:
+		return amf.AMFMap(obj), true
+	}
+	return nil, false
+}
+
+//data 消息解析成 cue，不是广告插入点返回 nil
+func hlsCueParse(msgdata []byte) *HlsCue {
+	name, n, err := amf.ParseAMF0Val(msgdata)
+	if err != nil {
+		return nil
+	}
+	if s, ok := name.(string); !ok || !hlsCueMsg[s] {
+		return nil
+	}
+	val, _, err := amf.ParseAMF0Val(msgdata[n:])
+	if err != nil {
+		return nil
+	}
+	obj, ok := hlsAmfObject(val)
+	if !ok {
+		return nil
+	}
+	if params, ok := hlsAmfObject(obj["parameters"]); ok {
+		for k, v := range obj {
+			if _, ok := params[k]; !ok {
+				params[k] = v
+			}
+		}
+		obj = params
+	}
+
+	cue := &HlsCue{}
+	if s, ok := hlsCueString(obj, "scte35", "SCTE35"); ok {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil
+		}
+		info, ok := tsio.ParseSCTE35(b)
+		if !ok {
+			return nil
+		}
+		cue.Out, cue.Id, cue.Scte35 = info.Out, info.EventId, b
+		cue.Duration = float32(info.Duration) / tsio.PTS_HZ
+		return cue
+	}
+
+	//onCuePoint 的 type 是 event navigation，cue 类型在 name 中
+	for _, key := range []string{"type", "cueType", "name"} {
+		s, _ := hlsCueString(obj, key)
+		switch strings.ToLower(s) {
+		case "cue-out", "cueout", "out", "spliceout", "splice-out", "ad-start", "adstart":
+			cue.Out = true
+		case "cue-in", "cuein", "in", "splicein", "splice-in", "ad-end", "adend":
+			cue.Out = false
+		default:
+			continue
+		}
+		cue.Id = uint32(hlsCueNumber(obj, "id", "eventId", "spliceEventId"))
+		cue.Duration = float32(hlsCueNumber(obj, "duration", "breakDuration"))
+		return cue
+	}
+	return nil
+}
+
+//广告插入点在下一个关键帧切片
+func hlsLiveRecordCue(self *Session, pkt *av.Packet, cue *HlsCue) {
+	info := &self.hlsLiveRecordInfo
+	if cue.Id == 0 {
+		if !cue.Out && info.cueOut != nil {
+			cue.Id = info.cueOut.Id
+		} else {
+			info.cueId++
+			cue.Id = info.cueId
+		}
+	}
+	log.Log.Info(fmt.Sprintf("%s hls cue out:%v id:%d duration:%.3f ts:%d", self.LogFormat(),
+		cue.Out, cue.Id, cue.Duration, flvio.TimeToTs(pkt.Time)))
+	//下一个分片的 pmt 带 scte35 流
+	info.muxer.EnableSCTE35()
+	info.cuePending = cue
+}
+
+//是否因为广告插入点需要切片，cue-out 到时间时生成 cue-in
+func hlsLiveRecordCueCut(self *Session, pkt *av.Packet) bool {
+	info := &self.hlsLiveRecordInfo
+	if info.cuePending == nil && info.cueOut != nil && info.cueOutEnd > 0 && pkt.Time >= info.cueOutEnd {
+		info.cuePending = &HlsCue{Id: info.cueOut.Id}
+	}
+	return info.cuePending != nil
+}
+
+//新分片开始，写 splice_info_section，记下这个分片的 cue
+func hlsLiveRecordCueOpen(self *Session, pkt *av.Packet) {
+	info := &self.hlsLiveRecordInfo
+	info.fragStart = time.Now()
+	cue := info.cuePending
+	info.cuePending = nil
+	if cue == nil {
+		if out := info.cueOut; out != nil {
+			info.fragCue = &HlsCue{Cont: true, Id: out.Id, Duration: out.Duration,
+				Elapsed: float32(flvio.TimeToTs(pkt.Time-info.cueOutTs)) / 1000.0}
+		}
+		return
+	}
+	if len(cue.Scte35) == 0 {
+		var duration uint64
+		if cue.Out {
+			duration = uint64(cue.Duration * tsio.PTS_HZ)
+		}
+		b := make([]byte, 64)
+		n := tsio.FillSCTE35SpliceInsert(b, cue.Id, cue.Out, tsio.TimeToTs(pkt.Time), duration)
+		cue.Scte35 = b[:n]
+	}
+	if err := info.muxer.WriteSCTE35(cue.Scte35); err != nil {
+		fmt.Printf("write scte35 %s err the err is %s\n", info.tsBackFileName, err.Error())
+	}
+	if cue.Out {
+		info.cueOut, info.cueOutTs, info.cueOutEnd = cue, pkt.Time, 0
+		if cue.Duration > 0 {
+			info.cueOutEnd = pkt.Time + time.Duration(cue.Duration*float32(time.Second))
+		}
+		cue.Start = info.fragStart
+	} else {
+		if info.cueOut != nil {
+			cue.Start = info.cueOut.Start
+		}
+		info.cueOut = nil
+	}
+	info.fragCue = cue
+}
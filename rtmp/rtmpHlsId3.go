@@ -0,0 +1,87 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/ts/tsio"
+)
+
+/*
+hls 的 timed metadata，data 消息按时间戳写成 ts 中的 id3 tag
+进 hls 录制的有推流端的 onTextData、DataForward 中的消息和控制接口注入的消息
+TXXX 的描述是消息名，值是 onTextData 的 text 或者参数的 json，PRIV 带原始 amf0 消息
+*/
+
+//不在 DataForward 中也写入 hls 的消息
+var hlsId3Msg = map[string]bool{
+	"onTextData": true,
+}
+
+const hlsId3PrivOwner = "rtmpServerStudy.amf0"
+
+//推流端的消息不转发时是否还要给 hls 录制
+func hlsDataMsg(name string) bool {
+	return hlsCueMsg[name] || hlsId3Msg[name]
+}
+
+//data 消息转成 id3 tag
+func hlsId3Tag(msgdata []byte) (tag []byte, err error) {
+	val, n, err := amf.ParseAMF0Val(msgdata)
+	if err != nil {
+		return
+	}
+	name, ok := val.(string)
+	if !ok {
+		err = fmt.Errorf("%s", "Rtmp.Hls.Id3.BadMessage")
+		return
+	}
+	var args []interface{}
+	for n < len(msgdata) {
+		var size int
+		if val, size, err = amf.ParseAMF0Val(msgdata[n:]); err != nil {
+			return
+		}
+		args = append(args, val)
+		n += size
+	}
+
+	var value string
+	if len(args) > 0 && name == "onTextData" {
+		if obj, ok := hlsAmfObject(args[0]); ok {
+			value, _ = obj["text"].(string)
+		}
+	}
+	if len(value) == 0 && len(args) > 0 {
+		var b []byte
+		if len(args) == 1 {
+			b, err = json.Marshal(args[0])
+		} else {
+			b, err = json.Marshal(args)
+		}
+		if err != nil {
+			return
+		}
+		value = string(b)
+	}
+
+	frames := []tsio.ID3Frame{
+		tsio.ID3TXXX(name, value),
+		tsio.ID3PRIV(hlsId3PrivOwner, msgdata),
+	}
+	tag = make([]byte, tsio.ID3Len(frames))
+	tsio.FillID3(tag, frames)
+	return
+}
+
+func hlsLiveRecordId3(self *Session, pkt *av.Packet) {
+	tag, err := hlsId3Tag(pkt.Data)
+	if err != nil {
+		fmt.Printf("hls id3 %s err the err is %s\n", self.hlsLiveRecordInfo.tsBackFileName, err.Error())
+		return
+	}
+	if err = self.hlsLiveRecordInfo.muxer.WriteID3(tag, tsio.TimeToTs(pkt.Time)); err != nil {
+		fmt.Printf("write id3 %s err the err is %s\n", self.hlsLiveRecordInfo.tsBackFileName, err.Error())
+	}
+}
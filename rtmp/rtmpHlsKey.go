@@ -0,0 +1,283 @@
+package rtmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/ts"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	HlsEncryptAES128    = "AES-128"
+	HlsEncryptSampleAES = "SAMPLE-AES"
+
+	HlsKeyLength = 16
+	//默认 key provider
+	HlsKeyProviderLocal = "local"
+)
+
+//hls key 的生成和获取，目前是本地文件，后续可以接入 kms
+type HlsKeyProvider interface {
+	//生成新的 key，keyId 在同一路流内唯一
+	NewKey(cnf *config.App, uniqueName, app, name, keyId string) (key []byte, err error)
+	//key 路由根据 keyId 取 key
+	GetKey(cnf *config.App, uniqueName, app, name, keyId string) (key []byte, err error)
+}
+
+//可选，provider 实现时删除分片都已滑出窗口的 key
+type HlsKeyRemover interface {
+	RemoveKey(cnf *config.App, uniqueName, app, name, keyId string) error
+}
+
+var hlsKeyProviders = map[string]HlsKeyProvider{
+	HlsKeyProviderLocal: localHlsKeyProvider{},
+}
+
+//注册 key provider，需要在服务启动前调用
+func RegisterHlsKeyProvider(name string, provider HlsKeyProvider) {
+	hlsKeyProviders[name] = provider
+}
+
+func getHlsKeyProvider(name string) HlsKeyProvider {
+	if len(name) == 0 {
+		name = HlsKeyProviderLocal
+	}
+	return hlsKeyProviders[name]
+}
+
+//key 保存在 HlsKeyPath/unique/app/stream/keyId.key
+type localHlsKeyProvider struct{}
+
+func (localHlsKeyProvider) keyPath(cnf *config.App, uniqueName, app, name, keyId string) string {
+	keyPath := cnf.HlsKeyPath
+	if len(keyPath) == 0 {
+		keyPath = BasePath + "/hlskey/"
+	}
+	return filepath.Join(keyPath, uniqueName, app, name, keyId+".key")
+}
+
+func (self localHlsKeyProvider) NewKey(cnf *config.App, uniqueName, app, name, keyId string) (key []byte, err error) {
+	key = make([]byte, HlsKeyLength)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return
+	}
+	keyFile := self.keyPath(cnf, uniqueName, app, name, keyId)
+	if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, key, 0600)
+	return
+}
+
+func (self localHlsKeyProvider) GetKey(cnf *config.App, uniqueName, app, name, keyId string) (key []byte, err error) {
+	if key, err = ioutil.ReadFile(self.keyPath(cnf, uniqueName, app, name, keyId)); err != nil {
+		return
+	}
+	if len(key) != HlsKeyLength {
+		err = fmt.Errorf("%s","Rtmp.Hls.Key.Invalid")
+	}
+	return
+}
+
+func (self localHlsKeyProvider) RemoveKey(cnf *config.App, uniqueName, app, name, keyId string) (err error) {
+	if err = os.Remove(self.keyPath(cnf, uniqueName, app, name, keyId)); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+//每个分片的 iv 为分片序号
+func hlsKeyIV(seqNum uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seqNum)
+	return iv
+}
+
+func hlsKeyUri(cnf *config.App, app, name, keyId string) string {
+	if len(cnf.HlsKeyUrl) > 0 {
+		return cnf.HlsKeyUrl + keyId + ".key"
+	}
+	return fmt.Sprintf("/hlskey/%s/%s/%s.key", app, name, keyId)
+}
+
+//从 key uri 取 keyId，不是本流的 uri 返回 false
+func hlsKeyIdFromUri(cnf *config.App, app, name, uri string) (keyId string, ok bool) {
+	prefix := strings.TrimSuffix(hlsKeyUri(cnf, app, name, ""), ".key")
+	if !strings.HasPrefix(uri, prefix) || !strings.HasSuffix(uri, ".key") {
+		return
+	}
+	keyId = strings.TrimSuffix(strings.TrimPrefix(uri, prefix), ".key")
+	return keyId, len(keyId) > 0
+}
+
+//窗口内的分片和正在加密的分片都不再使用时删除 key
+func hlsLiveRecordRemoveKey(self *Session, uri string) {
+	info := &self.hlsLiveRecordInfo
+	if uri == info.keyUri || info.m3u8Box.keyInUse(uri) {
+		return
+	}
+	remover, ok := getHlsKeyProvider(self.UserCnf.HlsKeyProvider).(HlsKeyRemover)
+	if !ok {
+		return
+	}
+	keyId, ok := hlsKeyIdFromUri(&self.UserCnf, self.App, self.StreamId, uri)
+	if !ok {
+		return
+	}
+	if err := remover.RemoveKey(&self.UserCnf, self.uniqueName, self.App, self.StreamId, keyId); err != nil {
+		fmt.Printf("remove hls key %s err the err is %s\n", uri, err.Error())
+	}
+}
+
+//AES-128 整个 ts 文件 cbc 加密，PKCS7 填充
+type aesCbcWriter struct {
+	w    io.WriteCloser
+	mode cipher.BlockMode
+	buf  []byte
+}
+
+func newAesCbcWriter(w io.WriteCloser, key, iv []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesCbcWriter{w: w, mode: cipher.NewCBCEncrypter(block, iv)}, nil
+}
+
+func (self *aesCbcWriter) Write(b []byte) (n int, err error) {
+	self.buf = append(self.buf, b...)
+	blocks := len(self.buf) / aes.BlockSize * aes.BlockSize
+	if blocks > 0 {
+		self.mode.CryptBlocks(self.buf[:blocks], self.buf[:blocks])
+		if _, err = self.w.Write(self.buf[:blocks]); err != nil {
+			return
+		}
+		self.buf = append(self.buf[:0], self.buf[blocks:]...)
+	}
+	n = len(b)
+	return
+}
+
+func (self *aesCbcWriter) Close() (err error) {
+	pad := aes.BlockSize - len(self.buf)%aes.BlockSize
+	for i := 0; i < pad; i++ {
+		self.buf = append(self.buf, byte(pad))
+	}
+	self.mode.CryptBlocks(self.buf, self.buf)
+	if _, err = self.w.Write(self.buf); err != nil {
+		self.w.Close()
+		return
+	}
+	return self.w.Close()
+}
+
+//由 play 域名的 UniqueName 找到推流域名下 app 的配置
+func publishAppConf(uniqueName, app string) *config.App {
+	for _, domain := range Gconfig.UserConf.PublishDomain {
+		if domain.UniqueName == uniqueName && domain.App[app] != nil {
+			return domain.App[app]
+		}
+	}
+	return nil
+}
+
+//key 路由 /hlskey/{app}/{name}/{key}.key 和 flv 播放相同的鉴权
+func hlsKeyHandler(w http.ResponseWriter, r *http.Request) {
+	host, ok := httpPlayAuth(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	app := mux.Vars(r)["app"]
+	keyId := mux.Vars(r)["key"]
+
+	uniqueName := Gconfig.UserConf.PlayDomain[host].UniqueName
+	cnf := publishAppConf(uniqueName, app)
+	if cnf == nil || len(cnf.HlsEncrypt) == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	provider := getHlsKeyProvider(cnf.HlsKeyProvider)
+	if provider == nil {
+		w.WriteHeader(404)
+		return
+	}
+	key, err := provider.GetKey(cnf, uniqueName, app, name, keyId)
+	if err != nil {
+		fmt.Printf("get hls key %s/%s/%s err the err is %s\n", app, name, keyId, err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	w.Write(key)
+}
+
+//每个分片打开时调用，按配置换 key，AES-128 返回加密的 writer
+func hlsLiveRecordEncryptFile(self *Session, f io.WriteCloser) (w io.WriteCloser, err error) {
+	info := &self.hlsLiveRecordInfo
+	if len(info.keyMethod) == 0 {
+		info.keyInfo = nil
+		return f, nil
+	}
+	rotate := self.UserCnf.HlsKeyRotate
+	if info.key == nil || (rotate > 0 && info.keySegments >= rotate) {
+		provider := getHlsKeyProvider(self.UserCnf.HlsKeyProvider)
+		if provider == nil {
+			err = fmt.Errorf("%s","Rtmp.Hls.KeyProvider.NotFound")
+			return
+		}
+		keyId := fmt.Sprintf("%d", info.seqNum)
+		if info.key, err = provider.NewKey(&self.UserCnf, self.uniqueName, self.App, self.StreamId, keyId); err != nil {
+			return
+		}
+		info.keyUri = hlsKeyUri(&self.UserCnf, self.App, self.StreamId, keyId)
+		info.keySegments = 0
+	}
+	info.keySegments++
+	info.keyInfo = &HlsKey{
+		Method: info.keyMethod,
+		URI:    info.keyUri,
+		IV:     hlsKeyIV(info.seqNum),
+	}
+	if info.keyMethod == HlsEncryptAES128 {
+		return newAesCbcWriter(f, info.key, info.keyInfo.IV)
+	}
+	return f, nil
+}
+
+//SAMPLE-AES 由 ts muxer 加密，需要在写 pmt 之前设置
+func hlsLiveRecordSetSampleAES(self *Session) (err error) {
+	info := &self.hlsLiveRecordInfo
+	if info.keyInfo != nil && info.keyMethod == HlsEncryptSampleAES {
+		return info.muxer.SetSampleAES(info.key, info.keyInfo.IV)
+	}
+	return info.muxer.SetSampleAES(nil, nil)
+}
+
+//SAMPLE-AES 只支持 h264 aac，其他编码退回 AES-128
+func hlsLiveRecordKeyMethod(self *Session, audioInTs bool) string {
+	method := strings.ToUpper(self.UserCnf.HlsEncrypt)
+	switch method {
+	case HlsEncryptAES128:
+	case HlsEncryptSampleAES:
+		if (audioInTs && !ts.SampleAESSupported(self.aCodec)) || !ts.SampleAESSupported(self.vCodec) {
+			method = HlsEncryptAES128
+		}
+	default:
+		method = ""
+	}
+	return method
+}
@@ -2,6 +2,7 @@ package rtmp
 
 import (
 	"rtmpServerStudy/av"
+	"rtmpServerStudy/caption"
 	"os"
 	"fmt"
 	"time"
@@ -12,10 +13,11 @@ import (
 	"net/http"
 	"net/url"
 	"github.com/gorilla/mux"
-	"rtmpServerStudy/aacParse"
-	"strconv"
 	"bufio"
 	"github.com/grafov/m3u8"
+	"encoding/hex"
+	"io"
+	"rtmpServerStudy/log"
 )
 
 //hls直播
@@ -24,7 +26,7 @@ func hlsLiveRecordOnPublish(self *Session){
 		return
 	}
 
-	if len(self.UserCnf.RecodeHlsPath) < 0{
+	if len(self.UserCnf.RecodeHlsPath) == 0{
 		self.UserCnf.RecodeHlsPath = BasePath + "/hls/"
 	}
 
@@ -39,23 +41,14 @@ func hlsLiveRecordOnPublish(self *Session){
 
 	// /data/hls/test/app/
 	self.UserCnf.RecodeHlsPath = fmt.Sprintf("%s%s/%s/%s/",self.UserCnf.RecodeHlsPath,self.uniqueName,self.App,self.StreamId)
-	err:=os.MkdirAll(self.UserCnf.RecodeHlsPath,0666)
+	err:=os.MkdirAll(self.UserCnf.RecodeHlsPath,0755)
 	if err != nil{
 		fmt.Printf("%s\n",err.Error())
 		return
 	}
 
-	HlsFragment:=5.0
 	//大于5s 切片
-	if len(self.UserCnf.HlsFragment)>0{
-		time_len := len(self.UserCnf.HlsFragment)
-		if self.UserCnf.HlsFragment[time_len-1] == 's' {
-			time_len--
-			HlsFragment, _ = strconv.ParseFloat(self.UserCnf.HlsFragment[:time_len],64)
-		}
-	}
-
-	self.hlsLiveRecordInfo.HlsFragment = (HlsFragment)
+	self.hlsLiveRecordInfo.HlsFragment = parseFragment(self.UserCnf.HlsFragment, 5.0)
 	return
 }
 
@@ -66,7 +59,31 @@ func hlsRecordOnPublishDone(self *Session) {
 	if self.UserCnf.RecodeHls != 1{
 		return
 	}
-	hlsLiveRecordCloseFragment(self,nil,nil)
+	if self.hlsLiveRecordInfo.muxer == nil {
+		self.hlsLiveRecordInfo.fragFailed = false
+		return
+	}
+	//分片创建失败时没有打开的文件
+	if !self.hlsLiveRecordInfo.fragFailed {
+		hlsLiveRecordCloseFragment(self,nil,nil)
+	}
+	self.hlsLiveRecordInfo.fragFailed = false
+	//vod event 断流后结束播放列表，live 保持滑动窗口等待重推
+	if self.hlsLiveRecordInfo.m3u8Box.playlistType != HlsPlaylistLive {
+		self.hlsLiveRecordInfo.m3u8Box.SetEndList()
+		hlsLiveRecordWriteM3u8(self)
+	}
+	//live 模式当前的 key 不在窗口内时删除，重推时换新的 key
+	if uri := self.hlsLiveRecordInfo.keyUri; len(uri) > 0 {
+		self.hlsLiveRecordInfo.key, self.hlsLiveRecordInfo.keyUri = nil, ""
+		if self.hlsLiveRecordInfo.m3u8Box.playlistType == HlsPlaylistLive {
+			hlsLiveRecordRemoveKey(self, uri)
+		}
+	}
+	hlsLiveRecordCaptionDone(self)
+	hlsAbrOnPublishDone(self)
+	self.hlsLiveRecordInfo.muxer = nil
+	self.hlsLiveRecordInfo.cuePending, self.hlsLiveRecordInfo.cueOut = nil, nil
 }
 
 func hlsLiveRecordOnPublishDone(self *Session){
@@ -100,25 +117,87 @@ type  hlsLiveRecordInfo struct {
 	m3u8Box *m3u8Box
 	seqNum uint64
 	HlsFragment float64
+	//最后一个包的时间戳，断流时计算最后一个分片时长
+	lastPktTs        time.Duration
+	//下一个分片与之前的分片不连续（重推后合并 m3u8）
+	discontinuity    bool
+	//加密方式 AES-128 SAMPLE-AES，空不加密
+	keyMethod        string
+	key              []byte
+	keyUri           string
+	//当前 key 已经加密的分片数
+	keySegments      int
+	//当前分片的 EXT-X-KEY
+	keyInfo          *HlsKey
+	//多码率分组，空不属于分组
+	abrKey           string
+	//等待下一个关键帧切片的广告插入点
+	cuePending       *HlsCue
+	//当前分片的 cue 标记
+	fragCue          *HlsCue
+	//插播中的 cue-out，nil 不在插播
+	cueOut           *HlsCue
+	cueOutTs         time.Duration
+	//cue-out 带时长时自动 cue-in 的时间戳
+	cueOutEnd        time.Duration
+	cueId            uint32
+	//当前分片开始的时间
+	fragStart        time.Time
+	//当前分片结束的字幕
+	captionCues      []caption.Cue
+	//webvtt 分片列表
+	captionBox       *m3u8Box
+	//分片文件创建失败（如取 key 失败），等下一个关键帧重试
+	fragFailed       bool
 }
 
-//打开新的文件
-func hlsLiveRecordOpenFragment(self *Session,stream av.CodecData,pkt *av.Packet){
-
+//创建分片文件，需要时换 key 并加密
+func hlsLiveRecordCreateFile(self *Session) (w io.WriteCloser, err error) {
 	nowTime:=time.Now().UnixNano()/1000000
-	err:=os.MkdirAll(self.UserCnf.RecodeHlsPath,0666)
 	self.hlsLiveRecordInfo.tsBackFileName = fmt.Sprintf("%s%d.tsbak",self.UserCnf.RecodeHlsPath,nowTime)
 	self.hlsLiveRecordInfo.tsName = fmt.Sprintf("%d.ts",nowTime)
 	fmt.Println(self.hlsLiveRecordInfo.tsBackFileName)
 	f1, err := FileCreate(self.hlsLiveRecordInfo.tsBackFileName)
+	if err != nil {
+		return
+	}
+	if w, err = hlsLiveRecordEncryptFile(self, f1); err != nil {
+		f1.Close()
+		os.Remove(self.hlsLiveRecordInfo.tsBackFileName)
+		return
+	}
+	return
+}
+
+//打开新的文件
+func hlsLiveRecordOpenFragment(self *Session,stream av.CodecData,pkt *av.Packet){
+
+	os.MkdirAll(self.UserCnf.RecodeHlsPath,0755)
+	self.hlsLiveRecordInfo.seqNum++
+	//多码率时序号按时间戳对齐
+	if len(self.hlsLiveRecordInfo.abrKey) > 0 {
+		if seqNum := hlsAbrSegmentIndex(self, pkt.Time); seqNum > self.hlsLiveRecordInfo.seqNum {
+			self.hlsLiveRecordInfo.seqNum = seqNum
+		}
+	}
+	f1, err := hlsLiveRecordCreateFile(self)
 	if err != nil {
 		fmt.Printf("create ts file %s err the err is %s\n",self.hlsLiveRecordInfo.tsBackFileName,err.Error())
+		//丢掉的数据前后不连续
+		self.hlsLiveRecordInfo.fragFailed, self.hlsLiveRecordInfo.discontinuity = true, true
+		self.hlsLiveRecordInfo.audioCachedPkts = make([](*av.Packet), 0, 10)
+		return
 	}
+	self.hlsLiveRecordInfo.fragFailed = false
 
 	//重置文件
 	self.hlsLiveRecordInfo.muxer.SetWriter(f1)
+	if err = hlsLiveRecordSetSampleAES(self); err != nil {
+		fmt.Printf("set sample aes %s err the err is %s\n",self.hlsLiveRecordInfo.tsBackFileName,err.Error())
+	}
 	//写pat pmt ts header
 	self.hlsLiveRecordInfo.muxer.WritePATPMT()
+	hlsLiveRecordCueOpen(self, pkt)
 
 	//self.hlsLiveRecordInfo.lasetTs = pkt.Time
 	if pkt.PacketType == RtmpMsgAudio {
@@ -127,20 +206,59 @@ func hlsLiveRecordOpenFragment(self *Session,stream av.CodecData,pkt *av.Packet)
 		self.hlsLiveRecordInfo.lastVideoTs = pkt.Time
 	}
 	self.hlsLiveRecordInfo.lastTs =  pkt.Time
-	self.hlsLiveRecordInfo.seqNum++
 
 	//flush audio
 	self.hlsLiveRecordInfo.muxer.WriteAudioPacket(self.hlsLiveRecordInfo.audioCachedPkts, self.aCodec, self.hlsLiveRecordInfo.audioPts)
 	self.hlsLiveRecordInfo.audioCachedPkts = make([](*av.Packet), 0, 10)
 }
 
+//视频的关键帧，纯音频的任意音频包可以开始新的分片
+func hlsLiveRecordBoundary(self *Session, pkt *av.Packet) bool {
+	if self.vCodec != nil {
+		return pkt.PacketType == RtmpMsgVideo && pkt.IsKeyFrame
+	}
+	return pkt.PacketType == RtmpMsgAudio
+}
+
 func hlsLiveRecordCloseFragment(self *Session,stream av.CodecData,pkt *av.Packet){
+	//断流时没有切片的包，按最后一个包计算时长
+	if pkt == nil {
+		self.hlsLiveRecordInfo.duration =
+			float32(flvio.TimeToTs(self.hlsLiveRecordInfo.lastPktTs - self.hlsLiveRecordInfo.lastTs))/(1000.0)
+	}
 	self.hlsLiveRecordInfo.muxer.WriteTrailer()
 	dstkey := strings.Replace(self.hlsLiveRecordInfo.tsBackFileName, ".tsbak", ".ts", 1)
 	os.Rename(self.hlsLiveRecordInfo.tsBackFileName, dstkey)
 	tsitem := NewTSItem(self.hlsLiveRecordInfo.tsName,self.hlsLiveRecordInfo.duration,self.hlsLiveRecordInfo.seqNum)
+	tsitem.Discontinuity = self.hlsLiveRecordInfo.discontinuity
+	tsitem.Key = self.hlsLiveRecordInfo.keyInfo
+	tsitem.Cue = self.hlsLiveRecordInfo.fragCue
+	tsitem.StartTime = self.hlsLiveRecordInfo.fragStart
+	self.hlsLiveRecordInfo.fragCue = nil
+	if info, err := os.Stat(dstkey); err == nil {
+		tsitem.Size = info.Size()
+	}
+	self.hlsLiveRecordInfo.discontinuity = false
 	//写m3u8
-	self.hlsLiveRecordInfo.m3u8Box.SetItem(tsitem)
+	hlsLiveRecordRemoveExpired(self, self.hlsLiveRecordInfo.m3u8Box.SetItem(tsitem))
+	hlsLiveRecordWriteM3u8(self)
+	hlsLiveRecordCaption(self, tsitem)
+	hlsAbrUpdate(self)
+}
+
+//删除滑出窗口的 ts，vod 模式不会有过期分片
+func hlsLiveRecordRemoveExpired(self *Session,expired []*TSItem){
+	for _, item := range expired {
+		if err := os.Remove(self.UserCnf.RecodeHlsPath + item.Name); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		if item.Key != nil {
+			hlsLiveRecordRemoveKey(self, item.Key.URI)
+		}
+	}
+}
+
+func hlsLiveRecordWriteM3u8(self *Session){
 	b,err:=self.hlsLiveRecordInfo.m3u8Box.GenM3U8PlayList()
 	if err != nil{
 		fmt.Println(err)
@@ -158,10 +276,19 @@ func hlsLiveUpdateFragment(self *Session,stream av.CodecData,pkt *av.Packet,flus
 	cutting := 0
 	self.hlsLiveRecordInfo.duration =
 		float32(flvio.TimeToTs(pkt.Time - self.hlsLiveRecordInfo.lastTs))/(1000.0)
-	if float64(self.hlsLiveRecordInfo.duration) >
+	if len(self.hlsLiveRecordInfo.abrKey) > 0 {
+		//多码率按对齐的时间点切片
+		if hlsAbrNeedCut(self, pkt.Time) && boundary == 1 {
+			cutting = 1
+		}
+	} else if float64(self.hlsLiveRecordInfo.duration) >
 		(self.hlsLiveRecordInfo.HlsFragment)   && boundary == 1{
 		cutting = 1
 	}
+	//广告插入点在关键帧切片
+	if hlsLiveRecordCueCut(self, pkt) && boundary == 1 {
+		cutting = 1
+	}
 	//需要切割
 	if cutting == 1  {
 		hlsLiveRecordCloseFragment(self,stream,pkt)
@@ -220,13 +347,18 @@ func hlsAudioRecord(self *Session,stream av.CodecData,pkt *av.Packet){
 
 	//更新pts 只有缓存第一个音频时才需要更新pts（其他缓存的音频参考该pts）
 	self.hlsLiveRecordInfo.audioPts = uint64(pts)
-	codec := stream.(aacparser.CodecData)
-	if codec.SampleFormat() <=0{
+	codec, ok := stream.(av.AudioCodecData)
+	if !ok || codec.SampleRate() <=0{
+		return
+	}
+	//aac 1024 mp3 1152 个采样一帧
+	frameDur, err := codec.PacketDuration(pkt.Data[pkt.DataPos:])
+	if err != nil {
 		return
 	}
 
-	est_pts := self.hlsLiveRecordInfo.audioBaseTime + self.hlsLiveRecordInfo.aframeNum * 90000 * 1024 /
-		uint64(codec.SampleRate())
+	est_pts := self.hlsLiveRecordInfo.audioBaseTime + self.hlsLiveRecordInfo.aframeNum * 90000 * uint64(frameDur) /
+		uint64(time.Second)
 
 	//
 	dpts := int64(est_pts - pts)
@@ -249,21 +381,57 @@ func Exist(filename string) bool {
 	return err == nil || os.IsExist(err)
 }
 
-func MergM3u8(self *Session,fileName string) uint64{
+//重推时合并之前的 m3u8，新的分片前插入 EXT-X-DISCONTINUITY，返回新分片的序号
+func MergM3u8(self *Session,fileName string) (seqNum uint64, err error){
 	f, err := os.Open(fileName)
 	if err != nil {
-		panic(err)
+		return
 	}
-	p, _, err := m3u8.DecodeFrom(bufio.NewReader(f), true)
+	defer f.Close()
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(f), true)
 	if err != nil {
-		panic(err)
+		return
+	}
+	if listType != m3u8.MEDIA {
+		err = fmt.Errorf("%s","Rtmp.Hls.Merge.NotMediaPlaylist")
+		return
 	}
 	p0 := p.(*(m3u8.MediaPlaylist))
-	item:=p0.Segments[p0.Count()-1]
-	tsitem := NewTSItem(item.URI,  float32(item.Duration),p0.SeqNo +2)
-	//写m3u8
-	self.hlsLiveRecordInfo.m3u8Box.SetItem(tsitem)
-	return p0.SeqNo + 3
+	self.hlsLiveRecordInfo.m3u8Box.discSeq = p0.DiscontinuitySeq
+	var key *HlsKey
+	for i:=uint(0); i < p0.Count(); i++ {
+		item := p0.Segments[i]
+		tsitem := NewTSItem(item.URI, float32(item.Duration), p0.SeqNo + uint64(i))
+		tsitem.Discontinuity = item.Discontinuity
+		//EXT-X-KEY 只出现在变化的分片上，之后的分片沿用
+		if item.Key != nil {
+			key = nil
+			if item.Key.Method != "NONE" {
+				iv, _ := hex.DecodeString(strings.TrimPrefix(strings.ToLower(item.Key.IV), "0x"))
+				key = &HlsKey{Method: item.Key.Method, URI: item.Key.URI, IV: iv}
+			}
+		}
+		tsitem.Key = key
+		//写m3u8
+		hlsLiveRecordRemoveExpired(self, self.hlsLiveRecordInfo.m3u8Box.SetItem(tsitem))
+	}
+	self.hlsLiveRecordInfo.discontinuity = p0.Count() > 0
+	return p0.SeqNo + uint64(p0.Count()), nil
+}
+
+//data 消息，广告插入点切片，其他的写 id3
+func hlsLiveRecordData(self *Session,pkt *av.Packet) {
+	if self.hlsLiveRecordInfo.muxer == nil {
+		return
+	}
+	if cue := hlsCueParse(pkt.Data); cue != nil {
+		hlsLiveRecordCue(self, pkt, cue)
+		return
+	}
+	if self.hlsLiveRecordInfo.fragFailed {
+		return
+	}
+	hlsLiveRecordId3(self, pkt)
 }
 
 func hlsLiveRecord(self *Session,stream av.CodecData,pkt *av.Packet) {
@@ -271,18 +439,75 @@ func hlsLiveRecord(self *Session,stream av.CodecData,pkt *av.Packet) {
 	if self.UserCnf.RecodeHls != 1{
 		return
 	}
+	//data 消息
+	if pkt.PacketType == RtmpMsgAmfMeta {
+		hlsLiveRecordData(self, pkt)
+		return
+	}
+	if pkt.PacketType != RtmpMsgAudio && pkt.PacketType != RtmpMsgVideo {
+		return
+	}
+	//分片创建失败，丢弃数据直到下一个可以切片的关键帧
+	if self.hlsLiveRecordInfo.fragFailed {
+		if !hlsLiveRecordBoundary(self, pkt) {
+			return
+		}
+		if self.hlsLiveRecordInfo.muxer != nil {
+			hlsLiveRecordOpenFragment(self, stream, pkt)
+			if self.hlsLiveRecordInfo.fragFailed {
+				return
+			}
+		}
+	}
 	if self.hlsLiveRecordInfo.muxer == nil {
 		self.hlsLiveRecordInfo.audioCachedPkts = make([]*av.Packet,0,1024)
-		nowTime:=time.Now().UnixNano()/1000000
-		self.hlsLiveRecordInfo.tsBackFileName = fmt.Sprintf("%s%d.tsbak",self.UserCnf.RecodeHlsPath,nowTime)
-		self.hlsLiveRecordInfo.tsName = fmt.Sprintf("%d.ts",nowTime)
-		fmt.Println(self.hlsLiveRecordInfo.tsBackFileName)
-		f1, err := FileCreate(self.hlsLiveRecordInfo.tsBackFileName)
+		self.hlsLiveRecordInfo.m3u8BackFileName = fmt.Sprintf("%sindex.m3u8",self.UserCnf.RecodeHlsPath)
+		self.hlsLiveRecordInfo.m3u8Box = NewM3u8BoxWithType(self.StreamId,
+			strings.ToLower(self.UserCnf.HlsPlaylistType), self.UserCnf.HlsPlaylistLength,
+			float32(parseFragment(self.UserCnf.HlsDvrWindow, 0)))
+
+		self.hlsLiveRecordInfo.seqNum = uint64(time.Now().UnixNano()/1000000)
+		if hlsAbrOnRecord(self) {
+			self.hlsLiveRecordInfo.seqNum = hlsAbrSegmentIndex(self, pkt.Time)
+		}
+		if Exist(self.hlsLiveRecordInfo.m3u8BackFileName) == true{
+			if seqNum, err := MergM3u8(self,self.hlsLiveRecordInfo.m3u8BackFileName); err == nil {
+				self.hlsLiveRecordInfo.seqNum = seqNum
+			} else {
+				fmt.Printf("merge m3u8 file %s err the err is %s\n",self.hlsLiveRecordInfo.m3u8BackFileName,err.Error())
+			}
+		}
+
+		//g711 opus 等 ts 不支持的音频不写入
+		audioInTs := ts.IsCodecSupported(self.aCodec)
+		self.hlsLiveRecordInfo.keyMethod = hlsLiveRecordKeyMethod(self, audioInTs)
+		if self.hlsLiveRecordInfo.keyMethod != strings.ToUpper(self.UserCnf.HlsEncrypt) {
+			log.Log.Info(fmt.Sprintf("%s hls encrypt %s not supported by codec, use %s",
+				self.LogFormat(), self.UserCnf.HlsEncrypt, self.hlsLiveRecordInfo.keyMethod))
+		}
+		f1, err := hlsLiveRecordCreateFile(self)
 		if err != nil {
 			fmt.Printf("create ts file %s err the err is %s\n",self.hlsLiveRecordInfo.tsBackFileName,err.Error())
+			self.hlsLiveRecordInfo.fragFailed = true
+			return
 		}
+		self.hlsLiveRecordInfo.fragFailed = false
 		self.hlsLiveRecordInfo.muxer = ts.NewMuxer(f1)
-		self.hlsLiveRecordInfo.muxer.WriteHeader()
+		//pmt 中一直带 id3 流，播放端只在开始时解析 pmt
+		self.hlsLiveRecordInfo.muxer.ID3 = true
+		if err = hlsLiveRecordSetSampleAES(self); err != nil {
+			fmt.Printf("set sample aes %s err the err is %s\n",self.hlsLiveRecordInfo.tsBackFileName,err.Error())
+		}
+		var streams []av.CodecData
+		if audioInTs {
+			streams = append(streams, self.aCodec)
+		}
+		if self.vCodec != nil {
+			streams = append(streams, self.vCodec)
+		}
+		if err = self.hlsLiveRecordInfo.muxer.WriteHeader(streams); err != nil {
+			fmt.Printf("write ts header %s err the err is %s\n",self.hlsLiveRecordInfo.tsBackFileName,err.Error())
+		}
 
 		//self.hlsLiveRecordInfo.lasetTs = pkt.Time
 		if pkt.PacketType == RtmpMsgAudio {
@@ -291,19 +516,16 @@ func hlsLiveRecord(self *Session,stream av.CodecData,pkt *av.Packet) {
 			self.hlsLiveRecordInfo.lastVideoTs = pkt.Time
 		}
 		self.hlsLiveRecordInfo.lastTs =  pkt.Time
-		self.hlsLiveRecordInfo.m3u8BackFileName = fmt.Sprintf("%sindex.m3u8",self.UserCnf.RecodeHlsPath)
-		self.hlsLiveRecordInfo.m3u8Box = NewM3u8Box(self.StreamId)
-
-		if Exist(self.hlsLiveRecordInfo.m3u8BackFileName) == true{
-			self.hlsLiveRecordInfo.seqNum = MergM3u8(self,self.hlsLiveRecordInfo.m3u8BackFileName)
-		}else {
-			self.hlsLiveRecordInfo.seqNum = uint64(nowTime)
-		}
+		self.hlsLiveRecordInfo.fragStart = time.Now()
 	}
+	self.hlsLiveRecordInfo.lastPktTs = pkt.Time
 
 
 	switch pkt.PacketType {
 	case RtmpMsgAudio:
+		if !ts.IsCodecSupported(stream) {
+			return
+		}
 		hlsAudioRecord(self,stream,pkt)
 	case RtmpMsgVideo:
 		hlsVedioRecord(self,stream,pkt)
@@ -332,25 +554,3 @@ func m3u8Handler(w http.ResponseWriter, r *http.Request) {
 	pubSession := RtmpSessionGet(StreamAnchor)
 	fmt.Println(pubSession)
 }
-
-func tsHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.URL.Path)
-	//itmes:=strings.Split(r.URL.Path, ".flv")
-	host := r.Host
-	m, _ := url.ParseQuery(r.URL.RawQuery)
-	if len(m["vhost"]) > 0 {
-		host = m["vhost"][0]
-	}
-	if _, PlayOk := Gconfig.UserConf.PlayDomain[host]; PlayOk == false {
-		w.WriteHeader(404)
-	}
-
-	//hashPath:=itmes[0]
-	//fmt.Println(hashPath)
-	name := mux.Vars(r)["name"]
-	app := mux.Vars(r)["app"]
-	fmt.Println(name, app)
-	StreamAnchor := name + ":" + Gconfig.UserConf.PlayDomain[host].UniqueName + ":" + app
-	pubSession := RtmpSessionGet(StreamAnchor)
-	fmt.Println(pubSession)
-}
\ No newline at end of file
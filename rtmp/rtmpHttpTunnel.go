@@ -0,0 +1,343 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+/*
+rtmp over http，只能走 80/443 的客户端使用
+websocket: /rtmp/ws 每个 binary message 是一段 rtmp 字节流
+rtmpt: POST /open/1 返回 session id，/send/{id}/{seq} 上行数据，/idle/{id}/{seq} 轮询下行数据，/close/{id}/{seq} 关闭
+两种方式都包装成 net.Conn 交给 ServerSession，推流播放和 tcp 一样
+*/
+
+const (
+	rtmptContentType = "application/x-fcs"
+	//客户端多久没有请求认为断开
+	rtmptTimeout = 30 * time.Second
+	//轮询间隔，有数据时为 1，空闲时逐渐增加到 0x21
+	rtmptMinInterval = 0x01
+	rtmptMaxInterval = 0x21
+	//上下行缓存的最大字节数，上行超过时断开，下行超过时写阻塞到客户端轮询取走
+	rtmptMaxBuffer = 4 << 20
+)
+
+type tunnelAddr string
+
+func (self tunnelAddr) Network() string {
+	return "rtmpt"
+}
+
+func (self tunnelAddr) String() string {
+	return string(self)
+}
+
+//websocket 包装成 net.Conn
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (self *wsConn) Read(b []byte) (n int, err error) {
+	for {
+		if self.r == nil {
+			var typ int
+			if typ, self.r, err = self.Conn.NextReader(); err != nil {
+				return
+			}
+			if typ != websocket.BinaryMessage {
+				self.r = nil
+				continue
+			}
+		}
+		n, err = self.r.Read(b)
+		if err == io.EOF {
+			self.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (self *wsConn) Write(b []byte) (n int, err error) {
+	if err = self.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (self *wsConn) SetDeadline(t time.Time) error {
+	if err := self.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return self.Conn.SetWriteDeadline(t)
+}
+
+var rtmpWsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+var rtmpTunnelSeq uint64
+var rtmpTunnelSeqLock sync.Mutex
+
+func rtmpTunnelSessionId(prefix string) string {
+	rtmpTunnelSeqLock.Lock()
+	rtmpTunnelSeq++
+	id := fmt.Sprintf("%s-%d", prefix, rtmpTunnelSeq)
+	rtmpTunnelSeqLock.Unlock()
+	return id
+}
+
+func (self *Server) rtmpWsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := rtmpWsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("rtmp websocket upgrade err the err is %s\n", err.Error())
+		return
+	}
+	session := NewSsesion(&wsConn{Conn: conn})
+	session.SessionId = rtmpTunnelSessionId("ws")
+	session.RemoteAddr = r.RemoteAddr
+	session.isServer = true
+	self.rtmpServeSession(session)
+}
+
+//rtmpt 的 net.Conn，send 写入 in，idle send 的响应取走 out
+type rtmptConn struct {
+	id         string
+	lock       sync.Mutex
+	cond       *sync.Cond
+	in         bytes.Buffer
+	out        bytes.Buffer
+	closed     bool
+	interval   byte
+	lastActive time.Time
+	remote     tunnelAddr
+}
+
+var rtmptConns = struct {
+	sync.RWMutex
+	conns map[string]*rtmptConn
+}{conns: make(map[string]*rtmptConn)}
+
+func newRtmptConn(remote string) *rtmptConn {
+	b := make([]byte, 8)
+	io.ReadFull(rand.Reader, b)
+	conn := &rtmptConn{
+		id:         hex.EncodeToString(b),
+		interval:   rtmptMinInterval,
+		lastActive: time.Now(),
+		remote:     tunnelAddr(remote),
+	}
+	conn.cond = sync.NewCond(&conn.lock)
+	return conn
+}
+
+func (self *rtmptConn) Read(b []byte) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.in.Len() == 0 && !self.closed {
+		self.cond.Wait()
+	}
+	if self.in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return self.in.Read(b)
+}
+
+func (self *rtmptConn) Write(b []byte) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.out.Len() > 0 && self.out.Len()+len(b) > rtmptMaxBuffer && !self.closed {
+		self.cond.Wait()
+	}
+	if self.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return self.out.Write(b)
+}
+
+func (self *rtmptConn) Close() error {
+	self.lock.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *rtmptConn) LocalAddr() net.Addr {
+	return tunnelAddr("rtmpt")
+}
+
+func (self *rtmptConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+//轮询由客户端驱动，没有超时
+func (self *rtmptConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *rtmptConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *rtmptConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//上行数据交给 ServerSession
+func (self *rtmptConn) push(b []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return io.ErrClosedPipe
+	}
+	//ServerSession 读不过来
+	if self.in.Len()+len(b) > rtmptMaxBuffer {
+		self.closed = true
+		self.cond.Broadcast()
+		return fmt.Errorf("%s", "Rtmpt.Input.Buffer.Full")
+	}
+	self.lastActive = time.Now()
+	self.in.Write(b)
+	self.cond.Broadcast()
+	return nil
+}
+
+//响应: 1 字节轮询间隔 + 下行数据
+func (self *rtmptConn) pull() []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastActive = time.Now()
+	if self.out.Len() > 0 {
+		self.interval = rtmptMinInterval
+	} else if self.interval < rtmptMaxInterval {
+		self.interval++
+	}
+	b := make([]byte, 1+self.out.Len())
+	b[0] = self.interval
+	self.out.Read(b[1:])
+	//唤醒等待下行缓存的写
+	self.cond.Broadcast()
+	return b
+}
+
+//send 之后等一会 ServerSession 的响应，减少一次轮询
+func (self *rtmptConn) waitOutput(timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(2 * time.Millisecond) {
+		self.lock.Lock()
+		n := self.out.Len()
+		self.lock.Unlock()
+		if n > 0 {
+			return
+		}
+	}
+}
+
+func (self *rtmptConn) expired() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed || time.Since(self.lastActive) > rtmptTimeout
+}
+
+func rtmptGet(id string) *rtmptConn {
+	rtmptConns.RLock()
+	defer rtmptConns.RUnlock()
+	return rtmptConns.conns[id]
+}
+
+func rtmptDel(conn *rtmptConn) {
+	rtmptConns.Lock()
+	delete(rtmptConns.conns, conn.id)
+	rtmptConns.Unlock()
+	conn.Close()
+}
+
+func rtmptWrite(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", rtmptContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "Keep-Alive")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+//flash 先请求 /fcs/ident2，返回 404 后再 open
+func rtmptIdentHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(404)
+}
+
+func (self *Server) rtmptOpenHandler(w http.ResponseWriter, r *http.Request) {
+	conn := newRtmptConn(r.RemoteAddr)
+	rtmptConns.Lock()
+	rtmptConns.conns[conn.id] = conn
+	rtmptConns.Unlock()
+
+	session := NewSsesion(conn)
+	session.SessionId = "rtmpt-" + conn.id
+	session.RemoteAddr = r.RemoteAddr
+	session.isServer = true
+	go func() {
+		self.rtmpServeSession(session)
+		rtmptDel(conn)
+	}()
+	//客户端不再轮询时关闭
+	go func() {
+		for !conn.expired() {
+			time.Sleep(time.Second)
+		}
+		rtmptDel(conn)
+	}()
+	rtmptWrite(w, []byte(conn.id+"\n"))
+}
+
+func rtmptSendHandler(w http.ResponseWriter, r *http.Request) {
+	conn := rtmptGet(mux.Vars(r)["id"])
+	if conn == nil {
+		w.WriteHeader(404)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, rtmptMaxBuffer+1))
+	if err != nil || len(body) > rtmptMaxBuffer {
+		w.WriteHeader(400)
+		return
+	}
+	if err = conn.push(body); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	conn.waitOutput(20 * time.Millisecond)
+	rtmptWrite(w, conn.pull())
+}
+
+func rtmptIdleHandler(w http.ResponseWriter, r *http.Request) {
+	conn := rtmptGet(mux.Vars(r)["id"])
+	if conn == nil {
+		w.WriteHeader(404)
+		return
+	}
+	rtmptWrite(w, conn.pull())
+}
+
+func rtmptCloseHandler(w http.ResponseWriter, r *http.Request) {
+	if conn := rtmptGet(mux.Vars(r)["id"]); conn != nil {
+		rtmptDel(conn)
+	}
+	rtmptWrite(w, []byte{0})
+}
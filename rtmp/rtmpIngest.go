@@ -0,0 +1,219 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"time"
+)
+
+/*
+非 rtmp 协议推流 (http flv 等) 的公共部分
+创建一个没有 rtmp 握手的推流 session，域名 app 检查、注册、集群转推和录制都和 rtmp publish 一致
+数据转成 flv tag 后交给 RtmpMsgDecodeVideoHandler RtmpMsgDecodeAudioHandler，播放端感知不到区别
+*/
+
+type ingestAddr struct {
+	network string
+	addr    string
+}
+
+func (self ingestAddr) Network() string {
+	return self.network
+}
+
+func (self ingestAddr) String() string {
+	return self.addr
+}
+
+//只读的 net.Conn，session 关闭时关闭数据源
+type ingestConn struct {
+	io.ReadCloser
+	remote ingestAddr
+}
+
+func (self *ingestConn) Write(b []byte) (n int, err error) {
+	return 0, fmt.Errorf("%s", "Rtmp.Ingest.Conn.ReadOnly")
+}
+
+func (self *ingestConn) LocalAddr() net.Addr {
+	return ingestAddr{network: self.remote.network}
+}
+
+func (self *ingestConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+func (self *ingestConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *ingestConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *ingestConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//r 为数据源，session.bufr 从 r 读
+func newIngestSession(r io.ReadCloser, network, remoteAddr string) *Session {
+	session := NewSsesion(&ingestConn{ReadCloser: r, remote: ingestAddr{network: network, addr: remoteAddr}})
+	session.network = network
+	session.SessionId = rtmpTunnelSessionId(network)
+	session.RemoteAddr = remoteAddr
+	session.isServer = true
+	return session
+}
+
+//同 rtmp connect publish 的域名和 app 检查
+func (self *Session) ingestCheck(host, app, name string) (err error) {
+	domain, ok := Gconfig.UserConf.PublishDomain[host]
+	if !ok {
+		return fmt.Errorf("%s", "NetStream.Publish.IllegalDomain")
+	}
+	cnf, ok := domain.App[app]
+	if !ok {
+		return fmt.Errorf("%s", "NetStream.Connect.IllegalApplication")
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("%s", "NetStream.Publish.BadName")
+	}
+	if cnf != nil {
+		self.UserCnf = *cnf
+	}
+	self.uniqueName = domain.UniqueName
+	self.Vhost = host
+	self.App = app
+	self.StreamId = name
+	self.StreamAnchor = name + ":" + domain.UniqueName + ":" + app
+	return
+}
+
+//同 RtmpPublishCmdHandler 注册推流，流已存在时返回错误
+func (self *Session) ingestPublish() (err error) {
+	self.context, self.cancel = context.WithCancel(context.Background())
+	self.gopCacheCreate()
+	self.timeShift = newTimeShiftBuffer(&self.UserCnf)
+	if !RtmpSessionPush(self) {
+		self.cancel()
+		self.context = nil
+		log.Log.Info(fmt.Sprintf("%s %s client publish:%s desc:Already publishing",
+			self.LogFormat(), self.network, self.StreamAnchor))
+		return fmt.Errorf("%s", "NetStream.Publish.BadName")
+	}
+	self.RegisterChannel = make(chan *Session, MAXREGISTERCHANNEL)
+	self.publishing = true
+	self.recordTime = time.Now()
+	self.stage = stageCommandDone
+
+	if self.IsSelf = self.RtmpCheckStreamIsSelf(); self.IsSelf != true {
+		url1 := "rtmp://" + self.pushIp + "/" + self.App + "?" + "vhost=" + self.Vhost + "/" + self.StreamId + "?hashpull=1"
+		log.Log.Info(fmt.Sprintf("%s %s publish must hash push: push url:%s",
+			self.LogFormat(), self.network, url1))
+		go rtmpClientPullProxy(self, "tcp", self.pushIp, url1, stageSessionDone)
+	}
+	if self.IsSelf == true {
+		RecordPublishHandler(self)
+	}
+	log.Log.Info(fmt.Sprintf("%s %s publish ok! client addr:%s",
+		self.LogFormat(), self.network, self.RemoteAddr))
+	return
+}
+
+//ReadTag 去掉了 tag 头，还原成 rtmp 音视频消息体，点播发送也用
+func flvTagBody(tag flvio.Tag) []byte {
+	b := make([]byte, flvio.MaxTagSubHeaderLength+len(tag.Data))
+	n := tag.FillHeader(b)
+	if tag.Type == flvio.TAG_VIDEO && !(tag.FrameType == flvio.FRAME_INTER || tag.FrameType == flvio.FRAME_KEY) {
+		n = 1
+	}
+	n += copy(b[n:], tag.Data)
+	return b[:n]
+}
+
+//flv tag 交给 rtmp 的音视频和 metadata 处理
+func (self *Session) ingestWriteTag(tag flvio.Tag, ts int32) (err error) {
+	switch tag.Type {
+	case flvio.TAG_AUDIO, flvio.TAG_VIDEO:
+		b := flvTagBody(tag)
+		if tag.Type == flvio.TAG_AUDIO {
+			return RtmpMsgDecodeAudioHandler(self, uint32(ts), self.avmsgsid, RtmpMsgAudio, b)
+		}
+		return RtmpMsgDecodeVideoHandler(self, uint32(ts), self.avmsgsid, RtmpMsgVideo, b)
+	case flvio.TAG_SCRIPTDATA:
+		//onMetaData 或者 @setDataFrame
+		return RtmpMsgAmfHandler(self, uint32(ts), self.avmsgsid, RtmpMsgAmfMeta, tag.Data)
+	}
+	return
+}
+
+//读 flv 文件头，http flv 推流和拉流共用
+func (self *Session) ingestFlvHeader() (err error) {
+	b := make([]byte, flvio.FileHeaderLength)
+	if _, err = io.ReadFull(self.bufr, b); err != nil {
+		return
+	}
+	var skip int
+	if _, skip, err = flvio.ParseFileHeader(b); err != nil {
+		return
+	}
+	_, err = io.CopyN(ioutil.Discard, self.bufr, int64(skip))
+	return
+}
+
+//读 flv tag 写入推流直到出错，正常结束返回 io.EOF
+func (self *Session) ingestFlvTags() (err error) {
+	b := make([]byte, flvio.TagHeaderLength+flvio.FileHeaderLength)
+	for {
+		var tag flvio.Tag
+		var ts int32
+		if tag, ts, err = flvio.ReadTag(self.bufr, b); err != nil {
+			return
+		}
+		if err = self.ingestWriteTag(tag, ts); err != nil {
+			return
+		}
+	}
+}
+
+//rtp 等解包出的一组音视频写入推流，codec 新出现或者更新时先写 sequence header，rtsp webrtc 共用
+//offset 为这一路相对推流开始的时间
+func (self *Session) ingestWritePackets(codec av.CodecData, codecChanged bool, pkts []av.Packet, offset time.Duration) (err error) {
+	if codecChanged {
+		if tag, ok, err1 := flv.CodecDataToTag(codec); err1 == nil && ok {
+			var ts int32
+			if len(pkts) > 0 {
+				ts = flvio.TimeToTs(pkts[0].Time + offset)
+			}
+			if err = self.ingestWriteTag(*tag, ts); err != nil {
+				return
+			}
+		}
+	}
+	for _, pkt := range pkts {
+		pkt.Time += offset
+		tag, ts := flv.PacketToTag(pkt, codec)
+		if err = self.ingestWriteTag(tag, ts); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//断流，同 rtmp 推流断开
+func (self *Session) ingestClose() {
+	if self.publishing {
+		self.rtmpCloseSessionHanler()
+		log.Log.Info(fmt.Sprintf("%s %s publish done", self.LogFormat(), self.network))
+		return
+	}
+	self.isClosed = true
+	self.netconn.Close()
+}
@@ -23,8 +23,9 @@ func (self *Session)rtmpClosePublishingSession(){
 	self.isClosed = true
 	var next *list.Element
 	if self.CursorList != nil {
-		CursorList := self.CursorList.GetList()
 		self.ReadRegister()
+		self.CursorList.Lock()
+		CursorList := self.CursorList.GetList()
 		//free play session
 		for e := CursorList.Front(); e != nil; {
 			switch value1 := e.Value.(type) {
@@ -38,6 +39,7 @@ func (self *Session)rtmpClosePublishingSession(){
 				e = next
 			}
 		}
+		self.CursorList.Unlock()
 	}
 	//close other thing
 	//recode
@@ -48,7 +50,7 @@ func (self *Session)rtmpClosePublishingSession(){
 	//hls
 	//flv
 	//other things
-	self.CursorList = nil
+	//拉流的空闲检查可能还在数播放端，不置空
 	if self.QuicOn == true{
 		self.QuicConn.Close()
 	}else{
@@ -169,7 +171,14 @@ func (self *Session) RtmpSendAvPackets() (err error) {
 			return
 		}
 
+		//读协程收到的字节在这里回 ack
+		if err = self.rtmpAckSend(); err != nil {
+			return
+		}
 		if pkt != nil {
+			if err = self.rtmpAckThrottle(); err != nil {
+				return
+			}
 			if err = self.writeAVPacket(pkt); err != nil {
 				return
 			}
@@ -188,6 +197,7 @@ func (self *Session) ServerSession(stage int) (err error) {
 				self.netconn.Close()
 				return
 			}
+			self.outBytes = 0
 			log.Log.Info(self.LogFormat() + "rtmp handshake done")
 		case stageHandshakeDone:
 			log.Log.Info(self.LogFormat() + "rtmp cmd Msg Cycle")
@@ -205,6 +215,12 @@ func (self *Session) ServerSession(stage int) (err error) {
 				log.Log.Info(self.LogFormat() + "rtmp publish client read msg cycle err:" + err.Error())
 				self.stage = stageSessionDone
 				continue
+			} else if self.playing && self.vod != nil {
+				//录制文件点播
+				err = self.vodPlay()
+				self.isClosed = true
+				self.stage = stageSessionDone
+				continue
 			} else if self.playing {
 				pubSession:= RtmpSessionGet(self.StreamAnchor)
 				if pubSession != nil {
@@ -232,17 +248,33 @@ func (self *Session) ServerSession(stage int) (err error) {
 					pubSession.RUnlock()
 
 					self.context, self.cancel = pubSession.context, pubSession.cancel
-					//send audio,video head and meta
-					if err = self.rtmpSendHead(); err != nil {
-						self.isClosed = true
-						return err
+					//时移播放发时移点的头，从时移缓存开始
+					if self.timeShiftOpen() {
+						if err = self.rtmpSendTimeShiftHead(); err != nil {
+							self.isClosed = true
+							return err
+						}
+					} else {
+						//send audio,video head and meta
+						if err = self.rtmpSendHead(); err != nil {
+							self.isClosed = true
+							return err
+						}
+						//send gop for first screen
+						if err = self.rtmpSendGop(); err != nil {
+							self.isClosed = true
+							return err
+						}
 					}
-					//send gop for first screen
-					if err = self.rtmpSendGop(); err != nil {
-						self.isClosed = true
-						return err
+					//时移播放等待时靠读协程发现断开
+					if playAckTimeout > 0 || self.shiftCursor != nil {
+						self.rtmpCtrlReadStart()
+					}
+					if self.shiftCursor != nil {
+						err = self.rtmpSendTimeShift()
+					} else {
+						err = self.RtmpSendAvPackets()
 					}
-					err = self.RtmpSendAvPackets()
 					self.isClosed = true
 					self.stage = stageSessionDone
 				} else {
@@ -255,6 +287,10 @@ func (self *Session) ServerSession(stage int) (err error) {
 						if playTimes == 5 {
 							self.stage++
 						}
+					}else if playTimes < 10 && sourcePullOnDemand(self.Vhost,self.App,self.StreamId) {
+						//外部拉流还没连上
+						time.Sleep(1*time.Second)
+						playTimes++
 					}else{
 						self.stage++
 					}
@@ -1,9 +1,10 @@
 package rtmp
 
+/* SetPeerBandwidth limit type */
 const (
-	RtmpLimitSoft    = 0
-	RtmpLimitHard    = 1
-	RtmpLimiTDynamic = 2 //only user this
+	RtmpLimitHard    = 0
+	RtmpLimitSoft    = 1
+	RtmpLimitDynamic = 2
 )
 const (
 	RtmpMsgChunkSize = 1
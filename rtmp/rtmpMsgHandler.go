@@ -5,6 +5,7 @@ import (
 	"rtmpServerStudy/utils/bits/pio"
 	"rtmpServerStudy/amf"
 	"rtmpServerStudy/log"
+	"sync/atomic"
 )
 
 // recv peer set chunk  size
@@ -51,6 +52,18 @@ func (self *Session) writeRtmpMsgAbort(msgsid uint32) (err error) {
 
 func RtmpMsgAckHanldler(session *Session, timestamp uint32,
 	msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+	msgLen := len(msgdata)
+	if msgLen < 4 {
+		err = fmt.Errorf("rtmp: short packet of Ack the len:%d", msgLen)
+		return
+	}
+	//对端收到的累计字节数，发送协程按这个流控
+	atomic.StoreUint32(&session.peerAckSeq, pio.U32BE(msgdata))
+	atomic.StoreInt32(&session.peerAcked, 1)
+	select {
+	case session.ackNotify <- true:
+	default:
+	}
 	return
 }
 
@@ -99,7 +112,7 @@ func RtmpMsgAckSizeHandler(session *Session, timestamp uint32,
 		err = fmt.Errorf("rtmp: short packet of SetChunkSize the len:%d", msgLen)
 		return
 	}
-	session.readAckSize= pio.U32BE(msgdata)
+	atomic.StoreUint32(&session.readAckSize, pio.U32BE(msgdata))
 	/*if session.readAckSize != readAckSize {
 		if err = session.writeWindowAckSize(0xffffffff); err != nil {
 			return
@@ -115,6 +128,7 @@ func (self *Session) writeWindowAckSize(size uint32) (err error) {
 	pio.PutU32BE(b[n:], size)
 	n += 4
 	_, err = self.bufw.Write(b[:n])
+	self.writeAckSize = size
 	return
 }
 
@@ -136,7 +150,42 @@ func RtmpMsgBandwidthHandler(session *Session, timestamp uint32,
 		err = fmt.Errorf("rtmp: short packet of BandWidthHandler the len:%d", msgLen)
 		return
 	}
-
+	size, limit := pio.U32BE(msgdata), msgdata[4]
+	last := atomic.LoadUint32(&session.peerBandwidth)
+	switch limit {
+	case RtmpLimitHard:
+	case RtmpLimitSoft:
+		//取较小的
+		if last != 0 && last < size {
+			size = last
+		}
+	case RtmpLimitDynamic:
+		//上一次是 hard 时按 hard 处理，否则忽略
+		if atomic.LoadUint32(&session.peerLimitType) != RtmpLimitHard || last == 0 {
+			return
+		}
+		limit = RtmpLimitHard
+	default:
+		return
+	}
+	atomic.StoreUint32(&session.peerBandwidth, size)
+	atomic.StoreUint32(&session.peerLimitType, uint32(limit))
+	//读协程不写，交给发送协程回
+	if session.ctrlRead {
+		atomic.StoreUint32(&session.peerWindowAck, size)
+		select {
+		case session.ackNotify <- true:
+		default:
+		}
+		return
+	}
+	//窗口和上次发给对端的不同时回 WindowAckSize
+	if size != session.writeAckSize {
+		if err = session.writeWindowAckSize(size); err != nil {
+			return
+		}
+		err = session.flushWrite()
+	}
 	return
 }
 
@@ -194,6 +243,10 @@ func RtmpMsgAmf3Handler(session *Session, timestamp uint32,
 		return
 	}
 
+	//amf3 data 消息第一个字节之后是 amf0
+	if msgtypeid == RtmpMsgAmf3Meta && session.rtmpDataMsgForward(timestamp, msgdata[1:]) {
+		return
+	}
 	// skip first byte
 	if _, err = session.handleCommandMsgAMF0(msgdata[1:],session.rtmpCmdHandler); err != nil {
 		return
@@ -205,6 +258,9 @@ func RtmpMsgAmfHandler(session *Session, timestamp uint32,
 	msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
 	/* AMF command names come with string type, but shared object names
 	 * come without type */
+	if msgtypeid == RtmpMsgAmfMeta && session.rtmpDataMsgForward(timestamp, msgdata) {
+		return
+	}
 	if _, err = session.handleCommandMsgAMF0(msgdata,session.rtmpCmdHandler); err != nil {
 		return
 	}
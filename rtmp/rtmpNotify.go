@@ -0,0 +1,46 @@
+package rtmp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+	"rtmpServerStudy/log"
+)
+
+const (
+	NotifyTimeOut = 5
+)
+
+var notifyClient = &http.Client{Timeout: NotifyTimeOut * time.Second}
+
+//http 回调 参考 nginx rtmp 的 on_xxx 通知，post form 表单
+//call=record_done&app=live&name=123&vhost=test.uplive.com&...
+func rtmpNotify(notifyUrl string, call string, self *Session, values url.Values) {
+
+	if len(notifyUrl) == 0 {
+		return
+	}
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("call", call)
+	values.Set("app", self.App)
+	values.Set("name", self.StreamId)
+	values.Set("vhost", self.Vhost)
+	values.Set("addr", self.RemoteAddr)
+	values.Set("clientid", self.SessionId)
+
+	//不阻塞推流
+	go func() {
+		resp, err := notifyClient.PostForm(notifyUrl, values)
+		if err != nil {
+			log.Log.Info(fmt.Sprintf("%s notify %s to %s err:%s",
+				self.LogFormat(), call, notifyUrl, err.Error()))
+			return
+		}
+		resp.Body.Close()
+		log.Log.Info(fmt.Sprintf("%s notify %s to %s status:%d",
+			self.LogFormat(), call, notifyUrl, resp.StatusCode))
+	}()
+}
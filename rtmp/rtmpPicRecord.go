@@ -0,0 +1,159 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/log"
+	"time"
+)
+
+/*
+关键帧截图，app 配置 RecodePicture: 1 时每隔 RecidePicFragment 保存一个关键帧
+RecodePicPath/uniquename/app/stream/毫秒时间_流时间戳.h264 是带 vps sps pps 的 annex-b，可以直接用 ffmpeg 解码成图片
+同名的 .flv 是只有这一帧的 flv
+*/
+
+//RecidePicFragment 没有配置时的截图间隔，秒
+const picRecordFragment = 10
+
+var annexbStartCode = []byte{0, 0, 0, 1}
+
+type picRecordInfo struct {
+	picPath     string
+	picFragment float64
+	//上一次截图的时间戳
+	lastTs time.Duration
+	saved  bool
+}
+
+//截图初始化目录
+func picRecordOnPublish(self *Session) {
+
+	if self.UserCnf.RecodePicture != 1 {
+		return
+	}
+
+	picPath := self.UserCnf.RecodePicPath
+	if len(picPath) == 0 {
+		picPath = BasePath + "/pic/"
+	}
+
+	if picPath[len(picPath)-1] != '/' {
+		picPath = picPath + "/"
+	}
+
+	// /data/pic/test/app/stream/
+	self.picRecordInfo.picPath = fmt.Sprintf("%s%s/%s/%s/", picPath, self.uniqueName, self.App, self.StreamId)
+	if err := os.MkdirAll(self.picRecordInfo.picPath, 0755); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		self.picRecordInfo.picPath = ""
+		return
+	}
+	self.picRecordInfo.picFragment = parseFragment(self.UserCnf.RecidePicFragment, picRecordFragment)
+	self.picRecordInfo.saved = false
+	return
+}
+
+//参数集加上关键帧的 nalu，都用 00 00 00 01 分隔
+func picAnnexB(stream av.CodecData, pkt *av.Packet) (b []byte, ok bool) {
+	var params [][]byte
+	switch codec := stream.(type) {
+	case h264parser.CodecData:
+		params = [][]byte{codec.SPS(), codec.PPS()}
+	case h265parser.CodecData:
+		params = [][]byte{codec.VPS(), codec.SPS(), codec.PPS()}
+	default:
+		return
+	}
+	nalus, _ := h264parser.SplitNALUs(pkt.Data[pkt.DataPos:])
+	if len(nalus) == 0 {
+		return
+	}
+	w := bytes.NewBuffer(nil)
+	for _, nalu := range append(params, nalus...) {
+		if len(nalu) == 0 {
+			continue
+		}
+		w.Write(annexbStartCode)
+		w.Write(nalu)
+	}
+	return w.Bytes(), true
+}
+
+//flv 头 sequence header 和这一个关键帧，时间戳为 0
+func picFlv(stream av.CodecData, metaData amf.AMFMap, pkt *av.Packet) (b []byte, err error) {
+	w := bytes.NewBuffer(nil)
+	muxer := flv.NewMuxer(w)
+	if err = muxer.WriteHeader([]av.CodecData{stream}, metaData); err != nil {
+		return
+	}
+	tag, _ := PacketToTag(pkt)
+	if err = flvio.WriteTag(muxer.GetMuxerWrite(), tag, 0, muxer.B); err != nil {
+		return
+	}
+	if err = muxer.GetMuxerWrite().Flush(); err != nil {
+		return
+	}
+	return w.Bytes(), nil
+}
+
+func (self *Session) picRecordSave(pkt *av.Packet) (err error) {
+	annexb, ok := picAnnexB(self.vCodec, pkt)
+	if !ok {
+		return
+	}
+	var flvData []byte
+	if flvData, err = picFlv(self.vCodec, self.metaData, pkt); err != nil {
+		return
+	}
+	name := fmt.Sprintf("%s%d_%d", self.picRecordInfo.picPath, time.Now().UnixNano()/1000000, flvio.TimeToTs(pkt.Time))
+	if err = ioutil.WriteFile(name+".h264", annexb, 0644); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(name+".flv", flvData, 0644); err != nil {
+		return
+	}
+	log.Log.Info(fmt.Sprintf("%s save keyframe picture %s.h264", self.LogFormat(), name))
+	return
+}
+
+func picRecord(self *Session, stream av.CodecData, pkt *av.Packet) {
+
+	if self.UserCnf.RecodePicture != 1 {
+		return
+	}
+	if len(self.picRecordInfo.picPath) == 0 || self.vCodec == nil {
+		return
+	}
+	if pkt.PacketType != RtmpMsgVideo || !pkt.IsKeyFrame {
+		return
+	}
+	info := &self.picRecordInfo
+	//时间戳回退时重新计时
+	if info.saved && pkt.Time >= info.lastTs &&
+		float64(flvio.TimeToTs(pkt.Time-info.lastTs))/1000.0 < info.picFragment {
+		return
+	}
+	if err := self.picRecordSave(pkt); err != nil {
+		fmt.Printf("save picture %s err the err is %s\n", info.picPath, err.Error())
+		return
+	}
+	info.lastTs = pkt.Time
+	info.saved = true
+	return
+}
+
+func picRecordOnPublishDone(self *Session) {
+	if self.UserCnf.RecodePicture != 1 {
+		return
+	}
+	self.picRecordInfo.saved = false
+}
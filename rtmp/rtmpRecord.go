@@ -5,6 +5,7 @@ import (
 	//"net/url"
 	"io"
 	"os"
+	"strconv"
 )
 
 const(
@@ -57,20 +58,47 @@ func FileCreate(uri string) (w io.WriteCloser, err error) {
 	return
 }
 
+//解析配置中的切片时长 "5s" "10m" "1h"，单位秒，没有配置或非法时返回默认值
+func parseFragment(fragment string, def float64) float64 {
+	timeLen := len(fragment)
+	if timeLen == 0 {
+		return def
+	}
+	unit := 1.0
+	switch fragment[timeLen-1] {
+	case 's':
+		timeLen--
+	case 'm':
+		timeLen--
+		unit = 60
+	case 'h':
+		timeLen--
+		unit = 3600
+	}
+	value, err := strconv.ParseFloat(fragment[:timeLen], 64)
+	if err != nil || value < 0 {
+		return def
+	}
+	return value * unit
+}
+
 func init(){
 	//
 
 	RecordOnPublishs = append(RecordOnPublishs,hlsLiveRecordOnPublish)
 	RecordOnPublishs = append(RecordOnPublishs,flvRecordOnPublish)
+	RecordOnPublishs = append(RecordOnPublishs,picRecordOnPublish)
 
 	//
 	Records = append(Records,hlsLiveRecord)
 	Records = append(Records,flvRecord)
+	Records = append(Records,picRecord)
 
 	//
 	RecordOnPublishDones = append(RecordOnPublishDones,hlsLiveRecordOnPublishDone)
 	RecordOnPublishDones = append(RecordOnPublishDones,hlsRecordOnPublishDone)
 	RecordOnPublishDones = append(RecordOnPublishDones,flvRecordOnPublishDone)
+	RecordOnPublishDones = append(RecordOnPublishDones,picRecordOnPublishDone)
 }
 
 
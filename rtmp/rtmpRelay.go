@@ -9,7 +9,6 @@ import (
 	"runtime"
 	//"github.com/aws/aws-sdk-go/aws/session"
 	"context"
-	"rtmpServerStudy/AvQue"
 )
 
 func rtmpClientRelayProxy(network,host,vhost,App,streamId,desUrl string,stage int) (err error) {
@@ -90,6 +89,26 @@ func rtmpClientRelayProxy(network,host,vhost,App,streamId,desUrl string,stage in
 }
 
 func (self *Session) connectPlay() (err error) {
+	if err = self.rtmpClientPlay(); err != nil {
+		return
+	}
+	self.StreamAnchor = self.StreamId + ":" + Gconfig.UserConf.PlayDomain[self.Vhost].UniqueName + ":" + self.App
+	self.context, self.cancel = context.WithCancel(context.Background())
+	self.gopCacheCreate()
+	self.timeShift = newTimeShiftBuffer(&self.UserCnf)
+	self.RegisterChannel = make(chan *Session, MAXREGISTERCHANNEL)
+	ok := RtmpSessionPush(self)
+	if !ok {
+		err = fmt.Errorf("Stream.Already.Publishing")
+		return
+	}
+	self.publishing = true
+	err = self.rtmpReadMsgCycle()
+	return err
+}
+
+//connect createStream play，成功之后读到的就是音视频，中转和外部拉流共用
+func (self *Session) rtmpClientPlay() (err error) {
 	//write connect
 	connectpath, playpath := SplitPath(self.URL)
 	fmt.Println(playpath)
@@ -161,18 +180,7 @@ func (self *Session) connectPlay() (err error) {
 		err = fmt.Errorf("NetConnection.Play.Err")
 		return
 	}
-	self.StreamAnchor = self.StreamId + ":" + Gconfig.UserConf.PlayDomain[self.Vhost].UniqueName + ":" + self.App
-	self.context, self.cancel = context.WithCancel(context.Background())
-	self.GopCache = AvQue.RingBufferCreate(8)
-	self.RegisterChannel = make(chan *Session, MAXREGISTERCHANNEL)
-	ok := RtmpSessionPush(self)
-	if !ok {
-		err = fmt.Errorf("Stream.Already.Publishing")
-		return
-	}
-	self.publishing = true
-	err = self.rtmpReadMsgCycle()
-	return err
+	return
 }
 
 func (self *Session) writeConnect(path string) (err error) {
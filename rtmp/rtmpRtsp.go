@@ -0,0 +1,577 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/rtsp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+rtsp 服务，地址 rtsp://host:554/app/name?vhost=xxx
+ANNOUNCE/SETUP/RECORD 推流: rtp 解包成 av.Packet，转成 flv tag 后按普通推流处理，支持 tcp interleaved 和 udp
+DESCRIBE/SETUP/PLAY 播放: 从推流的 gop 缓存和 CursorList 取数据，打包成 rtp 发送
+只支持 h264 h265 aac，没有 rtcp，各路 track 按第一个 rtp 包到达的时间对齐
+*/
+
+const (
+	rtspReadTimeout    = 60 * time.Second
+	rtspSessionTimeout = 60
+	rtspPublic         = "OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER, SET_PARAMETER"
+)
+
+type rtspTrack struct {
+	media     *rtsp.Media
+	transport rtsp.Transport
+	//udp
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	clientAddr *net.UDPAddr
+
+	depacketizer *rtsp.Depacketizer
+	//已经发送的 sequence header 对应的 codec 版本
+	codecVersion int
+	packetizer   *rtsp.Packetizer
+	//第一个 rtp 包到达时距推流开始的时间，加到这路的时间戳上
+	started bool
+	offset  time.Duration
+}
+
+type rtspConn struct {
+	conn      net.Conn
+	bufr      *bufio.Reader
+	wlock     sync.Mutex
+	sessionId string
+	remote    string
+
+	host, app, name string
+	medias          []*rtsp.Media
+	tracks          []*rtspTrack
+
+	//推流和播放的 session
+	publish    *Session
+	play       *Session
+	ingestLock sync.Mutex
+	//第一个 rtp 包到达的时间，各路 track 共用
+	start time.Time
+	//teardown 和收包在不同协程，原子读写
+	closed int32
+}
+
+func (self *Server) rtspServeStart(addr string) (err error) {
+	defer func() {
+		self.done <- false
+	}()
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		log.Log.Error("rtsp server listen err the addr: "+addr, zap.String("errMsg", err.Error()))
+		return
+	}
+	log.Log.Info("the rtsp server listening on :" + addr)
+	for {
+		var conn net.Conn
+		if conn, err = listener.Accept(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Log.Error("rtsp server accept err", zap.String("errMsg", err.Error()))
+			return
+		}
+		go rtspServeConn(conn)
+	}
+}
+
+func rtspServeConn(conn net.Conn) {
+	self := &rtspConn{
+		conn:   conn,
+		bufr:   bufio.NewReaderSize(conn, 65536),
+		remote: conn.RemoteAddr().String(),
+	}
+	defer self.close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+		req, frame, err := rtsp.ReadMessage(self.bufr)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("rtsp conn %s read err the err is %s\n", self.remote, err.Error())
+			}
+			return
+		}
+		if frame != nil {
+			//tcp interleaved，偶数 channel 为 rtp
+			if err = self.onInterleaved(frame); err != nil {
+				fmt.Printf("rtsp conn %s rtp err the err is %s\n", self.remote, err.Error())
+				return
+			}
+			continue
+		}
+		res := self.handle(req)
+		self.wlock.Lock()
+		err = rtsp.WriteResponse(conn, res)
+		self.wlock.Unlock()
+		if err != nil || req.Method == "TEARDOWN" {
+			return
+		}
+		//响应之后开始发送
+		if req.Method == "PLAY" && res.StatusCode == 200 && self.play != nil {
+			go self.playLoop(self.play)
+		}
+	}
+}
+
+func (self *rtspConn) close() {
+	atomic.StoreInt32(&self.closed, 1)
+	if self.play != nil {
+		self.play.isClosed = true
+		select {
+		case self.play.PacketAck <- true:
+		default:
+		}
+	}
+	for _, track := range self.tracks {
+		if track != nil && track.rtpConn != nil {
+			track.rtpConn.Close()
+			track.rtcpConn.Close()
+		}
+	}
+	if self.publish != nil {
+		self.ingestLock.Lock()
+		self.publish.ingestClose()
+		self.ingestLock.Unlock()
+		return
+	}
+	self.conn.Close()
+}
+
+func rtspError(req *rtsp.Request, code int, reason string, err error) *rtsp.Response {
+	fmt.Printf("rtsp %s %s err the err is %s\n", req.Method, req.URL.String(), err.Error())
+	return rtsp.NewResponse(req, code, reason)
+}
+
+func (self *rtspConn) handle(req *rtsp.Request) (res *rtsp.Response) {
+	switch req.Method {
+	case "OPTIONS":
+		res = rtsp.NewResponse(req, 200, "OK")
+		res.Header.Set("Public", rtspPublic)
+	case "DESCRIBE":
+		res = self.onDescribe(req)
+	case "ANNOUNCE":
+		res = self.onAnnounce(req)
+	case "SETUP":
+		res = self.onSetup(req)
+	case "PLAY":
+		res = self.onPlay(req)
+	case "RECORD":
+		res = self.onRecord(req)
+	case "TEARDOWN", "GET_PARAMETER", "SET_PARAMETER":
+		res = rtsp.NewResponse(req, 200, "OK")
+	default:
+		res = rtsp.NewResponse(req, 501, "Not Implemented")
+	}
+	if len(self.sessionId) > 0 {
+		res.Header.Set("Session", fmt.Sprintf("%s;timeout=%d", self.sessionId, rtspSessionTimeout))
+	}
+	return
+}
+
+//rtsp://host/app/name/trackID=0?vhost=xxx
+func rtspParseUrl(u *url.URL) (host, app, name string, err error) {
+	host = u.Hostname()
+	if vhost := u.Query().Get("vhost"); len(vhost) > 0 {
+		host = vhost
+	}
+	items := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(items) < 2 || len(items[0]) == 0 || len(items[1]) == 0 {
+		err = fmt.Errorf("%s", "Rtsp.Url.Path.Invalid")
+		return
+	}
+	return host, items[0], items[1], nil
+}
+
+func (self *rtspConn) onDescribe(req *rtsp.Request) *rtsp.Response {
+	host, app, name, err := rtspParseUrl(req.URL)
+	if err != nil {
+		return rtspError(req, 400, "Bad Request", err)
+	}
+	domain, ok := Gconfig.UserConf.PlayDomain[host]
+	if !ok {
+		return rtspError(req, 404, "Not Found", fmt.Errorf("%s", "NetStream.Play.IllegalDomain"))
+	}
+	//同 rtmp connect 的 app 检查
+	if _, ok = domain.App[app]; !ok {
+		return rtspError(req, 404, "Not Found", fmt.Errorf("%s", "NetStream.Connect.IllegalApplication"))
+	}
+	anchor := name + ":" + domain.UniqueName + ":" + app
+	pubSession := RtmpSessionGet(anchor)
+	if pubSession == nil {
+		pubSession = sourcePullWait(host, app, name, anchor, sourcePullWaitTimeout)
+	}
+	if pubSession == nil {
+		return rtspError(req, 404, "Not Found", fmt.Errorf("%s", "NetStream.Play.StreamNotFound"))
+	}
+	pubSession.RLock()
+	codecs := []av.CodecData{pubSession.vCodec, pubSession.aCodec}
+	pubSession.RUnlock()
+
+	self.host, self.app, self.name = host, app, name
+	self.medias = nil
+	for _, codec := range codecs {
+		if rtsp.CodecSupported(codec) {
+			self.medias = append(self.medias, rtsp.NewMedia(codec, fmt.Sprintf("trackID=%d", len(self.medias))))
+		}
+	}
+	if len(self.medias) == 0 {
+		return rtspError(req, 415, "Unsupported Media Type", fmt.Errorf("%s", "Rtsp.Codec.Unsupported"))
+	}
+	self.tracks = make([]*rtspTrack, len(self.medias))
+
+	res := rtsp.NewResponse(req, 200, "OK")
+	res.Header.Set("Content-Type", "application/sdp")
+	base := *req.URL
+	base.RawQuery = ""
+	res.Header.Set("Content-Base", strings.TrimSuffix(base.String(), "/")+"/")
+	local, _, _ := net.SplitHostPort(self.conn.LocalAddr().String())
+	res.Body = rtsp.BuildSDP(name, local, self.medias)
+	return res
+}
+
+func (self *rtspConn) onAnnounce(req *rtsp.Request) *rtsp.Response {
+	if self.publish != nil || self.play != nil {
+		return rtspError(req, 455, "Method Not Valid in This State", fmt.Errorf("%s", "Rtsp.Announce.Again"))
+	}
+	host, app, name, err := rtspParseUrl(req.URL)
+	if err != nil {
+		return rtspError(req, 400, "Bad Request", err)
+	}
+	medias, err := rtsp.ParseSDP(req.Body)
+	if err != nil {
+		return rtspError(req, 400, "Bad Request", err)
+	}
+	session := newIngestSession(self.conn, "rtsp", self.remote)
+	if err = session.ingestCheck(host, app, name); err != nil {
+		return rtspError(req, 403, "Forbidden", err)
+	}
+	//不支持的 track 不 SETUP
+	self.medias = nil
+	for _, media := range medias {
+		switch media.Encoding {
+		case "H264", "H265", "MPEG4-GENERIC":
+			self.medias = append(self.medias, media)
+		}
+	}
+	if len(self.medias) == 0 {
+		return rtspError(req, 415, "Unsupported Media Type", fmt.Errorf("%s", "Rtsp.Codec.Unsupported"))
+	}
+	self.tracks = make([]*rtspTrack, len(self.medias))
+	self.host, self.app, self.name = host, app, name
+	self.publish = session
+	return rtsp.NewResponse(req, 200, "OK")
+}
+
+//SETUP 的 url 以 sdp 中的 control 结尾
+func (self *rtspConn) trackIndex(u *url.URL) int {
+	for i, media := range self.medias {
+		control := media.Control
+		if strings.HasPrefix(control, "rtsp://") {
+			if cu, err := url.Parse(control); err == nil && cu.Path == u.Path {
+				return i
+			}
+			continue
+		}
+		if len(control) > 0 && control != "*" && strings.HasSuffix(u.Path, "/"+control) {
+			return i
+		}
+	}
+	if len(self.medias) == 1 {
+		return 0
+	}
+	return -1
+}
+
+//rtp rtcp 端口，rtp 为偶数
+func rtspListenUdpPair() (rtpConn, rtcpConn *net.UDPConn, err error) {
+	for i := 0; i < 10; i++ {
+		if rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return
+			}
+		}
+		rtpConn.Close()
+	}
+	err = fmt.Errorf("%s", "Rtsp.Udp.Port.Unavailable")
+	return
+}
+
+func (self *rtspConn) onSetup(req *rtsp.Request) *rtsp.Response {
+	i := self.trackIndex(req.URL)
+	if i < 0 || self.tracks[i] != nil {
+		return rtspError(req, 404, "Not Found", fmt.Errorf("%s", "Rtsp.Setup.Track.NotFound"))
+	}
+	transport, err := rtsp.ParseTransport(req.Header.Get("Transport"))
+	if err != nil {
+		return rtspError(req, 461, "Unsupported Transport", err)
+	}
+	track := &rtspTrack{media: self.medias[i]}
+	if transport.TCP {
+		if transport.Interleaved[0] == 0 && transport.Interleaved[1] == 0 {
+			transport.Interleaved = [2]int{2 * i, 2*i + 1}
+		}
+	} else {
+		if track.rtpConn, track.rtcpConn, err = rtspListenUdpPair(); err != nil {
+			return rtspError(req, 500, "Internal Server Error", err)
+		}
+		transport.ServerPort[0] = track.rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport.ServerPort[1] = transport.ServerPort[0] + 1
+		if ip, _, err := net.SplitHostPort(self.remote); err == nil {
+			track.clientAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: transport.ClientPort[0]}
+		}
+	}
+	track.transport = transport
+	if self.publish != nil {
+		if track.depacketizer, err = rtsp.NewDepacketizer(track.media); err != nil {
+			return rtspError(req, 415, "Unsupported Media Type", err)
+		}
+	} else {
+		track.packetizer = rtsp.NewPacketizer(track.media)
+	}
+	self.tracks[i] = track
+
+	if len(self.sessionId) == 0 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		self.sessionId = hex.EncodeToString(b)
+	}
+	res := rtsp.NewResponse(req, 200, "OK")
+	res.Header.Set("Transport", transport.String())
+	return res
+}
+
+func (self *rtspConn) onPlay(req *rtsp.Request) *rtsp.Response {
+	if self.publish != nil || len(self.sessionId) == 0 {
+		return rtspError(req, 455, "Method Not Valid in This State", fmt.Errorf("%s", "Rtsp.Play.Not.Setup"))
+	}
+	if self.play != nil {
+		//暂停后的再次 PLAY，直播直接继续
+		return rtsp.NewResponse(req, 200, "OK")
+	}
+	session := newLivePlaySession(self.host, self.app, self.name)
+	pubSession := RtmpSessionGet(session.StreamAnchor)
+	if pubSession == nil {
+		pubSession = sourcePullWait(self.host, self.app, self.name, session.StreamAnchor, sourcePullWaitTimeout)
+	}
+	if pubSession == nil {
+		return rtspError(req, 404, "Not Found", fmt.Errorf("%s", "NetStream.Play.StreamNotFound"))
+	}
+	session.SessionId = "rtsp-" + self.sessionId
+	session.RemoteAddr = self.remote
+	session.livePlayAttach(pubSession)
+	self.play = session
+
+	res := rtsp.NewResponse(req, 200, "OK")
+	res.Header.Set("Range", "npt=0.000-")
+	var infos []string
+	base := strings.TrimSuffix(req.URL.String(), "/")
+	for _, track := range self.tracks {
+		if track != nil {
+			infos = append(infos, fmt.Sprintf("url=%s/%s;seq=%d", base, track.media.Control, track.packetizer.Seq()))
+		}
+	}
+	res.Header.Set("RTP-Info", strings.Join(infos, ","))
+	log.Log.Info(fmt.Sprintf("%s rtsp play start client addr:%s", session.LogFormat(), self.remote))
+	return res
+}
+
+func (self *rtspConn) onRecord(req *rtsp.Request) *rtsp.Response {
+	if self.publish == nil || self.publish.publishing {
+		return rtspError(req, 455, "Method Not Valid in This State", fmt.Errorf("%s", "Rtsp.Record.Not.Announce"))
+	}
+	for _, track := range self.tracks {
+		if track == nil {
+			return rtspError(req, 455, "Method Not Valid in This State", fmt.Errorf("%s", "Rtsp.Record.Not.Setup"))
+		}
+	}
+	if err := self.publish.ingestPublish(); err != nil {
+		return rtspError(req, 409, "Conflict", err)
+	}
+	for _, track := range self.tracks {
+		if track.rtpConn != nil {
+			go self.udpRecvLoop(track)
+		}
+	}
+	return rtsp.NewResponse(req, 200, "OK")
+}
+
+func (self *rtspConn) onInterleaved(frame *rtsp.InterleavedFrame) (err error) {
+	if self.publish == nil || !self.publish.publishing {
+		//播放端的 rtcp
+		return
+	}
+	for _, track := range self.tracks {
+		if track.transport.TCP && int(frame.Channel) == track.transport.Interleaved[0] {
+			return self.onRtp(track, frame.Data)
+		}
+	}
+	return
+}
+
+func (self *rtspConn) udpRecvLoop(track *rtspTrack) {
+	b := make([]byte, 65536)
+	track.rtpConn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+	for atomic.LoadInt32(&self.closed) == 0 {
+		n, addr, err := track.rtpConn.ReadFromUDP(b)
+		if err != nil {
+			break
+		}
+		//只收 rtsp 客户端发来的 rtp，其他地址的包丢弃
+		if track.clientAddr == nil || !addr.IP.Equal(track.clientAddr.IP) {
+			continue
+		}
+		track.rtpConn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+		if err = self.onRtp(track, b[:n]); err != nil {
+			fmt.Printf("rtsp conn %s rtp err the err is %s\n", self.remote, err.Error())
+		}
+	}
+	//没有数据后断开，控制连接的读也会返回
+	self.conn.Close()
+}
+
+//rtp 解包后送入推流，udp 各 track 在不同协程
+func (self *rtspConn) onRtp(track *rtspTrack, b []byte) (err error) {
+	var pkts []av.Packet
+	if pkts, err = track.depacketizer.Decode(b); err != nil {
+		return
+	}
+	self.ingestLock.Lock()
+	defer self.ingestLock.Unlock()
+	if atomic.LoadInt32(&self.closed) != 0 {
+		return
+	}
+	//各路 rtp 时间戳都从 0 开始，按到达时间对齐音视频
+	if !track.started {
+		track.started = true
+		if self.start.IsZero() {
+			self.start = time.Now()
+		}
+		track.offset = time.Since(self.start)
+	}
+	codec := track.depacketizer.CodecData()
+	if codec == nil {
+		return
+	}
+	//新的或者带内更新的参数集
+	version := track.depacketizer.CodecVersion()
+	changed := version != track.codecVersion
+	track.codecVersion = version
+	return self.publish.ingestWritePackets(codec, changed, pkts, track.offset)
+}
+
+func (self *rtspConn) sendRtp(track *rtspTrack, pkts [][]byte) (err error) {
+	if track.transport.TCP {
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
+		self.conn.SetWriteDeadline(time.Now().Add(rtspReadTimeout))
+		for _, pkt := range pkts {
+			if err = rtsp.WriteInterleaved(self.conn, uint8(track.transport.Interleaved[0]), pkt); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if track.clientAddr == nil {
+		return
+	}
+	for _, pkt := range pkts {
+		if _, err = track.rtpConn.WriteToUDP(pkt, track.clientAddr); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//flv tag 的 av.Packet 打包成 rtp，sequence header 不发送
+func (self *rtspConn) writePacket(pkt *av.Packet) (err error) {
+	tag := flvio.Tag{}
+	var mediaType string
+	switch pkt.PacketType {
+	case RtmpMsgVideo:
+		tag.Type, mediaType = flvio.TAG_VIDEO, "video"
+	case RtmpMsgAudio:
+		tag.Type, mediaType = flvio.TAG_AUDIO, "audio"
+	default:
+		return
+	}
+	if _, err = tag.ParseHeader(pkt.Data); err != nil {
+		return nil
+	}
+	if (tag.Type == flvio.TAG_VIDEO && tag.AVCPacketType != flvio.AVC_NALU) ||
+		(tag.Type == flvio.TAG_AUDIO && (tag.SoundFormat != flvio.SOUND_AAC || tag.AACPacketType != flvio.AAC_RAW)) {
+		return
+	}
+	for _, track := range self.tracks {
+		if track != nil && track.media.Type == mediaType {
+			pts := pkt.Time + pkt.CompositionTime
+			return self.sendRtp(track, track.packetizer.Packetize(pkt.Data[pkt.DataPos:], pts, pkt.IsKeyFrame))
+		}
+	}
+	return
+}
+
+//同 hdlSendAvPackets，gop 之后发送 CursorList 分发的数据
+func (self *rtspConn) playLoop(session *Session) {
+	defer func() {
+		session.isClosed = true
+		self.conn.Close()
+	}()
+	if session.GopCache != nil {
+		for pkt := session.GopCache.RingBufferGet(); pkt != nil; pkt = session.GopCache.RingBufferGet() {
+			if err := self.writePacket(pkt); err != nil {
+				return
+			}
+		}
+		session.GopCache = nil
+	}
+	for {
+		pkt := session.CurQue.RingBufferGet()
+		select {
+		case <-session.context.Done():
+			return
+		default:
+		}
+		if pkt == nil && session.isClosed != true {
+			<-session.PacketAck
+		}
+		if session.pubSession.isClosed == true {
+			session.isClosed = true
+		}
+		if session.isClosed == true && pkt == nil {
+			log.Log.Info(fmt.Sprintf("%s rtsp play done client addr:%s", session.LogFormat(), self.remote))
+			return
+		}
+		if pkt != nil {
+			if err := self.writePacket(pkt); err != nil {
+				fmt.Printf("rtsp play %s err the err is %s\n", self.remote, err.Error())
+				return
+			}
+		}
+	}
+}
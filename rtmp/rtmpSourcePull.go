@@ -0,0 +1,362 @@
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"rtmpServerStudy/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+从外部 rtmp / http flv 源拉流，拉到的流注册成普通推流，播放端感知不到区别
+static 启动时开始拉，断了指数退避重试
+ondemand 第一个播放请求时开始拉，最后一个播放离开 IdleTimeout 后停止
+只有流 hash 到本机时才拉，其他节点的播放走原来的集群 relay
+*/
+
+const (
+	sourcePullMinBackoff   = time.Second
+	sourcePullMaxBackoff   = 60 * time.Second
+	sourcePullIdleDefault  = 30 * time.Second
+	sourcePullWaitInterval = 100 * time.Millisecond
+	sourcePullWaitTimeout  = 5 * time.Second
+)
+
+type sourcePull struct {
+	vhost  string
+	app    string
+	name   string
+	anchor string
+	url    string
+	static bool
+	idle   time.Duration
+
+	lock    sync.Mutex
+	session *Session
+	stopped bool
+	done    chan bool
+}
+
+var sourcePulls = struct {
+	sync.Mutex
+	pulls map[string]*sourcePull
+}{pulls: make(map[string]*sourcePull)}
+
+//按 PlayDomain app 的 Pull 配置匹配流名，没有配置返回 nil
+func sourcePullMatch(vhost, app, name string) *sourcePull {
+	domain, ok := Gconfig.UserConf.PlayDomain[vhost]
+	if !ok {
+		return nil
+	}
+	cnf := domain.App[app]
+	if cnf == nil {
+		return nil
+	}
+	for _, src := range cnf.Pull {
+		if ok, _ := path.Match(src.Name, name); !ok {
+			continue
+		}
+		pull := &sourcePull{
+			vhost:  vhost,
+			app:    app,
+			name:   name,
+			anchor: name + ":" + domain.UniqueName + ":" + app,
+			url:    strings.Replace(src.Url, "{name}", name, -1),
+			static: src.Mode == "static",
+			idle:   sourcePullIdleDefault,
+		}
+		if len(src.IdleTimeout) > 0 {
+			if idle, err := time.ParseDuration(src.IdleTimeout); err == nil && idle > 0 {
+				pull.idle = idle
+			}
+		}
+		return pull
+	}
+	return nil
+}
+
+//流 hash 到本机时才拉
+func (self *sourcePull) isSelf() bool {
+	session := &Session{StreamAnchor: self.anchor}
+	return session.RtmpCheckStreamIsSelf()
+}
+
+func (self *sourcePull) start() bool {
+	sourcePulls.Lock()
+	defer sourcePulls.Unlock()
+	if _, ok := sourcePulls.pulls[self.anchor]; ok {
+		return false
+	}
+	self.done = make(chan bool)
+	sourcePulls.pulls[self.anchor] = self
+	go self.run()
+	return true
+}
+
+func (self *sourcePull) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stopped {
+		return
+	}
+	self.stopped = true
+	close(self.done)
+	if self.session != nil {
+		self.session.netconn.Close()
+	}
+}
+
+func (self *sourcePull) isStopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stopped
+}
+
+//播放请求时调用，配置了拉流返回 true，调用方可以等待推流出现
+func sourcePullOnDemand(vhost, app, name string) bool {
+	pull := sourcePullMatch(vhost, app, name)
+	if pull == nil {
+		return false
+	}
+	if !pull.isSelf() {
+		return false
+	}
+	if pull.start() {
+		log.Log.Info(fmt.Sprintf("source pull %s start on demand url:%s", pull.anchor, pull.url))
+	}
+	return true
+}
+
+//rtsp webrtc 等没有重试循环的播放，按需拉流并等待推流出现
+//sdp 需要 codec，等到音视频 codec 都有，或者只有一路 codec 超过 1s
+func sourcePullWait(vhost, app, name, anchor string, timeout time.Duration) *Session {
+	if !sourcePullOnDemand(vhost, app, name) {
+		return nil
+	}
+	var first time.Time
+	for end := time.Now().Add(timeout); time.Now().Before(end); time.Sleep(sourcePullWaitInterval) {
+		pubSession := RtmpSessionGet(anchor)
+		if pubSession == nil {
+			continue
+		}
+		pubSession.RLock()
+		vCodec, aCodec := pubSession.vCodec, pubSession.aCodec
+		pubSession.RUnlock()
+		if vCodec != nil && aCodec != nil {
+			return pubSession
+		}
+		if vCodec != nil || aCodec != nil {
+			if first.IsZero() {
+				first = time.Now()
+			} else if time.Since(first) >= time.Second {
+				return pubSession
+			}
+		}
+	}
+	return RtmpSessionGet(anchor)
+}
+
+//启动时开始 static 拉流，流名带通配的只能按需拉
+func sourcePullStatic() {
+	for vhost, domain := range Gconfig.UserConf.PlayDomain {
+		for app, cnf := range domain.App {
+			if cnf == nil {
+				continue
+			}
+			for _, src := range cnf.Pull {
+				if src.Mode != "static" || strings.ContainsAny(src.Name, "*?[") {
+					continue
+				}
+				pull := sourcePullMatch(vhost, app, src.Name)
+				if pull == nil || !pull.isSelf() {
+					continue
+				}
+				if pull.start() {
+					log.Log.Info(fmt.Sprintf("source pull %s start static url:%s", pull.anchor, pull.url))
+				}
+			}
+		}
+	}
+}
+
+//拉流断开后退避重试，ondemand 没有播放时停止
+func (self *sourcePull) run() {
+	defer func() {
+		sourcePulls.Lock()
+		delete(sourcePulls.pulls, self.anchor)
+		sourcePulls.Unlock()
+		log.Log.Info(fmt.Sprintf("source pull %s stop", self.anchor))
+	}()
+	if !self.static {
+		go self.idleCheck()
+	}
+	backoff := sourcePullMinBackoff
+	for !self.isStopped() {
+		published, err := self.pull()
+		if self.isStopped() {
+			return
+		}
+		if published {
+			backoff = sourcePullMinBackoff
+		}
+		log.Log.Info(fmt.Sprintf("source pull %s url:%s err:%v retry after %s", self.anchor, self.url, err, backoff))
+		select {
+		case <-self.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > sourcePullMaxBackoff {
+			backoff = sourcePullMaxBackoff
+		}
+	}
+}
+
+//推流上没有播放超过 idle 停止拉流，拉流还没连上时也算没有播放
+func (self *sourcePull) idleCheck() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+		}
+		if pubSession := RtmpSessionGet(self.anchor); pubSession != nil {
+			players := len(pubSession.RegisterChannel) + sourcePullPlayers(pubSession)
+			if players > 0 {
+				last = time.Now()
+				continue
+			}
+		}
+		if time.Since(last) >= self.idle {
+			log.Log.Info(fmt.Sprintf("source pull %s idle %s", self.anchor, self.idle))
+			self.stop()
+			return
+		}
+	}
+}
+
+//关闭的播放要等推流下一个包才从 CursorList 移除，只数没有关闭的
+//推流协程同时在遍历和移除，持有 CursorList 的锁
+func sourcePullPlayers(pubSession *Session) (n int) {
+	pubSession.CursorList.Lock()
+	defer pubSession.CursorList.Unlock()
+	for e := pubSession.CursorList.GetList().Front(); e != nil; e = e.Next() {
+		if player, ok := e.Value.(*Session); ok && !player.isClosed {
+			n++
+		}
+	}
+	return
+}
+
+//拉一次直到断开，published 表示注册推流成功过
+func (self *sourcePull) pull() (published bool, err error) {
+	var u *url.URL
+	if u, err = url.Parse(self.url); err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "rtmp":
+		return self.pullRtmp(u)
+	case "http", "https":
+		return self.pullHttpFlv(u)
+	}
+	return false, fmt.Errorf("%s", "Rtmp.SourcePull.BadScheme")
+}
+
+func (self *sourcePull) setSession(session *Session) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stopped {
+		return false
+	}
+	self.session = session
+	return true
+}
+
+//同 ingestCheck，使用播放域名的配置
+func (self *sourcePull) sessionSetup(session *Session) {
+	domain := Gconfig.UserConf.PlayDomain[self.vhost]
+	if cnf := domain.App[self.app]; cnf != nil {
+		session.UserCnf = *cnf
+	}
+	session.uniqueName = domain.UniqueName
+	session.Vhost = self.vhost
+	session.App = self.app
+	session.StreamId = self.name
+	session.StreamAnchor = self.anchor
+}
+
+func (self *sourcePull) pullRtmp(u *url.URL) (published bool, err error) {
+	host := u.Host
+	if _, _, err1 := net.SplitHostPort(host); err1 != nil {
+		host = host + ":1935"
+	}
+	var netConn net.Conn
+	if netConn, err = Dial("tcp", host); err != nil {
+		return
+	}
+	session := NewSsesion(netConn)
+	session.network = "tcp"
+	session.URL = u
+	session.SessionId = rtmpTunnelSessionId("pull")
+	session.RemoteAddr = netConn.RemoteAddr().String()
+	if !self.setSession(session) {
+		netConn.Close()
+		return
+	}
+	defer session.ingestClose()
+
+	if err = session.handshakeClient(); err != nil {
+		return
+	}
+	if err = session.rtmpClientPlay(); err != nil {
+		return
+	}
+	//rtmpClientPlay 用 URL 里的 app 流名，注册时换成本地的
+	self.sessionSetup(session)
+	if err = session.ingestPublish(); err != nil {
+		return
+	}
+	published = true
+	err = session.rtmpReadMsgCycle()
+	return
+}
+
+func (self *sourcePull) pullHttpFlv(u *url.URL) (published bool, err error) {
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 5 * time.Second,
+	}}
+	var resp *http.Response
+	if resp, err = client.Get(u.String()); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return false, fmt.Errorf("%s", "Rtmp.SourcePull.HttpStatus")
+	}
+	session := newIngestSession(resp.Body, "httpflvpull", u.Host)
+	if !self.setSession(session) {
+		resp.Body.Close()
+		return
+	}
+	defer session.ingestClose()
+
+	self.sessionSetup(session)
+	if err = session.ingestFlvHeader(); err != nil {
+		return
+	}
+	if err = session.ingestPublish(); err != nil {
+		return
+	}
+	published = true
+	err = session.ingestFlvTags()
+	return
+}
@@ -0,0 +1,40 @@
+package rtmp
+
+import (
+	"rtmpServerStudy/AvQue"
+	"rtmpServerStudy/av"
+	"testing"
+)
+
+//推流协程分发时移除关闭的播放端，空闲检查同时数播放端，用 -race 跑
+func TestSourcePullPlayers(t *testing.T) {
+	pubSession := NewSsesion(nil)
+	for i := 0; i < 100; i++ {
+		pubSession.CursorList.PushBack(&Session{
+			CurQue:    AvQue.RingBufferCreate(10),
+			PacketAck: make(chan bool, 1),
+			needUpPkt: true,
+			isClosed:  i%2 == 0,
+		})
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			pubSession.rtmpPacketPut(&av.Packet{PacketType: RtmpMsgAudio})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if n := sourcePullPlayers(pubSession); n != 50 {
+			t.Fatalf("open players %d want 50", n)
+		}
+	}
+	if n := pubSession.CursorList.Len(); n != 50 {
+		t.Fatalf("cursor list len %d want 50 after closed players removed", n)
+	}
+}
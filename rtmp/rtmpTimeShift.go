@@ -0,0 +1,361 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/timer"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+时移，app 配置 TimeShift: "10m" 时推流在内存中保留最近 10 分钟的包，超过 TimeShiftMaxSize 字节时丢掉最早的
+播放 rtmp://host/app/name?delay=30 或 http://host/app/name.flv?delay=30 固定延迟 30 秒
+?start=-120 从 120 秒前的关键帧开始播，之后一直落后 120 秒
+每个包按到达服务器的时间加上延迟发送，gop 缓存只用于直播
+序列头和 metadata 也放入缓存，播放端先收到时移点生效的头，窗口内编码参数变化时按顺序发出
+*/
+
+//TimeShiftMaxSize 没有配置时每路流最多缓存的字节数
+const timeShiftMaxSize = 256 << 20
+
+const (
+	timeShiftNone = iota
+	//?delay=N 缓存不够 N 秒时等待
+	timeShiftDelay
+	//?start=-N 缓存不够 N 秒时从最早的关键帧开始
+	timeShiftStart
+)
+
+//缓存中的序列头和 metadata，按发送的顺序
+const (
+	timeShiftHdrMeta = iota
+	timeShiftHdrAudio
+	timeShiftHdrVideo
+	timeShiftHdrNum
+)
+
+//amf0 字符串 onMetaData
+var timeShiftMetaName = []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}
+
+//序列头和 metadata 的类型，其他包返回 -1
+func timeShiftHeaderKind(pkt *av.Packet) int {
+	if len(pkt.Data) < 2 {
+		return -1
+	}
+	switch pkt.PacketType {
+	case RtmpMsgAmfMeta:
+		//转发的其他 data 消息不算
+		if bytes.HasPrefix(pkt.Data, timeShiftMetaName) {
+			return timeShiftHdrMeta
+		}
+	case RtmpMsgAudio:
+		if pkt.Data[0]>>4 == flvio.SOUND_AAC && pkt.Data[1] == flvio.AAC_SEQHDR {
+			return timeShiftHdrAudio
+		}
+	case RtmpMsgVideo:
+		codecId := pkt.Data[0] & 0x0f
+		if (codecId == flvio.VIDEO_H264 || codecId == flvio.VIDEO_H265) && pkt.Data[1] == flvio.AVC_SEQHDR {
+			return timeShiftHdrVideo
+		}
+	}
+	return -1
+}
+
+type timeShiftPacket struct {
+	pkt     *av.Packet
+	arrival time.Time
+}
+
+type timeShiftBuffer struct {
+	sync.RWMutex
+	window  time.Duration
+	maxSize int64
+	size    int64
+	//pkts[0] 的序号，播放端按序号读
+	base     int64
+	pkts     []timeShiftPacket
+	hasVideo bool
+	//pkts[0] 之前生效的序列头和 metadata
+	hdrs [timeShiftHdrNum]*av.Packet
+}
+
+//没有配置 TimeShift 返回 nil
+func newTimeShiftBuffer(cnf *config.App) *timeShiftBuffer {
+	window := parseFragment(cnf.TimeShift, 0)
+	if window <= 0 {
+		return nil
+	}
+	maxSize := cnf.TimeShiftMaxSize
+	if maxSize <= 0 {
+		maxSize = timeShiftMaxSize
+	}
+	return &timeShiftBuffer{window: time.Duration(window * float64(time.Second)), maxSize: maxSize}
+}
+
+//推流协程调用，超过时长或者字节数丢掉最早的包
+func (self *timeShiftBuffer) put(pkt *av.Packet) {
+	now := time.Now()
+	self.Lock()
+	if pkt.PacketType == RtmpMsgVideo {
+		self.hasVideo = true
+	}
+	self.pkts = append(self.pkts, timeShiftPacket{pkt: pkt, arrival: now})
+	self.size += int64(len(pkt.Data))
+	n := 0
+	for n < len(self.pkts)-1 && (self.size > self.maxSize || now.Sub(self.pkts[n].arrival) > self.window) {
+		if kind := timeShiftHeaderKind(self.pkts[n].pkt); kind >= 0 {
+			self.hdrs[kind] = self.pkts[n].pkt
+		}
+		self.size -= int64(len(self.pkts[n].pkt.Data))
+		self.pkts[n] = timeShiftPacket{}
+		n++
+	}
+	self.pkts = self.pkts[n:]
+	self.base += int64(n)
+	self.Unlock()
+}
+
+//推流协程收到 onMetaData 时调用，时间戳跟着前一个包
+func (self *timeShiftBuffer) putMeta(metaData amf.AMFMap) {
+	tag, ok := flv.MetadeToTag("onMetaData", metaData)
+	if !ok {
+		return
+	}
+	pkt := &av.Packet{PacketType: RtmpMsgAmfMeta, Data: tag.Data}
+	self.RLock()
+	if len(self.pkts) > 0 {
+		pkt.Time = self.pkts[len(self.pkts)-1].pkt.Time
+	}
+	self.RUnlock()
+	self.put(pkt)
+}
+
+//index 之前最后的序列头和 metadata
+func (self *timeShiftBuffer) headers(index int) (hdrs []*av.Packet) {
+	last := self.hdrs
+	for _, e := range self.pkts[:index] {
+		if kind := timeShiftHeaderKind(e.pkt); kind >= 0 {
+			last[kind] = e.pkt
+		}
+	}
+	for _, pkt := range last {
+		if pkt != nil {
+			hdrs = append(hdrs, pkt)
+		}
+	}
+	return
+}
+
+//有视频时只能从关键帧开始
+func (self *timeShiftBuffer) startable(pkt *av.Packet) bool {
+	if !self.hasVideo {
+		return pkt.PacketType == RtmpMsgAudio || pkt.PacketType == RtmpMsgVideo
+	}
+	return pkt.PacketType == RtmpMsgVideo && pkt.IsKeyFrame
+}
+
+//from 之后第一个可以开始的位置，没有时返回 len(pkts)
+func (self *timeShiftBuffer) keyframe(from int) int {
+	for i := from; i < len(self.pkts); i++ {
+		if self.startable(self.pkts[i].pkt) {
+			return i
+		}
+	}
+	return len(self.pkts)
+}
+
+//到达时间不晚于 target 的最后一个关键帧，没有时取最早的关键帧
+func (self *timeShiftBuffer) seek(target time.Time) (index int, arrival time.Time, ok bool) {
+	index = -1
+	for i, e := range self.pkts {
+		if !self.startable(e.pkt) {
+			continue
+		}
+		if index >= 0 && e.arrival.After(target) {
+			break
+		}
+		index, arrival = i, e.arrival
+	}
+	return index, arrival, index >= 0
+}
+
+type timeShiftCursor struct {
+	buf    *timeShiftBuffer
+	next   int64
+	offset time.Duration
+	//开始播放前先发的序列头和 metadata
+	hdrs []*av.Packet
+}
+
+func (self *timeShiftBuffer) cursor(mode int, offset time.Duration) *timeShiftCursor {
+	//超过缓存时长的包等不到发送就被丢掉了
+	if offset > self.window {
+		offset = self.window
+	}
+	now := time.Now()
+	self.RLock()
+	defer self.RUnlock()
+	c := &timeShiftCursor{buf: self, offset: offset, next: self.base + int64(len(self.pkts))}
+	if index, arrival, ok := self.seek(now.Add(-offset)); ok {
+		c.next = self.base + int64(index)
+		if mode == timeShiftStart && now.Sub(arrival) < offset {
+			c.offset = now.Sub(arrival)
+		}
+	}
+	c.hdrs = self.headers(int(c.next - self.base))
+	return c
+}
+
+//下一个到时间的包，没有到时间时返回还要等多久，都发完时返回 nil 0
+func (self *timeShiftCursor) read(now time.Time) (pkt *av.Packet, wait time.Duration) {
+	buf := self.buf
+	buf.RLock()
+	defer buf.RUnlock()
+	if self.next < buf.base {
+		//没来得及发的被丢掉了，跳到下一个关键帧
+		self.next = buf.base + int64(buf.keyframe(0))
+	}
+	i := int(self.next - buf.base)
+	if i >= len(buf.pkts) {
+		return
+	}
+	e := buf.pkts[i]
+	if wait = e.arrival.Add(self.offset).Sub(now); wait > 0 {
+		return nil, wait
+	}
+	self.next++
+	return e.pkt, 0
+}
+
+//?delay=30 ?start=-120，单位秒
+func (self *Session) timeShiftQuery(query url.Values) {
+	if v, err := strconv.ParseFloat(query.Get("delay"), 64); err == nil && v > 0 {
+		self.shiftMode, self.shiftOffset = timeShiftDelay, time.Duration(v*float64(time.Second))
+		return
+	}
+	if v, err := strconv.ParseFloat(query.Get("start"), 64); err == nil && v < 0 {
+		self.shiftMode, self.shiftOffset = timeShiftStart, time.Duration(-v*float64(time.Second))
+	}
+}
+
+//挂到推流之后调用，返回 true 时从时移缓存发送，发时移点的头，不发当前的头和 gop
+func (self *Session) timeShiftOpen() bool {
+	if self.shiftMode == timeShiftNone {
+		return false
+	}
+	buf := self.pubSession.timeShift
+	if buf == nil {
+		log.Log.Info(fmt.Sprintf("%s time shift is not configured for app:%s play live",
+			self.LogFormat(), self.App))
+		return false
+	}
+	self.shiftCursor = buf.cursor(self.shiftMode, self.shiftOffset)
+	self.GopCache = nil
+	log.Log.Info(fmt.Sprintf("%s time shift play offset:%v", self.LogFormat(), self.shiftCursor.offset))
+	return true
+}
+
+//按时间从时移缓存发送，推流结束后把缓存发完再结束，done 关闭时播放端已经断开
+func (self *Session) timeShiftSend(write func(pkt *av.Packet) error, flush func() error,
+	done <-chan struct{}) (err error) {
+	for {
+		pkt, wait := self.shiftCursor.read(time.Now())
+		if pkt != nil {
+			if err = write(pkt); err != nil {
+				return
+			}
+			continue
+		}
+		if err = flush(); err != nil {
+			return
+		}
+		if self.isClosed {
+			err = fmt.Errorf("%s", "Rtmp.TimeShift.Session.Closed")
+			return
+		}
+		//等发送时间时不看新包，推流结束后 PacketAck 已经关闭
+		var t *time.Timer
+		ack := self.PacketAck
+		if wait > 0 {
+			t, ack = timer.GlobalTimerPool.Get(wait), nil
+		} else {
+			if self.pubSession.isClosed {
+				self.isClosed = true
+				err = fmt.Errorf("%s", "Rtmp.TimeShift.PubSession.Closed")
+				return
+			}
+			t = timer.GlobalTimerPool.Get(time.Second)
+		}
+		select {
+		case <-ack:
+		case <-t.C:
+		case <-done:
+			timer.GlobalTimerPool.Put(t)
+			self.isClosed = true
+			err = fmt.Errorf("%s", "Rtmp.TimeShift.Play.Closed")
+			return
+		}
+		timer.GlobalTimerPool.Put(t)
+	}
+}
+
+//时移点生效的序列头和 metadata，缓存中没有时发当前的
+func (self *Session) rtmpSendTimeShiftHead() (err error) {
+	if len(self.shiftCursor.hdrs) == 0 {
+		return self.rtmpSendHead()
+	}
+	self.metaversion = self.pubSession.metaversion
+	for _, pkt := range self.shiftCursor.hdrs {
+		if err = self.writeAVPacket(pkt); err != nil {
+			return
+		}
+	}
+	return self.flushWrite()
+}
+
+func (self *Session) rtmpSendTimeShift() (err error) {
+	return self.timeShiftSend(func(pkt *av.Packet) (err error) {
+		if err = self.rtmpAckSend(); err != nil {
+			return
+		}
+		if err = self.rtmpAckThrottle(); err != nil {
+			return
+		}
+		return self.writeAVPacket(pkt)
+	}, self.flushWrite, self.readDone)
+}
+
+//flv 头之后是时移点生效的序列头和 metadata，缓存中没有时发当前的
+func (self *Session) hdlSendTimeShiftHead(w *flv.Muxer, r *http.Request) (err error) {
+	if len(self.shiftCursor.hdrs) == 0 {
+		return self.hdlSendHead(w, r)
+	}
+	n := flvio.FillFileHeader(w.B, flvio.FILE_HAS_VIDEO|flvio.FILE_HAS_AUDIO)
+	if _, err = w.GetMuxerWrite().Write(w.B[:n]); err != nil {
+		return
+	}
+	for _, pkt := range self.shiftCursor.hdrs {
+		tag, _ := PacketToTag(pkt)
+		if err = flvio.WriteTag(w.GetMuxerWrite(), tag, 0, w.B); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *Session) hdlSendTimeShift(w *flv.Muxer, r *http.Request) (err error) {
+	return self.timeShiftSend(func(pkt *av.Packet) error {
+		tag, ts := PacketToTag(pkt)
+		return flvio.WriteTag(w.GetMuxerWrite(), tag, ts, w.B)
+	}, w.GetMuxerWrite().Flush, r.Context().Done())
+}
@@ -0,0 +1,51 @@
+package rtmp
+
+import (
+	"rtmpServerStudy/av"
+	"testing"
+	"time"
+)
+
+func timeShiftTestVideo(seqHdr bool, b byte) *av.Packet {
+	if seqHdr {
+		return &av.Packet{PacketType: RtmpMsgVideo, Data: []byte{0x17, 0, 0, 0, 0, b}}
+	}
+	return &av.Packet{PacketType: RtmpMsgVideo, IsKeyFrame: true, Data: []byte{0x17, 1, 0, 0, 0, b}}
+}
+
+//时移点之前最后的序列头，丢掉的包里的序列头也要保留
+func TestTimeShiftHeaders(t *testing.T) {
+	buf := &timeShiftBuffer{window: time.Minute, maxSize: timeShiftMaxSize}
+	hdrA, keyA := timeShiftTestVideo(true, 'a'), timeShiftTestVideo(false, 'a')
+	hdrB, keyB := timeShiftTestVideo(true, 'b'), timeShiftTestVideo(false, 'b')
+	for _, pkt := range []*av.Packet{hdrA, keyA, hdrB, keyB} {
+		buf.put(pkt)
+	}
+	now := time.Now()
+	for i := range buf.pkts {
+		buf.pkts[i].arrival = now.Add(-20 * time.Second)
+		if i >= 2 {
+			buf.pkts[i].arrival = now.Add(-10 * time.Second)
+		}
+	}
+	for _, c := range []struct {
+		offset time.Duration
+		hdr    *av.Packet
+	}{{15 * time.Second, hdrA}, {5 * time.Second, hdrB}} {
+		cursor := buf.cursor(timeShiftDelay, c.offset)
+		if len(cursor.hdrs) != 1 || cursor.hdrs[0] != c.hdr {
+			t.Fatalf("offset %v headers %v want %v", c.offset, cursor.hdrs, c.hdr)
+		}
+	}
+
+	//hdrA keyA 滑出窗口
+	buf.window = 12 * time.Second
+	buf.put(&av.Packet{PacketType: RtmpMsgVideo, Data: []byte{0x27, 1, 0, 0, 0}})
+	if len(buf.pkts) != 3 || buf.hdrs[timeShiftHdrVideo] != hdrA {
+		t.Fatalf("buffer len %d base video header %v", len(buf.pkts), buf.hdrs[timeShiftHdrVideo])
+	}
+	cursor := buf.cursor(timeShiftDelay, 15*time.Second)
+	if len(cursor.hdrs) != 1 || cursor.hdrs[0] != hdrB {
+		t.Fatalf("headers after evict %v want %v", cursor.hdrs, hdrB)
+	}
+}
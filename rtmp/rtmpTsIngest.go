@@ -0,0 +1,234 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/ts"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+mpegts 推流，编码器或者广电设备直接推 udp(单播/组播) 或 tcp
+每个监听地址对应配置的 vhost/app/name，demux 出的 h264/h265/aac 转成 flv tag 按普通推流处理
+udp 一段时间没有数据认为断流，之后来数据重新开始一次推流
+*/
+
+const (
+	tsIngestTimeout = 10 * time.Second
+	//连续多少次 demux 错误放弃
+	tsIngestMaxErrors = 100
+	//pts 33 bit 回绕
+	tsIngestWrap = time.Duration(1<<33) * time.Second / 90000
+)
+
+//udp 每个包是若干个 188 字节的 ts 包
+type udpTsReader struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	buf     []byte
+	data    []byte
+	remote  *net.UDPAddr
+}
+
+func (self *udpTsReader) Read(b []byte) (n int, err error) {
+	for len(self.data) == 0 {
+		self.conn.SetReadDeadline(time.Now().Add(self.timeout))
+		if n, self.remote, err = self.conn.ReadFromUDP(self.buf); err != nil {
+			return 0, err
+		}
+		self.data = self.buf[:n]
+	}
+	n = copy(b, self.data)
+	self.data = self.data[n:]
+	return
+}
+
+//ts 时间戳减去第一个包的时间，处理 33 bit 回绕
+type tsIngestClock struct {
+	started bool
+	base    time.Duration
+	last    time.Duration
+	wrap    time.Duration
+}
+
+func (self *tsIngestClock) timestamp(t time.Duration) int32 {
+	if !self.started {
+		self.started = true
+		self.base = t
+	}
+	t += self.wrap
+	if t < self.last-tsIngestWrap/2 {
+		self.wrap += tsIngestWrap
+		t += tsIngestWrap
+	}
+	self.last = t
+	if t < self.base {
+		return 0
+	}
+	return int32((t - self.base) / time.Millisecond)
+}
+
+func tsIngestTimeoutConf(cnf config.TsListen) time.Duration {
+	if timeout, err := time.ParseDuration(cnf.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return tsIngestTimeout
+}
+
+func (self *Server) tsServeStart(cnf config.TsListen) (err error) {
+	defer func() {
+		self.done <- false
+	}()
+
+	var u *url.URL
+	if u, err = url.Parse(cnf.Listen); err != nil {
+		log.Log.Error("ts server listen err the addr: "+cnf.Listen, zap.String("errMsg", err.Error()))
+		return
+	}
+	switch u.Scheme {
+	case "udp":
+		err = tsServeUdp(u.Host, cnf)
+	case "tcp":
+		err = tsServeTcp(u.Host, cnf)
+	default:
+		err = fmt.Errorf("%s", "Rtmp.Ts.Listen.Scheme.Invalid")
+	}
+	if err != nil {
+		log.Log.Error("ts server listen err the addr: "+cnf.Listen, zap.String("errMsg", err.Error()))
+	}
+	return
+}
+
+func tsServeUdp(addr string, cnf config.TsListen) (err error) {
+	var laddr *net.UDPAddr
+	if laddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+	var conn *net.UDPConn
+	if laddr.IP != nil && laddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if len(cnf.Interface) > 0 {
+			if ifi, err = net.InterfaceByName(cnf.Interface); err != nil {
+				return
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, laddr)
+	} else {
+		conn, err = net.ListenUDP("udp", laddr)
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	log.Log.Info("the ts server listening on :" + cnf.Listen)
+	r := &udpTsReader{conn: conn, timeout: tsIngestTimeoutConf(cnf), buf: make([]byte, 65536)}
+	for {
+		//等第一个包，没有推流时不创建 session
+		r.conn.SetReadDeadline(time.Time{})
+		var n int
+		if n, r.remote, err = conn.ReadFromUDP(r.buf); err != nil {
+			return
+		}
+		r.data = r.buf[:n]
+		//udp socket 一直复用，session 关闭时不关闭
+		tsIngestServe(ioutil.NopCloser(r), "udpts", r.remote.String(), cnf)
+	}
+}
+
+func tsServeTcp(addr string, cnf config.TsListen) (err error) {
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	defer listener.Close()
+
+	log.Log.Info("the ts server listening on :" + cnf.Listen)
+	timeout := tsIngestTimeoutConf(cnf)
+	for {
+		var conn net.Conn
+		if conn, err = listener.Accept(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		//同一路流同时只有一个推流，其他的连接 publish 时失败
+		go tsIngestServe(&tcpTsReader{Conn: conn, timeout: timeout}, "tcpts", conn.RemoteAddr().String(), cnf)
+	}
+}
+
+type tcpTsReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (self *tcpTsReader) Read(b []byte) (n int, err error) {
+	self.Conn.SetReadDeadline(time.Now().Add(self.timeout))
+	return self.Conn.Read(b)
+}
+
+func tsIngestServe(r io.ReadCloser, network, remoteAddr string, cnf config.TsListen) (err error) {
+	session := newIngestSession(r, network, remoteAddr)
+	defer func() {
+		session.ingestClose()
+		if err != nil && err != io.EOF {
+			log.Log.Info(fmt.Sprintf("%s %s publish end err:%s", session.LogFormat(), network, err.Error()))
+		}
+	}()
+	if err = session.ingestCheck(cnf.Vhost, cnf.App, cnf.Name); err != nil {
+		return
+	}
+
+	//拿到 sps pps adts 之后再注册，播放端先收到 sequence header
+	demuxer := ts.NewDemuxer(session.bufr)
+	var streams []av.CodecData
+	if streams, err = demuxer.Streams(); err != nil {
+		return
+	}
+	if err = session.ingestPublish(); err != nil {
+		return
+	}
+	for _, stream := range streams {
+		if tag, ok, err1 := flv.CodecDataToTag(stream); err1 == nil && ok {
+			if err = session.ingestWriteTag(*tag, 0); err != nil {
+				return
+			}
+		}
+	}
+
+	var clock tsIngestClock
+	errors := 0
+	for {
+		var pkt av.Packet
+		if pkt, err = demuxer.ReadPacket(); err != nil {
+			if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			//丢包造成的 pes 不完整等，跳过
+			if errors++; errors > tsIngestMaxErrors {
+				return
+			}
+			continue
+		}
+		errors = 0
+		if int(pkt.Idx) >= len(streams) {
+			continue
+		}
+		tag, _ := flv.PacketToTag(pkt, streams[pkt.Idx])
+		if err = session.ingestWriteTag(tag, clock.timestamp(pkt.Time)); err != nil {
+			return
+		}
+	}
+}
@@ -26,6 +26,10 @@ func RtmpUserSetBufLenHandler(session *Session, timestamp uint32, msgsid uint32,
 
 	log.Log.Info(fmt.Sprintf("%s %s RtmpUserSetBufLenHandler",
 				session.LogFormat(), session.TcUrl))
+	//点播按客户端 buffer 提前发送
+	if session.vod != nil && len(msgdata) >= 10 {
+		session.vodSendCmd(vodCmd{name: "_bufLen", value: pio.U32BE(msgdata[6:])})
+	}
 	return
 	//do something your self
 }
@@ -43,6 +47,15 @@ func (self *Session) sendSetPingResponse(msgsid uint32, timestamp uint32) (err e
 
 func RtmpUserPingRequestHandler(session *Session, timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
 	time := pio.U32BE(msgdata[2:])
+	//点播时写都在发送协程
+	if session.vod != nil {
+		session.vodSendCmd(vodCmd{name: "_ping", value: time})
+		return
+	}
+	//直播播放的读协程不写
+	if session.ctrlRead {
+		return
+	}
 	err = session.sendSetPingResponse(msgsid, time)
 	return
 }
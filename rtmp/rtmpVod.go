@@ -0,0 +1,837 @@
+package rtmp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"rtmpServerStudy/amf"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/flv"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/mp4"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+录制文件点播，play 的流名带 .flv .mp4 后缀或者 flv: mp4: 前缀时播放录制目录下的文件
+文件在 RecodeFlvPath/uniquename/app/ 下，例如 play("123/1500000000000.flv")
+支持 play 的 start duration reset 参数，seek pause pauseraw play2
+点播时起一个协程读客户端的命令，命令交给发送协程处理，所有的写都在发送协程
+*/
+
+const (
+	//默认提前发送的时长，客户端 SetBufferLength 后按客户端的 buffer
+	vodDefaultAhead = time.Second
+	vodMaxAhead     = 10 * time.Second
+	//没有视频时每隔多久记一个 seek 点
+	vodAudioSeekInterval = 1000
+)
+
+//点播文件，flv mp4 共用
+type vodFile interface {
+	//metadata 和 sequence header，开始播放和 seek 之后发送
+	Header() []flvio.Tag
+	ReadTag() (tag flvio.Tag, ts int32, err error)
+	//跳到 ts 之前最近的关键帧，返回实际的时间戳
+	Seek(ts int32) (int32, error)
+	Duration() int32
+	Close() error
+}
+
+func openVodFile(file string) (vodFile, error) {
+	if strings.ToLower(path.Ext(file)) == ".mp4" {
+		return openMp4VodFile(file)
+	}
+	return openFlvVodFile(file)
+}
+
+type flvVodKey struct {
+	ts  int32
+	pos int64
+}
+
+type flvVodFile struct {
+	f        *os.File
+	r        *bufio.Reader
+	b        []byte
+	header   []flvio.Tag
+	keys     []flvVodKey
+	dataPos  int64
+	duration int32
+}
+
+//扫一遍 tag 头，记录第一个音视频 tag 之前的 metadata sequence header 和关键帧位置
+func openFlvVodFile(file string) (vodFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	self := &flvVodFile{f: f, r: bufio.NewReaderSize(f, 64*1024), b: make([]byte, flvio.TagHeaderLength+flvio.FileHeaderLength)}
+	if err = self.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = self.Seek(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *flvVodFile) scan() (err error) {
+	b := self.b
+	if _, err = io.ReadFull(self.r, b[:flvio.FileHeaderLength]); err != nil {
+		return
+	}
+	var skip int
+	if _, skip, err = flvio.ParseFileHeader(b[:flvio.FileHeaderLength]); err != nil {
+		return
+	}
+	if _, err = self.r.Discard(skip); err != nil {
+		return
+	}
+	pos := int64(flvio.FileHeaderLength + skip)
+	self.dataPos = -1
+	var audioKeys []flvVodKey
+	for {
+		if _, err = io.ReadFull(self.r, b[:flvio.TagHeaderLength]); err != nil {
+			break
+		}
+		var tag flvio.Tag
+		var ts int32
+		var datalen int
+		if tag, ts, datalen, err = flvio.ParseTagHeader(b); err != nil {
+			break
+		}
+		var head []byte
+		if head, err = self.r.Peek(2); err != nil && datalen >= 2 {
+			break
+		}
+		isHeader := tag.Type == flvio.TAG_SCRIPTDATA
+		switch tag.Type {
+		case flvio.TAG_VIDEO:
+			isHeader = datalen >= 2 && head[1] == flvio.AVC_SEQHDR
+			if !isHeader && datalen >= 1 && head[0]>>4 == flvio.FRAME_KEY {
+				self.keys = append(self.keys, flvVodKey{ts: ts, pos: pos})
+			}
+		case flvio.TAG_AUDIO:
+			if datalen >= 2 {
+				format := head[0] >> 4
+				isHeader = (format == flvio.SOUND_AAC && head[1] == flvio.AAC_SEQHDR) ||
+					(format == flvio.SOUND_EXHEADER && head[0]&0x0f == flvio.AUDIO_PACKET_SEQSTART)
+			}
+			if !isHeader && (len(audioKeys) == 0 || ts-audioKeys[len(audioKeys)-1].ts >= vodAudioSeekInterval) {
+				audioKeys = append(audioKeys, flvVodKey{ts: ts, pos: pos})
+			}
+		}
+		if !isHeader && tag.Type != flvio.TAG_SCRIPTDATA && self.dataPos < 0 {
+			self.dataPos = pos
+		}
+		if isHeader && self.dataPos < 0 {
+			//第一个音视频 tag 之前的头完整读出来
+			data := make([]byte, datalen)
+			if _, err = io.ReadFull(self.r, data); err != nil {
+				break
+			}
+			var n int
+			if n, err = (&tag).ParseHeader(data); err != nil {
+				break
+			}
+			tag.Data = data[n:]
+			self.header = append(self.header, tag)
+		} else if _, err = self.r.Discard(datalen); err != nil {
+			break
+		}
+		if _, err = self.r.Discard(flvio.TagTrailerLength); err != nil {
+			break
+		}
+		pos += int64(flvio.TagHeaderLength + datalen + flvio.TagTrailerLength)
+		if ts > self.duration {
+			self.duration = ts
+		}
+	}
+	if self.dataPos < 0 {
+		return fmt.Errorf("%s", "Rtmp.Vod.Flv.NoData")
+	}
+	//纯音频文件按音频 seek
+	if len(self.keys) == 0 {
+		self.keys = audioKeys
+	}
+	return nil
+}
+
+func (self *flvVodFile) Header() []flvio.Tag {
+	return self.header
+}
+
+func (self *flvVodFile) ReadTag() (tag flvio.Tag, ts int32, err error) {
+	return flvio.ReadTag(self.r, self.b)
+}
+
+func (self *flvVodFile) Seek(ts int32) (int32, error) {
+	pos, at := self.dataPos, int32(0)
+	i := sort.Search(len(self.keys), func(i int) bool { return self.keys[i].ts > ts })
+	if i > 0 {
+		pos, at = self.keys[i-1].pos, self.keys[i-1].ts
+	}
+	if _, err := self.f.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	self.r.Reset(self.f)
+	return at, nil
+}
+
+func (self *flvVodFile) Duration() int32 {
+	return self.duration
+}
+
+func (self *flvVodFile) Close() error {
+	return self.f.Close()
+}
+
+type mp4VodFile struct {
+	f       *os.File
+	demuxer *mp4.Demuxer
+	streams []av.CodecData
+	header  []flvio.Tag
+}
+
+func openMp4VodFile(file string) (vodFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	self := &mp4VodFile{f: f, demuxer: mp4.NewDemuxer(f)}
+	if self.streams, err = self.demuxer.Streams(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	//不支持写进 metadata 的编码忽略
+	metadata, _ := flv.NewMetadataByStreams(self.streams)
+	if metadata == nil {
+		metadata = amf.AMFMap{}
+	}
+	metadata["duration"] = self.demuxer.Duration().Seconds()
+	if tag, ok := flv.MetadeToTag("onMetaData", metadata); ok {
+		self.header = append(self.header, *tag)
+	}
+	for _, stream := range self.streams {
+		if tag, ok, err := flv.CodecDataToTag(stream); err == nil && ok {
+			self.header = append(self.header, *tag)
+		}
+	}
+	return self, nil
+}
+
+func (self *mp4VodFile) Header() []flvio.Tag {
+	return self.header
+}
+
+func (self *mp4VodFile) ReadTag() (tag flvio.Tag, ts int32, err error) {
+	var pkt av.Packet
+	if pkt, err = self.demuxer.ReadPacket(); err != nil {
+		return
+	}
+	tag, ts = flv.PacketToTag(pkt, self.streams[pkt.Idx])
+	return
+}
+
+func (self *mp4VodFile) Seek(ts int32) (int32, error) {
+	pos, err := self.demuxer.SeekToTime(time.Duration(ts) * time.Millisecond)
+	return flvio.TimeToTs(pos), err
+}
+
+func (self *mp4VodFile) Duration() int32 {
+	return flvio.TimeToTs(self.demuxer.Duration())
+}
+
+func (self *mp4VodFile) Close() error {
+	return self.f.Close()
+}
+
+//play 的流名是否是点播文件，返回相对录制目录的文件名
+func vodName(playpath string) (name string, ok bool) {
+	name = strings.SplitN(playpath, "?", 2)[0]
+	for _, prefix := range []string{"flv:", "mp4:"} {
+		if strings.HasPrefix(name, prefix) {
+			name = name[len(prefix):]
+			if len(path.Ext(name)) == 0 {
+				name += "." + prefix[:3]
+			}
+		}
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".flv", ".mp4":
+		return name, len(name) > 4
+	}
+	return "", false
+}
+
+//录制目录，和 flvRecordOnPublish 一致，录制用的是推流域名 app 的配置
+func (self *Session) vodFilePath(name string) string {
+	flvPath := ""
+	for _, domain := range Gconfig.UserConf.PublishDomain {
+		if domain.UniqueName != self.uniqueName {
+			continue
+		}
+		if cnf := domain.App[self.App]; cnf != nil && len(cnf.RecodeFlvPath) > 0 {
+			flvPath = cnf.RecodeFlvPath
+			break
+		}
+	}
+	if len(flvPath) == 0 {
+		flvPath = self.UserCnf.RecodeFlvPath
+	}
+	if len(flvPath) == 0 {
+		flvPath = BasePath + "/flv/"
+	}
+	//不能跳出录制目录
+	return filepath.Join(flvPath, self.uniqueName, self.App, filepath.Clean("/"+name))
+}
+
+type vodItem struct {
+	name string
+	//ms，负数从头开始
+	start int32
+	//ms，负数播到结束，0 只播 start 处的一帧
+	duration int32
+}
+
+//读协程交给发送协程的命令
+type vodCmd struct {
+	name    string
+	transid float64
+	params  []interface{}
+	value   uint32
+}
+
+type vodPlayer struct {
+	items []vodItem
+	file  vodFile
+	ctrl  chan vodCmd
+	done  chan bool
+
+	paused   bool
+	complete bool
+	next     *flvio.Tag
+	nextTs   int32
+	//发送到的时间戳，和 end 比较
+	pos int32
+	end int32
+	//发送节奏，baseTs 对应 baseTime
+	baseTime time.Time
+	baseTs   int32
+	ahead    time.Duration
+	bytes    int64
+}
+
+var vodNow = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+//点播时替换 session 的命令表，除了 close delete 都交给发送协程
+func newRtmpVodCmdHandler() (RtmpCmdHandles RtmpCmdHandle) {
+	RtmpCmdHandles = make(RtmpCmdHandle)
+	RtmpCmdHandles["play"] = func(session *Session, b []byte) (int, error) {
+		return session.vodForward("play", b)
+	}
+	RtmpCmdHandles["play2"] = RtmpPlay2CmdHandler
+	RtmpCmdHandles["seek"] = RtmpSeekCmdHandler
+	RtmpCmdHandles["pause"] = RtmpPauseCmdHandler
+	RtmpCmdHandles["pauseraw"] = RtmpPauseCmdHandler
+	RtmpCmdHandles["closeStream"] = RtmpCloseStreamCmdHandler
+	RtmpCmdHandles["deleteStream"] = RtmpDeleteStreamCmdHandler
+	return
+}
+
+func RtmpPlay2CmdHandler(session *Session, b []byte) (n int, err error) {
+	return session.vodForward("play2", b)
+}
+
+func RtmpSeekCmdHandler(session *Session, b []byte) (n int, err error) {
+	return session.vodForward("seek", b)
+}
+
+func RtmpPauseCmdHandler(session *Session, b []byte) (n int, err error) {
+	return session.vodForward("pause", b)
+}
+
+//直播没有 seek pause，忽略
+func (self *Session) vodForward(name string, b []byte) (n int, err error) {
+	if self.vod == nil {
+		log.Log.Info(fmt.Sprintf("%s rtmp %s cmd not vod ignore", self.LogFormat(), name))
+		return
+	}
+	cmd := vodCmd{name: name}
+	var transid, obj interface{}
+	var size int
+	if transid, size, err = amf.ParseAMF0Val(b[n:]); err != nil {
+		return
+	}
+	n += size
+	cmd.transid, _ = transid.(float64)
+	if n < len(b) {
+		if _, size, err = amf.ParseAMF0Val(b[n:]); err != nil {
+			return
+		}
+		n += size
+	}
+	for n < len(b) {
+		if obj, size, err = amf.ParseAMF0Val(b[n:]); err != nil {
+			return
+		}
+		n += size
+		cmd.params = append(cmd.params, obj)
+	}
+	self.vodSendCmd(cmd)
+	return
+}
+
+func (self *Session) vodSendCmd(cmd vodCmd) {
+	select {
+	case self.vod.ctrl <- cmd:
+	case <-self.vod.done:
+	}
+}
+
+//amf 数字参数，秒转 ms
+func vodArgMs(params []interface{}, i int, scale float64, def int32) int32 {
+	if i < len(params) {
+		if v, ok := params[i].(float64); ok {
+			return int32(v * scale)
+		}
+	}
+	return def
+}
+
+func vodArgBool(params []interface{}, i int, def bool) bool {
+	if i < len(params) {
+		switch v := params[i].(type) {
+		case bool:
+			return v
+		case float64:
+			return v != 0
+		}
+	}
+	return def
+}
+
+//play(name, start, duration, reset)
+func vodPlayItem(name string, params []interface{}) vodItem {
+	return vodItem{
+		name:     name,
+		start:    vodArgMs(params, 0, 1000, -1),
+		duration: vodArgMs(params, 1, 1000, -1),
+	}
+}
+
+//RtmpPlayCmdHandler 中流名是点播文件时调用
+func (self *Session) vodPlayCmd(name string, params []interface{}) (err error) {
+	self.StreamId = name
+	self.vod = &vodPlayer{ctrl: make(chan vodCmd, 16), done: make(chan bool), ahead: vodDefaultAhead}
+	item := vodPlayItem(name, params)
+	if err = self.vodOpenItem(item); err != nil {
+		log.Log.Info(fmt.Sprintf("%s rtmp vod play %s err:%s", self.LogFormat(), name, err.Error()))
+		self.vod = nil
+		if err = self.writeRtmpStatus("NetStream.Play.StreamNotFound", "error", "No such file"); err != nil {
+			return
+		}
+		self.flushWrite()
+		return fmt.Errorf("%s", "NetStream.Play.StreamNotFound")
+	}
+	self.vod.items = []vodItem{item}
+	self.rtmpCmdHandler = newRtmpVodCmdHandler()
+
+	if err = self.writeRtmpStatus("NetStream.Play.Reset", "status", "Playing and resetting "+name); err != nil {
+		return
+	}
+	if err = self.writeRtmpStatus("NetStream.Play.Start", "status", "Started playing "+name); err != nil {
+		return
+	}
+	if err = self.writeStreamBegin(self.avmsgsid); err != nil {
+		return
+	}
+	if err = self.writeDataMsg(5, self.avmsgsid, "|RtmpSampleAccess", true, true); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	log.Log.Info(fmt.Sprintf("%s rtmp vod play %s ok!", self.LogFormat(), name))
+	self.playing = true
+	self.stage = stageCommandDone
+	return
+}
+
+//打开文件并跳到 start
+func (self *Session) vodOpenItem(item vodItem) (err error) {
+	vod := self.vod
+	var file vodFile
+	if file, err = openVodFile(self.vodFilePath(item.name)); err != nil {
+		return
+	}
+	if vod.file != nil {
+		vod.file.Close()
+	}
+	vod.file = file
+	vod.end = -1
+	if err = self.vodSeek(item.start); err != nil {
+		return
+	}
+	if item.duration >= 0 {
+		vod.end = vod.pos + item.duration
+	}
+	return
+}
+
+func (self *Session) vodSeek(ts int32) (err error) {
+	vod := self.vod
+	if ts < 0 {
+		ts = 0
+	}
+	if ts > vod.file.Duration() {
+		ts = vod.file.Duration()
+	}
+	if vod.pos, err = vod.file.Seek(ts); err != nil {
+		return
+	}
+	vod.next = nil
+	vod.complete = false
+	vod.baseTime, vod.baseTs = time.Now(), vod.pos
+	return
+}
+
+func (self *Session) vodWriteTag(tag *flvio.Tag, ts int32) (err error) {
+	var n int
+	switch tag.Type {
+	case flvio.TAG_AUDIO:
+		b := flvTagBody(*tag)
+		n, err = self.DoSend(b, 6, uint32(ts), RtmpMsgAudio, self.avmsgsid, len(b))
+	case flvio.TAG_VIDEO:
+		b := flvTagBody(*tag)
+		n, err = self.DoSend(b, 7, uint32(ts), RtmpMsgVideo, self.avmsgsid, len(b))
+	case flvio.TAG_SCRIPTDATA:
+		n, err = self.DoSend(tag.Data, 5, uint32(ts), RtmpMsgAmfMeta, self.avmsgsid, len(tag.Data))
+	}
+	self.vod.bytes += int64(n)
+	return
+}
+
+func (self *Session) vodWriteHeader() (err error) {
+	for _, tag := range self.vod.file.Header() {
+		if err = self.vodWriteTag(&tag, self.vod.pos); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *Session) vodPlayStatus(code string) (err error) {
+	vod := self.vod
+	return self.writeDataMsg(5, self.avmsgsid, "onPlayStatus", amf.AMFMap{
+		"level":    "status",
+		"code":     code,
+		"duration": float64(vod.pos) / 1000,
+		"bytes":    vod.bytes,
+	})
+}
+
+//读客户端命令，连接断开时关闭 ctrl
+func (self *Session) vodReadCycle() {
+	defer close(self.vod.ctrl)
+	for {
+		if err := self.readChunk(RtmpMsgHandles); err != nil {
+			log.Log.Info(fmt.Sprintf("%s rtmp vod read err:%s", self.LogFormat(), err.Error()))
+			return
+		}
+	}
+}
+
+//点播发送协程，按时间戳发送，处理读协程交过来的命令
+func (self *Session) vodPlay() (err error) {
+	vod := self.vod
+	defer func() {
+		close(vod.done)
+		if vod.file != nil {
+			vod.file.Close()
+		}
+	}()
+	//读协程不写，写都在这个协程
+	self.ctrlRead = true
+	go self.vodReadCycle()
+
+	if err = self.vodWriteHeader(); err != nil {
+		return
+	}
+	for {
+		//读协程收到的字节在这里回 ack
+		if err = self.rtmpAckSend(); err != nil {
+			return
+		}
+		var due <-chan time.Time
+		if vod.file != nil && !vod.paused && !vod.complete {
+			if vod.next == nil {
+				if err = self.vodReadNext(); err != nil {
+					return
+				}
+				continue
+			}
+			wait := vod.baseTime.Add(time.Duration(vod.nextTs-vod.baseTs)*time.Millisecond - vod.ahead).Sub(time.Now())
+			if wait > 0 {
+				due = time.After(wait)
+			} else {
+				due = vodNow
+			}
+		}
+		if due != vodNow {
+			if err = self.flushWrite(); err != nil {
+				return
+			}
+		}
+		select {
+		case cmd, ok := <-vod.ctrl:
+			if !ok {
+				return
+			}
+			if err = self.vodHandleCmd(cmd); err != nil {
+				return
+			}
+			if err = self.flushWrite(); err != nil {
+				return
+			}
+		case <-due:
+			if err = self.rtmpAckThrottle(); err != nil {
+				return
+			}
+			if err = self.vodWriteTag(vod.next, vod.nextTs); err != nil {
+				return
+			}
+			vod.pos = vod.nextTs
+			vod.next = nil
+		}
+	}
+}
+
+func (self *Session) vodReadNext() (err error) {
+	vod := self.vod
+	tag, ts, err := vod.file.ReadTag()
+	if err == nil && (vod.end < 0 || ts <= vod.end) {
+		vod.next, vod.nextTs = &tag, ts
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		log.Log.Info(fmt.Sprintf("%s rtmp vod read file err:%s", self.LogFormat(), err.Error()))
+	}
+	return self.vodItemDone()
+}
+
+//一个文件播完，播放列表里还有时接着播下一个
+func (self *Session) vodItemDone() (err error) {
+	vod := self.vod
+	for len(vod.items) > 1 {
+		vod.items = vod.items[1:]
+		item := vod.items[0]
+		if err = self.vodOpenItem(item); err != nil {
+			log.Log.Info(fmt.Sprintf("%s rtmp vod play %s err:%s", self.LogFormat(), item.name, err.Error()))
+			if err = self.writeRtmpStatus("NetStream.Play.StreamNotFound", "error", "No such file "+item.name); err != nil {
+				return
+			}
+			continue
+		}
+		if err = self.vodPlayStatus("NetStream.Play.Switch"); err != nil {
+			return
+		}
+		if err = self.writeRtmpStatus("NetStream.Play.Start", "status", "Started playing "+item.name); err != nil {
+			return
+		}
+		return self.vodWriteHeader()
+	}
+	vod.complete = true
+	if err = self.vodPlayStatus("NetStream.Play.Complete"); err != nil {
+		return
+	}
+	if err = self.writeStreamEof(self.avmsgsid); err != nil {
+		return
+	}
+	if err = self.writeRtmpStatus("NetStream.Play.Stop", "status", "Stopped playing"); err != nil {
+		return
+	}
+	log.Log.Info(fmt.Sprintf("%s rtmp vod play complete", self.LogFormat()))
+	return
+}
+
+//新的 play 或 play2 reset，替换播放列表
+func (self *Session) vodReset(item vodItem, reset bool) (err error) {
+	vod := self.vod
+	if err = self.vodOpenItem(item); err != nil {
+		log.Log.Info(fmt.Sprintf("%s rtmp vod play %s err:%s", self.LogFormat(), item.name, err.Error()))
+		return self.writeRtmpStatus("NetStream.Play.StreamNotFound", "error", "No such file "+item.name)
+	}
+	vod.items = []vodItem{item}
+	vod.paused = false
+	if reset {
+		if err = self.writeRtmpStatus("NetStream.Play.Reset", "status", "Playing and resetting "+item.name); err != nil {
+			return
+		}
+	}
+	if err = self.writeRtmpStatus("NetStream.Play.Start", "status", "Started playing "+item.name); err != nil {
+		return
+	}
+	if err = self.writeStreamBegin(self.avmsgsid); err != nil {
+		return
+	}
+	return self.vodWriteHeader()
+}
+
+//加到播放列表，当前已经播完时直接开始
+func (self *Session) vodAppend(item vodItem) (err error) {
+	vod := self.vod
+	if vod.complete {
+		return self.vodReset(item, false)
+	}
+	vod.items = append(vod.items, item)
+	return
+}
+
+func (self *Session) vodHandleCmd(cmd vodCmd) (err error) {
+	vod := self.vod
+	if len(cmd.name) > 0 && cmd.name[0] != '_' {
+		self.commandtransid = cmd.transid
+	}
+	switch cmd.name {
+	case "play":
+		playpath, _ := vodArgString(cmd.params, 0)
+		name, ok := vodName(playpath)
+		if !ok {
+			return self.writeRtmpStatus("NetStream.Play.StreamNotFound", "error", "Not a vod file "+playpath)
+		}
+		item := vodPlayItem(name, cmd.params[1:])
+		if vodArgBool(cmd.params, 3, true) {
+			return self.vodReset(item, true)
+		}
+		return self.vodAppend(item)
+
+	case "play2":
+		var opts amf.AMFMap
+		if len(cmd.params) > 0 {
+			opts, _ = cmd.params[0].(amf.AMFMap)
+		}
+		streamName, _ := opts["streamName"].(string)
+		name, ok := vodName(streamName)
+		if !ok {
+			return self.writeRtmpStatus("NetStream.Play.StreamNotFound", "error", "Not a vod file "+streamName)
+		}
+		item := vodItem{name: name, start: -1, duration: -1}
+		if v, ok := opts["start"].(float64); ok {
+			item.start = int32(v * 1000)
+		}
+		if v, ok := opts["len"].(float64); ok {
+			item.duration = int32(v * 1000)
+		}
+		transition, _ := opts["transition"].(string)
+		switch transition {
+		case "reset":
+			return self.vodReset(item, true)
+		case "append", "appendAndWait":
+			return self.vodAppend(item)
+		}
+		//switch swap: 在当前位置换成另一个文件，用于切换码率
+		item.start = vod.pos
+		if v, ok := opts["offset"].(float64); ok && v >= 0 {
+			item.start = int32(v * 1000)
+		}
+		if err = self.vodOpenItem(item); err != nil {
+			log.Log.Info(fmt.Sprintf("%s rtmp vod play2 %s err:%s", self.LogFormat(), name, err.Error()))
+			return self.writeRtmpStatus("NetStream.Play.Failed", "error", "Switch failed "+streamName)
+		}
+		if len(vod.items) > 0 {
+			vod.items[0] = item
+		} else {
+			vod.items = []vodItem{item}
+		}
+		if err = self.writeRtmpStatus("NetStream.Play.Transition", "status", "Transition to "+streamName); err != nil {
+			return
+		}
+		if err = self.vodWriteHeader(); err != nil {
+			return
+		}
+		return self.vodPlayStatus("NetStream.Play.TransitionComplete")
+
+	case "seek":
+		if vod.file == nil {
+			return self.writeRtmpStatus("NetStream.Seek.Failed", "error", "Seek failed")
+		}
+		if err = self.vodSeek(vodArgMs(cmd.params, 0, 1, 0)); err != nil {
+			return
+		}
+		if len(vod.items) > 0 && vod.items[0].duration >= 0 {
+			vod.end = vod.pos + vod.items[0].duration
+		}
+		if err = self.writeRtmpStatus("NetStream.Seek.Notify", "status", fmt.Sprintf("Seeking %d.", vod.pos)); err != nil {
+			return
+		}
+		if err = self.writeStreamBegin(self.avmsgsid); err != nil {
+			return
+		}
+		return self.vodWriteHeader()
+
+	case "pause":
+		if vodArgBool(cmd.params, 0, true) {
+			if vod.paused {
+				return
+			}
+			vod.paused = true
+			if err = self.writeStreamEof(self.avmsgsid); err != nil {
+				return
+			}
+			return self.writeRtmpStatus("NetStream.Pause.Notify", "status", "Paused")
+		}
+		if !vod.paused {
+			return
+		}
+		vod.paused = false
+		if vod.file != nil {
+			if err = self.vodSeek(vodArgMs(cmd.params, 1, 1, vod.pos)); err != nil {
+				return
+			}
+		}
+		if err = self.writeStreamBegin(self.avmsgsid); err != nil {
+			return
+		}
+		if err = self.writeRtmpStatus("NetStream.Unpause.Notify", "status", "Unpaused"); err != nil {
+			return
+		}
+		if vod.file != nil {
+			return self.vodWriteHeader()
+		}
+
+	case "_bufLen":
+		vod.ahead = time.Duration(cmd.value) * time.Millisecond
+		if vod.ahead < vodDefaultAhead {
+			vod.ahead = vodDefaultAhead
+		}
+		if vod.ahead > vodMaxAhead {
+			vod.ahead = vodMaxAhead
+		}
+
+	case "_ping":
+		return self.sendSetPingResponse(self.avmsgsid, cmd.value)
+	}
+	return
+}
+
+func vodArgString(params []interface{}, i int) (string, bool) {
+	if i < len(params) {
+		s, ok := params[i].(string)
+		return s, ok
+	}
+	return "", false
+}
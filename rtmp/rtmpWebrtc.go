@@ -0,0 +1,579 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/flv/flvio"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/log"
+	"rtmpServerStudy/rtsp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+webrtc 网关，浏览器低延时推流和播放，只支持 h264 和 opus，不转码
+whip 推流: POST /whip/{app}/{name}?vhost=xxx body 为 offer sdp，返回 201 和 answer sdp，rtp 解包后和 rtmp 推流一致
+whep 播放: POST /whep/{app}/{name}?vhost=xxx 同上，从推流的 gop 缓存和 CursorList 取数据打包成 rtp
+Location 为 /webrtc/{id}，DELETE 结束
+服务端 ice-lite，不支持 trickle ice，answer 中带全部 candidate
+*/
+
+const (
+	webrtcContentType = "application/sdp"
+	//ice dtls 建连超时
+	webrtcConnectTimeout = 10 * time.Second
+	//推流定时请求关键帧，播放端秒开
+	webrtcPliInterval = 2 * time.Second
+	webrtcReceiveMTU  = 1500
+)
+
+//只协商 packetization-mode=1 的 h264 和 opus，浏览器推流不会选到 vp8
+var webrtcVideoProfiles = []struct {
+	payloadType    webrtc.PayloadType
+	profileLevelId string
+}{
+	{102, "42001f"},
+	{125, "42e01f"},
+	{127, "4d001f"},
+	{123, "640032"},
+}
+
+var webrtcApi *webrtc.API
+
+//udpConn 为 UdpListen 监听的连接，没有配置时为 nil
+func newWebrtcApi(cnf config.Webrtc) (api *webrtc.API, udpConn *net.UDPConn, err error) {
+	m := &webrtc.MediaEngine{}
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"},
+		{Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, profile := range webrtcVideoProfiles {
+		if err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile.profileLevelId,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: profile.payloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return
+		}
+	}
+	if err = m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return
+	}
+	//nack rtcp 报告等
+	i := &interceptor.Registry{}
+	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetLite(true)
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	if len(cnf.PublicIp) > 0 {
+		s.SetNAT1To1IPs(cnf.PublicIp, webrtc.ICECandidateTypeHost)
+	}
+	if len(cnf.UdpListen) > 0 {
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr("udp", cnf.UdpListen); err != nil {
+			return
+		}
+		if udpConn, err = net.ListenUDP("udp", addr); err != nil {
+			return
+		}
+		s.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpConn))
+		log.Log.Info("the webrtc server listening on :" + cnf.UdpListen)
+	}
+	api = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+	return
+}
+
+//whep 播放的一路 track
+type webrtcTrack struct {
+	local      *webrtc.TrackLocalStaticRTP
+	media      *rtsp.Media
+	packetizer *rtsp.Packetizer
+}
+
+type webrtcConn struct {
+	id        string
+	pc        *webrtc.PeerConnection
+	remote    string
+	connected chan bool
+	done      chan bool
+	connOnce  sync.Once
+	closeOnce sync.Once
+
+	//推流，各 track 在不同协程，写入推流时串行
+	publish    *Session
+	ingestLock sync.Mutex
+	start      time.Time
+
+	//播放
+	play         *Session
+	video, audio *webrtcTrack
+}
+
+var webrtcConns = struct {
+	sync.RWMutex
+	conns map[string]*webrtcConn
+}{conns: make(map[string]*webrtcConn)}
+
+func newWebrtcConn(remote string) (self *webrtcConn, err error) {
+	if webrtcApi == nil {
+		return nil, fmt.Errorf("%s", "Rtmp.Webrtc.Disabled")
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	self = &webrtcConn{
+		id:        hex.EncodeToString(b),
+		remote:    remote,
+		connected: make(chan bool),
+		done:      make(chan bool),
+		start:     time.Now(),
+	}
+	if self.pc, err = webrtcApi.NewPeerConnection(webrtc.Configuration{}); err != nil {
+		return
+	}
+	self.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			self.connOnce.Do(func() {
+				close(self.connected)
+			})
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			//回调中不能同步 close
+			go self.close()
+		}
+	})
+	return
+}
+
+func (self *webrtcConn) close() {
+	self.closeOnce.Do(func() {
+		close(self.done)
+		webrtcConns.Lock()
+		delete(webrtcConns.conns, self.id)
+		webrtcConns.Unlock()
+		self.pc.Close()
+		if self.play != nil {
+			self.play.isClosed = true
+			select {
+			case self.play.PacketAck <- true:
+			default:
+			}
+		}
+		if self.publish != nil {
+			self.ingestLock.Lock()
+			self.publish.ingestClose()
+			self.ingestLock.Unlock()
+		}
+	})
+}
+
+//设置 offer 生成 answer，等 candidate 收集完，成功后可以 DELETE
+func (self *webrtcConn) negotiate(offer []byte) (answer []byte, err error) {
+	if err = self.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		return
+	}
+	var desc webrtc.SessionDescription
+	if desc, err = self.pc.CreateAnswer(nil); err != nil {
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(self.pc)
+	if err = self.pc.SetLocalDescription(desc); err != nil {
+		return
+	}
+	<-gatherComplete
+	webrtcConns.Lock()
+	webrtcConns.conns[self.id] = self
+	webrtcConns.Unlock()
+	return []byte(self.pc.LocalDescription().SDP), nil
+}
+
+//建连超时或者结束返回 false
+func (self *webrtcConn) waitConnected() bool {
+	select {
+	case <-self.connected:
+		return true
+	case <-self.done:
+	case <-time.After(webrtcConnectTimeout):
+		fmt.Printf("webrtc %s err the err is %s\n", self.remote, "Rtmp.Webrtc.Connect.Timeout")
+	}
+	self.close()
+	return false
+}
+
+func webrtcCors(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
+
+func webrtcWriteAnswer(w http.ResponseWriter, conn *webrtcConn, answer []byte) {
+	w.Header().Set("Content-Type", webrtcContentType)
+	w.Header().Set("Location", "/webrtc/"+conn.id)
+	w.WriteHeader(201)
+	w.Write(answer)
+}
+
+//浏览器跨域的预检
+func WebrtcOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	webrtcCors(w)
+	w.WriteHeader(204)
+}
+
+//whip 推流，例如 POST http://test.uplive.com:8087/whip/live/123
+func WHIPHandler(w http.ResponseWriter, r *http.Request) {
+	webrtcCors(w)
+	host := httpRequestHost(r)
+	app := mux.Vars(r)["app"]
+	name := mux.Vars(r)["name"]
+
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	session := newIngestSession(ioutil.NopCloser(&bytes.Buffer{}), "whip", r.RemoteAddr)
+	if err = session.ingestCheck(host, app, name); err != nil {
+		fmt.Printf("whip publish %s err the err is %s\n", r.URL.Path, err.Error())
+		w.WriteHeader(403)
+		return
+	}
+	conn, err := newWebrtcConn(r.RemoteAddr)
+	if err != nil {
+		fmt.Printf("whip publish %s err the err is %s\n", r.URL.Path, err.Error())
+		w.WriteHeader(503)
+		return
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err = conn.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			conn.close()
+			w.WriteHeader(500)
+			return
+		}
+	}
+	conn.pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go conn.recvLoop(remote)
+	})
+
+	if err = session.ingestPublish(); err != nil {
+		conn.close()
+		w.WriteHeader(409)
+		return
+	}
+	conn.publish = session
+	answer, err := conn.negotiate(offer)
+	if err != nil {
+		fmt.Printf("whip publish %s err the err is %s\n", r.URL.Path, err.Error())
+		conn.close()
+		w.WriteHeader(400)
+		return
+	}
+	webrtcWriteAnswer(w, conn, answer)
+	go conn.waitConnected()
+}
+
+//fmtp 参数，如 minptime=10;useinbandfec=1
+func webrtcParseFmtp(line string) map[string]string {
+	fmtp := map[string]string{}
+	for _, param := range strings.Split(line, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+			fmtp[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+	return fmtp
+}
+
+//推流的一路 track，rtp 解包后写入推流，时间按这一路第一个包到达的时间对齐
+func (self *webrtcConn) recvLoop(remote *webrtc.TrackRemote) {
+	defer self.close()
+	codec := remote.Codec()
+	media := &rtsp.Media{
+		Type:        remote.Kind().String(),
+		PayloadType: uint8(remote.PayloadType()),
+		Encoding:    strings.ToUpper(codec.MimeType[strings.Index(codec.MimeType, "/")+1:]),
+		ClockRate:   int(codec.ClockRate),
+		Fmtp:        webrtcParseFmtp(codec.SDPFmtpLine),
+	}
+	depacketizer, err := rtsp.NewDepacketizer(media)
+	if err != nil {
+		fmt.Printf("whip publish %s err the err is %s\n", self.remote, err.Error())
+		return
+	}
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		go self.pliLoop(remote.SSRC())
+	}
+
+	var offset time.Duration
+	started := false
+	codecVersion := 0
+	b := make([]byte, webrtcReceiveMTU)
+	for {
+		n, _, err := remote.Read(b)
+		if err != nil {
+			return
+		}
+		var pkts []av.Packet
+		if pkts, err = depacketizer.Decode(b[:n]); err != nil {
+			continue
+		}
+		if !started && len(pkts) > 0 {
+			started = true
+			offset = time.Since(self.start) - pkts[0].Time
+		}
+		codec := depacketizer.CodecData()
+		if codec == nil {
+			continue
+		}
+		version := depacketizer.CodecVersion()
+		self.ingestLock.Lock()
+		err = self.publish.ingestWritePackets(codec, version != codecVersion, pkts, offset)
+		self.ingestLock.Unlock()
+		codecVersion = version
+		if err != nil {
+			fmt.Printf("whip publish %s err the err is %s\n", self.remote, err.Error())
+			return
+		}
+	}
+}
+
+func (self *webrtcConn) pliLoop(ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(webrtcPliInterval)
+	defer ticker.Stop()
+	for {
+		if err := self.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+			return
+		}
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *webrtcConn) addTrack(media *rtsp.Media) (track *webrtcTrack, err error) {
+	mimeType := webrtc.MimeTypeH264
+	if media.Encoding == "OPUS" {
+		mimeType = webrtc.MimeTypeOpus
+	}
+	track = &webrtcTrack{media: media, packetizer: rtsp.NewPacketizer(media)}
+	if track.local, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, media.Type, "rtmpServerStudy"); err != nil {
+		return
+	}
+	var sender *webrtc.RTPSender
+	if sender, err = self.pc.AddTrack(track.local); err != nil {
+		return
+	}
+	//读走 rtcp，nack 等 interceptor 才能工作
+	go func() {
+		b := make([]byte, webrtcReceiveMTU)
+		for {
+			if _, _, err := sender.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	return
+}
+
+//whep 播放，例如 POST http://test.live.com:8087/whep/live/123
+func WHEPHandler(w http.ResponseWriter, r *http.Request) {
+	webrtcCors(w)
+	host, ok := httpPlayAuth(w, r)
+	if !ok {
+		return
+	}
+	offer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	session := newLivePlaySession(host, mux.Vars(r)["app"], mux.Vars(r)["name"])
+	pubSession := RtmpSessionGet(session.StreamAnchor)
+	if pubSession == nil {
+		pubSession = sourcePullWait(host, session.App, session.StreamId, session.StreamAnchor, sourcePullWaitTimeout)
+	}
+	if pubSession == nil {
+		w.WriteHeader(404)
+		return
+	}
+	pubSession.RLock()
+	vCodec, aCodec := pubSession.vCodec, pubSession.aCodec
+	pubSession.RUnlock()
+
+	conn, err := newWebrtcConn(r.RemoteAddr)
+	if err != nil {
+		fmt.Printf("whep play %s err the err is %s\n", r.URL.Path, err.Error())
+		w.WriteHeader(503)
+		return
+	}
+	if vCodec != nil && vCodec.Type() == av.H264 {
+		media := &rtsp.Media{Type: "video", Encoding: "H264", ClockRate: 90000, CodecData: vCodec}
+		if conn.video, err = conn.addTrack(media); err != nil {
+			conn.close()
+			w.WriteHeader(500)
+			return
+		}
+	}
+	if aCodec != nil && aCodec.Type() == av.OPUS {
+		media := &rtsp.Media{Type: "audio", Encoding: "OPUS", ClockRate: 48000}
+		if conn.audio, err = conn.addTrack(media); err != nil {
+			conn.close()
+			w.WriteHeader(500)
+			return
+		}
+	}
+	if conn.video == nil && conn.audio == nil {
+		conn.close()
+		w.WriteHeader(415)
+		return
+	}
+	answer, err := conn.negotiate(offer)
+	if err != nil {
+		fmt.Printf("whep play %s err the err is %s\n", r.URL.Path, err.Error())
+		conn.close()
+		w.WriteHeader(400)
+		return
+	}
+	session.SessionId = "whep-" + conn.id
+	session.RemoteAddr = r.RemoteAddr
+	conn.play = session
+	webrtcWriteAnswer(w, conn, answer)
+
+	//dtls 建连后再挂到推流，不然 gop 之后的数据会丢
+	go func() {
+		if !conn.waitConnected() {
+			return
+		}
+		session.livePlayAttach(pubSession)
+		log.Log.Info(fmt.Sprintf("%s whep play start client addr:%s", session.LogFormat(), conn.remote))
+		conn.playLoop(session)
+	}()
+}
+
+//flv tag 的 av.Packet 打包成 rtp，h264 的 sequence header 更新关键帧前补的参数集
+func (self *webrtcConn) writePacket(pkt *av.Packet) (err error) {
+	tag := flvio.Tag{}
+	switch pkt.PacketType {
+	case RtmpMsgVideo:
+		tag.Type = flvio.TAG_VIDEO
+	case RtmpMsgAudio:
+		tag.Type = flvio.TAG_AUDIO
+	default:
+		return
+	}
+	if _, err = tag.ParseHeader(pkt.Data); err != nil {
+		return nil
+	}
+	var track *webrtcTrack
+	switch {
+	case tag.Type == flvio.TAG_VIDEO && tag.CodecID == flvio.VIDEO_H264 && self.video != nil:
+		track = self.video
+		if tag.AVCPacketType == flvio.AVC_SEQHDR {
+			if codec, err1 := h264parser.NewCodecDataFromAVCDecoderConfRecord(pkt.Data[pkt.DataPos:]); err1 == nil {
+				track.media.CodecData = codec
+			}
+			return
+		}
+		if tag.AVCPacketType != flvio.AVC_NALU {
+			return
+		}
+	case tag.Type == flvio.TAG_AUDIO && tag.SoundFormat == flvio.SOUND_EXHEADER && tag.AudioFourCC == flvio.FOURCC_OPUS && self.audio != nil:
+		track = self.audio
+		if tag.AudioPacketType != flvio.AUDIO_PACKET_CODEDFRAMES {
+			return
+		}
+	default:
+		return
+	}
+	for _, b := range track.packetizer.Packetize(pkt.Data[pkt.DataPos:], pkt.Time+pkt.CompositionTime, pkt.IsKeyFrame) {
+		if _, err = track.local.Write(b); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//同 rtsp playLoop，gop 之后发送 CursorList 分发的数据
+func (self *webrtcConn) playLoop(session *Session) {
+	defer func() {
+		session.isClosed = true
+		self.close()
+	}()
+	if session.GopCache != nil {
+		for pkt := session.GopCache.RingBufferGet(); pkt != nil; pkt = session.GopCache.RingBufferGet() {
+			if err := self.writePacket(pkt); err != nil {
+				return
+			}
+		}
+		session.GopCache = nil
+	}
+	for {
+		pkt := session.CurQue.RingBufferGet()
+		select {
+		case <-session.context.Done():
+			return
+		default:
+		}
+		if pkt == nil && session.isClosed != true {
+			select {
+			case <-session.PacketAck:
+			case <-self.done:
+				session.isClosed = true
+			}
+		}
+		if session.pubSession.isClosed == true {
+			session.isClosed = true
+		}
+		if session.isClosed == true && pkt == nil {
+			log.Log.Info(fmt.Sprintf("%s whep play done client addr:%s", session.LogFormat(), self.remote))
+			return
+		}
+		if pkt != nil {
+			if err := self.writePacket(pkt); err != nil {
+				fmt.Printf("whep play %s err the err is %s\n", self.remote, err.Error())
+				return
+			}
+		}
+	}
+}
+
+//DELETE /webrtc/{id} 结束推流或者播放
+func WebrtcDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	webrtcCors(w)
+	webrtcConns.RLock()
+	conn := webrtcConns.conns[mux.Vars(r)["id"]]
+	webrtcConns.RUnlock()
+	if conn == nil {
+		w.WriteHeader(404)
+		return
+	}
+	conn.close()
+	w.WriteHeader(200)
+}
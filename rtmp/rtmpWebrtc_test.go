@@ -0,0 +1,305 @@
+package rtmp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/config"
+	"rtmpServerStudy/rtsp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const webrtcTestConf = `
+RtmpServer:
+  ClusterCnf: ["127.0.0.1:1935"]
+  SelfIp: "127.0.0.1:1935"
+UserConf:
+  PublishDomain:
+    test.uplive.com:
+      UniqueName: test
+      App:
+        live:
+          RecodeFlv: 0
+          RecodeHls: 0
+  PlayDomain:
+    test.live.com:
+      UniqueName: test
+      App:
+        live:
+`
+
+var (
+	webrtcTestSps = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03,
+		0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	webrtcTestPps = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	//celt fb 20ms stereo
+	webrtcTestOpus = []byte{0xfc, 0xff, 0xfe}
+)
+
+//服务端 ice-lite 监听 127.0.0.1，客户端是普通的 pion peer
+func webrtcTestSetup(t *testing.T) (server *httptest.Server, client *webrtc.API) {
+	//测试结束时恢复全局的配置和 webrtc api
+	oldConfig, oldApi := Gconfig, webrtcApi
+	t.Cleanup(func() {
+		Gconfig, webrtcApi = oldConfig, oldApi
+	})
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(file, []byte(webrtcTestConf), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, Gconfig = config.ParseConfig(file); err != nil {
+		t.Fatal(err)
+	}
+	var udpConn *net.UDPConn
+	if webrtcApi, udpConn, err = newWebrtcApi(config.Webrtc{UdpListen: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		udpConn.Close()
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/whip/{app}/{name}", WHIPHandler).Methods("POST")
+	r.HandleFunc("/whep/{app}/{name}", WHEPHandler).Methods("POST")
+	r.HandleFunc("/webrtc/{id}", WebrtcDeleteHandler).Methods("DELETE")
+	server = httptest.NewServer(r)
+
+	m := &webrtc.MediaEngine{}
+	if err = m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	s := webrtc.SettingEngine{}
+	s.SetIncludeLoopbackCandidate(true)
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	client = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s))
+	return
+}
+
+//发送 offer，返回 answer 的状态码和 Location
+func webrtcTestOffer(t *testing.T, pc *webrtc.PeerConnection, url string) (code int, location string) {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	res, err := http.Post(url, webrtcContentType, strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return res.StatusCode, ""
+	}
+	answer, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Contains(answer, []byte("a=ice-lite")) {
+		t.Fatalf("answer is not ice-lite:\n%s", answer)
+	}
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, res.Header.Get("Location")
+}
+
+func webrtcTestConnected(t *testing.T, pc *webrtc.PeerConnection) {
+	connected := make(chan bool, 1)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			select {
+			case connected <- true:
+			default:
+			}
+		}
+	})
+	if pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		return
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dtls connect timeout")
+	}
+}
+
+func webrtcTestDelete(t *testing.T, url string) int {
+	req, _ := http.NewRequest("DELETE", url, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func webrtcTestWait(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWebrtcWhipWhep(t *testing.T) {
+	server, client := webrtcTestSetup(t)
+	defer server.Close()
+
+	//whip 推流 h264 + opus
+	pub, err := client.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	video, _ := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+	audio, _ := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "test")
+	for _, track := range []webrtc.TrackLocal{video, audio} {
+		if _, err = pub.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, whip := webrtcTestOffer(t, pub, server.URL+"/whip/live/cam?vhost=test.uplive.com")
+	if code != 201 {
+		t.Fatalf("whip status %d", code)
+	}
+	webrtcTestConnected(t, pub)
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		start := []byte{0, 0, 0, 1}
+		for i := 0; ; i++ {
+			frame := append(append([]byte{}, start...), 0x41, 0x9a, byte(i))
+			if i%10 == 0 {
+				frame = bytes.Join([][]byte{nil, webrtcTestSps, webrtcTestPps, {0x65, 0x88, byte(i)}}, start)
+			}
+			video.WriteSample(media.Sample{Data: frame, Duration: 40 * time.Millisecond})
+			audio.WriteSample(media.Sample{Data: webrtcTestOpus, Duration: 20 * time.Millisecond})
+			audio.WriteSample(media.Sample{Data: webrtcTestOpus, Duration: 20 * time.Millisecond})
+			select {
+			case <-done:
+				return
+			case <-time.After(40 * time.Millisecond):
+			}
+		}
+	}()
+
+	var pubSession *Session
+	if !webrtcTestWait(func() bool {
+		if pubSession = RtmpSessionGet("cam:test:live"); pubSession == nil {
+			return false
+		}
+		pubSession.RLock()
+		defer pubSession.RUnlock()
+		return pubSession.vCodec != nil && pubSession.vCodec.Type() == av.H264 &&
+			pubSession.aCodec != nil && pubSession.aCodec.Type() == av.OPUS
+	}) {
+		t.Fatal("whip publish has no h264 or opus")
+	}
+
+	//同一路流重复推流
+	dup, _ := client.NewPeerConnection(webrtc.Configuration{})
+	dup.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if code, _ = webrtcTestOffer(t, dup, server.URL+"/whip/live/cam?vhost=test.uplive.com"); code != 409 {
+		t.Fatalf("duplicate whip status %d", code)
+	}
+	dup.Close()
+
+	//whep 播放，收到的 h264 能组成帧
+	play, err := client.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err = play.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keyFrames, audioPkts int32
+	play.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		depacketizer, _ := rtsp.NewDepacketizer(&rtsp.Media{
+			Encoding:    strings.ToUpper(strings.TrimPrefix(strings.TrimPrefix(remote.Codec().MimeType, "video/"), "audio/")),
+			PayloadType: uint8(remote.PayloadType()),
+			Fmtp:        map[string]string{},
+		})
+		b := make([]byte, 1500)
+		for {
+			n, _, err := remote.Read(b)
+			if err != nil {
+				return
+			}
+			pkts, _ := depacketizer.Decode(b[:n])
+			for _, pkt := range pkts {
+				if remote.Kind() == webrtc.RTPCodecTypeAudio {
+					atomic.AddInt32(&audioPkts, 1)
+				} else if pkt.IsKeyFrame {
+					atomic.AddInt32(&keyFrames, 1)
+				}
+			}
+		}
+	})
+	code, whep := webrtcTestOffer(t, play, server.URL+"/whep/live/cam?vhost=test.live.com")
+	if code != 201 {
+		t.Fatalf("whep status %d", code)
+	}
+	webrtcTestConnected(t, play)
+	if !webrtcTestWait(func() bool {
+		return atomic.LoadInt32(&keyFrames) >= 2 && atomic.LoadInt32(&audioPkts) >= 10
+	}) {
+		t.Fatalf("whep got key frames %d audio %d", keyFrames, audioPkts)
+	}
+
+	if code = webrtcTestDelete(t, server.URL+whep); code != 200 {
+		t.Fatalf("whep delete status %d", code)
+	}
+	if code = webrtcTestDelete(t, server.URL+whep); code != 404 {
+		t.Fatalf("whep delete again status %d", code)
+	}
+	if code = webrtcTestDelete(t, server.URL+whip); code != 200 {
+		t.Fatalf("whip delete status %d", code)
+	}
+	if !webrtcTestWait(func() bool { return RtmpSessionGet("cam:test:live") == nil }) {
+		t.Fatal("whip publish is not removed")
+	}
+}
+
+func TestWebrtcReject(t *testing.T) {
+	server, client := webrtcTestSetup(t)
+	defer server.Close()
+
+	for _, c := range []struct {
+		url  string
+		code int
+	}{
+		{"/whip/live/cam?vhost=bad.uplive.com", 403},
+		{"/whip/bad/cam?vhost=test.uplive.com", 403},
+		{"/whep/live/cam?vhost=bad.live.com", 404},
+		{"/whep/live/none?vhost=test.live.com", 404},
+	} {
+		pc, _ := client.NewPeerConnection(webrtc.Configuration{})
+		pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if code, _ := webrtcTestOffer(t, pc, server.URL+c.url); code != c.code {
+			t.Errorf("%s status %d want %d", c.url, code, c.code)
+		}
+		pc.Close()
+	}
+	if code := webrtcTestDelete(t, server.URL+"/webrtc/00"); code != 404 {
+		t.Errorf("delete unknown status %d", code)
+	}
+}
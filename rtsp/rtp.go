@@ -0,0 +1,540 @@
+package rtsp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"time"
+
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/codec"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/utils/bits/pio"
+)
+
+/*
+rtp 打包和解包
+h264 RFC 6184 (single nalu, STAP-A, FU-A)，h265 RFC 7798 (single nalu, AP, FU)，aac RFC 3640 AAC-hbr
+opus RFC 7587 (webrtc 用)
+视频输出 avcc 格式的一帧，音频输出一个 aac 或 opus 帧，时间从第一个包开始
+*/
+
+const (
+	RtpHeaderLength = 12
+	//rtp payload 最大长度，tcp interleaved 和 udp 都不超过以太网 mtu
+	RtpMaxPayload = 1400
+
+	h264NalSTAPA = 24
+	h264NalFUA   = 28
+	h265NalAP    = 48
+	h265NalFU    = 49
+)
+
+type RtpPacket struct {
+	PayloadType uint8
+	Marker      bool
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte
+}
+
+func ParseRtp(b []byte) (pkt RtpPacket, err error) {
+	if len(b) < RtpHeaderLength || b[0]>>6 != 2 {
+		err = fmt.Errorf("%s", "Rtsp.Rtp.Header.Invalid")
+		return
+	}
+	n := RtpHeaderLength + int(b[0]&0xf)*4
+	//扩展头
+	if b[0]&0x10 != 0 {
+		if len(b) < n+4 {
+			err = fmt.Errorf("%s", "Rtsp.Rtp.Extension.Invalid")
+			return
+		}
+		n += 4 + int(pio.U16BE(b[n+2:]))*4
+	}
+	end := len(b)
+	//padding
+	if b[0]&0x20 != 0 && end > 0 {
+		end -= int(b[end-1])
+	}
+	if n > end {
+		err = fmt.Errorf("%s", "Rtsp.Rtp.Length.Invalid")
+		return
+	}
+	pkt.Marker = b[1]&0x80 != 0
+	pkt.PayloadType = b[1] & 0x7f
+	pkt.Seq = pio.U16BE(b[2:])
+	pkt.Timestamp = pio.U32BE(b[4:])
+	pkt.SSRC = pio.U32BE(b[8:])
+	pkt.Payload = b[n:end]
+	return
+}
+
+func (self RtpPacket) Marshal() []byte {
+	b := make([]byte, RtpHeaderLength+len(self.Payload))
+	b[0] = 0x80
+	b[1] = self.PayloadType & 0x7f
+	if self.Marker {
+		b[1] |= 0x80
+	}
+	pio.PutU16BE(b[2:], self.Seq)
+	pio.PutU32BE(b[4:], self.Timestamp)
+	pio.PutU32BE(b[8:], self.SSRC)
+	copy(b[RtpHeaderLength:], self.Payload)
+	return b
+}
+
+func randUint32() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return pio.U32BE(b)
+}
+
+func avccNalus(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	b := make([]byte, size)
+	pos := 0
+	for _, nalu := range nalus {
+		pio.PutU32BE(b[pos:], uint32(len(nalu)))
+		pos += 4 + copy(b[pos+4:], nalu)
+	}
+	return b
+}
+
+type Depacketizer struct {
+	media *Media
+	codec av.CodecData
+	//codec 更新次数，codec 不能直接比较
+	version int
+
+	//rtp 时间戳展开
+	started bool
+	lastTs  uint32
+	extTs   int64
+	lastSeq uint16
+
+	//当前帧
+	frameTs uint32
+	nalus   [][]byte
+	fu      []byte
+	key     bool
+
+	vps, sps, pps []byte
+
+	//aac
+	sizeLength  int
+	indexLength int
+}
+
+func NewDepacketizer(media *Media) (self *Depacketizer, err error) {
+	self = &Depacketizer{media: media, codec: media.CodecData}
+	if self.codec != nil {
+		self.version = 1
+	}
+	switch media.Encoding {
+	case "H264", "H265":
+		if media.ClockRate == 0 {
+			media.ClockRate = 90000
+		}
+	case "MPEG4-GENERIC":
+		if self.codec == nil {
+			err = fmt.Errorf("%s", "Rtsp.Aac.Config.Missing")
+			return
+		}
+		if media.ClockRate == 0 {
+			media.ClockRate = self.codec.(av.AudioCodecData).SampleRate()
+		}
+		self.sizeLength, self.indexLength = 13, 3
+		if v, err1 := strconv.Atoi(media.Fmtp["sizelength"]); err1 == nil {
+			self.sizeLength = v
+		}
+		if v, err1 := strconv.Atoi(media.Fmtp["indexlength"]); err1 == nil {
+			self.indexLength = v
+		}
+		if self.sizeLength+self.indexLength != 16 {
+			err = fmt.Errorf("%s", "Rtsp.Aac.AuHeader.Unsupported")
+			return
+		}
+	case "OPUS":
+		//rtpmap 固定 opus/48000/2，实际声道数在 fmtp stereo 中
+		channels := 1
+		if media.Fmtp["stereo"] == "1" {
+			channels = 2
+		}
+		self.codec = codec.NewOpusCodecData(channels)
+		self.version = 1
+		media.ClockRate = 48000
+	default:
+		err = fmt.Errorf("Rtsp.Codec.Unsupported(%s)", media.Encoding)
+	}
+	return
+}
+
+//sdp 中没有参数集时，收到带内 sps pps 后才有
+func (self *Depacketizer) CodecData() av.CodecData {
+	return self.codec
+}
+
+func (self *Depacketizer) CodecVersion() int {
+	return self.version
+}
+
+func (self *Depacketizer) time(ts uint32) time.Duration {
+	return time.Duration(self.extTs+int64(int32(ts-self.lastTs))) * time.Second / time.Duration(self.media.ClockRate)
+}
+
+func (self *Depacketizer) Decode(b []byte) (pkts []av.Packet, err error) {
+	var rtp RtpPacket
+	if rtp, err = ParseRtp(b); err != nil {
+		return
+	}
+	if rtp.PayloadType != self.media.PayloadType {
+		return
+	}
+	if !self.started {
+		self.started = true
+		self.lastTs = rtp.Timestamp
+		self.frameTs = rtp.Timestamp
+		self.lastSeq = rtp.Seq - 1
+	}
+	//丢包时丢掉正在组的分片
+	if rtp.Seq != self.lastSeq+1 {
+		self.fu = nil
+	}
+	self.lastSeq = rtp.Seq
+
+	switch self.media.Encoding {
+	case "MPEG4-GENERIC":
+		pkts, err = self.decodeAac(rtp)
+	case "OPUS":
+		//一个 rtp 包一个 opus 包
+		if len(rtp.Payload) > 0 {
+			pkts = append(pkts, av.Packet{Time: self.time(rtp.Timestamp), Data: append([]byte(nil), rtp.Payload...)})
+		}
+	default:
+		//时间戳变了说明上一帧没有 marker
+		if rtp.Timestamp != self.frameTs {
+			pkts = self.flushFrame(pkts)
+			self.frameTs = rtp.Timestamp
+		}
+		if self.media.Encoding == "H264" {
+			err = self.decodeH264(rtp.Payload)
+		} else {
+			err = self.decodeH265(rtp.Payload)
+		}
+		if rtp.Marker {
+			pkts = self.flushFrame(pkts)
+		}
+	}
+	self.extTs += int64(int32(rtp.Timestamp - self.lastTs))
+	self.lastTs = rtp.Timestamp
+	return
+}
+
+func (self *Depacketizer) flushFrame(pkts []av.Packet) []av.Packet {
+	self.updateCodec()
+	if len(self.nalus) > 0 && self.codec != nil {
+		pkts = append(pkts, av.Packet{
+			IsKeyFrame: self.key,
+			Time:       self.time(self.frameTs),
+			Data:       avccNalus(self.nalus),
+		})
+	}
+	self.nalus = nil
+	self.key = false
+	return pkts
+}
+
+//带内参数集生成或者更新 codec
+func (self *Depacketizer) updateCodec() {
+	if self.sps == nil || self.pps == nil {
+		return
+	}
+	switch self.media.Encoding {
+	case "H264":
+		if codec, err := h264parser.NewCodecDataFromSPSAndPPS([][]byte{self.sps}, [][]byte{self.pps}); err == nil {
+			if old, ok := self.codec.(h264parser.CodecData); !ok ||
+				!bytes.Equal(old.SPS(), codec.SPS()) || !bytes.Equal(old.PPS(), codec.PPS()) {
+				self.codec = codec
+				self.version++
+			}
+		}
+	case "H265":
+		var vps [][]byte
+		if self.vps != nil {
+			vps = [][]byte{self.vps}
+		}
+		if codec, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, [][]byte{self.sps}, [][]byte{self.pps}); err == nil {
+			if old, ok := self.codec.(h265parser.CodecData); !ok ||
+				!bytes.Equal(old.SPS(), codec.SPS()) || !bytes.Equal(old.PPS(), codec.PPS()) {
+				self.codec = codec
+				self.version++
+			}
+		}
+	}
+	self.vps, self.sps, self.pps = nil, nil, nil
+}
+
+func (self *Depacketizer) addH264Nalu(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	switch nalu[0] & 0x1f {
+	case 7:
+		self.sps = append([]byte(nil), nalu...)
+	case 8:
+		self.pps = append([]byte(nil), nalu...)
+	case 9:
+	case 5:
+		self.key = true
+		self.nalus = append(self.nalus, nalu)
+	default:
+		self.nalus = append(self.nalus, nalu)
+	}
+}
+
+func (self *Depacketizer) decodeH264(b []byte) (err error) {
+	if len(b) < 1 {
+		return
+	}
+	switch typ := b[0] & 0x1f; {
+	case typ >= 1 && typ <= 23:
+		self.addH264Nalu(append([]byte(nil), b...))
+	case typ == h264NalSTAPA:
+		for b = b[1:]; len(b) >= 2; {
+			size := int(pio.U16BE(b))
+			if size+2 > len(b) {
+				return fmt.Errorf("%s", "Rtsp.H264.StapA.Invalid")
+			}
+			self.addH264Nalu(append([]byte(nil), b[2:2+size]...))
+			b = b[2+size:]
+		}
+	case typ == h264NalFUA:
+		if len(b) < 2 {
+			return fmt.Errorf("%s", "Rtsp.H264.FuA.Invalid")
+		}
+		if b[1]&0x80 != 0 {
+			self.fu = append([]byte{b[0]&0xe0 | b[1]&0x1f}, b[2:]...)
+		} else if self.fu != nil {
+			self.fu = append(self.fu, b[2:]...)
+		}
+		if b[1]&0x40 != 0 && self.fu != nil {
+			self.addH264Nalu(self.fu)
+			self.fu = nil
+		}
+	}
+	return
+}
+
+func (self *Depacketizer) addH265Nalu(nalu []byte) {
+	if len(nalu) < 2 {
+		return
+	}
+	switch h265parser.NALUType(nalu) {
+	case h265parser.HEVC_NAL_VPS:
+		self.vps = append([]byte(nil), nalu...)
+	case h265parser.HEVC_NAL_SPS:
+		self.sps = append([]byte(nil), nalu...)
+	case h265parser.HEVC_NAL_PPS:
+		self.pps = append([]byte(nil), nalu...)
+	case h265parser.HEVC_NAL_AUD:
+	default:
+		if h265parser.IsIRAPNALU(nalu) {
+			self.key = true
+		}
+		self.nalus = append(self.nalus, nalu)
+	}
+}
+
+func (self *Depacketizer) decodeH265(b []byte) (err error) {
+	if len(b) < 2 {
+		return
+	}
+	switch typ := int(b[0]>>1) & 0x3f; {
+	case typ == h265NalAP:
+		for b = b[2:]; len(b) >= 2; {
+			size := int(pio.U16BE(b))
+			if size+2 > len(b) {
+				return fmt.Errorf("%s", "Rtsp.H265.Ap.Invalid")
+			}
+			self.addH265Nalu(append([]byte(nil), b[2:2+size]...))
+			b = b[2+size:]
+		}
+	case typ == h265NalFU:
+		if len(b) < 3 {
+			return fmt.Errorf("%s", "Rtsp.H265.Fu.Invalid")
+		}
+		if b[2]&0x80 != 0 {
+			self.fu = append([]byte{b[0]&0x81 | (b[2]&0x3f)<<1, b[1]}, b[3:]...)
+		} else if self.fu != nil {
+			self.fu = append(self.fu, b[3:]...)
+		}
+		if b[2]&0x40 != 0 && self.fu != nil {
+			self.addH265Nalu(self.fu)
+			self.fu = nil
+		}
+	case typ < 48:
+		self.addH265Nalu(append([]byte(nil), b...))
+	}
+	return
+}
+
+//AU-headers-length(16 bit) + AU-header(sizelength + indexlength) * n + AU * n
+func (self *Depacketizer) decodeAac(rtp RtpPacket) (pkts []av.Packet, err error) {
+	b := rtp.Payload
+	if len(b) < 2 {
+		return
+	}
+	headersLen := (int(pio.U16BE(b)) + 7) / 8
+	if 2+headersLen > len(b) {
+		err = fmt.Errorf("%s", "Rtsp.Aac.AuHeader.Invalid")
+		return
+	}
+	headers := b[2 : 2+headersLen]
+	data := b[2+headersLen:]
+	for i := 0; i+2 <= len(headers); i += 2 {
+		size := int(pio.U16BE(headers[i:])) >> uint(self.indexLength)
+		if size > len(data) {
+			err = fmt.Errorf("%s", "Rtsp.Aac.Au.Invalid")
+			return
+		}
+		pkts = append(pkts, av.Packet{
+			Time: self.time(rtp.Timestamp + uint32(i/2*1024)),
+			Data: append([]byte(nil), data[:size]...),
+		})
+		data = data[size:]
+	}
+	return
+}
+
+type Packetizer struct {
+	media  *Media
+	SSRC   uint32
+	seq    uint16
+	baseTs uint32
+}
+
+func NewPacketizer(media *Media) *Packetizer {
+	return &Packetizer{media: media, SSRC: randUint32(), seq: uint16(randUint32()), baseTs: randUint32()}
+}
+
+func (self *Packetizer) Seq() uint16 {
+	return self.seq
+}
+
+func (self *Packetizer) Timestamp(t time.Duration) uint32 {
+	return self.baseTs + uint32(int64(t)*int64(self.media.ClockRate)/int64(time.Second))
+}
+
+func (self *Packetizer) packet(payload []byte, ts uint32, marker bool) []byte {
+	rtp := RtpPacket{
+		PayloadType: self.media.PayloadType,
+		Marker:      marker,
+		Seq:         self.seq,
+		Timestamp:   ts,
+		SSRC:        self.SSRC,
+		Payload:     payload,
+	}
+	self.seq++
+	return rtp.Marshal()
+}
+
+//视频 data 为 avcc 格式的一帧，音频为一个 aac 或 opus 帧
+func (self *Packetizer) Packetize(data []byte, pts time.Duration, key bool) (pkts [][]byte) {
+	ts := self.Timestamp(pts)
+	switch self.media.Encoding {
+	case "OPUS":
+		return [][]byte{self.packet(data, ts, true)}
+	case "MPEG4-GENERIC":
+		payload := make([]byte, 4+len(data))
+		pio.PutU16BE(payload, 16)
+		pio.PutU16BE(payload[2:], uint16(len(data)<<3))
+		copy(payload[4:], data)
+		return [][]byte{self.packet(payload, ts, true)}
+	}
+
+	nalus, _ := h264parser.SplitNALUs(data)
+	//rtmp 推流的参数集在 sequence header 中，关键帧前补上
+	if key {
+		var params [][]byte
+		switch codec := self.media.CodecData.(type) {
+		case h264parser.CodecData:
+			params = [][]byte{codec.SPS(), codec.PPS()}
+		case h265parser.CodecData:
+			if vps := codec.VPS(); vps != nil {
+				params = append(params, vps)
+			}
+			params = append(params, codec.SPS(), codec.PPS())
+		}
+		nalus = append(params, nalus...)
+	}
+	for i, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nalu) <= RtpMaxPayload {
+			pkts = append(pkts, self.packet(nalu, ts, last))
+			continue
+		}
+		if self.media.Encoding == "H265" {
+			pkts = append(pkts, self.fragmentH265(nalu, ts, last)...)
+		} else {
+			pkts = append(pkts, self.fragmentH264(nalu, ts, last)...)
+		}
+	}
+	return
+}
+
+func (self *Packetizer) fragmentH264(nalu []byte, ts uint32, last bool) (pkts [][]byte) {
+	indicator := nalu[0]&0xe0 | h264NalFUA
+	typ := nalu[0] & 0x1f
+	for b, start := nalu[1:], true; len(b) > 0; start = false {
+		n := len(b)
+		if n > RtpMaxPayload-2 {
+			n = RtpMaxPayload - 2
+		}
+		header := typ
+		if start {
+			header |= 0x80
+		}
+		end := n == len(b)
+		if end {
+			header |= 0x40
+		}
+		payload := append([]byte{indicator, header}, b[:n]...)
+		pkts = append(pkts, self.packet(payload, ts, end && last))
+		b = b[n:]
+	}
+	return
+}
+
+func (self *Packetizer) fragmentH265(nalu []byte, ts uint32, last bool) (pkts [][]byte) {
+	hdr0 := nalu[0]&0x81 | h265NalFU<<1
+	hdr1 := nalu[1]
+	typ := (nalu[0] >> 1) & 0x3f
+	for b, start := nalu[2:], true; len(b) > 0; start = false {
+		n := len(b)
+		if n > RtpMaxPayload-3 {
+			n = RtpMaxPayload - 3
+		}
+		header := typ
+		if start {
+			header |= 0x80
+		}
+		end := n == len(b)
+		if end {
+			header |= 0x40
+		}
+		payload := append([]byte{hdr0, hdr1, header}, b[:n]...)
+		pkts = append(pkts, self.packet(payload, ts, end && last))
+		b = b[n:]
+	}
+	return
+}
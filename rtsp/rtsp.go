@@ -0,0 +1,230 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rtmpServerStudy/utils/bits/pio"
+)
+
+/*
+rtsp 1.0 (RFC 2326) 服务端用到的部分
+请求和 tcp interleaved 的 rtp/rtcp 数据 ($ channel len data) 在同一个连接上交替出现
+*/
+
+const (
+	Version = "RTSP/1.0"
+	//interleaved 帧头 $ + channel + 2 字节长度
+	InterleavedHeaderLength = 4
+	maxBodyLength           = 1 << 20
+)
+
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+func (self *Request) CSeq() string {
+	return self.Header.Get("CSeq")
+}
+
+type Response struct {
+	StatusCode int
+	Reason     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+func NewResponse(req *Request, code int, reason string) *Response {
+	res := &Response{StatusCode: code, Reason: reason, Header: textproto.MIMEHeader{}}
+	if req != nil {
+		res.Header.Set("CSeq", req.CSeq())
+	}
+	res.Header.Set("Server", "rtmpServerStudy")
+	return res
+}
+
+//rtp rtcp over tcp
+type InterleavedFrame struct {
+	Channel uint8
+	Data    []byte
+}
+
+//读一个请求或者一个 interleaved 帧
+func ReadMessage(r *bufio.Reader) (req *Request, frame *InterleavedFrame, err error) {
+	var b []byte
+	if b, err = r.Peek(1); err != nil {
+		return
+	}
+	if b[0] == '$' {
+		hdr := make([]byte, InterleavedHeaderLength)
+		if _, err = io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		frame = &InterleavedFrame{Channel: hdr[1], Data: make([]byte, pio.U16BE(hdr[2:]))}
+		_, err = io.ReadFull(r, frame.Data)
+		return
+	}
+	req, err = ReadRequest(r)
+	return
+}
+
+func ReadRequest(r *bufio.Reader) (req *Request, err error) {
+	tp := textproto.NewReader(r)
+	var line string
+	if line, err = tp.ReadLine(); err != nil {
+		return
+	}
+	items := strings.SplitN(line, " ", 3)
+	if len(items) != 3 || !strings.HasPrefix(items[2], "RTSP/") {
+		err = fmt.Errorf("Rtsp.Request.Line.Invalid(%s)", line)
+		return
+	}
+	req = &Request{Method: items[0]}
+	if req.URL, err = url.Parse(items[1]); err != nil {
+		return
+	}
+	if req.Header, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	if length := req.Header.Get("Content-Length"); len(length) > 0 {
+		var n int
+		if n, err = strconv.Atoi(length); err != nil || n < 0 || n > maxBodyLength {
+			err = fmt.Errorf("%s", "Rtsp.Request.ContentLength.Invalid")
+			return
+		}
+		req.Body = make([]byte, n)
+		_, err = io.ReadFull(r, req.Body)
+	}
+	return
+}
+
+func WriteResponse(w io.Writer, res *Response) (err error) {
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "%s %d %s\r\n", Version, res.StatusCode, res.Reason)
+	if len(res.Body) > 0 {
+		res.Header.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	}
+	keys := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		keys = append(keys, k)
+	}
+	//CSeq 放第一行，其他按名字排序
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == "Cseq" || keys[j] == "Cseq" {
+			return keys[i] == "Cseq"
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		name := k
+		if k == "Cseq" {
+			name = "CSeq"
+		}
+		for _, v := range res.Header[k] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	if _, err = io.WriteString(w, buf.String()); err != nil {
+		return
+	}
+	if len(res.Body) > 0 {
+		_, err = w.Write(res.Body)
+	}
+	return
+}
+
+func WriteInterleaved(w io.Writer, channel uint8, data []byte) (err error) {
+	hdr := make([]byte, InterleavedHeaderLength)
+	hdr[0] = '$'
+	hdr[1] = channel
+	pio.PutU16BE(hdr[2:], uint16(len(data)))
+	if _, err = w.Write(hdr); err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+//Transport: RTP/AVP/TCP;unicast;interleaved=0-1 或 RTP/AVP;unicast;client_port=8000-8001
+type Transport struct {
+	TCP         bool
+	Interleaved [2]int
+	ClientPort  [2]int
+	ServerPort  [2]int
+	Mode        string
+}
+
+func parsePortRange(s string) (ports [2]int, err error) {
+	items := strings.SplitN(s, "-", 2)
+	if ports[0], err = strconv.Atoi(items[0]); err != nil {
+		return
+	}
+	ports[1] = ports[0] + 1
+	if len(items) == 2 {
+		ports[1], err = strconv.Atoi(items[1])
+	}
+	return
+}
+
+//多个 transport 用逗号分隔时取第一个支持的
+func ParseTransport(s string) (transport Transport, err error) {
+	for _, spec := range strings.Split(s, ",") {
+		transport = Transport{}
+		items := strings.Split(strings.TrimSpace(spec), ";")
+		switch strings.ToUpper(items[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			transport.TCP = true
+		default:
+			continue
+		}
+		for _, item := range items[1:] {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "interleaved":
+				transport.Interleaved, err = parsePortRange(kv[1])
+			case "client_port":
+				transport.ClientPort, err = parsePortRange(kv[1])
+			case "mode":
+				transport.Mode = strings.ToLower(strings.Trim(kv[1], "\""))
+			}
+			if err != nil {
+				return
+			}
+		}
+		if !transport.TCP && transport.ClientPort[0] == 0 && transport.Mode != "record" {
+			continue
+		}
+		return
+	}
+	err = fmt.Errorf("%s", "Rtsp.Transport.Unsupported")
+	return
+}
+
+func (self Transport) String() string {
+	if self.TCP {
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", self.Interleaved[0], self.Interleaved[1])
+	}
+	s := "RTP/AVP;unicast"
+	if self.ClientPort[0] > 0 {
+		s += fmt.Sprintf(";client_port=%d-%d", self.ClientPort[0], self.ClientPort[1])
+	}
+	s += fmt.Sprintf(";server_port=%d-%d", self.ServerPort[0], self.ServerPort[1])
+	if len(self.Mode) > 0 {
+		s += ";mode=" + self.Mode
+	}
+	return s
+}
@@ -0,0 +1,214 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+)
+
+//sdp 中的一路媒体
+type Media struct {
+	//video audio
+	Type        string
+	PayloadType uint8
+	//H264 H265 MPEG4-GENERIC
+	Encoding  string
+	ClockRate int
+	Channels  int
+	Fmtp      map[string]string
+	Control   string
+	//sdp 中没有参数集时为 nil，由 rtp 中的 sps pps 生成
+	CodecData av.CodecData
+}
+
+func ParseSDP(b []byte) (medias []*Media, err error) {
+	var media *Media
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		key, value := line[0], line[2:]
+		switch {
+		case key == 'm':
+			items := strings.Fields(value)
+			if len(items) < 4 {
+				err = fmt.Errorf("Rtsp.Sdp.Media.Invalid(%s)", line)
+				return
+			}
+			media = &Media{Type: items[0], Fmtp: map[string]string{}}
+			var pt int
+			if pt, err = strconv.Atoi(items[3]); err != nil {
+				return
+			}
+			media.PayloadType = uint8(pt)
+			medias = append(medias, media)
+		case key == 'a' && media != nil:
+			kv := strings.SplitN(value, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "rtpmap":
+				//96 H264/90000 或 97 MPEG4-GENERIC/44100/2
+				items := strings.Fields(kv[1])
+				if len(items) < 2 {
+					continue
+				}
+				enc := strings.Split(items[1], "/")
+				media.Encoding = strings.ToUpper(enc[0])
+				if len(enc) > 1 {
+					media.ClockRate, _ = strconv.Atoi(enc[1])
+				}
+				media.Channels = 1
+				if len(enc) > 2 {
+					media.Channels, _ = strconv.Atoi(enc[2])
+				}
+			case "fmtp":
+				items := strings.SplitN(kv[1], " ", 2)
+				if len(items) < 2 {
+					continue
+				}
+				for _, param := range strings.Split(items[1], ";") {
+					param = strings.TrimSpace(param)
+					if i := strings.Index(param, "="); i > 0 {
+						media.Fmtp[strings.ToLower(param[:i])] = param[i+1:]
+					}
+				}
+			case "control":
+				media.Control = kv[1]
+			}
+		}
+	}
+	for _, media := range medias {
+		//参数集解析失败时等 rtp 中的
+		media.CodecData, _ = media.codecDataFromFmtp()
+	}
+	return
+}
+
+func decodeBase64List(s string) (list [][]byte) {
+	for _, item := range strings.Split(s, ",") {
+		if b, err := base64.StdEncoding.DecodeString(item); err == nil && len(b) > 0 {
+			list = append(list, b)
+		}
+	}
+	return
+}
+
+func (self *Media) codecDataFromFmtp() (codec av.CodecData, err error) {
+	switch self.Encoding {
+	case "H264":
+		var sps, pps [][]byte
+		for _, nalu := range decodeBase64List(self.Fmtp["sprop-parameter-sets"]) {
+			switch nalu[0] & 0x1f {
+			case 7:
+				sps = append(sps, nalu)
+			case 8:
+				pps = append(pps, nalu)
+			}
+		}
+		if len(sps) > 0 && len(pps) > 0 {
+			return h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+		}
+	case "H265":
+		vps := decodeBase64List(self.Fmtp["sprop-vps"])
+		sps := decodeBase64List(self.Fmtp["sprop-sps"])
+		pps := decodeBase64List(self.Fmtp["sprop-pps"])
+		if len(sps) > 0 && len(pps) > 0 {
+			return h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps)
+		}
+	case "MPEG4-GENERIC":
+		var config []byte
+		if config, err = hex.DecodeString(self.Fmtp["config"]); err != nil {
+			return
+		}
+		return aacparser.NewCodecDataFromMPEG4AudioConfigBytes(config)
+	}
+	return
+}
+
+//rtsp 支持的编码
+func CodecSupported(codec av.CodecData) bool {
+	if codec == nil {
+		return false
+	}
+	switch codec.Type() {
+	case av.H264, av.H265, av.AAC:
+		return true
+	}
+	return false
+}
+
+//由 codec 生成 DESCRIBE 的媒体描述，payload type 视频 96 音频 97
+func NewMedia(codec av.CodecData, control string) (media *Media) {
+	media = &Media{Control: control, Fmtp: map[string]string{}, CodecData: codec}
+	switch codec.Type() {
+	case av.H264:
+		h264 := codec.(h264parser.CodecData)
+		media.Type, media.PayloadType, media.Encoding, media.ClockRate = "video", 96, "H264", 90000
+		sps := h264.SPS()
+		media.Fmtp["packetization-mode"] = "1"
+		if len(sps) >= 4 {
+			media.Fmtp["profile-level-id"] = strings.ToUpper(hex.EncodeToString(sps[1:4]))
+		}
+		media.Fmtp["sprop-parameter-sets"] = base64.StdEncoding.EncodeToString(sps) + "," +
+			base64.StdEncoding.EncodeToString(h264.PPS())
+	case av.H265:
+		h265 := codec.(h265parser.CodecData)
+		media.Type, media.PayloadType, media.Encoding, media.ClockRate = "video", 96, "H265", 90000
+		if vps := h265.VPS(); vps != nil {
+			media.Fmtp["sprop-vps"] = base64.StdEncoding.EncodeToString(vps)
+		}
+		media.Fmtp["sprop-sps"] = base64.StdEncoding.EncodeToString(h265.SPS())
+		media.Fmtp["sprop-pps"] = base64.StdEncoding.EncodeToString(h265.PPS())
+	case av.AAC:
+		aac := codec.(aacparser.CodecData)
+		media.Type, media.PayloadType, media.Encoding = "audio", 97, "MPEG4-GENERIC"
+		media.ClockRate = aac.SampleRate()
+		media.Channels = aac.ChannelLayout().Count()
+		media.Fmtp["profile-level-id"] = "1"
+		media.Fmtp["mode"] = "AAC-hbr"
+		media.Fmtp["sizelength"] = "13"
+		media.Fmtp["indexlength"] = "3"
+		media.Fmtp["indexdeltalength"] = "3"
+		media.Fmtp["config"] = hex.EncodeToString(aac.MPEG4AudioConfigBytes())
+	}
+	return
+}
+
+//fmtp 参数固定顺序，方便比较
+var fmtpOrder = []string{"packetization-mode", "profile-level-id", "sprop-parameter-sets",
+	"sprop-vps", "sprop-sps", "sprop-pps", "mode", "sizelength", "indexlength", "indexdeltalength", "config"}
+
+func BuildSDP(name, addr string, medias []*Media) []byte {
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "v=0\r\no=- 0 0 IN IP4 %s\r\ns=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n", addr, name)
+	for _, media := range medias {
+		fmt.Fprintf(w, "m=%s 0 RTP/AVP %d\r\n", media.Type, media.PayloadType)
+		if media.Type == "audio" && media.Channels > 0 {
+			fmt.Fprintf(w, "a=rtpmap:%d %s/%d/%d\r\n", media.PayloadType, media.Encoding, media.ClockRate, media.Channels)
+		} else {
+			fmt.Fprintf(w, "a=rtpmap:%d %s/%d\r\n", media.PayloadType, media.Encoding, media.ClockRate)
+		}
+		var params []string
+		for _, k := range fmtpOrder {
+			if v, ok := media.Fmtp[k]; ok {
+				params = append(params, k+"="+v)
+			}
+		}
+		if len(params) > 0 {
+			fmt.Fprintf(w, "a=fmtp:%d %s\r\n", media.PayloadType, strings.Join(params, ";"))
+		}
+		fmt.Fprintf(w, "a=control:%s\r\n", media.Control)
+	}
+	return w.Bytes()
+}
@@ -11,6 +11,7 @@ import (
 	"rtmpServerStudy/ts/tsio"
 	"rtmpServerStudy/aacParse"
 	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
 	"io"
 )
 
@@ -108,15 +109,18 @@ func (self *Demuxer) initPMT(payload []byte) (err error) {
 	}
 
 	self.streams = []*Stream{}
-	for i, info := range self.pmt.ElementaryStreamInfos {
+	for _, info := range self.pmt.ElementaryStreamInfos {
 		stream := &Stream{}
-		stream.idx = i
+		//Streams() 中的序号
+		stream.idx = len(self.streams)
 		stream.demuxer = self
 		stream.pid = info.ElementaryPID
 		stream.streamType = info.StreamType
 		switch info.StreamType {
 		case tsio.ElementaryStreamTypeH264:
 			self.streams = append(self.streams, stream)
+		case tsio.ElementaryStreamTypeH265:
+			self.streams = append(self.streams, stream)
 		case tsio.ElementaryStreamTypeAdtsAAC:
 			self.streams = append(self.streams, stream)
 		}
@@ -144,10 +148,20 @@ func (self *Demuxer) readTSPacket() (err error) {
 	if _, err = io.ReadFull(self.r, self.tshdr); err != nil {
 		return
 	}
+	//udp 丢包或者中途接入时找下一个同步字节
+	if self.tshdr[0] != 0x47 {
+		if err = self.resync(); err != nil {
+			return
+		}
+	}
 
 	if pid, start, iskeyframe, hdrlen, err = tsio.ParseTSHeader(self.tshdr); err != nil {
 		return
 	}
+	if hdrlen > len(self.tshdr) {
+		err = fmt.Errorf("ts: adaptation field length invalid")
+		return
+	}
 	payload := self.tshdr[hdrlen:]
 
 	if self.pat == nil {
@@ -185,6 +199,21 @@ func (self *Demuxer) readTSPacket() (err error) {
 	return
 }
 
+func (self *Demuxer) resync() (err error) {
+	for {
+		i := 1
+		for ; i < len(self.tshdr) && self.tshdr[i] != 0x47; i++ {
+		}
+		n := copy(self.tshdr, self.tshdr[i:])
+		if _, err = io.ReadFull(self.r, self.tshdr[n:]); err != nil {
+			return
+		}
+		if n > 0 {
+			return
+		}
+	}
+}
+
 func (self *Stream) addPacket(payload []byte, timedelta time.Duration) {
 	dts := self.dts
 	pts := self.pts
@@ -194,7 +223,7 @@ func (self *Stream) addPacket(payload []byte, timedelta time.Duration) {
 
 	demuxer := self.demuxer
 	pkt := av.Packet{
-		//Idx: int8(self.idx),
+		Idx: int8(self.idx),
 		IsKeyFrame: self.iskeyframe,
 		Time: dts+timedelta,
 		Data: payload,
@@ -211,6 +240,8 @@ func (self *Stream) payloadEnd() (n int, err error) {
 		return
 	}
 	if self.datalen != 0 && len(payload) != self.datalen {
+		//丢掉不完整的 pes
+		self.data = nil
 		err = fmt.Errorf("ts: packet size mismatch size=%d correct=%d", len(payload), self.datalen)
 		return
 	}
@@ -239,7 +270,7 @@ func (self *Stream) payloadEnd() (n int, err error) {
 
 	case tsio.ElementaryStreamTypeH264:
 		nalus, _ := h264parser.SplitNALUs(payload)
-		var sps, pps [][]byte
+		var sps, pps, datas [][]byte
 		for _, nalu := range nalus {
 			if len(nalu) > 0 {
 				naltype := nalu[0] & 0x1f
@@ -248,13 +279,12 @@ func (self *Stream) payloadEnd() (n int, err error) {
 					sps = append(sps, nalu)
 				case naltype == 8:
 					pps = append(pps, nalu)
-				case h264parser.IsDataNALU(nalu):
-					// raw nalu to avcc
-					b := make([]byte, 4+len(nalu))
-					pio.PutU32BE(b[0:4], uint32(len(nalu)))
-					copy(b[4:], nalu)
-					self.addPacket(b, time.Duration(0))
-					n++
+				case naltype == h264parser.AVC_NAL_AUD:
+				default:
+					if naltype == 5 {
+						self.iskeyframe = true
+					}
+					datas = append(datas, nalu)
 				}
 			}
 		}
@@ -264,11 +294,64 @@ func (self *Stream) payloadEnd() (n int, err error) {
 				return
 			}
 		}
+		//一个 pes 为一个访问单元
+		if len(datas) > 0 {
+			self.addPacket(nalusToAVCC(datas), time.Duration(0))
+			n++
+		}
+
+	case tsio.ElementaryStreamTypeH265:
+		nalus, _ := h265parser.SplitNALUs(payload)
+		var vps, sps, pps, datas [][]byte
+		for _, nalu := range nalus {
+			if len(nalu) > 1 {
+				switch naltype := h265parser.NALUType(nalu); {
+				case naltype == h265parser.HEVC_NAL_VPS:
+					vps = append(vps, nalu)
+				case naltype == h265parser.HEVC_NAL_SPS:
+					sps = append(sps, nalu)
+				case naltype == h265parser.HEVC_NAL_PPS:
+					pps = append(pps, nalu)
+				case naltype == h265parser.HEVC_NAL_AUD:
+				default:
+					if h265parser.IsIRAPNALU(nalu) {
+						self.iskeyframe = true
+					}
+					datas = append(datas, nalu)
+				}
+			}
+		}
+
+		if self.CodecData == nil && len(sps) > 0 && len(pps) > 0 {
+			if self.CodecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps); err != nil {
+				return
+			}
+		}
+		if len(datas) > 0 {
+			self.addPacket(nalusToAVCC(datas), time.Duration(0))
+			n++
+		}
 	}
 
 	return
 }
 
+// raw nalu to avcc
+func nalusToAVCC(nalus [][]byte) []byte {
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	b := make([]byte, size)
+	pos := 0
+	for _, nalu := range nalus {
+		pio.PutU32BE(b[pos:], uint32(len(nalu)))
+		copy(b[pos+4:], nalu)
+		pos += 4 + len(nalu)
+	}
+	return b
+}
+
 func (self *Stream) handleTSPacket(start bool, iskeyframe bool, payload []byte) (err error) {
 	if start {
 		if _, err = self.payloadEnd(); err != nil {
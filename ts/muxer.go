@@ -5,16 +5,30 @@ import (
 	"rtmpServerStudy/av"
 	"rtmpServerStudy/aacParse"
 	"rtmpServerStudy/h264Parse"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/codec"
 	"rtmpServerStudy/ts/tsio"
 	"io"
-//	"time"
+	"time"
 	//"encoding/hex"
 	"bufio"
 	"rtmpServerStudy/utils/bits/pio"
 )
 
-//now just support aac h264 for ts
-var CodecTypes = []av.CodecType{av.H264, av.AAC}
+//now just support aac mp3 h264 h265 for ts
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC, av.MP3}
+
+func IsCodecSupported(codec av.CodecData) bool {
+	if codec == nil {
+		return false
+	}
+	for _, c := range CodecTypes {
+		if codec.Type() == c {
+			return true
+		}
+	}
+	return false
+}
 
 type Muxer struct {
 	w                        io.WriteCloser
@@ -32,6 +46,26 @@ type Muxer struct {
 	nalus   [][]byte
 
 	tswpat, tswpmt *tsio.TSWriter
+	tswscte35      *tsio.TSWriter
+	tswid3         *tsio.TSWriter
+
+	//pmt 中加入 scte35 流，广告插入点写在单独的 pid 上
+	SCTE35 bool
+	//pmt 中加入 id3 timed metadata 流
+	ID3 bool
+
+	//SAMPLE-AES 加密，nil 不加密
+	sampleAes *sampleAES
+
+	//连续输出的 ts 流 (http ts) 按间隔插入 pcr 和 pat/pmt，0 只在关键帧处插入 pcr 不重复 pat/pmt
+	PCRInterval time.Duration
+	PSIInterval time.Duration
+	lastPCR     time.Duration
+	lastPSI     time.Duration
+	hasPCR      bool
+	hasPSI      bool
+	//pat pmt 的 version，流中途编码参数变化时加 1
+	psiVersion  uint8
 }
 
 
@@ -47,6 +81,8 @@ func NewMuxer(w io.WriteCloser) *Muxer {
 		datav:   make([][]byte, 16),
 		tswpmt:  tsio.NewTSWriter(tsio.PMT_PID),
 		tswpat:  tsio.NewTSWriter(tsio.PAT_PID),
+		tswscte35: tsio.NewTSWriter(scte35Pid),
+		tswid3:  tsio.NewTSWriter(id3Pid),
 	}
 }
 
@@ -54,29 +90,28 @@ func NewMuxer(w io.WriteCloser) *Muxer {
 const	(
 	videoPid = uint16(0x100)
 	audioPid = uint16(0x101)
+	scte35Pid = uint16(0x102)
+	id3Pid = uint16(0x103)
 )
 //new stream
-func (self *Muxer) newStream(codec av.CodecData) (err error) {
-	ok := false
-	for _, c := range CodecTypes {
-		if codec.Type() == c {
-			ok = true
-			break
-		}
-	}
-	if !ok {
-		err = fmt.Errorf("ts: codec type=%s is not supported", codec.Type())
+func (self *Muxer) newStream(codecData av.CodecData) (err error) {
+	if !IsCodecSupported(codecData) {
+		err = fmt.Errorf("ts: codec type=%s is not supported", codecData.Type())
 		return
 	}
-	switch codec.Type() {
-	case av.H264:
+	switch codecData.Type() {
+	case av.H264, av.H265:
 		pid:=videoPid
 		stream := &Stream{
 			muxer:     self,
-			CodecData: codec,
+			CodecData: codecData,
 			pid:       pid,
+			streamType: tsio.ElementaryStreamTypeH264,
 			tsw:       tsio.NewTSWriter(pid),
 		}
+		if codecData.Type() == av.H265 {
+			stream.streamType = tsio.ElementaryStreamTypeH265
+		}
 		self.vstream = stream
 	case av.NELLYMOSER:
 	case av.SPEEX:
@@ -84,13 +119,27 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 		pid:=audioPid
 		stream := &Stream{
 			muxer:     self,
-			CodecData: codec,
+			CodecData: codecData,
 			pid:       pid,
+			streamType: tsio.ElementaryStreamTypeAdtsAAC,
 			tsw:       tsio.NewTSWriter(pid),
 		}
 		self.astream = stream
+	case av.MP3:
+		pid:=audioPid
+		stream := &Stream{
+			muxer:     self,
+			CodecData: codecData,
+			pid:       pid,
+			streamType: tsio.ElementaryStreamTypeMPEG2Audio,
+			tsw:       tsio.NewTSWriter(pid),
+		}
+		if codecData.(codec.MP3CodecData).IsMPEG1() {
+			stream.streamType = tsio.ElementaryStreamTypeMPEG1Audio
+		}
+		self.astream = stream
 	default:
-		err = fmt.Errorf("ts.Unspported.CodecType(%v)", codec.Type())
+		err = fmt.Errorf("ts.Unspported.CodecType(%v)", codecData.Type())
 		return
 	}
 	return
@@ -126,6 +175,8 @@ func (self *Muxer) WriteTrailer() (err error) {
 
 func (self *Muxer) SetWriter(w io.WriteCloser) {
 	self.w = w
+	//新文件重新插入 pcr
+	self.hasPCR = false
 	self.bufw = bufio.NewWriterSize(w, pio.RecommendBufioSize)
 	return
 }
@@ -137,30 +188,60 @@ func (self *Muxer) WritePATPMT() (err error) {
 		},
 	}
 	patlen := pat.Marshal(self.psidata[tsio.PSIHeaderLength:])
-	n := tsio.FillPSI(self.psidata, tsio.TableIdPAT, tsio.TableExtPAT, patlen)
+	n := tsio.FillPSIVersion(self.psidata, tsio.TableIdPAT, tsio.TableExtPAT, self.psiVersion, patlen)
 	self.datav[0] = self.psidata[:n]
 	if err = self.tswpat.WritePackets(self.bufw, self.datav[:1], 0, false, true); err != nil {
 		return
 	}
 
 	var elemStreams []tsio.ElementaryStreamInfo
+	pcrPid := videoPid
+
+	//audio
+	if self.astream.CodecData != nil {
+		if self.sampleAes != nil {
+			elemStreams = append(elemStreams, self.sampleAes.elementaryStreamInfo(self.astream))
+		} else {
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    self.astream.streamType,
+				ElementaryPID: self.astream.pid,
+			})
+		}
+	}
 
-	//aac
-	elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
-		StreamType:    tsio.ElementaryStreamTypeAdtsAAC,
-		ElementaryPID: self.astream.pid,
-	})
-
-	//h264
-	elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
-		StreamType:    tsio.ElementaryStreamTypeH264,
-		ElementaryPID: self.vstream.pid,
-	})
+	//video
+	if self.vstream.CodecData != nil {
+		if self.sampleAes != nil {
+			elemStreams = append(elemStreams, self.sampleAes.elementaryStreamInfo(self.vstream))
+		} else {
+			elemStreams = append(elemStreams, tsio.ElementaryStreamInfo{
+				StreamType:    self.vstream.streamType,
+				ElementaryPID: self.vstream.pid,
+			})
+		}
+	} else if self.astream.CodecData != nil {
+		pcrPid = audioPid
+	}
 
 	pmt := tsio.PMT{
-		PCRPID:                0x100,
+		PCRPID:                pcrPid,
 		ElementaryStreamInfos: elemStreams,
 	}
+	if self.SCTE35 {
+		pmt.ProgramDescriptors = append(pmt.ProgramDescriptors, tsio.SCTE35Registration)
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    tsio.ElementaryStreamTypeSCTE35,
+			ElementaryPID: scte35Pid,
+		})
+	}
+	if self.ID3 {
+		pmt.ProgramDescriptors = append(pmt.ProgramDescriptors, tsio.ID3MetadataPointer)
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    tsio.ElementaryStreamTypeMetadata,
+			ElementaryPID: id3Pid,
+			Descriptors:   []tsio.Descriptor{tsio.ID3Metadata},
+		})
+	}
 
 	pmtlen := pmt.Len()
 	if pmtlen+tsio.PSIHeaderLength > len(self.psidata) {
@@ -169,7 +250,7 @@ func (self *Muxer) WritePATPMT() (err error) {
 	}
 
 	pmt.Marshal(self.psidata[tsio.PSIHeaderLength:])
-	n = tsio.FillPSI(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, pmtlen)
+	n = tsio.FillPSIVersion(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, self.psiVersion, pmtlen)
 	self.datav[0] = self.psidata[:n]
 	if err = self.tswpmt.WritePackets(self.bufw, self.datav[:1], 0, false, true); err != nil {
 		return
@@ -178,7 +259,35 @@ func (self *Muxer) WritePATPMT() (err error) {
 	return
 }
 
-func (self *Muxer) WriteHeader() (err error) {
+//pmt 中的 stream type 由 streams 决定
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	if err = self.setStreams(streams); err != nil {
+		return
+	}
+
+	//write pat pmt
+	if err = self.WritePATPMT(); err != nil {
+		return
+	}
+	return
+}
+
+//连续的 ts 流中途编码参数变化，各 pid 的 continuity counter 接着之前的
+//pat pmt 的 version 加 1 后重发
+func (self *Muxer) UpdateHeader(streams []av.CodecData) (err error) {
+	if self.vstream == nil || self.astream == nil {
+		return self.WriteHeader(streams)
+	}
+	vtsw, atsw := self.vstream.tsw, self.astream.tsw
+	if err = self.setStreams(streams); err != nil {
+		return
+	}
+	self.vstream.tsw, self.astream.tsw = vtsw, atsw
+	self.psiVersion = (self.psiVersion + 1) & 0x1f
+	return self.WritePATPMT()
+}
+
+func (self *Muxer) setStreams(streams []av.CodecData) (err error) {
 
 	self.vstream = &Stream{
 		muxer:     self,
@@ -192,9 +301,10 @@ func (self *Muxer) WriteHeader() (err error) {
 		tsw:       tsio.NewTSWriter(audioPid),
 	}
 
-	//write pat pmt
-	if err = self.WritePATPMT(); err != nil {
-		return
+	for _, stream := range streams {
+		if err = self.newStream(stream); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -202,26 +312,56 @@ func (self *Muxer) WriteHeader() (err error) {
 //const NGX_RTMP_HLS_DELAY = 63000
 func (self *Muxer)WriteAudioPacket(pkts []*av.Packet,Cstream av.CodecData,pts uint64)(err error){
 
+	if len(pkts) == 0 {
+		return
+	}
 	datav:=make([][]byte,(len(pkts)+1)*2+1)
 	audioLen:=0
 	j:=1
 
 	for i,_:= range pkts {
-		codec := Cstream.(aacparser.CodecData)
-		aacparser.FillADTSHeader(self.adtshdr, codec.Config, 1024, len(pkts[i].Data[pkts[i].DataPos:]))
-		datav[j] = self.adtshdr
-		j++
+		switch Cstream.Type() {
+		case av.AAC:
+			codec := Cstream.(aacparser.CodecData)
+			aacparser.FillADTSHeader(self.adtshdr, codec.Config, 1024, len(pkts[i].Data[pkts[i].DataPos:]))
+			//每一帧的 adts 头不同，不能共用 self.adtshdr
+			adtshdr := make([]byte, len(self.adtshdr))
+			copy(adtshdr, self.adtshdr)
+			datav[j] = adtshdr
+			j++
+			audioLen+=len(adtshdr)
+		case av.MP3:
+			//mp3 帧自带帧头
+		default:
+			err = fmt.Errorf("ts.Unspported.CodecType(%v)", Cstream.Type())
+			return
+		}
 		datav[j] = pkts[i].Data[pkts[i].DataPos:]
+		if self.sampleAes != nil && Cstream.Type() == av.AAC {
+			datav[j] = self.sampleAes.encryptAudioFrame(datav[j])
+		}
 		j++
-		audioLen+=len(self.adtshdr) + len(pkts[i].Data[pkts[i].DataPos:])
+		audioLen+=len(pkts[i].Data[pkts[i].DataPos:])
 	}
 	pts1:=(pts)
 	// pes heaer
 	n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdAAC,audioLen ,pts1, 0)
 	datav[0] = self.peshdr[:n]
 
+	//没有视频时 pcr 在音频上
+	var pcr uint64
+	tm := time.Duration(pts) * time.Second / time.Duration(tsio.PTS_HZ)
+	if self.vstream.CodecData == nil {
+		if err = self.writePSIIfNeeded(tm, false); err != nil {
+			return
+		}
+		if !self.hasPCR || self.pcrDue(tm) {
+			pcr = self.pcr(tm)
+		}
+	}
+
 	// packet
-	if err = self.astream.tsw.WritePackets(self.bufw, datav[:j],0, true, false); err != nil {
+	if err = self.astream.tsw.WritePackets(self.bufw, datav[:j],pcr, true, false); err != nil {
 		return
 	}
 	return
@@ -260,22 +400,141 @@ func (self *Muxer) WritePacket(pkt *av.Packet,Cstream av.CodecData) (err error)
 			}else {
 				datav = append(datav, h264parser.StartCodeBytes)
 			}
+			if self.sampleAes != nil {
+				nal = self.sampleAes.encryptNALU(nal)
+			}
 			datav = append(datav, nal)
 		}
 
-		pts:=tsio.TimeToTs(pkt.Time+pkt.CompositionTime)
-		dts:=tsio.TimeToTs(pkt.Time)
-		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH264, -1, pts, dts)
-		datav[0] = self.peshdr[:n]
-		var pcr uint64
-		if pkt.IsKeyFrame{
-			pcr =tsio.TimeToTs(pkt.Time)
-		}else{
-			pcr = uint64(0)
+		err = self.writeVideoPES(pkt, datav)
+
+	case av.H265:
+		codec := Cstream.(h265parser.CodecData)
+
+		pktnalus, _ := h265parser.SplitNALUs(pkt.Data[pkt.DataPos:])
+		irap := false
+		hasParamSets := false
+		for _, pktnalu:= range pktnalus {
+			if len(pktnalu) < 2 {
+				continue
+			}
+			switch naltype := h265parser.NALUType(pktnalu); {
+			case naltype == h265parser.HEVC_NAL_VPS ||
+				naltype == h265parser.HEVC_NAL_SPS ||
+				naltype == h265parser.HEVC_NAL_PPS:
+				hasParamSets = true
+			case h265parser.IsIRAPNALU(pktnalu):
+				irap = true
+			}
 		}
-		if err = self.vstream.tsw.WritePackets(self.bufw, datav, pcr, pkt.IsKeyFrame, false); err != nil {
-			return
+
+		//irap 帧前插入 vps sps pps
+		nalus := self.nalus[:0]
+		if (irap || pkt.IsKeyFrame) && !hasParamSets {
+			if vps := codec.VPS(); vps != nil {
+				nalus = append(nalus, vps)
+			}
+			nalus = append(nalus, codec.SPS())
+			nalus = append(nalus, codec.PPS())
 		}
+		for _, pktnalu:= range pktnalus {
+			nalus = append(nalus, pktnalu)
+		}
+
+		datav := self.datav[:1]
+		audSent := 0
+		for _,nal:= range nalus {
+			if len(nal) < 2 || h265parser.NALUType(nal) == h265parser.HEVC_NAL_AUD {
+				continue
+			}
+			if audSent == 0{
+				datav = append(datav, h265parser.AUDBytes)
+				audSent = 1
+			}else {
+				datav = append(datav, h265parser.StartCodeBytes)
+			}
+			datav = append(datav, nal)
+		}
+
+		err = self.writeVideoPES(pkt, datav)
+	}
+	return
+}
+
+func (self *Muxer) pcrDue(tm time.Duration) bool {
+	return self.PCRInterval > 0 && (!self.hasPCR || tm-self.lastPCR >= self.PCRInterval || tm < self.lastPCR)
+}
+
+func (self *Muxer) pcr(tm time.Duration) uint64 {
+	self.lastPCR = tm
+	self.hasPCR = true
+	return tsio.TimeToPCR(tm)
+}
+
+//按间隔或者在关键帧前重复 pat/pmt，播放端中途接入也能解码
+func (self *Muxer) writePSIIfNeeded(tm time.Duration, key bool) (err error) {
+	if self.PSIInterval <= 0 {
+		return
+	}
+	if !key && self.hasPSI && tm-self.lastPSI < self.PSIInterval && tm >= self.lastPSI {
+		return
+	}
+	self.lastPSI = tm
+	self.hasPSI = true
+	return self.WritePATPMT()
+}
+
+//流中途加入 scte35 流，pmt 的 version 加 1，播放端缓存的 pmt 在下一次写 pat pmt 时更新
+func (self *Muxer) EnableSCTE35() {
+	if self.SCTE35 {
+		return
+	}
+	self.SCTE35 = true
+	self.psiVersion = (self.psiVersion + 1) & 0x1f
+}
+
+//写一个 scte35 splice_info_section，需要先设置 SCTE35 写 pmt
+func (self *Muxer) WriteSCTE35(section []byte) (err error) {
+	if !self.SCTE35 {
+		return fmt.Errorf("ts.SCTE35.Not.Enabled")
+	}
+	//pointer_field
+	datav := [][]byte{{0}, section}
+	return self.tswscte35.WritePackets(self.bufw, datav, 0, false, true)
+}
+
+//写一个 id3 tag，pts 90k，需要先设置 ID3 写 pmt
+func (self *Muxer) WriteID3(tag []byte, pts uint64) (err error) {
+	if !self.ID3 {
+		return fmt.Errorf("ts.ID3.Not.Enabled")
+	}
+	n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdPrivate1, len(tag), pts, 0)
+	//data_alignment_indicator
+	self.peshdr[6] |= 0x04
+	datav := [][]byte{self.peshdr[:n], tag}
+	return self.tswid3.WritePackets(self.bufw, datav, 0, false, false)
+}
+
+//写入底层 writer
+func (self *Muxer) Flush() error {
+	return self.bufw.Flush()
+}
+
+//datav[0] 留给 pes 头
+func (self *Muxer) writeVideoPES(pkt *av.Packet, datav [][]byte) (err error) {
+	if err = self.writePSIIfNeeded(pkt.Time, pkt.IsKeyFrame); err != nil {
+		return
+	}
+	pts:=tsio.TimeToTs(pkt.Time+pkt.CompositionTime)
+	dts:=tsio.TimeToTs(pkt.Time)
+	n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH264, -1, pts, dts)
+	datav[0] = self.peshdr[:n]
+	var pcr uint64
+	if pkt.IsKeyFrame || self.pcrDue(pkt.Time) {
+		pcr = self.pcr(pkt.Time)
+	}
+	if err = self.vstream.tsw.WritePackets(self.bufw, datav, pcr, pkt.IsKeyFrame, false); err != nil {
+		return
 	}
 	return
 }
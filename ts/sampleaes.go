@@ -0,0 +1,130 @@
+package ts
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"rtmpServerStudy/aacParse"
+	"rtmpServerStudy/av"
+	"rtmpServerStudy/h265Parse"
+	"rtmpServerStudy/ts/tsio"
+)
+
+/*
+SAMPLE-AES 参考 apple MPEG-2 Stream Encryption Format for HTTP Live Streaming
+h264: 只加密类型 1 5 且大于 48 字节的 nalu，前 32 字节明文，之后每 160 字节加密前 16 字节
+aac: adts 头和之后 16 字节明文，剩余的完整 16 字节块加密
+每个 nalu 每个音频帧都从 iv 重新开始 cbc
+*/
+const (
+	ElementaryStreamTypeSampleAESH264 = 0xdb
+	ElementaryStreamTypeSampleAESAAC  = 0xcf
+
+	sampleAESVideoLeader = 32
+	sampleAESAudioLeader = 16
+	sampleAESPattern     = 160
+)
+
+type sampleAES struct {
+	block cipher.Block
+	iv    []byte
+}
+
+//key 为 nil 时关闭 SAMPLE-AES
+func (self *Muxer) SetSampleAES(key, iv []byte) (err error) {
+	if key == nil {
+		self.sampleAes = nil
+		return
+	}
+	if len(iv) != aes.BlockSize {
+		err = fmt.Errorf("%s","ts.SampleAES.Iv.Invalid")
+		return
+	}
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+	self.sampleAes = &sampleAES{block: block, iv: append([]byte(nil), iv...)}
+	return
+}
+
+//只有 h264 aac 可以 SAMPLE-AES
+func SampleAESSupported(codec av.CodecData) bool {
+	if codec == nil {
+		return true
+	}
+	return codec.Type() == av.H264 || codec.Type() == av.AAC
+}
+
+func addEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/64+1)
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+//返回新的 nalu，不修改 gop 中共享的数据
+func (self *sampleAES) encryptNALU(nal []byte) []byte {
+	if len(nal) == 0 {
+		return nal
+	}
+	naltype := nal[0] & 0x1f
+	if (naltype != 1 && naltype != 5) || len(nal) <= 48 {
+		return nal
+	}
+	raw := h265parser.RemoveEmulationPrevention(nal)
+	mode := cipher.NewCBCEncrypter(self.block, self.iv)
+	for pos := sampleAESVideoLeader; pos+aes.BlockSize <= len(raw); pos += sampleAESPattern {
+		mode.CryptBlocks(raw[pos:pos+aes.BlockSize], raw[pos:pos+aes.BlockSize])
+	}
+	return addEmulationPrevention(raw)
+}
+
+func (self *sampleAES) encryptAudioFrame(frame []byte) []byte {
+	if len(frame) <= sampleAESAudioLeader+aes.BlockSize {
+		return frame
+	}
+	out := append([]byte(nil), frame...)
+	n := (len(out) - sampleAESAudioLeader) / aes.BlockSize * aes.BlockSize
+	mode := cipher.NewCBCEncrypter(self.block, self.iv)
+	mode.CryptBlocks(out[sampleAESAudioLeader:sampleAESAudioLeader+n], out[sampleAESAudioLeader:sampleAESAudioLeader+n])
+	return out
+}
+
+//SAMPLE-AES 的 stream type 和 descriptor
+func (self *sampleAES) elementaryStreamInfo(stream *Stream) (info tsio.ElementaryStreamInfo) {
+	info.StreamType = stream.streamType
+	info.ElementaryPID = stream.pid
+	switch stream.CodecData.Type() {
+	case av.H264:
+		info.StreamType = ElementaryStreamTypeSampleAESH264
+		info.Descriptors = []tsio.Descriptor{
+			//private_data_indicator_descriptor
+			{Tag: 0x0f, Data: []byte("zavc")},
+		}
+	case av.AAC:
+		info.StreamType = ElementaryStreamTypeSampleAESAAC
+		config := stream.CodecData.(aacparser.CodecData).MPEG4AudioConfigBytes()
+		// audio_setup_information: audio_type(32) priming(16) version(8) setup_data_length(8) setup_data
+		setup := []byte("apad")
+		setup = append(setup, 'z', 'a', 'a', 'c', 0, 0, 1, uint8(len(config)))
+		setup = append(setup, config...)
+		info.Descriptors = []tsio.Descriptor{
+			{Tag: 0x0f, Data: []byte("aacd")},
+			//registration_descriptor
+			{Tag: 0x05, Data: setup},
+		}
+	}
+	return
+}
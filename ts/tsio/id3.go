@@ -0,0 +1,87 @@
+package tsio
+
+import (
+	"rtmpServerStudy/utils/bits/pio"
+)
+
+/*
+hls timed metadata，pes 中放 ID3v2.4 tag
+pmt 的 program info 带 metadata_pointer_descriptor，es info 带 metadata_descriptor
+stream_type 0x15，stream_id 0xbd，pes 头 data_alignment_indicator 为 1
+*/
+
+const (
+	ElementaryStreamTypeMetadata = 0x15
+	StreamIdPrivate1             = 0xbd
+	DescriptorTagMetadataPointer = 0x25
+	DescriptorTagMetadata        = 0x26
+)
+
+//metadata_application_format=0xffff 'ID3 ' metadata_format=0xff 'ID3 ' metadata_service_id=0
+//metadata_locator_record_flag(1)=0 MPEG_carriage_flags(2)=0 reserved(5) program_number=1
+var ID3MetadataPointer = Descriptor{Tag: DescriptorTagMetadataPointer,
+	Data: []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x1f, 0x00, 0x01}}
+
+//decoder_config_flags(3)=0 DSM-CC_flag(1)=0 reserved(4)
+var ID3Metadata = Descriptor{Tag: DescriptorTagMetadata,
+	Data: []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}}
+
+const ID3HeaderLength = 10
+
+type ID3Frame struct {
+	Id   string
+	Data []byte
+}
+
+//用户自定义文本，utf-8
+func ID3TXXX(desc string, value string) ID3Frame {
+	b := make([]byte, 0, 2+len(desc)+len(value))
+	b = append(b, 3)
+	b = append(b, desc...)
+	b = append(b, 0)
+	b = append(b, value...)
+	return ID3Frame{Id: "TXXX", Data: b}
+}
+
+//私有数据，owner 一般是反向域名
+func ID3PRIV(owner string, data []byte) ID3Frame {
+	b := make([]byte, 0, 1+len(owner)+len(data))
+	b = append(b, owner...)
+	b = append(b, 0)
+	b = append(b, data...)
+	return ID3Frame{Id: "PRIV", Data: b}
+}
+
+//v2.4 的长度每字节只用低 7 位
+func putSynchsafe(b []byte, v int) {
+	b[0] = byte(v>>21) & 0x7f
+	b[1] = byte(v>>14) & 0x7f
+	b[2] = byte(v>>7) & 0x7f
+	b[3] = byte(v) & 0x7f
+}
+
+func ID3Len(frames []ID3Frame) (n int) {
+	n = ID3HeaderLength
+	for _, frame := range frames {
+		n += ID3HeaderLength + len(frame.Data)
+	}
+	return
+}
+
+func FillID3(b []byte, frames []ID3Frame) (n int) {
+	//"ID3" version(16)=0x0400 flags(8)=0 size(32)
+	copy(b, "ID3")
+	pio.PutU16BE(b[3:], 0x0400)
+	b[5] = 0
+	putSynchsafe(b[6:], ID3Len(frames)-ID3HeaderLength)
+	n = ID3HeaderLength
+	for _, frame := range frames {
+		copy(b[n:], frame.Id)
+		putSynchsafe(b[n+4:], len(frame.Data))
+		pio.PutU16BE(b[n+8:], 0)
+		n += ID3HeaderLength
+		copy(b[n:], frame.Data)
+		n += len(frame.Data)
+	}
+	return
+}
@@ -0,0 +1,233 @@
+package tsio
+
+import (
+	"rtmpServerStudy/utils/bits/pio"
+)
+
+/*
+SCTE-35 splice_info_section
+table_id(8)=0xfc section_syntax_indicator(1)=0 private_indicator(1)=0 sap_type(2)=3 section_length(12)
+protocol_version(8) encrypted_packet(1) encryption_algorithm(6) pts_adjustment(33)
+cw_index(8) tier(12) splice_command_length(12) splice_command_type(8) splice_command()
+descriptor_loop_length(16) splice_descriptor() crc32(32)
+*/
+
+const (
+	TableIdSCTE35               = 0xfc
+	ElementaryStreamTypeSCTE35  = 0x86
+	SCTE35SpliceInsert          = 0x05
+	SCTE35TimeSignal            = 0x06
+	SCTE35SegmentationDescriptor = 0x02
+	//registration_descriptor 'CUEI'
+	DescriptorTagRegistration = 0x05
+)
+
+var SCTE35Registration = Descriptor{Tag: DescriptorTagRegistration, Data: []byte("CUEI")}
+
+//splice_insert 和 segmentation_descriptor 中关心的字段
+type SCTE35Info struct {
+	EventId uint32
+	//true 开始插播 false 回到节目
+	Out bool
+	//90k，0 没有时长
+	Duration uint64
+}
+
+//生成立即执行的 splice_insert，pts 为 0 时不带 splice_time，duration 为 0 时不带 break_duration
+func FillSCTE35SpliceInsert(b []byte, eventId uint32, out bool, pts uint64, duration uint64) (n int) {
+	b[n] = TableIdSCTE35
+	n++
+	//section_length 最后填
+	n += 2
+	//protocol_version
+	b[n] = 0
+	n++
+	//encrypted_packet encryption_algorithm pts_adjustment
+	b[n] = 0
+	n++
+	pio.PutU32BE(b[n:], 0)
+	n += 4
+	//cw_index
+	b[n] = 0
+	n++
+	//tier(12)=0xfff splice_command_length(12) 最后填
+	hold := n
+	n += 3
+	b[n] = SCTE35SpliceInsert
+	n++
+
+	pos := n
+	pio.PutU32BE(b[n:], eventId)
+	n += 4
+	//splice_event_cancel_indicator(1)=0 reserved(7)
+	b[n] = 0x7f
+	n++
+	//out_of_network_indicator program_splice_flag duration_flag splice_immediate_flag reserved(4)
+	flags := uint8(0x4f)
+	if out {
+		flags |= 0x80
+	}
+	if duration > 0 {
+		flags |= 0x20
+	}
+	if pts == 0 {
+		flags |= 0x10
+	}
+	b[n] = flags
+	n++
+	if pts > 0 {
+		//time_specified_flag(1)=1 reserved(6) pts_time(33)
+		b[n] = 0xfe | uint8(pts>>32)&0x1
+		pio.PutU32BE(b[n+1:], uint32(pts))
+		n += 5
+	}
+	if duration > 0 {
+		//auto_return(1)=1 reserved(6) duration(33)
+		b[n] = 0xfe | uint8(duration>>32)&0x1
+		pio.PutU32BE(b[n+1:], uint32(duration))
+		n += 5
+	}
+	//unique_program_id avail_num avails_expected
+	pio.PutU16BE(b[n:], 1)
+	n += 2
+	b[n] = 0
+	b[n+1] = 0
+	n += 2
+	cmdlen := n - pos
+	b[hold] = 0xff
+	pio.PutU16BE(b[hold+1:], uint16(0xf<<12|cmdlen&0xfff))
+
+	//descriptor_loop_length
+	pio.PutU16BE(b[n:], 0)
+	n += 2
+
+	pio.PutU16BE(b[1:], uint16(0x3<<12|(n+4-3)&0xfff))
+	crc := calcCRC32(0xffffffff, b[:n])
+	pio.PutU32LE(b[n:], crc)
+	n += 4
+	return
+}
+
+func parseSCTE35Time(b []byte) (v uint64) {
+	return uint64(b[0]&0x1)<<32 | uint64(pio.U32BE(b[1:]))
+}
+
+//解析 splice_insert，或者 time_signal 后面的 segmentation_descriptor，其他命令返回 false
+func ParseSCTE35(b []byte) (info SCTE35Info, ok bool) {
+	if len(b) < 17 || b[0] != TableIdSCTE35 {
+		return
+	}
+	seclen := int(pio.U16BE(b[1:]) & 0xfff)
+	if len(b) < seclen+3 || b[4]&0x80 != 0 {
+		//加密的不解析
+		return
+	}
+	b = b[:seclen+3]
+	cmdlen := int(pio.U16BE(b[11:]) & 0xfff)
+	cmdtype := b[13]
+	n := 14
+	if n+cmdlen+2 > len(b) {
+		return
+	}
+	cmd := b[n : n+cmdlen]
+	n += cmdlen
+
+	switch cmdtype {
+	case SCTE35SpliceInsert:
+		if len(cmd) < 6 || cmd[4]&0x80 != 0 {
+			return
+		}
+		info.EventId = pio.U32BE(cmd)
+		flags := cmd[5]
+		info.Out = flags&0x80 != 0
+		i := 6
+		spliceTime := func() {
+			if flags&0x10 != 0 {
+				return
+			}
+			//time_specified_flag 为 1 时 5 字节
+			if i < len(cmd) && cmd[i]&0x80 != 0 {
+				i += 5
+			} else {
+				i++
+			}
+		}
+		if flags&0x40 != 0 {
+			spliceTime()
+		} else if i < len(cmd) {
+			//按分量 splice
+			count := int(cmd[i])
+			i++
+			for c := 0; c < count && i < len(cmd); c++ {
+				i++
+				spliceTime()
+			}
+		}
+		if flags&0x20 != 0 && i+5 <= len(cmd) {
+			info.Duration = parseSCTE35Time(cmd[i:])
+		}
+		ok = true
+		return
+	case SCTE35TimeSignal:
+	default:
+		return
+	}
+
+	//time_signal 看 segmentation_descriptor 的 segmentation_type_id
+	looplen := int(pio.U16BE(b[n:]))
+	n += 2
+	end := n + looplen
+	if end > len(b) {
+		return
+	}
+	for n+2 <= end {
+		tag, dlen := b[n], int(b[n+1])
+		desc := b[n+2:]
+		n += 2 + dlen
+		if n > end || tag != SCTE35SegmentationDescriptor || dlen < 10 {
+			continue
+		}
+		//identifier(32) segmentation_event_id(32) cancel_indicator(1)
+		info.EventId = pio.U32BE(desc[4:])
+		if desc[8]&0x80 != 0 {
+			continue
+		}
+		flags := desc[9]
+		i := 10
+		if flags&0x40 == 0 {
+			//program_segmentation_flag 为 0 时有分量列表
+			if i >= dlen {
+				continue
+			}
+			i += 1 + int(desc[i])*6
+		}
+		if flags&0x20 != 0 {
+			if i+5 > dlen {
+				continue
+			}
+			//segmentation_duration 40 位
+			info.Duration = pio.U40BE(desc[i:])
+			i += 5
+		}
+		//segmentation_upid_type upid_length upid
+		if i+2 > dlen {
+			continue
+		}
+		i += 2 + int(desc[i+1])
+		if i >= dlen {
+			continue
+		}
+		//奇数结束 偶数开始，0x22 break 0x30 provider ad 0x34 placement opportunity ...
+		switch typeid := desc[i]; {
+		case typeid >= 0x22 && typeid <= 0x3f && typeid&1 == 0:
+			info.Out = true
+		case typeid >= 0x23 && typeid <= 0x3f && typeid&1 == 1:
+			info.Out = false
+		default:
+			continue
+		}
+		ok = true
+		return
+	}
+	return
+}
@@ -35,6 +35,9 @@ var ErrParsePAT = fmt.Errorf("invalid.PAT")
 
 const (
 	ElementaryStreamTypeH264    = 0x1B
+	ElementaryStreamTypeH265    = 0x24
+	ElementaryStreamTypeMPEG1Audio = 0x03
+	ElementaryStreamTypeMPEG2Audio = 0x04
 	ElementaryStreamTypeAdtsAAC = 0x0F
 )
 
@@ -412,6 +415,11 @@ Descriptor data	        N*8	Data as defined by the Descriptor Tag.
 */
 
 func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
+	return FillPSIVersion(h, tableid, tableext, 0, datalen)
+}
+
+//内容变化时 version 加 1，解码端据此重新解析
+func FillPSIVersion(h []byte, tableid uint8, tableext uint16, version uint8, datalen int) (n int) {
 	// pointer(8)
 	h[n] = 0
 	n++
@@ -428,8 +436,8 @@ func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
 	pio.PutU16BE(h[n:], tableext)
 	n += 2
 
-	// resverd(2)=3,version(5)=0,Current_next_indicator(1)=1
-	h[n] = 0x3<<6 | 1
+	// resverd(2)=3,version(5),Current_next_indicator(1)=1
+	h[n] = 0x3<<6 | (version&0x1f)<<1 | 1
 	n++
 
 	// section_number(8)
@@ -451,8 +459,9 @@ func FillPSI(h []byte, tableid uint8, tableext uint16, datalen int) (n int) {
 
 func TimeToPCR(tm time.Duration) (pcr uint64) {
 	// base(33)+resverd(6)+ext(9)
-	ts := uint64(tm*PCR_HZ/time.Second)
-	base := ts / 300
+	//按微秒计算，tm*PCR_HZ 几分钟就会溢出
+	ts := uint64(tm/time.Microsecond) * (PCR_HZ / 1000000)
+	base := (ts / 300) & 0x1ffffffff
 	ext := ts % 300
 	pcr = base<<15 | 0x3f<<9 | ext
 	return
@@ -462,7 +471,8 @@ func PCRToTime(pcr uint64) (tm time.Duration) {
 	base := pcr >> 15
 	ext := pcr & 0x1ff
 	ts := base*300 + ext
-	tm = time.Duration(ts)*time.Second/time.Duration(PCR_HZ)
+	tm = time.Duration(ts/(PCR_HZ/1000000))*time.Microsecond
+	tm += time.Duration(ts%(PCR_HZ/1000000))*time.Microsecond/time.Duration(PCR_HZ/1000000)
 	return
 }
 